@@ -8,29 +8,38 @@ import (
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	"github.com/Azure/azure-sdk-for-go/sdk/containerservice/armcontainerservice"
+	"github.com/blue-eight/azgo/azgo/trace"
 )
 
+// newConnection returns a connection to Azure Resource Manager which is
+// authenticated with the DefaultAzureCredential. Tests replace it to point
+// at a local server.
+var newConnection = func(options *arm.ConnectionOptions) (*arm.Connection, error) {
+	cred, err := azidentity.NewDefaultAzureCredential(nil)
+	if err != nil {
+		return nil, err
+	}
+	return arm.NewDefaultConnection(cred, options), nil
+}
+
+// pollFrequency is how often RunCommand checks whether the command has
+// finished, unless the service asks for a different interval.
+var pollFrequency = 5 * time.Second
+
 // RunCommand runs a command on an AKS cluster
 // specified via its subscription, resource group,
 // and cluster name. The command is a string which
 // is run inside a container on the cluster itself.
 // This command authenticates against Azure via the
 // DefaultAzureCredential (see: https://docs.microsoft.com/en-us/azure/developer/go/azure-sdk-authentication?tabs=bash#3-use-defaultazurecredential-to-authenticate-resourceclient ) in the azidentity package.
-func RunCommand(subscriptionID, resourceGroup, resourceName, command string) (string, error) {
-
-	cred, err := azidentity.NewDefaultAzureCredential(nil)
-	if err != nil {
-		return "", err
-	}
-
-	con := arm.NewDefaultConnection(cred, nil)
+func RunCommand(ctx context.Context, subscriptionID, resourceGroup, resourceName, command string) (string, error) {
+	con, err := newConnection(&arm.ConnectionOptions{HTTPClient: trace.Transport(nil)})
 	if err != nil {
 		return "", err
 	}
 
 	client := armcontainerservice.NewManagedClustersClient(con, subscriptionID)
 
-	ctx := context.Background()
 	request := armcontainerservice.RunCommandRequest{}
 	request.Command = &command
 
@@ -38,7 +47,7 @@ func RunCommand(subscriptionID, resourceGroup, resourceName, command string) (st
 	if err != nil {
 		return "", err
 	}
-	res, err := result.PollUntilDone(ctx, 5*time.Second)
+	res, err := result.PollUntilDone(ctx, pollFrequency)
 	if err != nil {
 		return "", err
 	}
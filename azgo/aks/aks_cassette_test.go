@@ -0,0 +1,49 @@
+package aks
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/blue-eight/azgo/azgo/internal/cassette"
+)
+
+func TestCassetteRunCommand(t *testing.T) {
+	rec := cassette.New(t, "testdata/cassettes/run-command.json")
+	subscription := rec.Value("AZURE_SUBSCRIPTION", testSubscription)
+	resourceGroup := rec.Value("RESOURCE_GROUP", "azgo-rg")
+	cluster := rec.Value("AKS_NAME", "azgo-aks")
+
+	previousConnection, previousFrequency := newConnection, pollFrequency
+	newConnection = func(options *arm.ConnectionOptions) (*arm.Connection, error) {
+		return rec.ARMConnection(options), nil
+	}
+	if !rec.Recording() {
+		pollFrequency = time.Millisecond
+	}
+	t.Cleanup(func() { newConnection, pollFrequency = previousConnection, previousFrequency })
+
+	res, err := RunCommand(context.Background(), subscription, resourceGroup, cluster, "kubectl get nodes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := struct {
+		Properties struct {
+			ProvisioningState string
+			ExitCode          int
+			Logs              string
+		}
+	}{}
+	if err := json.Unmarshal([]byte(res), &result); err != nil {
+		t.Fatalf("RunCommand returned invalid JSON %q: %v", res, err)
+	}
+	if result.Properties.ProvisioningState != "Succeeded" || result.Properties.ExitCode != 0 {
+		t.Errorf("RunCommand = %s", res)
+	}
+	if !strings.Contains(result.Properties.Logs, "STATUS") {
+		t.Errorf("RunCommand logs = %q, want the output of kubectl get nodes", result.Properties.Logs)
+	}
+}
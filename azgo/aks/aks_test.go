@@ -1,34 +1,116 @@
 package aks
 
 import (
-	"log"
-	"os"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/blue-eight/azgo/azgo/internal/testutil"
 )
 
-var subscriptionID string
+const testSubscription = "00000000-0000-0000-0000-000000000000"
+
+// fakeCluster serves the runCommand long-running operation of a single
+// cluster: the POST is accepted with a Location to poll, which reports
+// in progress until it has been polled pending times.
+type fakeCluster struct {
+	mu       sync.Mutex
+	server   *httptest.Server
+	pending  int
+	polls    int
+	commands []string
+}
+
+func (f *fakeCluster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cluster := "/subscriptions/" + testSubscription + "/resourceGroups/rg/providers/Microsoft.ContainerService/managedClusters/aks1"
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == cluster+"/runCommand":
+		body, _ := io.ReadAll(r.Body)
+		request := struct{ Command string }{}
+		json.Unmarshal(body, &request)
+		f.commands = append(f.commands, request.Command)
+		w.Header().Set("Location", f.server.URL+"/operations/1")
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == http.MethodGet && r.URL.Path == "/operations/1":
+		f.polls++
+		if f.polls <= f.pending {
+			w.Header().Set("Location", f.server.URL+"/operations/1")
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"id":"1","properties":{"provisioningState":"Succeeded","exitCode":0,"logs":"ran %s"}}`, f.commands[len(f.commands)-1])
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"error":{"code":"ResourceNotFound","message":"%s was not found"}}`, r.URL.Path)
+	}
+}
+
+func newCluster(t *testing.T, pending int) *fakeCluster {
+	f := &fakeCluster{pending: pending}
+	f.server = httptest.NewServer(f)
+	t.Cleanup(f.server.Close)
 
-func init() {
-	subscriptionID = os.Getenv("AZURE_SUBSCRIPTION")
-	if subscriptionID == "" {
-		log.Fatal("AZURE_SUBSCRIPTION environment variable not set!")
+	previousConnection, previousFrequency := newConnection, pollFrequency
+	newConnection = func(options *arm.ConnectionOptions) (*arm.Connection, error) {
+		return testutil.ARMConnection(f.server.URL, options), nil
 	}
+	pollFrequency = time.Millisecond
+	t.Cleanup(func() { newConnection, pollFrequency = previousConnection, previousFrequency })
+	return f
 }
 
 func TestRunCommand(t *testing.T) {
-	resourceGroup := os.Getenv("RESOURCE_GROUP")
-	if resourceGroup == "" {
-		log.Fatal("RESOURCE_GROUP not set.")
+	f := newCluster(t, 2)
+
+	res, err := RunCommand(context.Background(), testSubscription, "rg", "aks1", "kubectl get pods")
+	if err != nil {
+		t.Fatal(err)
 	}
-	clusterName := os.Getenv("AKS_NAME")
-	if clusterName == "" {
-		log.Fatal("AKS_NAME not set.")
+	result := struct {
+		ID         string
+		Properties struct {
+			ExitCode int
+			Logs     string
+		}
+	}{}
+	if err := json.Unmarshal([]byte(res), &result); err != nil {
+		t.Fatalf("RunCommand returned invalid JSON %q: %v", res, err)
 	}
-	command := "kubectl run nginx --image=nginx"
-	res, err := RunCommand(subscriptionID, resourceGroup, clusterName, command)
-	log.Println(res)
-	if err != nil {
-		t.Error(err)
+	if result.Properties.Logs != "ran kubectl get pods" || result.Properties.ExitCode != 0 {
+		t.Errorf("RunCommand = %s", res)
+	}
+	if f.polls != 3 {
+		t.Errorf("polled %d times, want 3", f.polls)
+	}
+}
+
+func TestRunCommandNotFound(t *testing.T) {
+	newCluster(t, 0)
+
+	_, err := RunCommand(context.Background(), testSubscription, "rg", "missing", "ls")
+	if err == nil || !strings.Contains(err.Error(), "ResourceNotFound") {
+		t.Errorf("RunCommand on a missing cluster error = %v, want ResourceNotFound", err)
+	}
+}
+
+func TestRunCommandCancel(t *testing.T) {
+	newCluster(t, 1000)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := RunCommand(ctx, testSubscription, "rg", "aks1", "sleep 60"); err == nil {
+		t.Error("RunCommand returned no error after its context expired")
 	}
-	_ = res
 }
@@ -6,36 +6,137 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	"github.com/Azure/azure-sdk-for-go/sdk/resources/armresources"
+	"github.com/blue-eight/azgo/azgo/output"
+	"github.com/blue-eight/azgo/azgo/trace"
 )
 
-// ListResources lists all the resources in the subscription and prints them to the
-// standard output in JSON format.
-func ListResources(subscriptionID string) error {
+// connect returns a connection to Azure Resource Manager, traced if
+// tracing is on.
+func connect(options *arm.ConnectionOptions) (*arm.Connection, error) {
+	if options == nil {
+		options = &arm.ConnectionOptions{}
+	}
+	options.HTTPClient = trace.Transport(options.HTTPClient)
+	return newConnection(options)
+}
+
+// newConnection returns a connection to Azure Resource Manager which is
+// authenticated with the DefaultAzureCredential. Tests replace it to point
+// at a local server.
+var newConnection = func(options *arm.ConnectionOptions) (*arm.Connection, error) {
 	cred, err := azidentity.NewDefaultAzureCredential(nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	con := arm.NewDefaultConnection(cred, nil)
+	return arm.NewDefaultConnection(cred, options), nil
+}
+
+// ListResources lists all the resources in the subscription and prints them to the
+// standard output via output.Print.
+func ListResources(ctx context.Context, subscriptionID string) error {
+	con, err := connect(nil)
 	if err != nil {
 		return err
 	}
 
 	client := armresources.NewResourcesClient(con, subscriptionID)
 	pager := client.List(nil)
-	for pager.NextPage(context.Background()) {
-		if err := pager.Err(); err != nil {
-			log.Fatalf("failed to advance page: %v", err)
-		}
+	for pager.NextPage(ctx) {
 		for _, r := range pager.PageResponse().ResourceListResult.Value {
-			printJSON(r)
+			if err := output.Print(r); err != nil {
+				return err
+			}
+		}
+	}
+	if err := pager.Err(); err != nil {
+		return fmt.Errorf("failed to advance page: %w", err)
+	}
+	return nil
+}
+
+// ListOptions narrows the resources printed by List.
+type ListOptions struct {
+	// ResourceGroup limits the list to a single resource group.
+	ResourceGroup string
+	// Type is a resource type such as Microsoft.Compute/virtualMachines.
+	Type string
+	// Tags are "name" or "name=value" and must all match. Resource Manager
+	// cannot combine tag and type filters, and drops the tags from the
+	// results when filtering by tag, so we match tags on our side.
+	Tags []string
+}
+
+// filter returns the $filter query for o.
+func (o *ListOptions) filter() *string {
+	if o.Type == "" {
+		return nil
+	}
+	filter := fmt.Sprintf("resourceType eq '%s'", strings.ReplaceAll(o.Type, "'", "''"))
+	return &filter
+}
+
+// match reports whether r has all the tags in o.
+func (o *ListOptions) match(r *armresources.GenericResourceExpanded) bool {
+	for _, tag := range o.Tags {
+		name, want, hasValue := tag, "", false
+		if i := strings.Index(tag, "="); i >= 0 {
+			name, want, hasValue = tag[:i], tag[i+1:], true
+		}
+		value, ok := r.Tags[name]
+		if !ok || (hasValue && (value == nil || *value != want)) {
+			return false
+		}
+	}
+	return true
+}
+
+// List prints the resources in the subscription which match options via
+// output.Print. Unlike ListResources, it also asks for the created and
+// changed times and provisioning state of each resource.
+func List(ctx context.Context, subscriptionID string, options *ListOptions) error {
+	if options == nil {
+		options = &ListOptions{}
+	}
+	con, err := connect(nil)
+	if err != nil {
+		return err
+	}
+
+	client := armresources.NewResourcesClient(con, subscriptionID)
+	expand := "createdTime,changedTime,provisioningState"
+	var pager interface {
+		NextPage(context.Context) bool
+		Err() error
+	}
+	var page func() []*armresources.GenericResourceExpanded
+	if options.ResourceGroup == "" {
+		p := client.List(&armresources.ResourcesListOptions{Expand: &expand, Filter: options.filter()})
+		pager, page = p, func() []*armresources.GenericResourceExpanded { return p.PageResponse().ResourceListResult.Value }
+	} else {
+		p := client.ListByResourceGroup(options.ResourceGroup, &armresources.ResourcesListByResourceGroupOptions{Expand: &expand, Filter: options.filter()})
+		pager, page = p, func() []*armresources.GenericResourceExpanded { return p.PageResponse().ResourceListResult.Value }
+	}
+
+	for pager.NextPage(ctx) {
+		for _, r := range page() {
+			if !options.match(r) {
+				continue
+			}
+			if err := output.Print(r); err != nil {
+				return err
+			}
 		}
 	}
+	if err := pager.Err(); err != nil {
+		return fmt.Errorf("failed to advance page: %w", err)
+	}
 	return nil
 }
 
@@ -70,15 +171,10 @@ func (m *MyPolicy) Do(req *policy.Request) (*http.Response, error) {
 
 // ListResourcesWithPolicy lists all the resources
 // in a subscription and prints them to the standard
-// output in JSON format. It also demonstrates how to
+// output via output.Print. It also demonstrates how to
 // use a custom policy, MyPolicy, which logs data to
 // standard error.
-func ListResourcesWithPolicy(subscriptionID string) error {
-	cred, err := azidentity.NewDefaultAzureCredential(nil)
-	if err != nil {
-		return err
-	}
-
+func ListResourcesWithPolicy(ctx context.Context, subscriptionID string) error {
 	mp := &MyPolicy{
 		LogPrefix: "[MyPolicy]",
 	}
@@ -88,28 +184,22 @@ func ListResourcesWithPolicy(subscriptionID string) error {
 		RetryDelay: 20 * time.Millisecond,
 	}
 
-	con := arm.NewDefaultConnection(cred, options)
+	con, err := connect(options)
 	if err != nil {
 		return err
 	}
 
 	client := armresources.NewResourcesClient(con, subscriptionID)
 	pager := client.List(nil)
-	for pager.NextPage(context.Background()) {
-		if err := pager.Err(); err != nil {
-			log.Fatalf("failed to advance page: %v", err)
-		}
+	for pager.NextPage(ctx) {
 		for _, r := range pager.PageResponse().ResourceListResult.Value {
-			printJSON(r)
+			if err := output.Print(r); err != nil {
+				return err
+			}
 		}
 	}
-	return nil
-}
-
-func printJSON(i interface{}) {
-	b, err := json.Marshal(i)
-	if err != nil {
-		log.Fatal(err)
+	if err := pager.Err(); err != nil {
+		return fmt.Errorf("failed to advance page: %w", err)
 	}
-	fmt.Printf("%s\n", b)
+	return nil
 }
@@ -0,0 +1,48 @@
+package arm
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/blue-eight/azgo/azgo/internal/cassette"
+	"github.com/blue-eight/azgo/azgo/internal/testutil"
+)
+
+// useCassette points newConnection at the named cassette and returns it
+// with the subscription to use.
+func useCassette(t *testing.T, name string) (*cassette.Recorder, string) {
+	rec := cassette.New(t, filepath.Join("testdata", "cassettes", name+".json"))
+	previous := newConnection
+	newConnection = func(options *arm.ConnectionOptions) (*arm.Connection, error) {
+		return rec.ARMConnection(options), nil
+	}
+	t.Cleanup(func() { newConnection = previous })
+	return rec, rec.Value("AZURE_SUBSCRIPTION", testSubscription)
+}
+
+func TestCassetteListResources(t *testing.T) {
+	rec, subscription := useCassette(t, "list-resources")
+
+	out := testutil.CaptureOutput(t)
+	if err := ListResources(context.Background(), subscription); err != nil {
+		t.Fatal(err)
+	}
+	records := testutil.Records(t, out)
+	if len(records) == 0 {
+		t.Fatal("ListResources printed no resources")
+	}
+	prefix := strings.ToLower("/subscriptions/" + subscription + "/")
+	for _, r := range records {
+		id, _ := r["id"].(string)
+		if !strings.HasPrefix(strings.ToLower(id), prefix) || r["name"] == nil || r["type"] == nil {
+			t.Errorf("ListResources printed %v", r)
+		}
+	}
+	// the cassette has two pages, joined by a nextLink
+	if !rec.Recording() && len(records) != 4 {
+		t.Errorf("ListResources printed %d resources, want 4", len(records))
+	}
+}
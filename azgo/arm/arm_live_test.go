@@ -0,0 +1,26 @@
+//go:build live
+// +build live
+
+package arm
+
+import (
+	"context"
+	"log"
+	"os"
+	"testing"
+)
+
+var subscriptionID string
+
+func init() {
+	subscriptionID = os.Getenv("AZURE_SUBSCRIPTION")
+	if subscriptionID == "" {
+		log.Fatal("AZURE_SUBSCRIPTION environment variable not set!")
+	}
+}
+
+func TestLiveListResourcesWithPolicy(t *testing.T) {
+	if err := ListResourcesWithPolicy(context.Background(), subscriptionID); err != nil {
+		t.Error(err)
+	}
+}
@@ -1,19 +1,175 @@
 package arm
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"strings"
 	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/blue-eight/azgo/azgo/internal/testutil"
 )
 
-var subscriptionID string
+const testSubscription = "00000000-0000-0000-0000-000000000000"
+
+// newServer starts a fake Resource Manager which serves pages of resources
+// for testSubscription, or its resource group rg, and points newConnection
+// at it. The requests it receives are appended to *requests if not nil.
+func newServer(t *testing.T, pages []string, requests ...*[]*url.URL) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+testutil.Token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		for _, received := range requests {
+			*received = append(*received, r.URL)
+		}
+		subscription := "/subscriptions/" + testSubscription
+		if r.URL.Path != subscription+"/resources" && r.URL.Path != subscription+"/resourceGroups/rg/resources" {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, `{"error":{"code":"AuthorizationFailed","message":"no access to %s"}}`, r.URL.Path)
+			return
+		}
+		page := 0
+		fmt.Sscan(r.URL.Query().Get("page"), &page)
+		nextLink := ""
+		if page+1 < len(pages) {
+			nextLink = fmt.Sprintf(`,"nextLink":"%s%s?page=%d"`, server.URL, r.URL.Path, page+1)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"value":[%s]%s}`, pages[page], nextLink)
+	}))
+	t.Cleanup(server.Close)
 
-func init() {
-	subscriptionID = os.Getenv("AZURE_SUBSCRIPTION")
-	if subscriptionID == "" {
-		log.Fatal("AZURE_SUBSCRIPTION environment variable not set!")
+	previous := newConnection
+	newConnection = func(options *arm.ConnectionOptions) (*arm.Connection, error) {
+		return testutil.ARMConnection(server.URL, options), nil
 	}
+	t.Cleanup(func() { newConnection = previous })
+	return server
+}
+
+func resource(name, typ string) string {
+	return taggedResource(name, typ, `{"env":"test"}`)
+}
+
+func taggedResource(name, typ, tags string) string {
+	return fmt.Sprintf(`{"id":"/subscriptions/%s/resourceGroups/rg/providers/%s/%s","name":"%s","type":"%s","location":"eastus","tags":%s}`,
+		testSubscription, typ, name, name, typ, tags)
 }
+
+func TestListResources(t *testing.T) {
+	newServer(t, []string{
+		resource("vm1", "Microsoft.Compute/virtualMachines") + "," + resource("disk1", "Microsoft.Compute/disks"),
+		resource("st1", "Microsoft.Storage/storageAccounts"),
+	})
+
+	out := testutil.CaptureOutput(t)
+	if err := ListResources(context.Background(), testSubscription); err != nil {
+		t.Fatal(err)
+	}
+	records := testutil.Records(t, out)
+	if len(records) != 3 {
+		t.Fatalf("ListResources printed %d records, want 3 across two pages:\n%s", len(records), out)
+	}
+	for i, want := range []string{"vm1", "disk1", "st1"} {
+		if records[i]["name"] != want {
+			t.Errorf("record %d name = %v, want %s", i, records[i]["name"], want)
+		}
+	}
+	if tags, _ := records[2]["tags"].(map[string]interface{}); tags["env"] != "test" {
+		t.Errorf("record 2 tags = %v", records[2]["tags"])
+	}
+}
+
+func TestListResourcesError(t *testing.T) {
+	newServer(t, []string{""})
+
+	err := ListResources(context.Background(), "other")
+	if err == nil {
+		t.Fatal("ListResources for a forbidden subscription returned no error")
+	}
+	if !strings.Contains(err.Error(), "AuthorizationFailed") {
+		t.Errorf("error = %v, want it to include AuthorizationFailed", err)
+	}
+}
+
 func TestListResourcesWithPolicy(t *testing.T) {
-	ListResourcesWithPolicy(subscriptionID)
+	newServer(t, []string{resource("vm1", "Microsoft.Compute/virtualMachines")})
+
+	logged := &bytes.Buffer{}
+	log.SetOutput(logged)
+	defer log.SetOutput(os.Stderr)
+
+	out := testutil.CaptureOutput(t)
+	if err := ListResourcesWithPolicy(context.Background(), testSubscription); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(testutil.Records(t, out)); n != 1 {
+		t.Errorf("ListResourcesWithPolicy printed %d records, want 1", n)
+	}
+	if !strings.Contains(logged.String(), `[MyPolicy] {"Policy":"MyPolicy","URL":"/subscriptions/`+testSubscription+`/resources?`) {
+		t.Errorf("MyPolicy logged %q", logged)
+	}
+}
+
+func TestList(t *testing.T) {
+	requests := []*url.URL{}
+	newServer(t, []string{
+		taggedResource("vm1", "Microsoft.Compute/virtualMachines", `{"env":"prod","team":"ops"}`) + "," +
+			taggedResource("vm2", "Microsoft.Compute/virtualMachines", `{"env":"test","team":"ops"}`) + "," +
+			taggedResource("vm3", "Microsoft.Compute/virtualMachines", `{"env":"prod"}`),
+	}, &requests)
+
+	out := testutil.CaptureOutput(t)
+	options := &ListOptions{
+		ResourceGroup: "rg",
+		Type:          "Microsoft.Compute/virtualMachines",
+		Tags:          []string{"env=prod", "team"},
+	}
+	if err := List(context.Background(), testSubscription, options); err != nil {
+		t.Fatal(err)
+	}
+	records := testutil.Records(t, out)
+	if len(records) != 1 || records[0]["name"] != "vm1" {
+		t.Errorf("List printed %v, want only vm1", records)
+	}
+
+	if len(requests) != 1 {
+		t.Fatalf("List sent %d requests, want 1", len(requests))
+	}
+	request := requests[0]
+	if want := "/subscriptions/" + testSubscription + "/resourceGroups/rg/resources"; request.Path != want {
+		t.Errorf("List requested %s, want %s", request.Path, want)
+	}
+	query := request.Query()
+	if got := query.Get("$filter"); got != "resourceType eq 'Microsoft.Compute/virtualMachines'" {
+		t.Errorf("$filter = %q", got)
+	}
+	if got := query.Get("$expand"); got != "createdTime,changedTime,provisioningState" {
+		t.Errorf("$expand = %q", got)
+	}
+}
+
+func TestListSubscription(t *testing.T) {
+	requests := []*url.URL{}
+	newServer(t, []string{resource("vm1", "Microsoft.Compute/virtualMachines")}, &requests)
+
+	out := testutil.CaptureOutput(t)
+	if err := List(context.Background(), testSubscription, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(testutil.Records(t, out)); n != 1 {
+		t.Errorf("List printed %d records, want 1", n)
+	}
+	if len(requests) != 1 || requests[0].Query().Get("$filter") != "" {
+		t.Errorf("List without options sent %v, want no $filter", requests)
+	}
 }
@@ -0,0 +1,365 @@
+package blob
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// Defaults for AppendOptions.
+const (
+	DefaultAppendMaxSize       = 1 << 30
+	DefaultAppendFlushInterval = time.Second
+)
+
+// maxAppendBlock is the largest block the service appends at once.
+const maxAppendBlock = 4 << 20
+
+// tailInterval is how often Tail checks for new data; tests shorten it.
+var tailInterval = time.Second
+
+// AppendOptions configures Append.
+type AppendOptions struct {
+	// MaxSize is the size past which Append rolls over to the next blob,
+	// which defaults to DefaultAppendMaxSize.
+	MaxSize int64
+	// FlushInterval is the longest a line waits to be appended, which
+	// defaults to DefaultAppendFlushInterval. Lines which arrive together
+	// are appended as one block.
+	FlushInterval time.Duration
+}
+
+// segmentName returns the name of the blob index of the log name: name
+// itself, then name.1, name.2 and so on.
+func segmentName(name string, index int) string {
+	if index == 0 {
+		return name
+	}
+	return fmt.Sprintf("%s.%d", name, index)
+}
+
+// lastSegment returns the index of the last blob of the log name, and
+// false if there are none.
+func lastSegment(ctx context.Context, containerURL azblob.ContainerURL, name string) (int, bool, error) {
+	indexes := []int{}
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		list, err := containerURL.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{Prefix: name})
+		if err != nil {
+			return 0, false, err
+		}
+		marker = list.NextMarker
+		for _, item := range list.Segment.BlobItems {
+			if item.Name == name {
+				indexes = append(indexes, 0)
+			} else if i, err := strconv.Atoi(strings.TrimPrefix(item.Name, name+".")); err == nil && i > 0 && item.Name == segmentName(name, i) {
+				indexes = append(indexes, i)
+			}
+		}
+	}
+	if len(indexes) == 0 {
+		return 0, false, nil
+	}
+	sort.Ints(indexes)
+	return indexes[len(indexes)-1], true, nil
+}
+
+// Append reads lines from the standard input until it ends and appends
+// them to the Append Blob name in the container, which is created if
+// needed, so blob storage can be used as a log sink. Lines are batched
+// into blocks of up to 4 MiB for at most FlushInterval. When the blob
+// would grow past MaxSize, or reaches 50,000 blocks, Append rolls over to
+// name.1, name.2 and so on, and it carries on from the last of those when
+// run again. Several writers can append to the same log. The container
+// defaults to "main" if empty.
+func Append(ctx context.Context, container, name string, options *AppendOptions) error {
+	if container == "" {
+		container = "main"
+	}
+	o := AppendOptions{}
+	if options != nil {
+		o = *options
+	}
+	if o.MaxSize <= 0 {
+		o.MaxSize = DefaultAppendMaxSize
+	}
+	if o.FlushInterval <= 0 {
+		o.FlushInterval = DefaultAppendFlushInterval
+	}
+
+	serviceURL, err := BlobFromConfig()
+	if err != nil {
+		return err
+	}
+	w := &appendWriter{containerURL: serviceURL.NewContainerURL(container), name: name, maxSize: o.MaxSize}
+	if w.index, _, err = lastSegment(ctx, w.containerURL, name); err != nil {
+		return err
+	}
+
+	lines := make(chan []byte)
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(lines)
+		r := bufio.NewReaderSize(stdin, maxAppendBlock)
+		for {
+			// a line longer than a block is split, as ReadSlice does
+			line, err := r.ReadSlice('\n')
+			if len(line) > 0 {
+				select {
+				case lines <- append([]byte{}, line...):
+				case <-ctx.Done():
+					return
+				}
+			}
+			if err != nil && err != bufio.ErrBufferFull {
+				if err != io.EOF {
+					readErr <- err
+				}
+				return
+			}
+		}
+	}()
+
+	buf := &bytes.Buffer{}
+	timer := time.NewTimer(o.FlushInterval)
+	timer.Stop()
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				if err := w.append(ctx, buf.Bytes()); err != nil {
+					return err
+				}
+				select {
+				case err := <-readErr:
+					return err
+				default:
+					return ctx.Err()
+				}
+			}
+			if buf.Len()+len(line) > maxAppendBlock {
+				if err := w.append(ctx, buf.Bytes()); err != nil {
+					return err
+				}
+				buf.Reset()
+			}
+			if buf.Len() == 0 {
+				timer.Reset(o.FlushInterval)
+			}
+			buf.Write(line)
+		case <-timer.C:
+			if err := w.append(ctx, buf.Bytes()); err != nil {
+				return err
+			}
+			buf.Reset()
+		case <-ctx.Done():
+			// append what has been read, so a stopped sink loses nothing
+			flushCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := w.append(flushCtx, buf.Bytes()); err != nil {
+				return err
+			}
+			return ctx.Err()
+		}
+	}
+}
+
+// appendWriter appends blocks to the current blob of a log.
+type appendWriter struct {
+	containerURL azblob.ContainerURL
+	name         string
+	index        int
+	maxSize      int64
+}
+
+// append appends block to the current blob, creating it if needed and
+// rolling over to the next one when it is full.
+func (w *appendWriter) append(ctx context.Context, block []byte) error {
+	if len(block) == 0 {
+		return nil
+	}
+	if int64(len(block)) > w.maxSize {
+		return fmt.Errorf("a block of %d bytes is larger than the maximum size of %d", len(block), w.maxSize)
+	}
+	for {
+		blobURL := w.containerURL.NewAppendBlobURL(segmentName(w.name, w.index))
+		ac := azblob.AppendBlobAccessConditions{AppendPositionAccessConditions: azblob.AppendPositionAccessConditions{IfMaxSizeLessThanOrEqual: w.maxSize}}
+		_, err := blobURL.AppendBlock(ctx, bytes.NewReader(block), ac, nil, azblob.ClientProvidedKeyOptions{})
+		switch storageCode(err) {
+		case "":
+			return err
+		case azblob.ServiceCodeBlobNotFound:
+		case azblob.ServiceCodeMaxBlobSizeConditionNotMet, azblob.ServiceCodeBlockCountExceedsLimit:
+			w.index++
+		default:
+			return err
+		}
+
+		// another writer may create it first, which is fine
+		blobURL = w.containerURL.NewAppendBlobURL(segmentName(w.name, w.index))
+		headers := azblob.BlobHTTPHeaders{ContentType: "text/plain; charset=utf-8"}
+		create := azblob.BlobAccessConditions{ModifiedAccessConditions: azblob.ModifiedAccessConditions{IfNoneMatch: azblob.ETagAny}}
+		_, err = blobURL.Create(ctx, headers, azblob.Metadata{}, create, nil, azblob.ClientProvidedKeyOptions{})
+		if err != nil && storageCode(err) != azblob.ServiceCodeBlobAlreadyExists {
+			return err
+		}
+	}
+}
+
+// TailOptions configures Tail.
+type TailOptions struct {
+	// Lines is how many of the last lines to print first.
+	Lines int
+	// Follow prints new data as it is appended, and follows the log onto
+	// the next blob when Append rolls over, until ctx is cancelled.
+	Follow bool
+}
+
+// Tail prints the last lines of the last blob of the log name in the
+// container, as written by Append, to the standard output, and with
+// Follow keeps printing what is appended using ranged reads. It works on
+// any blob, not only Append Blobs. The container defaults to "main" if
+// empty.
+func Tail(ctx context.Context, container, name string, options *TailOptions) error {
+	if container == "" {
+		container = "main"
+	}
+	o := TailOptions{}
+	if options != nil {
+		o = *options
+	}
+	serviceURL, err := BlobFromConfig()
+	if err != nil {
+		return err
+	}
+	containerURL := serviceURL.NewContainerURL(container)
+
+	index, ok, err := lastSegment(ctx, containerURL, name)
+	if err != nil {
+		return err
+	}
+	offset := int64(0)
+	if ok {
+		blobURL := containerURL.NewBlobURL(segmentName(name, index))
+		props, err := blobURL.GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+		if err != nil {
+			return err
+		}
+		offset = props.ContentLength()
+		start, err := lastLines(ctx, blobURL, offset, o.Lines)
+		if err != nil {
+			return err
+		}
+		if err := readRange(ctx, blobURL, start, offset-start); err != nil {
+			return err
+		}
+	} else if !o.Follow {
+		_, err := containerURL.NewBlobURL(name).GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+		return err
+	}
+
+	for o.Follow {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(tailInterval):
+		}
+		if !ok {
+			if index, ok, err = lastSegment(ctx, containerURL, name); err != nil {
+				return err
+			}
+			continue
+		}
+		if offset, err = follow(ctx, containerURL.NewBlobURL(segmentName(name, index)), offset); err != nil {
+			return err
+		}
+		// only move on once the data appended before the rollover is read
+		next := containerURL.NewBlobURL(segmentName(name, index+1))
+		_, err = next.GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+		switch {
+		case err == nil:
+			if _, err := follow(ctx, containerURL.NewBlobURL(segmentName(name, index)), offset); err != nil {
+				return err
+			}
+			index, offset = index+1, 0
+		case storageCode(err) != azblob.ServiceCodeBlobNotFound:
+			return err
+		}
+	}
+	return nil
+}
+
+// follow prints what has been appended to the blob since offset and
+// returns its new size. A blob which has shrunk was replaced, so it is
+// printed from the start.
+func follow(ctx context.Context, blobURL azblob.BlobURL, offset int64) (int64, error) {
+	props, err := blobURL.GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return offset, err
+	}
+	size := props.ContentLength()
+	if size < offset {
+		offset = 0
+	}
+	if size == offset {
+		return size, nil
+	}
+	return size, readRange(ctx, blobURL, offset, size-offset)
+}
+
+// lastLines returns the offset of the start of the last n lines of the
+// first size bytes of the blob, reading backwards a block at a time.
+func lastLines(ctx context.Context, blobURL azblob.BlobURL, size int64, n int) (int64, error) {
+	if n <= 0 {
+		return size, nil
+	}
+	end := size
+	// a final newline ends the last line rather than starting another
+	skip := true
+	for end > 0 {
+		start := end - 64<<10
+		if start < 0 {
+			start = 0
+		}
+		data, err := downloadRange(ctx, blobURL, start, end-start, azblob.ETagNone)
+		if err != nil {
+			return 0, err
+		}
+		for i := len(data) - 1; i >= 0; i-- {
+			if data[i] != '\n' {
+				continue
+			}
+			if skip && start+int64(i) == size-1 {
+				continue
+			}
+			if n--; n == 0 {
+				return start + int64(i) + 1, nil
+			}
+		}
+		skip = false
+		end = start
+	}
+	return 0, nil
+}
+
+// readRange copies count bytes of the blob from offset to stdout.
+func readRange(ctx context.Context, blobURL azblob.BlobURL, offset, count int64) error {
+	if count <= 0 {
+		return nil
+	}
+	res, err := blobURL.Download(ctx, offset, count, azblob.BlobAccessConditions{}, false, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return err
+	}
+	body := res.Body(azblob.RetryReaderOptions{MaxRetryRequests: 3})
+	defer body.Close()
+	_, err = io.Copy(stdout, body)
+	return err
+}
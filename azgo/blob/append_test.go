@@ -0,0 +1,223 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// appendLines runs Append with lines as the standard input.
+func appendLines(ctx context.Context, lines string, options *AppendOptions) error {
+	stdin = strings.NewReader(lines)
+	defer func() { stdin = os.Stdin }()
+	return Append(ctx, "logs", "app.log", options)
+}
+
+func TestAppend(t *testing.T) {
+	ctx := context.Background()
+	s := newServer(t)
+	s.CreateContainer("logs")
+	options := &AppendOptions{MaxSize: 12}
+
+	for _, lines := range []string{"one\ntwo\n", "three\n", "four"} {
+		if err := appendLines(ctx, lines, options); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, want := range map[string]string{"app.log": "one\ntwo\n", "app.log.1": "three\nfour"} {
+		b := s.Blob("logs", name)
+		if b == nil || b.BlobType != "AppendBlob" || string(b.Data) != want || b.ContentType != "text/plain; charset=utf-8" {
+			t.Errorf("%s = %+v, want an append blob of %q", name, b, want)
+		}
+	}
+	if err := appendLines(ctx, "a line longer than twelve bytes\n", options); err == nil {
+		t.Error("Append of a line larger than the maximum size returned no error")
+	}
+
+	// lines are batched into blocks of at most 4 MiB
+	line := strings.Repeat("x", 1023) + "\n"
+	if err := appendLines(ctx, strings.Repeat(line, 5<<10), nil); err != nil {
+		t.Fatal(err)
+	}
+	appends := 0
+	for _, r := range s.Requests() {
+		if r.URL.Query().Get("comp") == "appendblock" && strings.HasSuffix(r.URL.Path, "/app.log.1") {
+			appends++
+		}
+	}
+	if b := s.Blob("logs", "app.log.1"); len(b.Data) != len("three\nfour")+5<<20 {
+		t.Errorf("app.log.1 has %d bytes after appending 5 MiB", len(b.Data))
+	}
+	if appends != 2+2 {
+		t.Errorf("5 MiB of lines took %d appends, want 2", appends-2)
+	}
+}
+
+func TestAppendConcurrently(t *testing.T) {
+	ctx := context.Background()
+	s := newServer(t)
+	s.CreateContainer("logs")
+	serviceURL, err := BlobFromConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := []*appendWriter{}
+	for i := 0; i < 4; i++ {
+		w = append(w, &appendWriter{containerURL: serviceURL.NewContainerURL("logs"), name: "app.log", maxSize: 40})
+	}
+
+	wg := sync.WaitGroup{}
+	for i := range w {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if err := w[i].append(ctx, []byte(fmt.Sprintf("writer %d: %d\n", i, j))); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	lines := []string{}
+	for i := 0; ; i++ {
+		b := s.Blob("logs", segmentName("app.log", i))
+		if b == nil {
+			break
+		}
+		if len(b.Data) > 40 {
+			t.Errorf("%s has %d bytes, more than the maximum", b.Name, len(b.Data))
+		}
+		lines = append(lines, strings.Split(strings.TrimSuffix(string(b.Data), "\n"), "\n")...)
+	}
+	if len(lines) != 40 {
+		t.Errorf("got %d lines, want 40: %q", len(lines), lines)
+	}
+	sort.Strings(lines)
+	for i := 1; i < len(lines); i++ {
+		if lines[i] == lines[i-1] {
+			t.Errorf("%q was appended twice", lines[i])
+		}
+	}
+}
+
+// syncBuffer is a bytes.Buffer which Tail can write while a test reads it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestTail(t *testing.T) {
+	ctx := context.Background()
+	s := newServer(t)
+	s.CreateContainer("logs")
+	out := &syncBuffer{}
+	stdout = out
+	defer func() { stdout = os.Stdout }()
+
+	lines := ""
+	for i := 1; i <= 15; i++ {
+		lines += fmt.Sprintf("line %d\n", i)
+	}
+	s.PutBlob("logs", "app.log", []byte(lines), "")
+	s.PutBlob("logs", "partial", []byte("a\nb\nc"), "")
+	for _, test := range []struct {
+		name  string
+		lines int
+		want  string
+	}{
+		{"app.log", 3, "line 13\nline 14\nline 15\n"},
+		{"app.log", 0, ""},
+		{"app.log", 100, lines},
+		{"partial", 2, "b\nc"},
+	} {
+		out.buf.Reset()
+		if err := Tail(ctx, "logs", test.name, &TailOptions{Lines: test.lines}); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != test.want {
+			t.Errorf("Tail of %d lines of %s = %q, want %q", test.lines, test.name, out, test.want)
+		}
+	}
+	if err := Tail(ctx, "logs", "missing", nil); err == nil {
+		t.Error("Tail of a missing blob returned no error")
+	}
+}
+
+func TestTailFollow(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newServer(t)
+	s.CreateContainer("logs")
+	out := &syncBuffer{}
+	stdout = out
+	interval := tailInterval
+	tailInterval = 10 * time.Millisecond
+	defer func() { stdout, tailInterval = os.Stdout, interval }()
+
+	// a log which does not exist yet is waited for
+	errs := make(chan error, 1)
+	go func() {
+		errs <- Tail(ctx, "logs", "app.log", &TailOptions{Lines: 10, Follow: true})
+	}()
+	wait := func(want string) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); out.String() != want; {
+			if time.Now().After(deadline) {
+				t.Fatalf("Tail output = %q, want %q", out, want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	options := &AppendOptions{MaxSize: 16}
+	if err := appendLines(context.Background(), "first\n", options); err != nil {
+		t.Fatal(err)
+	}
+	wait("first\n")
+	if err := appendLines(context.Background(), "second\n", options); err != nil {
+		t.Fatal(err)
+	}
+	wait("first\nsecond\n")
+
+	// the tail follows the log onto the next blob
+	if err := appendLines(context.Background(), "third\n", options); err != nil {
+		t.Fatal(err)
+	}
+	if err := appendLines(context.Background(), "fourth\n", options); err != nil {
+		t.Fatal(err)
+	}
+	wait("first\nsecond\nthird\nfourth\n")
+	if s.Blob("logs", "app.log.1") == nil {
+		t.Error("the log did not roll over")
+	}
+
+	cancel()
+	select {
+	case err := <-errs:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Tail error after cancel = %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Tail did not return after cancel")
+	}
+}
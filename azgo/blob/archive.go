@@ -0,0 +1,600 @@
+package blob
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/blue-eight/azgo/azgo/output"
+)
+
+// ArchiveFormats are the formats of Archive.
+var ArchiveFormats = []string{"tar", "tar.gz", "zip"}
+
+// PAX records of a tar entry which keep the content type and metadata of
+// a blob, so that Extract restores them.
+const (
+	paxContentType = "AZGO.content-type"
+	paxMetadata    = "AZGO.meta."
+)
+
+// ArchiveOptions configures Archive and Extract.
+type ArchiveOptions struct {
+	// Format is the format Archive writes, one of ArchiveFormats, which
+	// defaults to "tar.gz". Extract tells the format from the data.
+	Format string
+	// BlockSize and Concurrency are as for TransferOptions. Blobs and
+	// files up to BlockSize are transferred Concurrency at a time, and
+	// larger ones one at a time in Concurrency blocks at a time, so at
+	// most about their product is held in memory.
+	BlockSize   int64
+	Concurrency int
+	// Encryption decrypts the blobs Archive reads, and Compression and
+	// Encryption encode those Extract writes, as for Download and Upload.
+	// Both default to the settings of the active profile.
+	Compression string
+	Encryption  *Encryption
+}
+
+func (o *ArchiveOptions) withDefaults() ArchiveOptions {
+	options := ArchiveOptions{}
+	if o != nil {
+		options = *o
+	}
+	transfer := (&TransferOptions{Compression: options.Compression, Encryption: options.Encryption}).withDefaults()
+	options.Compression, options.Encryption = transfer.Compression, transfer.Encryption
+	if options.Format == "" {
+		options.Format = "tar.gz"
+	}
+	if options.BlockSize <= 0 {
+		options.BlockSize = DefaultBlockSize
+	}
+	if options.Concurrency <= 0 {
+		options.Concurrency = DefaultConcurrency
+	}
+	return options
+}
+
+// ExtractResult is a blob written by Extract.
+type ExtractResult struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// Archive writes every blob under remote, which is "container" or
+// "container/prefix", to the standard output as an archive, named by
+// their path after the prefix. Blobs are streamed as they are downloaded,
+// without temporary files. Blobs which azgo encrypted or compressed are
+// decoded as they are streamed. A tar entry needs its size first, so one
+// whose decoded size was not recorded when it was uploaded (from standard
+// input, say) is downloaded and decoded twice, once just to count it. A tar
+// archive keeps the content type and metadata of each blob in PAX records;
+// a zip keeps only the names and times.
+func Archive(ctx context.Context, remote string, options *ArchiveOptions) error {
+	o := options.withDefaults()
+	w, err := newArchiveWriter(stdout, o.Format)
+	if err != nil {
+		return err
+	}
+	container, prefix := splitRemote(remote)
+	serviceURL, err := BlobFromConfig()
+	if err != nil {
+		return err
+	}
+	containerURL := serviceURL.NewContainerURL(container)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type entry struct {
+		item azblob.BlobItemInternal
+		data []byte
+		err  error
+	}
+	// pending holds a channel per blob in order, as downloadRanges does
+	// for blocks; small blobs are downloaded ahead of their turn
+	pending := make(chan chan entry, o.Concurrency)
+	go func() {
+		defer close(pending)
+		err := archiveItems(ctx, containerURL, prefix, func(item azblob.BlobItemInternal) error {
+			result := make(chan entry, 1)
+			select {
+			case pending <- result:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			size := *item.Properties.ContentLength
+			if size == 0 || size > o.BlockSize || encodedBy(item.Metadata) {
+				result <- entry{item: item}
+				return nil
+			}
+			go func() {
+				data, err := downloadRange(ctx, containerURL.NewBlobURL(item.Name), 0, size, item.Properties.Etag)
+				result <- entry{item, data, err}
+			}()
+			return nil
+		})
+		if err != nil {
+			result := make(chan entry, 1)
+			result <- entry{err: err}
+			select {
+			case pending <- result:
+			case <-ctx.Done():
+			}
+		}
+	}()
+
+	count := 0
+	for result := range pending {
+		e := <-result
+		if e.err != nil {
+			return e.err
+		}
+		name, blobURL := strings.TrimPrefix(e.item.Name, prefix), containerURL.NewBlobURL(e.item.Name)
+		transfer := TransferOptions{BlockSize: o.BlockSize, Concurrency: o.Concurrency, Encryption: o.Encryption}
+		if encodedBy(e.item.Metadata) {
+			err = archiveDecoded(ctx, w, name, blobURL, e.item, transfer)
+		} else {
+			err = archiveBlob(ctx, w, name, blobURL, e.item, e.data, transfer)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", e.item.Name, err)
+		}
+		count++
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if count == 0 {
+		return fmt.Errorf("there are no blobs under %s/%s", container, prefix)
+	}
+	return w.Close()
+}
+
+// archiveBlob writes the blob item to w as the entry name, with data if
+// it was downloaded already.
+func archiveBlob(ctx context.Context, w archiveWriter, name string, blobURL azblob.BlobURL, item azblob.BlobItemInternal, data []byte, o TransferOptions) error {
+	f, err := w.create(name, item)
+	if err != nil {
+		return err
+	}
+	size := *item.Properties.ContentLength
+	if data != nil || size == 0 {
+		_, err = f.Write(data)
+		return err
+	}
+	return downloadRanges(ctx, blobURL, size, item.Properties.Etag, f, o)
+}
+
+// archiveDecoded writes the blob item, which azgo encoded, to w as the
+// entry name, decoded and without the metadata which azgo keeps about the
+// encoding.
+func archiveDecoded(ctx context.Context, w archiveWriter, name string, blobURL azblob.BlobURL, item azblob.BlobItemInternal, o TransferOptions) error {
+	metadata, stored := item.Metadata, *item.Properties.ContentLength
+	decodeTo := func(dst io.Writer) error {
+		d := newDecodeWriter(dst, metadata, o.Encryption)
+		return d.close(downloadRanges(ctx, blobURL, stored, item.Properties.Etag, d, o))
+	}
+	size, err := strconv.ParseInt(metadata[sizeMetadata], 10, 64)
+	if err != nil && w.needsSize() {
+		counted := byteCounter(0)
+		if err := decodeTo(&counted); err != nil {
+			return err
+		}
+		size = int64(counted)
+	}
+	item.Properties.ContentLength, item.Metadata = &size, withoutReserved(metadata)
+	entry, err := w.create(name, item)
+	if err != nil {
+		return err
+	}
+	return decodeTo(entry)
+}
+
+// byteCounter counts the bytes written to it.
+type byteCounter int64
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+// withoutReserved returns a copy of metadata without the keys which
+// SetMetadata keeps for azgo.
+func withoutReserved(metadata map[string]string) map[string]string {
+	m := map[string]string{}
+	for key, value := range metadata {
+		if !strings.HasPrefix(strings.ToLower(key), reservedMetadataPrefix) {
+			m[key] = value
+		}
+	}
+	return m
+}
+
+// archiveItems calls f with each blob under prefix, with its metadata, in
+// order of name. Directory markers, whose names end in a slash, are left
+// out.
+func archiveItems(ctx context.Context, containerURL azblob.ContainerURL, prefix string, f func(item azblob.BlobItemInternal) error) error {
+	segment := azblob.ListBlobsSegmentOptions{Prefix: prefix, Details: azblob.BlobListingDetails{Metadata: true}}
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		list, err := containerURL.ListBlobsFlatSegment(ctx, marker, segment)
+		if err != nil {
+			return err
+		}
+		marker = list.NextMarker
+		for _, item := range list.Segment.BlobItems {
+			if name := strings.TrimPrefix(item.Name, prefix); name == "" || strings.HasSuffix(name, "/") {
+				continue
+			}
+			if item.Properties.ContentLength == nil {
+				item.Properties.ContentLength = new(int64)
+			}
+			if err := f(item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// archiveWriter writes the entries of an archive.
+type archiveWriter interface {
+	// create starts the entry name for the blob item, whose data is
+	// written to the result.
+	create(name string, item azblob.BlobItemInternal) (io.Writer, error)
+	// needsSize reports whether create needs the size of the data.
+	needsSize() bool
+	Close() error
+}
+
+func newArchiveWriter(w io.Writer, format string) (archiveWriter, error) {
+	switch format {
+	case "tar":
+		return &tarWriter{tw: tar.NewWriter(w)}, nil
+	case "tar.gz", "tgz":
+		gz := gzip.NewWriter(w)
+		return &tarWriter{tw: tar.NewWriter(gz), gz: gz}, nil
+	case "zip":
+		return &zipWriter{zw: zip.NewWriter(w)}, nil
+	}
+	return nil, fmt.Errorf("unknown archive format %q (want one of %s)", format, strings.Join(ArchiveFormats, ", "))
+}
+
+type tarWriter struct {
+	tw *tar.Writer
+	gz *gzip.Writer
+}
+
+func (w *tarWriter) create(name string, item azblob.BlobItemInternal) (io.Writer, error) {
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     *item.Properties.ContentLength,
+		Mode:     0o644,
+		ModTime:  item.Properties.LastModified,
+	}
+	records := map[string]string{}
+	if item.Properties.ContentType != nil && *item.Properties.ContentType != "" {
+		records[paxContentType] = *item.Properties.ContentType
+	}
+	for key, value := range item.Metadata {
+		records[paxMetadata+key] = value
+	}
+	if len(records) > 0 {
+		header.PAXRecords, header.Format = records, tar.FormatPAX
+	}
+	if err := w.tw.WriteHeader(header); err != nil {
+		return nil, err
+	}
+	return w.tw, nil
+}
+
+func (w *tarWriter) needsSize() bool {
+	return true
+}
+
+func (w *tarWriter) Close() error {
+	err := w.tw.Close()
+	if w.gz != nil {
+		if gzErr := w.gz.Close(); err == nil {
+			err = gzErr
+		}
+	}
+	return err
+}
+
+type zipWriter struct {
+	zw *zip.Writer
+}
+
+func (w *zipWriter) create(name string, item azblob.BlobItemInternal) (io.Writer, error) {
+	return w.zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: item.Properties.LastModified,
+	})
+}
+
+func (w *zipWriter) needsSize() bool {
+	return false
+}
+
+func (w *zipWriter) Close() error {
+	return w.zw.Close()
+}
+
+// extractEntry is a file of an archive which Extract uploads. Its data is
+// read from r, or else from open.
+type extractEntry struct {
+	name        string
+	size        int64
+	contentType string
+	metadata    map[string]string
+	r           io.Reader
+	open        func() (io.ReadCloser, error)
+}
+
+// Extract reads a tar, tar.gz or zip archive from the standard input and
+// uploads each file in it to a blob under remote, which is "container" or
+// "container/prefix", Concurrency at a time. Each blob is printed as an
+// ExtractResult via output.Print. Directories, links and other entries
+// which are not files are left out, and a file whose name would be outside
+// the prefix, such as "../other", is an error. Files are compressed and
+// encrypted as the options say. A zip archive is read from a temporary
+// file unless the standard input is a file.
+func Extract(ctx context.Context, remote string, options *ArchiveOptions) error {
+	o := options.withDefaults()
+	container, prefix := splitRemote(remote)
+	serviceURL, err := BlobFromConfig()
+	if err != nil {
+		return err
+	}
+	containerURL := serviceURL.NewContainerURL(container)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		ExtractResult
+		err error
+	}
+	upload := func(e extractEntry) result {
+		name := prefix + e.name
+		r := e.r
+		if e.open != nil {
+			rc, err := e.open()
+			if err != nil {
+				return result{err: fmt.Errorf("%s: %w", e.name, err)}
+			}
+			defer rc.Close()
+			r = rc
+		}
+		transfer := TransferOptions{
+			BlockSize:   o.BlockSize,
+			Concurrency: o.Concurrency,
+			ContentType: e.contentType,
+			Metadata:    withoutReserved(e.metadata),
+			Compression: o.Compression,
+			Encryption:  o.Encryption,
+		}
+		size := e.size
+		if transfer.encodes() {
+			encoded, err := encodeUpload(r, e.size, &transfer, name, e.name)
+			if err != nil {
+				return result{err: fmt.Errorf("%s: %w", e.name, err)}
+			}
+			defer encoded.Close()
+			r, size = encoded, -1
+		}
+		if err := uploadStream(ctx, containerURL.NewBlockBlobURL(name), name, r, size, e.name, transfer, nil); err != nil {
+			return result{err: fmt.Errorf("%s: %w", e.name, err)}
+		}
+		return result{ExtractResult: ExtractResult{Name: name, Size: e.size}}
+	}
+
+	entries, results := make(chan extractEntry), make(chan result)
+	wg := sync.WaitGroup{}
+	for i := 0; i < o.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range entries {
+				results <- upload(e)
+			}
+		}()
+	}
+	readErr := make(chan error, 1)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(entries)
+		readErr <- readArchive(bufio.NewReader(stdin), o.BlockSize, func(e extractEntry, inline bool) error {
+			if inline {
+				// a large file of a tar is uploaded before the next
+				// is read
+				results <- upload(e)
+				return ctx.Err()
+			}
+			select {
+			case entries <- e:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var uploadErr error
+	for r := range results {
+		if uploadErr != nil {
+			continue
+		}
+		if r.err == nil {
+			r.err = output.Print(r.ExtractResult)
+		}
+		if r.err != nil {
+			uploadErr = r.err
+			cancel()
+		}
+	}
+	if uploadErr != nil {
+		return uploadErr
+	}
+	return <-readErr
+}
+
+// readArchive calls f with each file of the archive r. A file of a tar
+// which is larger than blockSize is passed inline, with r reading it, and
+// must be uploaded before f returns; smaller files are read into memory.
+func readArchive(r *bufio.Reader, blockSize int64, f func(e extractEntry, inline bool) error) error {
+	head, _ := r.Peek(4)
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")) || bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return readZip(r, f)
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		return readTar(gz, blockSize, f)
+	}
+	return readTar(r, blockSize, f)
+}
+
+func readTar(r io.Reader, blockSize int64, f func(e extractEntry, inline bool) error) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+			continue
+		}
+		name, err := archiveName(header.Name)
+		if err != nil {
+			return err
+		}
+		e := extractEntry{name: name, size: header.Size, contentType: header.PAXRecords[paxContentType]}
+		for key, value := range header.PAXRecords {
+			if strings.HasPrefix(key, paxMetadata) {
+				if e.metadata == nil {
+					e.metadata = map[string]string{}
+				}
+				e.metadata[strings.TrimPrefix(key, paxMetadata)] = value
+			}
+		}
+		if header.Size > blockSize {
+			e.r = tr
+			if err := f(e, true); err != nil {
+				return err
+			}
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		e.r = bytes.NewReader(data)
+		if err := f(e, false); err != nil {
+			return err
+		}
+	}
+}
+
+// readZip reads a zip archive, which has its directory at the end, from
+// r directly if it reads a file, or else from a copy in a temporary file.
+func readZip(r *bufio.Reader, f func(e extractEntry, inline bool) error) error {
+	// a file is read at offsets, whatever r has read of it
+	file, ok := stdin.(*os.File)
+	if ok {
+		info, err := file.Stat()
+		ok = err == nil && info.Mode().IsRegular()
+	}
+	if !ok {
+		tmp, err := os.CreateTemp("", "azgo-extract-*.zip")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		if _, err := io.Copy(tmp, r); err != nil {
+			return err
+		}
+		file = tmp
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	zr, err := zip.NewReader(file, info.Size())
+	if err != nil {
+		return err
+	}
+	// the file is read until every entry handed out is closed
+	open := sync.WaitGroup{}
+	defer open.Wait()
+	for _, zf := range zr.File {
+		if !zf.Mode().IsRegular() {
+			continue
+		}
+		name, err := archiveName(zf.Name)
+		if err != nil {
+			return err
+		}
+		zf := zf
+		open.Add(1)
+		e := extractEntry{name: name, size: int64(zf.UncompressedSize64), open: func() (io.ReadCloser, error) {
+			rc, err := zf.Open()
+			if err != nil {
+				open.Done()
+				return nil, err
+			}
+			return &doneCloser{ReadCloser: rc, done: open.Done}, nil
+		}}
+		if err := f(e, false); err != nil {
+			open.Done()
+			return err
+		}
+	}
+	return nil
+}
+
+// doneCloser calls done once it is closed.
+type doneCloser struct {
+	io.ReadCloser
+	done func()
+}
+
+func (c *doneCloser) Close() error {
+	err := c.ReadCloser.Close()
+	c.done()
+	return err
+}
+
+// archiveName returns the name of an archive entry as a blob name under
+// the prefix, or an error if it would be outside it.
+func archiveName(name string) (string, error) {
+	clean := path.Clean(strings.TrimPrefix(name, "./"))
+	if !relative(clean) {
+		return "", fmt.Errorf("the archive has a file outside the prefix: %q", name)
+	}
+	return clean, nil
+}
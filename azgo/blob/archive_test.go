@@ -0,0 +1,248 @@
+package blob
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/blue-eight/azgo/azgo/internal/testutil"
+)
+
+// archive runs Archive and returns what it writes.
+func archive(t *testing.T, remote string, options *ArchiveOptions) []byte {
+	t.Helper()
+	out := &bytes.Buffer{}
+	stdout = out
+	defer func() { stdout = os.Stdout }()
+	if err := Archive(context.Background(), remote, options); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+// extract runs Extract with data as the standard input and returns the
+// names of the blobs it prints, sorted.
+func extract(t *testing.T, remote string, data []byte, options *ArchiveOptions) ([]string, error) {
+	t.Helper()
+	stdin = bytes.NewReader(data)
+	defer func() { stdin = os.Stdin }()
+	out := testutil.CaptureOutput(t)
+	err := Extract(context.Background(), remote, options)
+	names := []string{}
+	for _, r := range testutil.Records(t, out) {
+		names = append(names, r["name"].(string))
+	}
+	sort.Strings(names)
+	return names, err
+}
+
+func TestArchive(t *testing.T) {
+	s := newServer(t)
+	s.CreateContainer("tenants")
+	files := map[string][]byte{
+		"a.json":         []byte(`{"id":1}`),
+		"empty.txt":      {},
+		"docs/large.bin": bytes.Repeat([]byte("0123456789"), 1000),
+		"docs/notes.txt": []byte("notes"),
+	}
+	for name, data := range files {
+		s.PutBlob("tenants", "t1/"+name, data, "")
+	}
+	s.PutBlob("tenants", "t1/a.json", files["a.json"], "application/vnd.tenant+json")
+	s.PutBlob("tenants", "t10/other.txt", []byte("another tenant"), "")
+	s.PutBlob("tenants", "t1/dir/", nil, "")
+	if err := SetMetadata(context.Background(), "tenants", "t1/a.json", map[string]string{"owner": "ada"}, false); err != nil {
+		t.Fatal(err)
+	}
+	// large.bin is streamed in blocks, and the rest are downloaded ahead
+	options := &ArchiveOptions{BlockSize: 4096, Concurrency: 2}
+
+	for _, format := range ArchiveFormats {
+		data := archive(t, "tenants/t1", &ArchiveOptions{Format: format, BlockSize: options.BlockSize, Concurrency: options.Concurrency})
+		remote := "tenants/restored-" + strings.Replace(format, ".", "-", 1)
+		names, err := extract(t, remote, data, options)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		want := []string{}
+		for name := range files {
+			want = append(want, strings.TrimPrefix(remote, "tenants/")+"/"+name)
+		}
+		sort.Strings(want)
+		if fmt.Sprint(names) != fmt.Sprint(want) {
+			t.Errorf("%s: extracted %v, want %v", format, names, want)
+		}
+		for name, data := range files {
+			b := s.Blob("tenants", strings.TrimPrefix(remote, "tenants/")+"/"+name)
+			if b == nil || !bytes.Equal(b.Data, data) {
+				t.Errorf("%s: %s = %+v, want %q", format, name, b, data)
+			}
+		}
+		// a tar keeps the content type and metadata
+		b := s.Blob("tenants", strings.TrimPrefix(remote, "tenants/")+"/a.json")
+		if format != "zip" && (b.Metadata["owner"] != "ada" || b.ContentType != "application/vnd.tenant+json") {
+			t.Errorf("%s: a.json has metadata %v and content type %s", format, b.Metadata, b.ContentType)
+		}
+	}
+
+	// a zip is read in place when the standard input is a file
+	file := filepath.Join(t.TempDir(), "t1.zip")
+	if err := os.WriteFile(file, archive(t, "tenants/t1/docs", &ArchiveOptions{Format: "zip"}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	stdin = f
+	defer func() { stdin = os.Stdin }()
+	if err := Extract(context.Background(), "tenants/from-file", nil); err != nil {
+		t.Fatal(err)
+	}
+	if b := s.Blob("tenants", "from-file/notes.txt"); b == nil || string(b.Data) != "notes" {
+		t.Errorf("from-file/notes.txt = %+v", b)
+	}
+
+	stdout = &bytes.Buffer{}
+	defer func() { stdout = os.Stdout }()
+	for _, test := range []struct {
+		remote string
+		format string
+	}{
+		{"tenants/missing", "tar"},
+		{"tenants/t1", "rar"},
+	} {
+		if err := Archive(context.Background(), test.remote, &ArchiveOptions{Format: test.format}); err == nil {
+			t.Errorf("Archive of %s as %s returned no error", test.remote, test.format)
+		}
+	}
+}
+
+func TestArchiveEncrypted(t *testing.T) {
+	ctx := context.Background()
+	s := newServer(t)
+	s.CreateContainer("tenants")
+	useEncryption(t, s, writeKey(t), "", "zstd")
+	value := strings.Repeat("secret ", 1000)
+	if err := InsertKeyValue(ctx, "tenants", "t1/secret.txt", value); err != nil {
+		t.Fatal(err)
+	}
+	// an upload from stdin has no decoded size recorded
+	stdin = strings.NewReader(value)
+	defer func() { stdin = os.Stdin }()
+	if err := Upload(ctx, "tenants", "t1/piped.txt", "-", nil); err != nil {
+		t.Fatal(err)
+	}
+	if size := s.Blob("tenants", "t1/secret.txt").Metadata[sizeMetadata]; size != fmt.Sprint(len(value)) {
+		t.Errorf("secret.txt has %s %q, want %d", sizeMetadata, size, len(value))
+	}
+	if size, ok := s.Blob("tenants", "t1/piped.txt").Metadata[sizeMetadata]; ok {
+		t.Errorf("piped.txt has %s %q, want none", sizeMetadata, size)
+	}
+
+	downloads := func(name string) int {
+		n := 0
+		for _, r := range s.Requests() {
+			if r.Method == "GET" && strings.HasSuffix(r.URL.Path, name) {
+				n++
+			}
+		}
+		return n
+	}
+	data := archive(t, "tenants/t1", &ArchiveOptions{Format: "tar"})
+	tr := tar.NewReader(bytes.NewReader(data))
+	for _, name := range []string{"piped.txt", "secret.txt"} {
+		header, err := tr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := &bytes.Buffer{}
+		got.ReadFrom(tr)
+		if header.Name != name || header.Size != int64(len(value)) || got.String() != value {
+			t.Errorf("archived %s of %d bytes, want %s decoded", header.Name, header.Size, name)
+		}
+		for key := range header.PAXRecords {
+			if strings.HasPrefix(key, paxMetadata+reservedMetadataPrefix) {
+				t.Errorf("archived the %s record of the encoding", key)
+			}
+		}
+	}
+	// the blob of unknown size is decoded once to count it, and again
+	// to archive it
+	if got := fmt.Sprint(downloads("/piped.txt"), downloads("/secret.txt")); got != "2 1" {
+		t.Errorf("downloads of piped.txt and secret.txt = %s, want 2 1", got)
+	}
+	if zipped := archive(t, "tenants/t1", &ArchiveOptions{Format: "zip"}); len(zipped) == 0 || downloads("/piped.txt") != 3 {
+		t.Errorf("a zip downloaded piped.txt %d times in all, want once more", downloads("/piped.txt"))
+	}
+
+	if _, err := extract(t, "tenants/restored", data, nil); err != nil {
+		t.Fatal(err)
+	}
+	b := s.Blob("tenants", "restored/secret.txt")
+	if strings.Contains(string(b.Data), "secret") || b.Metadata[encryptionMetadata] == "" || b.Metadata[compressionMetadata] != "zstd" {
+		t.Errorf("extracted %d bytes with metadata %v, want them encrypted", len(b.Data), b.Metadata)
+	}
+	if got, _, err := Get(ctx, "tenants", "restored/secret.txt"); err != nil || got != value {
+		t.Errorf("Get of the extracted blob = %d bytes, %v", len(got), err)
+	}
+}
+
+func TestExtractReservedMetadata(t *testing.T) {
+	s := newServer(t)
+	s.CreateContainer("tenants")
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	tw.WriteHeader(&tar.Header{
+		Name:     "data.json",
+		Size:     2,
+		Mode:     0o644,
+		Typeflag: tar.TypeReg,
+		Format:   tar.FormatPAX,
+		PAXRecords: map[string]string{
+			paxMetadata + encryptionMetadata:  "{}",
+			paxMetadata + compressionMetadata: "gzip",
+			paxMetadata + "owner":             "ada",
+		},
+	})
+	tw.Write([]byte("{}"))
+	tw.Close()
+
+	if _, err := extract(t, "tenants/t1", buf.Bytes(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if m := s.Blob("tenants", "t1/data.json").Metadata; fmt.Sprint(m) != "map[owner:ada]" {
+		t.Errorf("extracted metadata = %v, want only owner", m)
+	}
+	if got, _, err := Get(context.Background(), "tenants", "t1/data.json"); err != nil || got != "{}" {
+		t.Errorf("Get = %q, %v", got, err)
+	}
+}
+
+func TestExtractOutsidePrefix(t *testing.T) {
+	s := newServer(t)
+	s.CreateContainer("tenants")
+	for _, name := range []string{"../t2/data.json", "/etc/passwd", "ok/../../t2/data.json"} {
+		buf := &bytes.Buffer{}
+		tw := tar.NewWriter(buf)
+		tw.WriteHeader(&tar.Header{Name: name, Size: 2, Mode: 0o644, Typeflag: tar.TypeReg})
+		tw.Write([]byte("{}"))
+		tw.Close()
+		if _, err := extract(t, "tenants/t1", buf.Bytes(), nil); err == nil || !strings.Contains(err.Error(), "outside the prefix") {
+			t.Errorf("Extract of %s error = %v, want outside the prefix", name, err)
+		}
+	}
+	if b := s.Blob("tenants", "t2/data.json"); b != nil {
+		t.Error("Extract wrote outside the prefix")
+	}
+	if _, err := extract(t, "tenants/t1", []byte("not an archive at all, but long enough to be read as a tar header"), nil); err == nil {
+		t.Error("Extract of garbage returned no error")
+	}
+}
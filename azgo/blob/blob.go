@@ -3,42 +3,148 @@ package blob
 import (
 	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
-	"log"
+	"io"
+	"net/http"
 	"net/url"
-	"os"
+	"sort"
+	"strconv"
 	"strings"
 
+	"github.com/Azure/azure-pipeline-go/pipeline"
 	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/blue-eight/azgo/azgo/config"
+	"github.com/blue-eight/azgo/azgo/output"
+	"github.com/blue-eight/azgo/azgo/smoke"
+	"github.com/blue-eight/azgo/azgo/trace"
 )
 
 // BlobFromEnv returns an *azblob.ServiceURL authenticated via the environment variables
 // AZGO_STORAGE_ACCOUNT_NAME and AZGO_STORAGE_ACCOUNT_KEY
 func BlobFromEnv() (*azblob.ServiceURL, error) {
-	accountName := mustGetEnv("AZGO_STORAGE_ACCOUNT_NAME")
-	accountKey := mustGetEnv("AZGO_STORAGE_ACCOUNT_KEY")
-	credential, err := azblob.NewSharedKeyCredential(accountName, accountKey)
+	return BlobFromProfile(config.FromEnv())
+}
+
+// BlobFromConfig returns an *azblob.ServiceURL for the active profile
+// (see config.Active), which is what the functions in this package use.
+func BlobFromConfig() (*azblob.ServiceURL, error) {
+	return BlobFromProfile(config.Active())
+}
+
+// BlobFromProfile returns an *azblob.ServiceURL for the profile. If the
+// profile has a storage_connection_string (e.g. "UseDevelopmentStorage=true"
+// for Azurite) we use its endpoint and key or SAS. Otherwise we use
+// storage_account_name and storage_account_key, with blob_endpoint
+// overriding the default https://{account}.blob.core.windows.net. It returns
+// an error if the settings are missing or malformed.
+func BlobFromProfile(p *config.Profile) (*azblob.ServiceURL, error) {
+	u, credential, err := blobAccount(p)
 	if err != nil {
 		return nil, err
 	}
-	p := azblob.NewPipeline(credential, azblob.PipelineOptions{})
-	u, _ := url.Parse(fmt.Sprintf("https://%s.blob.core.windows.net", accountName))
-	serviceURL := azblob.NewServiceURL(*u, p)
+	serviceURL := azblob.NewServiceURL(*u, newPipeline(credential))
 	return &serviceURL, nil
 }
 
+// httpClient sends blob requests. Go's default transport asks for gzip
+// and decompresses responses with Content-Encoding gzip behind our back,
+// even a range of a blob, so we turn that off and decode blobs ourselves.
+var httpClient = func() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DisableCompression = true
+	transport.MaxIdleConnsPerHost = 100
+	return &http.Client{Transport: transport}
+}()
+
+// newPipeline returns the pipeline of blob requests with the credential.
+func newPipeline(credential azblob.Credential) pipeline.Pipeline {
+	sender := pipeline.FactoryFunc(func(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.PolicyFunc {
+		return func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+			res, err := httpClient.Do(request.WithContext(ctx))
+			if err != nil {
+				err = pipeline.NewError(err, "HTTP request failed")
+			}
+			return pipeline.NewHTTPResponse(res), err
+		}
+	})
+	return trace.NewBlobPipeline(credential, azblob.PipelineOptions{HTTPSender: sender})
+}
+
+// blobAccount returns the endpoint and credential of the profile, as
+// described for BlobFromProfile. The credential is a
+// *azblob.SharedKeyCredential unless the connection string has a SAS.
+func blobAccount(p *config.Profile) (*url.URL, azblob.Credential, error) {
+	accountName := p.StorageAccountName
+	accountKey := p.StorageAccountKey
+	endpoint := p.BlobEndpoint
+	sas := ""
+	if p.StorageConnectionString != "" {
+		conn, err := config.ParseStorageConnectionString(p.StorageConnectionString)
+		if err != nil {
+			return nil, nil, err
+		}
+		accountName, accountKey, sas = conn.AccountName, conn.AccountKey, conn.SharedAccessSignature
+		endpoint = conn.BlobEndpoint
+	}
+	if endpoint == "" {
+		if accountName == "" {
+			return nil, nil, config.Missing("storage_account_name")
+		}
+		endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", accountName)
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid blob endpoint %q: %w", endpoint, err)
+	}
+
+	var credential azblob.Credential
+	if sas != "" {
+		credential = azblob.NewAnonymousCredential()
+		u.RawQuery = sas
+	} else {
+		if accountName == "" {
+			return nil, nil, config.Missing("storage_account_name")
+		}
+		if accountKey == "" {
+			return nil, nil, config.Missing("storage_account_key")
+		}
+		credential, err = azblob.NewSharedKeyCredential(accountName, accountKey)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return u, credential, nil
+}
+
+// ContainerOptions configures CreateContainer.
+type ContainerOptions struct {
+	// PublicAccess lets anyone read the container's blobs without
+	// credentials: "blob" to read a blob by its URL, or "container" to
+	// list the blobs too (see PublicAccessLevels). It defaults to none.
+	PublicAccess string
+	// Metadata is the metadata of the container.
+	Metadata map[string]string
+}
+
 // CreateContainer creates a new container in the Blob Storage account
-// The container is created without any public access.
-func CreateContainer(container string) error {
-	serviceURL, err := BlobFromEnv()
+// The container is created without any public access or metadata unless
+// the options say otherwise.
+func CreateContainer(ctx context.Context, container string, options *ContainerOptions) error {
+	o := ContainerOptions{}
+	if options != nil {
+		o = *options
+	}
+	access, err := parsePublicAccess(o.PublicAccess)
+	if err != nil {
+		return err
+	}
+	serviceURL, err := BlobFromConfig()
 	if err != nil {
 		return err
 	}
 
-	ctx := context.Background()
 	containerURL := serviceURL.NewContainerURL(container)
-	_, err = containerURL.Create(ctx, azblob.Metadata{}, azblob.PublicAccessNone)
+	_, err = containerURL.Create(ctx, azblob.Metadata(o.Metadata), access)
 	if err != nil {
 		return err
 	}
@@ -46,14 +152,13 @@ func CreateContainer(container string) error {
 }
 
 // ListContainers lists all of the containers in the Blob Storage account.
-// It marsals the ContainerItems to JSON and writes them to the standard output.
-func ListContainers() error {
-	serviceURL, err := BlobFromEnv()
+// It prints each ContainerItem to the standard output via output.Print.
+func ListContainers(ctx context.Context) error {
+	serviceURL, err := BlobFromConfig()
 	if err != nil {
 		return err
 	}
 
-	ctx := context.Background()
 	marker := azblob.Marker{}
 	for marker.NotDone() {
 		listContainer, err := serviceURL.ListContainersSegment(ctx, marker, azblob.ListContainersSegmentOptions{})
@@ -63,87 +168,168 @@ func ListContainers() error {
 		marker = listContainer.NextMarker
 
 		for _, containerInfo := range listContainer.ContainerItems {
-			b, err := json.Marshal(containerInfo)
-			if err != nil {
+			if err := output.Print(containerInfo); err != nil {
 				return err
 			}
-			fmt.Printf("%s\n", b)
 		}
 	}
 	return nil
 }
 
 // InsertKeyValue creates a new Block Blob of type text/plain which is
-// named "key" and has the string value "value". The container defaults
-// to "main" if empty.
-func InsertKeyValue(container, key, value string) error {
+// named "key" and has the string value "value", compressed and encrypted
+// if the active profile says so (see TransferOptions). The container
+// defaults to "main" if empty.
+func InsertKeyValue(ctx context.Context, container, key, value string) error {
+	_, err := PutKeyValue(ctx, container, key, value, azblob.BlobAccessConditions{})
+	return err
+}
+
+// PutKeyValue writes value to the Block Blob "key" as InsertKeyValue does,
+// but only if the blob meets the If-Match or If-None-Match conditions in
+// ac, and returns its new ETag. A failed condition is a StorageError with
+// the service code ConditionNotMet, or BlobAlreadyExists for If-None-Match
+// of azblob.ETagAny. The container defaults to "main" if empty.
+func PutKeyValue(ctx context.Context, container, key, value string, ac azblob.BlobAccessConditions) (azblob.ETag, error) {
 	if container == "" {
 		container = "main"
 	}
 
-	serviceURL, err := BlobFromEnv()
+	serviceURL, err := BlobFromConfig()
 	if err != nil {
-		return err
+		return azblob.ETagNone, err
 	}
+	return WriteKeyValue(ctx, serviceURL.NewContainerURL(container), key, value, ac)
+}
 
-	ctx := context.Background()
-	containerURL := serviceURL.NewContainerURL(container)
+// WriteKeyValue is PutKeyValue for a container which the caller already
+// has a URL for, such as kv.BlobStore's. The value is compressed and
+// encrypted as the active profile says.
+func WriteKeyValue(ctx context.Context, containerURL azblob.ContainerURL, key, value string, ac azblob.BlobAccessConditions) (azblob.ETag, error) {
 	blobURL := containerURL.NewBlockBlobURL(key)
-	body := strings.NewReader(value)
+	var body io.ReadSeeker = strings.NewReader(value)
 	headers := azblob.BlobHTTPHeaders{ContentType: "text/plain"}
 	metadata := azblob.Metadata{}
-	ac := azblob.BlobAccessConditions{}
+	p := config.Active()
+	if e := EncryptionFromProfile(p); e != nil || p.BlobCompression != "" {
+		encoded, err := encode(body, p.BlobCompression, e)
+		if err != nil {
+			return azblob.ETagNone, err
+		}
+		data, err := io.ReadAll(encoded)
+		encoded.Close()
+		if err != nil {
+			return azblob.ETagNone, err
+		}
+		body, headers.ContentEncoding, metadata = bytes.NewReader(data), encoded.contentEncoding, encoded.metadata
+		metadata[sizeMetadata] = strconv.Itoa(len(value))
+	}
 	cpk := azblob.ClientProvidedKeyOptions{}
-	_, err = blobURL.Upload(ctx, body, headers, metadata, ac, azblob.DefaultAccessTier, nil, cpk)
+	res, err := blobURL.Upload(ctx, body, headers, metadata, ac, azblob.DefaultAccessTier, nil, cpk)
 	if err != nil {
-		return err
+		return azblob.ETagNone, err
 	}
-	return nil
+	return res.ETag(), nil
 }
 
-// Get gets the Block Blob specified by "key" and returns it as a string.
-// This function is designed to be paired with InsertKeyValue. The container
-// defaults to "main" if empty.
-func Get(container, key string) (string, error) {
+// InsertKeyValueIfNotExists is InsertKeyValue which fails with
+// BlobAlreadyExists rather than overwrite an existing key.
+func InsertKeyValueIfNotExists(ctx context.Context, container, key, value string) error {
+	ac := azblob.BlobAccessConditions{ModifiedAccessConditions: azblob.ModifiedAccessConditions{IfNoneMatch: azblob.ETagAny}}
+	_, err := PutKeyValue(ctx, container, key, value, ac)
+	return err
+}
+
+// CompareAndSwap writes value to "key" only if its ETag is still etag, as
+// returned by Get, or if etag is empty only if the key does not exist, and
+// returns the new ETag. When another writer got there first it fails with
+// ConditionNotMet (or BlobAlreadyExists), and the caller should Get the
+// value again and retry. The container defaults to "main" if empty.
+func CompareAndSwap(ctx context.Context, container, key string, etag azblob.ETag, value string) (azblob.ETag, error) {
+	ac := azblob.BlobAccessConditions{ModifiedAccessConditions: azblob.ModifiedAccessConditions{IfMatch: etag}}
+	if etag == azblob.ETagNone {
+		ac.ModifiedAccessConditions = azblob.ModifiedAccessConditions{IfNoneMatch: azblob.ETagAny}
+	}
+	return PutKeyValue(ctx, container, key, value, ac)
+}
+
+// Get gets the Block Blob specified by "key" and returns it as a string,
+// along with its ETag for CompareAndSwap. This function is designed to be
+// paired with InsertKeyValue, and decrypts and decompresses a value which
+// InsertKeyValue encoded. The container defaults to "main" if empty.
+func Get(ctx context.Context, container, key string) (string, azblob.ETag, error) {
 	if container == "" {
 		container = "main"
 	}
 
-	serviceURL, err := BlobFromEnv()
+	serviceURL, err := BlobFromConfig()
 	if err != nil {
-		return "", err
+		return "", azblob.ETagNone, err
 	}
+	return ReadKeyValue(ctx, serviceURL.NewContainerURL(container), key)
+}
 
-	ctx := context.Background()
-	containerURL := serviceURL.NewContainerURL(container)
+// ReadKeyValue is Get for a container which the caller already has a URL
+// for, such as kv.BlobStore's.
+func ReadKeyValue(ctx context.Context, containerURL azblob.ContainerURL, key string) (string, azblob.ETag, error) {
 	blobURL := containerURL.NewBlockBlobURL(key)
 	res, err := blobURL.Download(ctx, 0, 0, azblob.BlobAccessConditions{}, false, azblob.ClientProvidedKeyOptions{})
 	if err != nil {
-		return "", err
+		return "", azblob.ETagNone, err
 	}
 	b := &bytes.Buffer{}
 	reader := res.Body(azblob.RetryReaderOptions{})
 	defer reader.Close()
-	b.ReadFrom(reader)
-	return b.String(), nil
+	var r io.Reader = reader
+	if metadata := res.NewMetadata(); encodedBy(metadata) {
+		decoded, err := decode(reader, metadata, EncryptionFromProfile(config.Active()))
+		if err != nil {
+			return "", azblob.ETagNone, err
+		}
+		defer decoded.Close()
+		r = decoded
+	}
+	if _, err := b.ReadFrom(r); err != nil {
+		return "", azblob.ETagNone, err
+	}
+	return b.String(), res.ETag(), nil
+}
+
+// DeleteOptions configures Delete.
+type DeleteOptions struct {
+	// IncludeSnapshots deletes the snapshots of the blob with it. A blob
+	// with snapshots cannot be deleted without them.
+	IncludeSnapshots bool
+	// Version deletes only that snapshot or version of the blob.
+	Version BlobVersion
 }
 
 // Delete deletes a Block Blob specified by "key" in the given container.
 // The container defaults to "main" if empty.
-func Delete(container, key string) error {
+func Delete(ctx context.Context, container, key string, options *DeleteOptions) error {
 	if container == "" {
 		container = "main"
 	}
+	o := DeleteOptions{}
+	if options != nil {
+		o = *options
+	}
 
-	serviceURL, err := BlobFromEnv()
+	serviceURL, err := BlobFromConfig()
 	if err != nil {
 		return err
 	}
 
-	ctx := context.Background()
 	containerURL := serviceURL.NewContainerURL(container)
-	blobURL := containerURL.NewBlockBlobURL(key)
-	_, err = blobURL.Delete(ctx, azblob.DeleteSnapshotsOptionNone, azblob.BlobAccessConditions{})
+	blobURL, err := o.Version.url(containerURL.NewBlobURL(key))
+	if err != nil {
+		return err
+	}
+	snapshots := azblob.DeleteSnapshotsOptionNone
+	if o.IncludeSnapshots {
+		snapshots = azblob.DeleteSnapshotsOptionInclude
+	}
+	_, err = blobURL.Delete(ctx, snapshots, azblob.BlobAccessConditions{})
 	if err != nil {
 		return err
 	}
@@ -151,17 +337,16 @@ func Delete(container, key string) error {
 }
 
 // DeleteContainer deletes a container. The container defaults to "main" if empty.
-func DeleteContainer(container string) error {
+func DeleteContainer(ctx context.Context, container string) error {
 	if container == "" {
 		container = "main"
 	}
 
-	serviceURL, err := BlobFromEnv()
+	serviceURL, err := BlobFromConfig()
 	if err != nil {
 		return err
 	}
 
-	ctx := context.Background()
 	containerURL := serviceURL.NewContainerURL(container)
 	_, err = containerURL.Delete(ctx, azblob.ContainerAccessConditions{})
 	if err != nil {
@@ -170,52 +355,208 @@ func DeleteContainer(container string) error {
 	return nil
 }
 
+// ListOptions configures List.
+type ListOptions struct {
+	// Prefix limits the listing to blobs whose names start with it.
+	Prefix string
+	// Delimiter, e.g. "/", lists only the blobs directly under Prefix and
+	// collapses the names below the next delimiter into a VirtualDirectory.
+	Delimiter string
+	// Include adds details to each blob or lists more of them: copy,
+	// deleted, metadata, snapshots, tags, uncommittedblobs or versions.
+	Include []string
+	// Max is the most items to list, or 0 for all of them.
+	Max int
+	// Marker resumes a listing which stopped at Max.
+	Marker string
+}
+
+// VirtualDirectory is a name prefix which List collapses a group of blobs
+// into when listing with a Delimiter.
+type VirtualDirectory struct {
+	Name   string
+	Prefix bool
+}
+
+// listIncludes are the values of ListOptions.Include.
+var listIncludes = []string{"copy", "deleted", "metadata", "snapshots", "tags", "uncommittedblobs", "versions"}
+
+func listDetails(include []string) (azblob.BlobListingDetails, error) {
+	details := azblob.BlobListingDetails{}
+	for _, item := range include {
+		switch strings.ToLower(strings.TrimSpace(item)) {
+		case "copy":
+			details.Copy = true
+		case "deleted":
+			details.Deleted = true
+		case "metadata":
+			details.Metadata = true
+		case "snapshots":
+			details.Snapshots = true
+		case "tags":
+			details.Tags = true
+		case "uncommittedblobs":
+			details.UncommittedBlobs = true
+		case "versions":
+			details.Versions = true
+		default:
+			return details, fmt.Errorf("unknown include %q: want one of %s", item, strings.Join(listIncludes, ", "))
+		}
+	}
+	return details, nil
+}
+
+// maxListResults is the most items the service returns per request.
+const maxListResults = 5000
+
 // List lists the items in a container. The container defaults to "main"
-// if empty.
-func List(container string) error {
+// if empty. It prints each BlobItemInternal, or VirtualDirectory with a
+// Delimiter, to the standard output via output.Print in name order. If it
+// stops at options.Max with more to list, it writes the marker to resume
+// from to stderr.
+func List(ctx context.Context, container string, options *ListOptions) error {
 	if container == "" {
 		container = "main"
 	}
+	o := ListOptions{}
+	if options != nil {
+		o = *options
+	}
+	details, err := listDetails(o.Include)
+	if err != nil {
+		return err
+	}
 
-	serviceURL, err := BlobFromEnv()
+	serviceURL, err := BlobFromConfig()
 	if err != nil {
 		return err
 	}
 
-	ctx := context.Background()
 	containerURL := serviceURL.NewContainerURL(container)
 
 	marker := azblob.Marker{}
+	if o.Marker != "" {
+		marker.Val = &o.Marker
+	}
+	listed := 0
 	for marker.NotDone() {
+		segment := azblob.ListBlobsSegmentOptions{Prefix: o.Prefix, Details: details}
+		if o.Max > 0 {
+			remaining := o.Max - listed
+			if remaining == 0 {
+				fmt.Fprintf(stderr, "more results: --marker %s\n", *marker.Val)
+				return nil
+			}
+			if remaining < maxListResults {
+				segment.MaxResults = int32(remaining)
+			}
+		}
+
 		// Get a result segment starting with the blob indicated by the current Marker.
-		listBlob, err := containerURL.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{})
-		if err != nil {
-			return err
+		var items []interface{}
+		if o.Delimiter == "" {
+			listBlob, err := containerURL.ListBlobsFlatSegment(ctx, marker, segment)
+			if err != nil {
+				return err
+			}
+			// IMPORTANT: ListBlobs returns the start of the next segment; you MUST use this to get
+			// the next segment (after processing the current result segment).
+			marker = listBlob.NextMarker
+			for _, blobInfo := range listBlob.Segment.BlobItems {
+				items = append(items, blobInfo)
+			}
+		} else {
+			listBlob, err := containerURL.ListBlobsHierarchySegment(ctx, marker, o.Delimiter, segment)
+			if err != nil {
+				return err
+			}
+			marker = listBlob.NextMarker
+			items = hierarchyItems(listBlob.Segment)
 		}
-		// IMPORTANT: ListBlobs returns the start of the next segment; you MUST use this to get
-		// the next segment (after processing the current result segment).
-		marker = listBlob.NextMarker
 
 		// Process the blobs returned in this result segment (if the segment is empty, the loop body won't execute)
-		for _, blobInfo := range listBlob.Segment.BlobItems {
-			b, err := json.Marshal(blobInfo)
-			if err != nil {
+		for _, item := range items {
+			if err := output.Print(item); err != nil {
 				return err
 			}
-			fmt.Printf("%s\n", b)
+			listed++
 		}
 	}
 	return nil
 }
 
-func mustGetEnv(key string) string {
-	value := os.Getenv(key)
-	if value == "" {
-		log.Fatalf("Require environment variable: %s\n", key)
+// hierarchyItems returns the blobs and virtual directories of a segment
+// in name order, as the service lists them.
+func hierarchyItems(segment azblob.BlobHierarchyListSegment) []interface{} {
+	type named struct {
+		name string
+		item interface{}
+	}
+	all := []named{}
+	for _, prefix := range segment.BlobPrefixes {
+		all = append(all, named{prefix.Name, VirtualDirectory{Name: prefix.Name, Prefix: true}})
 	}
-	return value
+	for _, blobInfo := range segment.BlobItems {
+		all = append(all, named{blobInfo.Name, blobInfo})
+	}
+	sort.SliceStable(all, func(i, j int) bool { return all[i].name < all[j].name })
+	items := make([]interface{}, len(all))
+	for i, n := range all {
+		items[i] = n.item
+	}
+	return items
 }
 
-func Test() error {
-	return nil
+// Test is a smoke test of the storage account. It creates a temporary
+// container, uploads a blob, downloads it, lists the container, and deletes
+// the blob and the container, printing each step via output.Print (see
+// package smoke). It returns an error if any step failed.
+func Test(ctx context.Context) error {
+	test := smoke.New("blob")
+	container := smoke.Name("azgo-smoke", "-")
+	key := "smoke.txt"
+	value := smoke.Name("azgo smoke test", " ")
+
+	created := test.Step(ctx, "create container", func(ctx context.Context) error {
+		return CreateContainer(ctx, container, nil)
+	})
+	if !created {
+		return test.Err()
+	}
+	test.Step(ctx, "upload", func(ctx context.Context) error {
+		return InsertKeyValue(ctx, container, key, value)
+	})
+	test.Step(ctx, "download", func(ctx context.Context) error {
+		got, _, err := Get(ctx, container, key)
+		if err != nil {
+			return err
+		}
+		if got != value {
+			return fmt.Errorf("downloaded %q, want %q", got, value)
+		}
+		return nil
+	})
+	test.Step(ctx, "list", func(ctx context.Context) error {
+		serviceURL, err := BlobFromConfig()
+		if err != nil {
+			return err
+		}
+		res, err := serviceURL.NewContainerURL(container).ListBlobsFlatSegment(ctx, azblob.Marker{}, azblob.ListBlobsSegmentOptions{Prefix: key})
+		if err != nil {
+			return err
+		}
+		for _, item := range res.Segment.BlobItems {
+			if item.Name == key {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s is missing from the listing of %s", key, container)
+	})
+	test.Step(ctx, "delete", func(ctx context.Context) error {
+		return Delete(ctx, container, key, nil)
+	})
+	test.Cleanup(ctx, "delete container", func(ctx context.Context) error {
+		return DeleteContainer(ctx, container)
+	})
+	return test.Err()
 }
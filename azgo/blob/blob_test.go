@@ -0,0 +1,333 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/blue-eight/azgo/azgo/config"
+	"github.com/blue-eight/azgo/azgo/internal/fakestorage"
+	"github.com/blue-eight/azgo/azgo/internal/testutil"
+)
+
+func newServer(t *testing.T) *fakestorage.BlobServer {
+	s := fakestorage.NewBlobServer()
+	t.Cleanup(s.Close)
+	testutil.UseProfile(t, s.Profile())
+	return s
+}
+
+func TestContainers(t *testing.T) {
+	ctx := context.Background()
+	s := newServer(t)
+	s.PageSize = 2
+
+	for _, name := range []string{"c", "a", "b"} {
+		if err := CreateContainer(ctx, name, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := CreateContainer(ctx, "a", nil); storageCode(err) != azblob.ServiceCodeContainerAlreadyExists {
+		t.Errorf("CreateContainer(a) again error = %v, want ContainerAlreadyExists", err)
+	}
+
+	out := testutil.CaptureOutput(t)
+	if err := ListContainers(ctx); err != nil {
+		t.Fatal(err)
+	}
+	records := testutil.Records(t, out)
+	if len(records) != 3 {
+		t.Fatalf("ListContainers printed %d records, want 3:\n%s", len(records), out)
+	}
+	for i, want := range []string{"a", "b", "c"} {
+		if records[i]["Name"] != want {
+			t.Errorf("record %d Name = %v, want %s", i, records[i]["Name"], want)
+		}
+		if _, ok := records[i]["Properties"].(map[string]interface{}); !ok {
+			t.Errorf("record %d has no Properties object", i)
+		}
+	}
+
+	if err := DeleteContainer(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteContainer(ctx, "b"); storageCode(err) != azblob.ServiceCodeContainerNotFound {
+		t.Errorf("DeleteContainer(b) again error = %v, want ContainerNotFound", err)
+	}
+	if got := fmt.Sprint(s.Containers()); got != "[a c]" {
+		t.Errorf("containers = %s, want [a c]", got)
+	}
+}
+
+func TestKeyValue(t *testing.T) {
+	ctx := context.Background()
+	s := newServer(t)
+	s.CreateContainer("main")
+
+	if err := InsertKeyValue(ctx, "", "greeting", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	stored := s.Blob("main", "greeting")
+	if stored == nil || string(stored.Data) != "hello" || stored.ContentType != "text/plain" {
+		t.Fatalf("stored blob = %+v", stored)
+	}
+
+	value, etag, err := Get(ctx, "main", "greeting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "hello" || string(etag) != stored.ETag {
+		t.Errorf("Get = %q, %s, want hello, %s", value, etag, stored.ETag)
+	}
+
+	if err := Delete(ctx, "", "greeting", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Get(ctx, "main", "greeting"); storageCode(err) != azblob.ServiceCodeBlobNotFound {
+		t.Errorf("Get after Delete error = %v, want BlobNotFound", err)
+	}
+	if err := Delete(ctx, "main", "greeting", nil); storageCode(err) != azblob.ServiceCodeBlobNotFound {
+		t.Errorf("Delete of a missing blob error = %v, want BlobNotFound", err)
+	}
+	if err := InsertKeyValue(ctx, "missing", "k", "v"); storageCode(err) != azblob.ServiceCodeContainerNotFound {
+		t.Errorf("InsertKeyValue into a missing container error = %v, want ContainerNotFound", err)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	ctx := context.Background()
+	s := newServer(t)
+	s.CreateContainer("main")
+
+	if err := InsertKeyValueIfNotExists(ctx, "", "config", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := InsertKeyValueIfNotExists(ctx, "", "config", "v2"); storageCode(err) != azblob.ServiceCodeBlobAlreadyExists {
+		t.Errorf("InsertKeyValueIfNotExists of an existing key error = %v, want BlobAlreadyExists", err)
+	}
+	if _, err := CompareAndSwap(ctx, "main", "config", "", "v2"); storageCode(err) != azblob.ServiceCodeBlobAlreadyExists {
+		t.Errorf("CompareAndSwap from no ETag error = %v, want BlobAlreadyExists", err)
+	}
+
+	_, etag, err := Get(ctx, "main", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newETag, err := CompareAndSwap(ctx, "main", "config", etag, "v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newETag == etag || string(newETag) != s.Blob("main", "config").ETag {
+		t.Errorf("CompareAndSwap returned ETag %s, want the new %s", newETag, s.Blob("main", "config").ETag)
+	}
+	if _, err := CompareAndSwap(ctx, "main", "config", etag, "lost"); storageCode(err) != azblob.ServiceCodeConditionNotMet {
+		t.Errorf("CompareAndSwap with a stale ETag error = %v, want ConditionNotMet", err)
+	}
+	if value, _, _ := Get(ctx, "main", "config"); value != "v2" {
+		t.Errorf("value = %q, want v2", value)
+	}
+
+	// workers which retry on a conflict lose no increments
+	if err := InsertKeyValue(ctx, "main", "counter", "0"); err != nil {
+		t.Fatal(err)
+	}
+	const workers, increments = 4, 5
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for n := 0; n < increments; {
+				value, etag, err := Get(ctx, "main", "counter")
+				if err != nil {
+					errs <- err
+					return
+				}
+				count, _ := strconv.Atoi(value)
+				_, err = CompareAndSwap(ctx, "main", "counter", etag, strconv.Itoa(count+1))
+				switch {
+				case storageCode(err) == azblob.ServiceCodeConditionNotMet:
+					continue
+				case err != nil:
+					errs <- err
+					return
+				}
+				n++
+			}
+			errs <- nil
+		}()
+	}
+	for i := 0; i < workers; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if value, _, _ := Get(ctx, "main", "counter"); value != strconv.Itoa(workers*increments) {
+		t.Errorf("counter = %s, want %d", value, workers*increments)
+	}
+}
+
+func TestListPagination(t *testing.T) {
+	ctx := context.Background()
+	s := newServer(t)
+	s.PageSize = 2
+	for i := 4; i >= 0; i-- {
+		s.PutBlob("main", fmt.Sprintf("key%d", i), []byte(fmt.Sprint(i)), "text/plain")
+	}
+
+	out := testutil.CaptureOutput(t)
+	if err := List(ctx, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	records := testutil.Records(t, out)
+	if len(records) != 5 {
+		t.Fatalf("List printed %d records, want 5:\n%s", len(records), out)
+	}
+	for i, record := range records {
+		if want := fmt.Sprintf("key%d", i); record["Name"] != want {
+			t.Errorf("record %d Name = %v, want %s", i, record["Name"], want)
+		}
+		properties := record["Properties"].(map[string]interface{})
+		if properties["ContentLength"] != 1.0 || properties["ContentType"] != "text/plain" {
+			t.Errorf("record %d Properties = %v", i, properties)
+		}
+	}
+	if n := len(s.Requests()); n != 3 {
+		t.Errorf("List made %d requests, want 3 pages", n)
+	}
+
+	if err := List(ctx, "missing", nil); storageCode(err) != azblob.ServiceCodeContainerNotFound {
+		t.Errorf("List(missing) error = %v, want ContainerNotFound", err)
+	}
+}
+
+func TestListOptions(t *testing.T) {
+	ctx := context.Background()
+	s := newServer(t)
+	s.PageSize = 2
+	for _, name := range []string{"logs/2021/a.log", "logs/2021/b.log", "logs/2022/c.log", "logs/index", "other"} {
+		s.PutBlob("main", name, []byte(name), "text/plain").Metadata["source"] = "test"
+	}
+	names := func(out *bytes.Buffer) string {
+		got := []string{}
+		for _, r := range testutil.Records(t, out) {
+			name := fmt.Sprint(r["Name"])
+			if r["Prefix"] == true {
+				name += " (dir)"
+			}
+			got = append(got, name)
+		}
+		return strings.Join(got, ",")
+	}
+
+	out := testutil.CaptureOutput(t)
+	if err := List(ctx, "main", &ListOptions{Prefix: "logs/", Delimiter: "/"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := names(out), "logs/2021/ (dir),logs/2022/ (dir),logs/index"; got != want {
+		t.Errorf("List with a delimiter = %s, want %s", got, want)
+	}
+
+	out.Reset()
+	if err := List(ctx, "main", &ListOptions{Prefix: "logs/2021/", Include: []string{"metadata"}}); err != nil {
+		t.Fatal(err)
+	}
+	records := testutil.Records(t, out)
+	if len(records) != 2 || fmt.Sprint(records[0]["Metadata"]) != "map[source:test]" {
+		t.Errorf("List with metadata printed %v", records)
+	}
+
+	// three at a time, resuming from the marker on stderr
+	errOut := &bytes.Buffer{}
+	stderr = errOut
+	defer func() { stderr = os.Stderr }()
+	out.Reset()
+	if err := List(ctx, "main", &ListOptions{Max: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := names(out), "logs/2021/a.log,logs/2021/b.log,logs/2022/c.log"; got != want {
+		t.Errorf("List with max 3 = %s, want %s", got, want)
+	}
+	marker := strings.TrimSpace(strings.TrimPrefix(errOut.String(), "more results: --marker"))
+	if marker == "" || marker == errOut.String() {
+		t.Fatalf("List with max 3 wrote %q to stderr, want a marker", errOut)
+	}
+	out.Reset()
+	errOut.Reset()
+	if err := List(ctx, "main", &ListOptions{Max: 3, Marker: marker}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := names(out), "logs/index,other"; got != want {
+		t.Errorf("List from the marker = %s, want %s", got, want)
+	}
+	if errOut.Len() != 0 {
+		t.Errorf("List to the end wrote %q to stderr", errOut)
+	}
+
+	if err := List(ctx, "main", &ListOptions{Include: []string{"everything"}}); err == nil || !strings.Contains(err.Error(), "snapshots") {
+		t.Errorf("List with an unknown include error = %v", err)
+	}
+}
+
+func TestBlobFromProfile(t *testing.T) {
+	tests := []struct {
+		profile config.Profile
+		wantErr bool
+		wantURL string
+	}{
+		{config.Profile{}, true, ""},
+		{config.Profile{StorageAccountName: "acct"}, true, ""},
+		{config.Profile{StorageAccountName: "acct", StorageAccountKey: config.DevelopmentAccountKey}, false, "https://acct.blob.core.windows.net"},
+		{config.Profile{StorageConnectionString: "UseDevelopmentStorage=true"}, false, "http://127.0.0.1:10000/devstoreaccount1"},
+		{config.Profile{StorageConnectionString: "BlobEndpoint=https://x.example;TableEndpoint=https://t.example;SharedAccessSignature=sv=1&sig=abc"}, false, "https://x.example?sv=1&sig=abc"},
+	}
+	for _, test := range tests {
+		serviceURL, err := BlobFromProfile(&test.profile)
+		if (err != nil) != test.wantErr {
+			t.Errorf("BlobFromProfile(%+v) error = %v, wantErr %t", test.profile, err, test.wantErr)
+			continue
+		}
+		if err == nil {
+			u := serviceURL.URL()
+			if got := u.String(); got != test.wantURL {
+				t.Errorf("BlobFromProfile(%+v) URL = %s, want %s", test.profile, got, test.wantURL)
+			}
+		}
+	}
+}
+
+func TestSmoke(t *testing.T) {
+	ctx := context.Background()
+	s := newServer(t)
+
+	out := testutil.CaptureOutput(t)
+	if err := Test(ctx); err != nil {
+		t.Fatal(err)
+	}
+	records := testutil.Records(t, out)
+	steps := []string{"create container", "upload", "download", "list", "delete", "delete container"}
+	if len(records) != len(steps) {
+		t.Fatalf("Test printed %d steps, want %d:\n%s", len(records), len(steps), out)
+	}
+	for i, step := range steps {
+		if records[i]["step"] != step || records[i]["status"] != "pass" || records[i]["service"] != "blob" {
+			t.Errorf("step %d = %v, want %s to pass", i, records[i], step)
+		}
+	}
+	if containers := s.Containers(); len(containers) != 0 {
+		t.Errorf("Test left containers behind: %v", containers)
+	}
+
+	testutil.UseProfile(t, &config.Profile{})
+	out.Reset()
+	if err := Test(ctx); err == nil {
+		t.Error("Test without a storage account returned no error")
+	}
+	records = testutil.Records(t, out)
+	if len(records) != 1 || records[0]["status"] != "fail" || records[0]["error"] == nil {
+		t.Errorf("Test without a storage account printed %v, want create container to fail", records)
+	}
+}
@@ -0,0 +1,447 @@
+package blob
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/blue-eight/azgo/azgo/config"
+	"github.com/blue-eight/azgo/azgo/output"
+)
+
+// maxBatchRequests is the most subrequests the Blob Batch API takes in a
+// request.
+const maxBatchRequests = 256
+
+// AccessTiers are the tiers SetTier moves blobs to.
+var AccessTiers = []string{"Hot", "Cool", "Archive"}
+
+// BulkOptions configures Remove and SetTier, which act on every blob in a
+// container which matches all of the filters.
+type BulkOptions struct {
+	// Prefix limits them to blobs whose names start with it.
+	Prefix string
+	// OlderThan limits them to blobs last modified longer ago than it, if
+	// it is not 0 (see ParseAge).
+	OlderThan time.Duration
+	// Tags limits them to blobs with all of these index tags.
+	Tags map[string]string
+	// All must be set for Remove to delete every blob in the container,
+	// when neither Prefix, OlderThan nor Tags limits them.
+	All bool
+	// IncludeSnapshots removes the snapshots of each blob with it. A blob
+	// with snapshots cannot be removed without them.
+	IncludeSnapshots bool
+	// DryRun prints the blobs which match without changing them.
+	DryRun bool
+	// Concurrency is the number of batches sent at once, which defaults
+	// to DefaultConcurrency.
+	Concurrency int
+	// Progress is where the count of blobs done so far and a summary are
+	// written, e.g. os.Stderr.
+	Progress io.Writer
+}
+
+// BulkResult is a blob which Remove or SetTier changed, or would change
+// with DryRun.
+type BulkResult struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	// Tier is the tier SetTier moved the blob to.
+	Tier string `json:"tier,omitempty"`
+	// Status is "success" or "failed", with the Error, or empty with
+	// DryRun.
+	Status string `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+	DryRun bool   `json:"dry_run,omitempty"`
+}
+
+// ParseAge parses an age such as "30d", "2w" or "36h": a number of days
+// or weeks, or a duration as taken by time.ParseDuration.
+func ParseAge(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n, err := strconv.Atoi(strings.TrimSuffix(s, suffix)); strings.HasSuffix(s, suffix) && err == nil && n >= 0 {
+			return time.Duration(n) * unit, nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid age %q: want e.g. 30d, 2w or 36h", s)
+	}
+	return d, nil
+}
+
+// Remove deletes every blob in the container which matches the options,
+// 256 to a request with the Blob Batch API. The container defaults to
+// "main" if empty. It prints a BulkResult for each blob via output.Print,
+// and returns an error if any of them could not be deleted. Options with
+// no filter are an error unless All is set.
+func Remove(ctx context.Context, container string, options *BulkOptions) error {
+	o := BulkOptions{}
+	if options != nil {
+		o = *options
+	}
+	if o.Prefix == "" && o.OlderThan == 0 && len(o.Tags) == 0 && !o.All {
+		return errors.New("rm without --prefix, --older-than or --tag would remove every blob; pass --all to do so")
+	}
+	return bulk(ctx, container, "rm", "removed", o, "", func(u url.URL) (pipeline.Request, error) {
+		req, err := pipeline.NewRequest(http.MethodDelete, u, nil)
+		if err == nil && o.IncludeSnapshots {
+			req.Header.Set("x-ms-delete-snapshots", "include")
+		}
+		return req, err
+	})
+}
+
+// SetTier moves every blob in the container which matches the options,
+// and is not in it already, to the tier, which is Hot, Cool or Archive,
+// 256 to a request with the Blob Batch API. The container defaults to
+// "main" if empty. A blob in Archive must be rehydrated to Hot or Cool
+// before it can be read, which takes hours. It prints a BulkResult for
+// each blob via output.Print, and returns an error if any of them could
+// not be moved.
+func SetTier(ctx context.Context, container, tier string, options *BulkOptions) error {
+	o := BulkOptions{}
+	if options != nil {
+		o = *options
+	}
+	valid := false
+	for _, t := range AccessTiers {
+		if strings.EqualFold(tier, t) {
+			tier, valid = t, true
+		}
+	}
+	if !valid {
+		return fmt.Errorf("unknown tier %q: want one of %s", tier, strings.Join(AccessTiers, ", "))
+	}
+	return bulk(ctx, container, "set-tier", "moved to "+tier, o, tier, func(u url.URL) (pipeline.Request, error) {
+		query := u.Query()
+		query.Set("comp", "tier")
+		u.RawQuery = query.Encode()
+		req, err := pipeline.NewRequest(http.MethodPut, u, nil)
+		if err == nil {
+			req.Header.Set("x-ms-access-tier", tier)
+		}
+		return req, err
+	})
+}
+
+// bulkBatch is a batch of blobs and their results.
+type bulkBatch struct {
+	results []BulkResult
+	err     error
+}
+
+// bulk lists the blobs of the container which match o, and not those
+// already in tier if it is set, and sends subrequest for each of them in
+// batches, printing the results. The progress calls it name, and what it
+// did to a blob verb.
+func bulk(ctx context.Context, container, name, verb string, o BulkOptions, tier string, subrequest func(u url.URL) (pipeline.Request, error)) error {
+	if container == "" {
+		container = "main"
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = DefaultConcurrency
+	}
+	endpoint, credential, err := blobAccount(config.Active())
+	if err != nil {
+		return err
+	}
+	p := newPipeline(credential)
+	containerURL := azblob.NewServiceURL(*endpoint, p).NewContainerURL(container)
+	// each subrequest is signed on its own, by a pipeline which only signs
+	signer := pipeline.NewPipeline([]pipeline.Factory{credential}, pipeline.Options{
+		HTTPSender: pipeline.FactoryFunc(func(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.PolicyFunc {
+			return func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+				return pipeline.NewHTTPResponse(&http.Response{StatusCode: http.StatusOK}), nil
+			}
+		}),
+	})
+	send := func(results []BulkResult) error {
+		body := &bytes.Buffer{}
+		mw := multipart.NewWriter(body)
+		for i, r := range results {
+			req, err := subrequest(containerURL.NewBlobURL(r.Name).URL())
+			if err != nil {
+				return err
+			}
+			if _, err := signer.Do(ctx, nil, req); err != nil {
+				return err
+			}
+			if err := writeSubrequest(mw, i, req); err != nil {
+				return err
+			}
+		}
+		if err := mw.Close(); err != nil {
+			return err
+		}
+		return sendBatch(ctx, p, containerURL.URL(), mw.Boundary(), body.Bytes(), results)
+	}
+
+	progress := &bulkProgress{w: o.Progress, name: name, verb: verb, dryRun: o.DryRun}
+	batches := make(chan *bulkBatch)
+	done := make(chan *bulkBatch, o.Concurrency)
+	var (
+		printErr error
+		printed  sync.WaitGroup
+	)
+	printed.Add(1)
+	go func() {
+		defer printed.Done()
+		for b := range done {
+			for _, r := range b.results {
+				if b.err != nil && r.Status == "" {
+					r.Status, r.Error = "failed", b.err.Error()
+				}
+				progress.add(r)
+				if err := output.Print(r); err != nil && printErr == nil {
+					printErr = err
+				}
+			}
+		}
+	}()
+	workers := sync.WaitGroup{}
+	for i := 0; i < o.Concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for b := range batches {
+				b.err = send(b.results)
+				done <- b
+			}
+		}()
+	}
+	listErr := listBulk(ctx, containerURL, o, tier, func(results []BulkResult) {
+		if o.DryRun {
+			done <- &bulkBatch{results: results}
+			return
+		}
+		batches <- &bulkBatch{results: results}
+	})
+	close(batches)
+	workers.Wait()
+	close(done)
+	printed.Wait()
+	progress.done()
+
+	switch {
+	case listErr != nil:
+		return listErr
+	case printErr != nil:
+		return printErr
+	case progress.failed > 0:
+		return fmt.Errorf("%s: %d of %d blobs failed", name, progress.failed, progress.blobs)
+	}
+	return nil
+}
+
+// listBulk lists the blobs of the container which match o, and are not
+// in tier if it is set, and calls f with up to maxBatchRequests at a time.
+func listBulk(ctx context.Context, containerURL azblob.ContainerURL, o BulkOptions, tier string, f func([]BulkResult)) error {
+	before := time.Now().Add(-o.OlderThan)
+	details := azblob.BlobListingDetails{Tags: len(o.Tags) > 0}
+	results := []BulkResult{}
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		res, err := containerURL.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{Prefix: o.Prefix, Details: details})
+		if err != nil {
+			return err
+		}
+		marker = res.NextMarker
+		for _, item := range res.Segment.BlobItems {
+			if o.OlderThan > 0 && !item.Properties.LastModified.Before(before) {
+				continue
+			}
+			if !hasTags(item.BlobTags, o.Tags) {
+				continue
+			}
+			if tier != "" && string(item.Properties.AccessTier) == tier {
+				continue
+			}
+			r := BulkResult{Name: item.Name, Tier: tier, DryRun: o.DryRun}
+			if item.Properties.ContentLength != nil {
+				r.Size = *item.Properties.ContentLength
+			}
+			results = append(results, r)
+			if len(results) == maxBatchRequests {
+				f(results)
+				results = []BulkResult{}
+			}
+		}
+	}
+	if len(results) > 0 {
+		f(results)
+	}
+	return nil
+}
+
+// hasTags reports whether the index tags of a listed blob include all of
+// tags.
+func hasTags(blobTags *azblob.BlobTags, tags map[string]string) bool {
+	have := map[string]string{}
+	if blobTags != nil {
+		for _, tag := range blobTags.BlobTagSet {
+			have[tag.Key] = tag.Value
+		}
+	}
+	for key, value := range tags {
+		if v, ok := have[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// writeSubrequest writes a signed subrequest as the part of a batch with
+// Content-ID id.
+func writeSubrequest(mw *multipart.Writer, id int, req pipeline.Request) error {
+	pw, err := mw.CreatePart(map[string][]string{
+		"Content-Type":              {"application/http"},
+		"Content-Transfer-Encoding": {"binary"},
+		"Content-ID":                {strconv.Itoa(id)},
+	})
+	if err != nil {
+		return err
+	}
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "%s %s HTTP/1.1\r\n", req.Method, req.URL.RequestURI())
+	keys := []string{}
+	for key := range req.Header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(b, "%s: %s\r\n", key, req.Header.Get(key))
+	}
+	b.WriteString("Content-Length: 0\r\n\r\n")
+	_, err = pw.Write(b.Bytes())
+	return err
+}
+
+// sendBatch sends a batch of subrequests to the container at u, and sets the
+// Status of each result from its subresponse. It returns an error if the
+// batch as a whole failed.
+func sendBatch(ctx context.Context, p pipeline.Pipeline, u url.URL, boundary string, body []byte, results []BulkResult) error {
+	query := u.Query()
+	query.Set("restype", "container")
+	query.Set("comp", "batch")
+	u.RawQuery = query.Encode()
+	req, err := pipeline.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("x-ms-version", azblob.ServiceVersion)
+	req.Header.Set("Content-Type", "multipart/mixed; boundary="+boundary)
+	res, err := p.Do(ctx, nil, req)
+	if err != nil {
+		return err
+	}
+	defer res.Response().Body.Close()
+	if res.Response().StatusCode != http.StatusAccepted {
+		return batchError(res.Response())
+	}
+	_, params, err := mime.ParseMediaType(res.Response().Header.Get("Content-Type"))
+	if err != nil {
+		return fmt.Errorf("batch response: %w", err)
+	}
+	mr := multipart.NewReader(res.Response().Body, params["boundary"])
+	for i := 0; ; i++ {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("batch response: %w", err)
+		}
+		// the parts are in order, but have the Content-ID to be sure
+		if id, err := strconv.Atoi(part.Header.Get("Content-ID")); err == nil {
+			i = id
+		}
+		sub, err := http.ReadResponse(bufio.NewReader(part), nil)
+		if err != nil {
+			return fmt.Errorf("batch response: %w", err)
+		}
+		if i < 0 || i >= len(results) {
+			continue
+		}
+		if sub.StatusCode/100 == 2 {
+			results[i].Status = "success"
+		} else {
+			results[i].Status, results[i].Error = "failed", batchError(sub).Error()
+		}
+		sub.Body.Close()
+	}
+	return nil
+}
+
+// batchError returns an error for a failed batch or subrequest, with the
+// service's error code.
+func batchError(res *http.Response) error {
+	if code := res.Header.Get("x-ms-error-code"); code != "" {
+		return fmt.Errorf("%s (%d)", code, res.StatusCode)
+	}
+	return fmt.Errorf("%s", res.Status)
+}
+
+// bulkProgress counts the blobs a bulk operation has done, drawing the
+// count on a single line of w as they are added, if w is not nil, and then
+// a summary.
+type bulkProgress struct {
+	w      io.Writer
+	name   string
+	verb   string
+	dryRun bool
+	blobs  int
+	failed int
+	bytes  int64
+	drawn  time.Time
+}
+
+// add counts a result. It is only called from one goroutine.
+func (p *bulkProgress) add(r BulkResult) {
+	p.blobs++
+	if r.Status == "failed" {
+		p.failed++
+	} else {
+		p.bytes += r.Size
+	}
+	if p.w != nil && time.Since(p.drawn) >= progressInterval {
+		p.drawn = time.Now()
+		p.draw(p.verb)
+	}
+}
+
+// done draws the summary and ends the line.
+func (p *bulkProgress) done() {
+	if p.w == nil {
+		return
+	}
+	verb := p.verb
+	if p.dryRun {
+		verb = "would have " + verb
+	}
+	p.draw(verb)
+	fmt.Fprintln(p.w)
+}
+
+func (p *bulkProgress) draw(verb string) {
+	line := fmt.Sprintf("%s: %s %d blobs (%s)", p.name, verb, p.blobs-p.failed, FormatSize(p.bytes))
+	if p.failed > 0 {
+		line += fmt.Sprintf(", %d failed", p.failed)
+	}
+	fmt.Fprintf(p.w, "\r%-60s", line)
+}
@@ -0,0 +1,182 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blue-eight/azgo/azgo/internal/testutil"
+)
+
+// bulkNames returns the names of the blobs printed with the status, sorted.
+func bulkNames(records []map[string]interface{}, status string) []string {
+	names := []string{}
+	for _, r := range records {
+		if r["status"] == status || (status == "" && r["status"] == nil) {
+			names = append(names, r["name"].(string))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestRemove(t *testing.T) {
+	ctx := context.Background()
+	s := newServer(t)
+	s.CreateContainer("logs")
+	old := time.Now().Add(-40 * 24 * time.Hour)
+	// more than a batch of old logs, so they take several requests
+	want := []string{}
+	for i := 0; i < 300; i++ {
+		name := fmt.Sprintf("app/2021-08/%03d.log", i)
+		s.PutBlob("logs", name, []byte("line\n"), "").LastModified = old
+		want = append(want, name)
+	}
+	s.PutBlob("logs", "app/2021-10/001.log", []byte("line\n"), "")
+	s.PutBlob("logs", "db/2021-08/001.log", []byte("line\n"), "").LastModified = old
+
+	progress := &bytes.Buffer{}
+	out := testutil.CaptureOutput(t)
+	err := Remove(ctx, "logs", &BulkOptions{Prefix: "app/", OlderThan: 30 * 24 * time.Hour, DryRun: true, Progress: progress})
+	if got := bulkNames(testutil.Records(t, out), ""); err != nil || fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("Remove with DryRun printed %d blobs, %v, want the %d old logs", len(got), err, len(want))
+	}
+	if s.Blob("logs", want[0]) == nil {
+		t.Error("Remove with DryRun removed a blob")
+	}
+	if !strings.Contains(progress.String(), "rm: would have removed 300 blobs (1.5 KiB)") {
+		t.Errorf("Remove with DryRun wrote %q, want a summary", progress)
+	}
+
+	requests := len(s.Requests())
+	out = testutil.CaptureOutput(t)
+	if err := Remove(ctx, "logs", &BulkOptions{Prefix: "app/", OlderThan: 30 * 24 * time.Hour, Concurrency: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if got := bulkNames(testutil.Records(t, out), "success"); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Remove removed %d blobs, want the %d old logs", len(got), len(want))
+	}
+	batches := 0
+	for _, r := range s.Requests()[requests:] {
+		if r.URL.Query().Get("comp") == "batch" {
+			batches++
+		}
+	}
+	if batches != 2 {
+		t.Errorf("Remove sent %d batches, want 2", batches)
+	}
+	for _, name := range []string{want[0], want[299]} {
+		if s.Blob("logs", name) != nil {
+			t.Errorf("%s was not removed", name)
+		}
+	}
+	for _, name := range []string{"app/2021-10/001.log", "db/2021-08/001.log"} {
+		if s.Blob("logs", name) == nil {
+			t.Errorf("%s was removed", name)
+		}
+	}
+
+	// a blob which cannot be removed fails on its own
+	s.PutBlob("logs", "tmp/a.txt", []byte("a"), "")
+	s.PutBlob("logs", "tmp/b.txt", []byte("b"), "")
+	if err := SetTags(ctx, "logs", "tmp/b.txt", map[string]string{"retain": "false"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateSnapshot(ctx, "logs", "tmp/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	out = testutil.CaptureOutput(t)
+	err = Remove(ctx, "logs", &BulkOptions{Prefix: "tmp/"})
+	records := testutil.Records(t, out)
+	if err == nil || fmt.Sprint(bulkNames(records, "failed")) != "[tmp/a.txt]" || !strings.Contains(fmt.Sprint(records), "SnapshotsPresent") {
+		t.Errorf("Remove of a blob with snapshots = %v, printed %v", err, records)
+	}
+	if s.Blob("logs", "tmp/b.txt") != nil {
+		t.Error("tmp/b.txt was not removed")
+	}
+
+	// tags filter the blobs
+	s.PutBlob("logs", "tmp/c.txt", []byte("c"), "")
+	if err := SetTags(ctx, "logs", "tmp/c.txt", map[string]string{"retain": "false"}); err != nil {
+		t.Fatal(err)
+	}
+	out = testutil.CaptureOutput(t)
+	if err := Remove(ctx, "logs", &BulkOptions{Tags: map[string]string{"retain": "false"}, IncludeSnapshots: true}); err != nil {
+		t.Fatal(err)
+	}
+	if got := bulkNames(testutil.Records(t, out), "success"); fmt.Sprint(got) != "[tmp/c.txt]" {
+		t.Errorf("Remove with a tag removed %v, want tmp/c.txt", got)
+	}
+
+	// without a filter every blob goes, but only with All
+	s.PutBlob("logs", "keep/d.txt", []byte("d"), "")
+	if err := Remove(ctx, "logs", &BulkOptions{IncludeSnapshots: true}); err == nil || !strings.Contains(err.Error(), "--all") {
+		t.Errorf("Remove without a filter error = %v, want one asking for --all", err)
+	}
+	if s.Blob("logs", "keep/d.txt") == nil {
+		t.Error("Remove without a filter removed keep/d.txt")
+	}
+	out = testutil.CaptureOutput(t)
+	if err := Remove(ctx, "logs", &BulkOptions{All: true, IncludeSnapshots: true}); err != nil {
+		t.Fatal(err)
+	}
+	if got := bulkNames(testutil.Records(t, out), "success"); len(got) == 0 || s.Blob("logs", "keep/d.txt") != nil {
+		t.Errorf("Remove with All removed %v, want every blob", got)
+	}
+}
+
+func TestSetTier(t *testing.T) {
+	ctx := context.Background()
+	s := newServer(t)
+	s.CreateContainer("backups")
+	s.PutBlob("backups", "2021/01.tar", []byte("january"), "")
+	s.PutBlob("backups", "2021/02.tar", []byte("february"), "").AccessTier = "Cool"
+	s.PutBlob("backups", "2021/03.tar", []byte("march"), "")
+
+	out := testutil.CaptureOutput(t)
+	if err := SetTier(ctx, "backups", "cool", &BulkOptions{Prefix: "2021/"}); err != nil {
+		t.Fatal(err)
+	}
+	records := testutil.Records(t, out)
+	if got := bulkNames(records, "success"); fmt.Sprint(got) != "[2021/01.tar 2021/03.tar]" || records[0]["tier"] != "Cool" {
+		t.Errorf("SetTier printed %v, want the blobs not already in Cool", records)
+	}
+	for _, name := range []string{"2021/01.tar", "2021/02.tar", "2021/03.tar"} {
+		if tier := s.Blob("backups", name).AccessTier; tier != "Cool" {
+			t.Errorf("%s is in %q, want Cool", name, tier)
+		}
+	}
+
+	out = testutil.CaptureOutput(t)
+	if err := SetTier(ctx, "backups", "Archive", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Get(ctx, "backups", "2021/01.tar"); storageCode(err) != "BlobArchived" {
+		t.Errorf("Get of an archived blob error = %v, want BlobArchived", err)
+	}
+	if err := SetTier(ctx, "backups", "Glacier", nil); err == nil {
+		t.Error("SetTier to Glacier returned no error")
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	for s, want := range map[string]time.Duration{
+		"30d":   30 * 24 * time.Hour,
+		"2w":    14 * 24 * time.Hour,
+		"36h":   36 * time.Hour,
+		"1h30m": 90 * time.Minute,
+	} {
+		if got, err := ParseAge(s); err != nil || got != want {
+			t.Errorf("ParseAge(%q) = %v, %v, want %v", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "d", "-1d", "thirty days", "1.5d"} {
+		if _, err := ParseAge(s); err == nil {
+			t.Errorf("ParseAge(%q) returned no error", s)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package blob
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/blue-eight/azgo/azgo/output"
+)
+
+// PublicAccessLevels are the values of ContainerOptions.PublicAccess and
+// SetContainerAccess: none, or anonymous read of a blob by its URL, or of
+// the container's listing too.
+var PublicAccessLevels = []string{"none", "blob", "container"}
+
+// parsePublicAccess parses one of PublicAccessLevels, or "" for none.
+func parsePublicAccess(s string) (azblob.PublicAccessType, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "none":
+		return azblob.PublicAccessNone, nil
+	case "blob":
+		return azblob.PublicAccessBlob, nil
+	case "container":
+		return azblob.PublicAccessContainer, nil
+	}
+	return azblob.PublicAccessNone, fmt.Errorf("unknown public access %q: want one of %s", s, strings.Join(PublicAccessLevels, ", "))
+}
+
+// ContainerProperties are the properties and metadata of a container.
+type ContainerProperties struct {
+	Name         string
+	LastModified time.Time
+	ETag         string
+	// PublicAccess is one of PublicAccessLevels.
+	PublicAccess string
+	// LeaseStatus is locked or unlocked, and LeaseState available,
+	// leased, expired, breaking or broken. LeaseDuration is infinite or
+	// fixed while it is leased.
+	LeaseStatus   string
+	LeaseState    string
+	LeaseDuration string `json:",omitempty"`
+	// HasImmutabilityPolicy and HasLegalHold report whether blobs in the
+	// container cannot be changed or deleted for now, which are set
+	// through the management API.
+	HasImmutabilityPolicy bool
+	HasLegalHold          bool
+	Metadata              map[string]string
+}
+
+// GetContainerProperties returns the properties and metadata of the
+// container, which defaults to "main" if empty.
+func GetContainerProperties(ctx context.Context, container string) (*ContainerProperties, error) {
+	if container == "" {
+		container = "main"
+	}
+	serviceURL, err := BlobFromConfig()
+	if err != nil {
+		return nil, err
+	}
+	props, err := serviceURL.NewContainerURL(container).GetProperties(ctx, azblob.LeaseAccessConditions{})
+	if err != nil {
+		return nil, err
+	}
+	p := &ContainerProperties{
+		Name:                  container,
+		LastModified:          props.LastModified(),
+		ETag:                  string(props.ETag()),
+		PublicAccess:          string(props.BlobPublicAccess()),
+		LeaseStatus:           string(props.LeaseStatus()),
+		LeaseState:            string(props.LeaseState()),
+		LeaseDuration:         string(props.LeaseDuration()),
+		HasImmutabilityPolicy: props.HasImmutabilityPolicy() == "true",
+		HasLegalHold:          props.HasLegalHold() == "true",
+		Metadata:              props.NewMetadata(),
+	}
+	if p.PublicAccess == "" {
+		p.PublicAccess = "none"
+	}
+	return p, nil
+}
+
+// ShowContainer prints the ContainerProperties of the container via
+// output.Print. The container defaults to "main" if empty.
+func ShowContainer(ctx context.Context, container string) error {
+	p, err := GetContainerProperties(ctx, container)
+	if err != nil {
+		return err
+	}
+	return output.Print(p)
+}
+
+// SetContainerAccess sets the public access level of the container to one
+// of PublicAccessLevels, keeping its stored access policies, which are set
+// by the same request. The container defaults to "main" if empty.
+func SetContainerAccess(ctx context.Context, container, publicAccess string) error {
+	access, err := parsePublicAccess(publicAccess)
+	if err != nil {
+		return err
+	}
+	if container == "" {
+		container = "main"
+	}
+	serviceURL, err := BlobFromConfig()
+	if err != nil {
+		return err
+	}
+	containerURL := serviceURL.NewContainerURL(container)
+	_, items, err := accessPolicies(ctx, containerURL)
+	if err != nil {
+		return err
+	}
+	_, err = containerURL.SetAccessPolicy(ctx, access, items, azblob.ContainerAccessConditions{})
+	return err
+}
+
+// SetContainerMetadata sets the metadata of the container, replacing all
+// of it, or with merge only the given keys, where an empty value removes
+// a key. The container defaults to "main" if empty. Unlike SetMetadata,
+// a merge can lose a change made at the same time, as the service takes
+// no If-Match for containers.
+func SetContainerMetadata(ctx context.Context, container string, metadata map[string]string, merge bool) error {
+	if container == "" {
+		container = "main"
+	}
+	serviceURL, err := BlobFromConfig()
+	if err != nil {
+		return err
+	}
+	containerURL := serviceURL.NewContainerURL(container)
+	if merge {
+		props, err := containerURL.GetProperties(ctx, azblob.LeaseAccessConditions{})
+		if err != nil {
+			return err
+		}
+		merged := props.NewMetadata()
+		for key, value := range metadata {
+			merged[strings.ToLower(key)] = value
+		}
+		metadata = merged
+	}
+	m := azblob.Metadata{}
+	for key, value := range metadata {
+		if value != "" {
+			m[key] = value
+		}
+	}
+	_, err = containerURL.SetMetadata(ctx, m, azblob.ContainerAccessConditions{})
+	return err
+}
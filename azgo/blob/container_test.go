@@ -0,0 +1,84 @@
+package blob
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/blue-eight/azgo/azgo/internal/testutil"
+)
+
+func TestContainerProperties(t *testing.T) {
+	ctx := context.Background()
+	s := newServer(t)
+
+	options := &ContainerOptions{PublicAccess: "Blob", Metadata: map[string]string{"env": "staging", "team": "data"}}
+	if err := CreateContainer(ctx, "assets", options); err != nil {
+		t.Fatal(err)
+	}
+	if c := s.Container("assets"); c.PublicAccess != "blob" || fmt.Sprint(c.Metadata) != "map[env:staging team:data]" {
+		t.Errorf("CreateContainer made %+v", c)
+	}
+	if err := CreateContainer(ctx, "private", &ContainerOptions{PublicAccess: "everyone"}); err == nil {
+		t.Error("CreateContainer with public access everyone returned no error")
+	}
+	if s.Container("private") != nil {
+		t.Error("CreateContainer with invalid options created the container")
+	}
+
+	s.SetHolds("assets", false, true)
+	out := testutil.CaptureOutput(t)
+	if err := ShowContainer(ctx, "assets"); err != nil {
+		t.Fatal(err)
+	}
+	records := testutil.Records(t, out)
+	want := map[string]interface{}{
+		"Name":                  "assets",
+		"PublicAccess":          "blob",
+		"LeaseStatus":           "unlocked",
+		"LeaseState":            "available",
+		"HasImmutabilityPolicy": false,
+		"HasLegalHold":          true,
+		"ETag":                  s.Container("assets").ETag,
+	}
+	for key, value := range want {
+		if len(records) != 1 || records[0][key] != value {
+			t.Errorf("ShowContainer printed %v, want %s %v", records, key, value)
+		}
+	}
+
+	// the public access changes, and the stored access policies stay
+	if err := SetAccessPolicy(ctx, "assets", AccessPolicy{ID: "readers", Permissions: "rl"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, access := range []string{"container", "none"} {
+		if err := SetContainerAccess(ctx, "assets", access); err != nil {
+			t.Fatal(err)
+		}
+		p, err := GetContainerProperties(ctx, "assets")
+		if err != nil || p.PublicAccess != access || len(s.Container("assets").AccessPolicies) != 1 {
+			t.Errorf("after SetContainerAccess(%s), %+v, %v with policies %v", access, p, err, s.Container("assets").AccessPolicies)
+		}
+	}
+	if err := SetContainerAccess(ctx, "assets", "public"); err == nil {
+		t.Error("SetContainerAccess to public returned no error")
+	}
+
+	if err := SetContainerMetadata(ctx, "assets", map[string]string{"env": "", "owner": "ada"}, true); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(s.Container("assets").Metadata); got != "map[owner:ada team:data]" {
+		t.Errorf("after a merge, metadata = %s", got)
+	}
+	if err := SetContainerMetadata(ctx, "assets", map[string]string{"env": "prod"}, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(s.Container("assets").Metadata); got != "map[env:prod]" {
+		t.Errorf("after a replace, metadata = %s", got)
+	}
+
+	if _, err := GetContainerProperties(ctx, "missing"); storageCode(err) != azblob.ServiceCodeContainerNotFound {
+		t.Errorf("GetContainerProperties of a missing container error = %v", err)
+	}
+}
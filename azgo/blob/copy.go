@@ -0,0 +1,360 @@
+package blob
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/blue-eight/azgo/azgo/config"
+	"github.com/blue-eight/azgo/azgo/output"
+)
+
+// DefaultCopySASExpiry is how long the SAS which Copy signs for each
+// source blob lasts, which must be longer than the copy takes.
+const DefaultCopySASExpiry = 24 * time.Hour
+
+// CopyOptions configures Copy.
+type CopyOptions struct {
+	// SourceProfile is the profile of the source account, which defaults
+	// to the active profile. Its account key signs a read SAS for each
+	// source blob, unless the source URL or the profile has a SAS.
+	SourceProfile *config.Profile
+	// Sync copies each blob in a single request with Copy Blob From URL,
+	// which works for blobs up to 256 MiB, rather than starting a copy and
+	// waiting for it to finish.
+	Sync bool
+	// Concurrency is how many blobs are copied at once, which defaults to
+	// DefaultConcurrency.
+	Concurrency int
+	// Manifest is a file to which each blob copied is added, so a copy
+	// which is interrupted can be run again with the same manifest to skip
+	// the blobs which were copied, unless they have changed since.
+	Manifest string
+}
+
+// CopyResult is a blob copied, or skipped, by Copy.
+type CopyResult struct {
+	// Source is the URL of the source blob, without any SAS.
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Size        int64  `json:"size"`
+	// ETag is the ETag of the source blob which was copied.
+	ETag string `json:"etag"`
+	// Status is "success", or "skipped" if the manifest has the blob.
+	Status string `json:"status"`
+}
+
+// copySource is a container which Copy reads from, with the account key
+// to sign a read SAS for each blob if the URL of the container has none.
+type copySource struct {
+	containerURL azblob.ContainerURL
+	container    string
+	key          *azblob.SharedKeyCredential
+}
+
+// Copy copies blobs on the server side, without the data passing through
+// this process, from source to destination, which is "container/path" in
+// the account of the active profile. The source is the URL of a blob, or
+// "container/path" in the account of options.SourceProfile, which can be
+// another account. A source which is a container or ends with "/" is a
+// prefix, and every blob under it is copied to the same name under the
+// destination path. A destination which ends with "/" is a prefix too.
+// Each blob copied is printed as a CopyResult via output.Print.
+func Copy(ctx context.Context, source, destination string, options *CopyOptions) error {
+	o := CopyOptions{}
+	if options != nil {
+		o = *options
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = DefaultConcurrency
+	}
+	if o.SourceProfile == nil {
+		o.SourceProfile = config.Active()
+	}
+	src, name, err := parseCopySource(source, o.SourceProfile)
+	if err != nil {
+		return err
+	}
+	serviceURL, err := BlobFromConfig()
+	if err != nil {
+		return err
+	}
+	container, dstPath := destination, ""
+	if i := strings.Index(destination, "/"); i >= 0 {
+		container, dstPath = destination[:i], destination[i+1:]
+	}
+	if container == "" {
+		container = "main"
+	}
+	containerURL := serviceURL.NewContainerURL(container)
+
+	// a blob keeps its name under a destination prefix, and every blob
+	// under a source prefix keeps its name relative to it
+	prefix := name == "" || strings.HasSuffix(name, "/")
+	if prefix && dstPath != "" && !strings.HasSuffix(dstPath, "/") {
+		dstPath += "/"
+	}
+	destinationName := func(blob string) string {
+		if prefix {
+			return dstPath + strings.TrimPrefix(blob, name)
+		}
+		if dstPath == "" || strings.HasSuffix(dstPath, "/") {
+			return dstPath + path.Base(blob)
+		}
+		return dstPath
+	}
+
+	copied, err := readManifest(o.Manifest)
+	if err != nil {
+		return err
+	}
+	var manifest *os.File
+	if o.Manifest != "" {
+		if manifest, err = os.OpenFile(o.Manifest, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644); err != nil {
+			return err
+		}
+		defer manifest.Close()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type job struct {
+		name   string
+		result CopyResult
+		err    error
+	}
+	jobs, results := make(chan job), make(chan job)
+	listErr := make(chan error, 1)
+	go func() {
+		defer close(jobs)
+		listErr <- src.each(ctx, name, prefix, func(blob string, size int64, etag azblob.ETag) error {
+			u := src.containerURL.NewBlobURL(blob).URL()
+			u.RawQuery = ""
+			result := CopyResult{Source: u.String(), Destination: container + "/" + destinationName(blob), Size: size, ETag: string(etag), Status: "success"}
+			select {
+			case jobs <- job{name: blob, result: result}:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+	wg := sync.WaitGroup{}
+	for i := 0; i < o.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				if copied[j.result.Source+" "+j.result.Destination] == j.result.ETag {
+					j.result.Status = "skipped"
+				} else {
+					dst := containerURL.NewBlobURL(strings.TrimPrefix(j.result.Destination, container+"/"))
+					j.err = src.copy(ctx, j.name, azblob.ETag(j.result.ETag), dst, o.Sync)
+				}
+				results <- j
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var copyErr error
+	for j := range results {
+		if copyErr != nil {
+			continue
+		}
+		if j.err != nil {
+			copyErr = fmt.Errorf("copy %s: %w", j.result.Source, j.err)
+			cancel()
+			continue
+		}
+		if manifest != nil && j.result.Status == "success" {
+			line, err := json.Marshal(j.result)
+			if err == nil {
+				_, err = manifest.Write(append(line, '\n'))
+			}
+			if err != nil {
+				copyErr = fmt.Errorf("manifest: %w", err)
+				cancel()
+				continue
+			}
+		}
+		if err := output.Print(j.result); err != nil {
+			copyErr = err
+			cancel()
+		}
+	}
+	if copyErr != nil {
+		return copyErr
+	}
+	return <-listErr
+}
+
+// parseCopySource returns the container a Copy reads from and the name of
+// the blob or prefix in it. A source URL which has a SAS is used as it is;
+// any other must be in the account of the profile.
+func parseCopySource(source string, p *config.Profile) (*copySource, string, error) {
+	endpoint, credential, err := blobAccount(p)
+	if err != nil {
+		return nil, "", fmt.Errorf("source: %w", err)
+	}
+	container, name := source, ""
+	if strings.Contains(source, "://") {
+		u, err := url.Parse(source)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid source URL %q: %w", source, err)
+		}
+		parts := azblob.NewBlobURLParts(*u)
+		container, name = parts.ContainerName, parts.BlobName
+		if parts.SAS.Signature() != "" {
+			credential = azblob.NewAnonymousCredential()
+		} else if err := checkAccount(parts, credential); err != nil {
+			return nil, "", err
+		}
+		parts.ContainerName, parts.BlobName, parts.Snapshot, parts.VersionID = "", "", "", ""
+		sas := parts.SAS.Encode()
+		if sas == "" {
+			// a profile with a SAS has it in its endpoint
+			sas = endpoint.RawQuery
+		}
+		parts.SAS = azblob.SASQueryParameters{}
+		e := parts.URL()
+		e.RawQuery = sas
+		endpoint = &e
+	} else if i := strings.Index(source, "/"); i >= 0 {
+		container, name = source[:i], source[i+1:]
+	}
+	if container == "" {
+		return nil, "", fmt.Errorf("the source %q has no container", source)
+	}
+	src := &copySource{
+		containerURL: azblob.NewServiceURL(*endpoint, newPipeline(credential)).NewContainerURL(container),
+		container:    container,
+	}
+	src.key, _ = credential.(*azblob.SharedKeyCredential)
+	return src, name, nil
+}
+
+// checkAccount returns an error if the account of a URL is not the one
+// the credential signs for, as far as it can tell from the URL.
+func checkAccount(parts azblob.BlobURLParts, credential azblob.Credential) error {
+	key, ok := credential.(*azblob.SharedKeyCredential)
+	if !ok {
+		return nil
+	}
+	account := parts.IPEndpointStyleInfo.AccountName
+	if account == "" && strings.Contains(parts.Host, ".blob.") {
+		account = parts.Host[:strings.Index(parts.Host, ".")]
+	}
+	if account != "" && account != key.AccountName() {
+		return fmt.Errorf("the source is in account %s but the source profile is for %s: give its profile or a URL with a SAS", account, key.AccountName())
+	}
+	return nil
+}
+
+// each calls f with each blob to copy: every blob under name if prefix,
+// or else the blob name.
+func (src *copySource) each(ctx context.Context, name string, prefix bool, f func(name string, size int64, etag azblob.ETag) error) error {
+	if !prefix {
+		props, err := src.containerURL.NewBlobURL(name).GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+		if err != nil {
+			return err
+		}
+		return f(name, props.ContentLength(), props.ETag())
+	}
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		list, err := src.containerURL.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{Prefix: name})
+		if err != nil {
+			return err
+		}
+		marker = list.NextMarker
+		for _, item := range list.Segment.BlobItems {
+			size := int64(0)
+			if item.Properties.ContentLength != nil {
+				size = *item.Properties.ContentLength
+			}
+			if err := f(item.Name, size, item.Properties.Etag); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// copy copies the blob name, if it still has etag, to dst and waits for
+// the copy to finish.
+func (src *copySource) copy(ctx context.Context, name string, etag azblob.ETag, dst azblob.BlobURL, sync bool) error {
+	u := src.containerURL.NewBlobURL(name).URL()
+	if src.key != nil {
+		values := azblob.BlobSASSignatureValues{
+			Protocol:      azblob.SASProtocolHTTPS,
+			ExpiryTime:    time.Now().UTC().Add(DefaultCopySASExpiry),
+			Permissions:   "r",
+			ContainerName: src.container,
+			BlobName:      name,
+		}
+		if u.Scheme == "http" {
+			values.Protocol = azblob.SASProtocolHTTPSandHTTP
+		}
+		sas, err := values.NewSASQueryParameters(src.key)
+		if err != nil {
+			return err
+		}
+		u.RawQuery = sas.Encode()
+	}
+
+	srcac := azblob.ModifiedAccessConditions{IfMatch: etag}
+	if sync {
+		res, err := dst.ToBlockBlobURL().CopyFromURL(ctx, u, nil, srcac, azblob.BlobAccessConditions{}, nil, azblob.DefaultAccessTier, nil)
+		if err != nil {
+			return err
+		}
+		if res.CopyStatus() != azblob.SyncCopyStatusSuccess {
+			return fmt.Errorf("copy %s", res.CopyStatus())
+		}
+		return nil
+	}
+	res, err := dst.StartCopyFromURL(ctx, u, nil, srcac, azblob.BlobAccessConditions{}, azblob.DefaultAccessTier, nil)
+	if err != nil {
+		return err
+	}
+	return waitForCopy(ctx, dst, res.CopyID(), res.CopyStatus())
+}
+
+// readManifest returns the source ETag of each blob in the manifest file
+// by its source and destination, or nothing if there is no file yet.
+func readManifest(file string) (map[string]string, error) {
+	copied := map[string]string{}
+	if file == "" {
+		return copied, nil
+	}
+	f, err := os.Open(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return copied, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		result := CopyResult{}
+		if err := json.Unmarshal(scanner.Bytes(), &result); err != nil {
+			// the last line may be cut short if a copy was killed
+			continue
+		}
+		copied[result.Source+" "+result.Destination] = result.ETag
+	}
+	return copied, scanner.Err()
+}
@@ -0,0 +1,137 @@
+package blob
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/blue-eight/azgo/azgo/internal/fakestorage"
+	"github.com/blue-eight/azgo/azgo/internal/testutil"
+)
+
+// copyBlobs runs Copy and returns the CopyResults it prints.
+func copyBlobs(t *testing.T, source, destination string, options *CopyOptions) []map[string]interface{} {
+	t.Helper()
+	out := testutil.CaptureOutput(t)
+	if err := Copy(context.Background(), source, destination, options); err != nil {
+		t.Fatal(err)
+	}
+	return testutil.Records(t, out)
+}
+
+// statuses returns the destination and status of each result, sorted.
+func statuses(results []map[string]interface{}) string {
+	got := []string{}
+	for _, r := range results {
+		got = append(got, fmt.Sprint(r["destination"], " ", r["status"]))
+	}
+	sort.Strings(got)
+	return strings.Join(got, ", ")
+}
+
+func TestCopyAcrossAccounts(t *testing.T) {
+	dst := newServer(t)
+	dst.CreateContainer("backup")
+	src := fakestorage.NewBlobServer()
+	t.Cleanup(src.Close)
+	src.CreateContainer("photos")
+	for _, name := range []string{"2021/a.jpg", "2021/b.jpg", "2021/c.jpg", "2022/d.jpg"} {
+		src.PutBlob("photos", name, []byte("image "+name), "image/jpeg")
+	}
+	manifest := filepath.Join(t.TempDir(), "manifest.jsonl")
+	options := &CopyOptions{SourceProfile: src.Profile(), Concurrency: 2, Manifest: manifest}
+
+	results := copyBlobs(t, "photos/2021/", "backup/photos", options)
+	if got, want := statuses(results), "backup/photos/a.jpg success, backup/photos/b.jpg success, backup/photos/c.jpg success"; got != want {
+		t.Errorf("Copy results = %s, want %s", got, want)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		b := dst.Blob("backup", "photos/"+name+".jpg")
+		if b == nil || string(b.Data) != "image 2021/"+name+".jpg" || b.ContentType != "image/jpeg" {
+			t.Errorf("copy of %s.jpg = %+v", name, b)
+		}
+	}
+	// the source is read with a read-only SAS signed by its account key
+	for _, r := range src.Requests() {
+		if r.Method == "GET" && strings.Contains(r.URL.Path, "/2021/") {
+			if q := r.URL.Query(); q.Get("sig") == "" || q.Get("sp") != "r" {
+				t.Errorf("source read %s has no read SAS", r.URL)
+			}
+		}
+	}
+
+	// an interrupted copy resumes from the manifest, copying again only
+	// the blobs which changed
+	src.PutBlob("photos", "2021/b.jpg", []byte("edited"), "image/jpeg")
+	results = copyBlobs(t, "photos/2021/", "backup/photos", options)
+	if got, want := statuses(results), "backup/photos/a.jpg skipped, backup/photos/b.jpg success, backup/photos/c.jpg skipped"; got != want {
+		t.Errorf("Copy results with a manifest = %s, want %s", got, want)
+	}
+	if b := dst.Blob("backup", "photos/b.jpg"); string(b.Data) != "edited" {
+		t.Errorf("b.jpg = %q after it changed, want edited", b.Data)
+	}
+
+	// a single blob, given as a URL, keeps its name under a destination
+	// prefix
+	results = copyBlobs(t, src.Endpoint()+"/photos/2022/d.jpg", "backup/", &CopyOptions{SourceProfile: src.Profile(), Sync: true})
+	if got := statuses(results); got != "backup/d.jpg success" {
+		t.Errorf("sync Copy results = %s", got)
+	}
+	if b := dst.Blob("backup", "d.jpg"); b == nil || string(b.Data) != "image 2022/d.jpg" {
+		t.Errorf("sync copy of d.jpg = %+v", b)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	ctx := context.Background()
+	s := newServer(t)
+	s.CreateContainer("main")
+	s.CreateContainer("backup")
+	s.PutBlob("main", "report", []byte("quarterly"), "")
+	s.CopyPolls = 2
+	interval := copyPollInterval
+	copyPollInterval = time.Millisecond
+	defer func() { copyPollInterval = interval }()
+
+	// a copy in the same account is waited for until it finishes
+	copyBlobs(t, "main/report", "backup/report-2021", nil)
+	if b := s.Blob("backup", "report-2021"); b == nil || string(b.Data) != "quarterly" || b.CopyStatus != "success" {
+		t.Errorf("copy = %+v, want a finished copy of the report", b)
+	}
+
+	// a URL with a SAS is used as it is
+	values := azblob.BlobSASSignatureValues{
+		Protocol:      azblob.SASProtocolHTTPSandHTTP,
+		ExpiryTime:    time.Now().UTC().Add(time.Hour),
+		Permissions:   "r",
+		ContainerName: "main",
+		BlobName:      "report",
+	}
+	key, err := azblob.NewSharedKeyCredential(fakestorage.Account, s.Profile().StorageAccountKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sas, err := values.NewSASQueryParameters(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyBlobs(t, s.Endpoint()+"/main/report?"+sas.Encode(), "backup/report-sas", nil)
+	if b := s.Blob("backup", "report-sas"); b == nil || string(b.Data) != "quarterly" {
+		t.Errorf("copy from a SAS URL = %+v", b)
+	}
+
+	for _, test := range []struct{ source, destination string }{
+		{"main/missing", "backup/missing"},
+		{"https://other.blob.core.windows.net/main/report", "backup/report"},
+		{"/report", "backup/report"},
+	} {
+		if err := Copy(ctx, test.source, test.destination, nil); err == nil {
+			t.Errorf("Copy of %s returned no error", test.source)
+		}
+	}
+}
@@ -0,0 +1,446 @@
+package blob
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/blue-eight/azgo/azgo/config"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/crypto/scrypt"
+)
+
+// The metadata which records how azgo encoded a blob, so Download and Get
+// can decode it whatever options they are given, and the size of the data
+// before it was encoded, when that was known.
+const (
+	compressionMetadata = "azgocompression"
+	encryptionMetadata  = "azgoencryption"
+	sizeMetadata        = "azgosize"
+)
+
+const (
+	encryptionAlgorithm = "AES-256-GCM"
+	// encryptionSegmentSize is how much plaintext each segment of an
+	// encrypted blob holds; each is sealed separately so a blob of any size
+	// is streamed.
+	encryptionSegmentSize = 1 << 20
+	// maxSegmentSize bounds the segment size a blob's metadata can ask a
+	// download to hold in memory.
+	maxSegmentSize = 64 << 20
+)
+
+// scrypt parameters for deriving a key from a passphrase, as recommended
+// for interactive logins; they cost about 100ms per blob.
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// Compressions are the values of TransferOptions.Compression.
+var Compressions = []string{"gzip", "zstd"}
+
+// Encryption is the key encryption key (KEK) of client-side encryption.
+// Each blob is encrypted with AES-256-GCM under a new random data key,
+// which is wrapped with the KEK and kept in the blob's metadata, so only
+// holders of the KEK can read the blob.
+type Encryption struct {
+	// KeyFile is a file holding a 32-byte key, raw or in hex or base64,
+	// e.g. from "head -c 32 /dev/urandom".
+	KeyFile string
+	// Passphrase derives the KEK with scrypt, with a random salt for each
+	// blob, if there is no KeyFile.
+	Passphrase string
+}
+
+// EncryptionFromProfile returns the Encryption of the profile's
+// blob_encryption_key_file or blob_encryption_passphrase, or nil if it has
+// neither.
+func EncryptionFromProfile(p *config.Profile) *Encryption {
+	if p.BlobEncryptionKeyFile == "" && p.BlobEncryptionPassphrase == "" {
+		return nil
+	}
+	return &Encryption{KeyFile: p.BlobEncryptionKeyFile, Passphrase: p.BlobEncryptionPassphrase}
+}
+
+// encryptionData is the JSON of the azgoencryption metadata of a blob.
+type encryptionData struct {
+	Algorithm   string
+	SegmentSize int
+	// WrappedKey is the data key sealed with AES-256-GCM under the KEK,
+	// after the 12-byte nonce.
+	WrappedKey []byte
+	// KeyID identifies a key file by the start of the SHA-256 of its key.
+	KeyID string `json:",omitempty"`
+	// Salt and the scrypt parameters derive the KEK from a passphrase.
+	Salt    []byte `json:",omitempty"`
+	N, R, P int    `json:",omitempty"`
+}
+
+// kek returns the KEK for data, filling in its KeyID or a new Salt and
+// scrypt parameters if it has none yet.
+func (e *Encryption) kek(data *encryptionData) ([]byte, error) {
+	if e.KeyFile != "" {
+		key, err := readKeyFile(e.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(key)
+		id := hex.EncodeToString(sum[:8])
+		if data.KeyID == "" && data.Salt == nil {
+			data.KeyID = id
+		} else if data.KeyID != id {
+			return nil, fmt.Errorf("the blob was not encrypted with the key in %s", e.KeyFile)
+		}
+		return key, nil
+	}
+	if e.Passphrase == "" {
+		return nil, errors.New("encryption needs a key file or a passphrase")
+	}
+	if data.KeyID != "" {
+		return nil, errors.New("the blob was encrypted with a key file, not a passphrase")
+	}
+	if data.Salt == nil {
+		data.Salt = make([]byte, 16)
+		if _, err := rand.Read(data.Salt); err != nil {
+			return nil, err
+		}
+		data.N, data.R, data.P = scryptN, scryptR, scryptP
+	}
+	return scrypt.Key([]byte(e.Passphrase), data.Salt, data.N, data.R, data.P, 32)
+}
+
+// readKeyFile reads a 32-byte key, raw or in hex or base64, from file.
+func readKeyFile(file string) ([]byte, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 32 {
+		return b, nil
+	}
+	text := strings.TrimSpace(string(b))
+	if key, err := hex.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%s does not hold a 32-byte key, raw or in hex or base64", file)
+}
+
+// newAEAD returns AES-256-GCM with key.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// newDataKey returns a new random data key, and the encryptionData which
+// records it wrapped with the KEK.
+func (e *Encryption) newDataKey() ([]byte, *encryptionData, error) {
+	data := &encryptionData{Algorithm: encryptionAlgorithm, SegmentSize: encryptionSegmentSize}
+	kek, err := e.kek(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := newAEAD(kek)
+	if err != nil {
+		return nil, nil, err
+	}
+	key := make([]byte, 32)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, err
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	data.WrappedKey = aead.Seal(nonce, nonce, key, nil)
+	return key, data, nil
+}
+
+// dataKey unwraps the data key of data with the KEK.
+func (e *Encryption) dataKey(data *encryptionData) ([]byte, error) {
+	if data.Algorithm != encryptionAlgorithm {
+		return nil, fmt.Errorf("unknown encryption algorithm %q", data.Algorithm)
+	}
+	if data.SegmentSize <= 0 || data.SegmentSize > maxSegmentSize {
+		return nil, fmt.Errorf("invalid encryption segment size %d", data.SegmentSize)
+	}
+	kek, err := e.kek(data)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(data.WrappedKey) < aead.NonceSize() {
+		return nil, errors.New("the wrapped data key is too short")
+	}
+	nonce, wrapped := data.WrappedKey[:aead.NonceSize()], data.WrappedKey[aead.NonceSize():]
+	key, err := aead.Open(nil, nonce, wrapped, nil)
+	if err != nil {
+		return nil, errors.New("cannot unwrap the data key: wrong key or passphrase")
+	}
+	return key, nil
+}
+
+// segmentNonce and segmentAD are the nonce and additional data of segment
+// index of an encrypted blob. The data key is new for every blob, so the
+// index is a unique nonce, and the last segment is marked so that a blob
+// cut short at a segment boundary does not decrypt.
+func segmentNonce(index uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], index)
+	return nonce
+}
+
+func segmentAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// segmentWriter encrypts what is written to it in segments of
+// encryptionSegmentSize. Close seals the last segment, which may be empty.
+type segmentWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	buf   []byte
+	out   []byte
+	index uint64
+}
+
+func (s *segmentWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		// a full segment is only sealed when more follows, as the last
+		// segment is sealed differently
+		if len(s.buf) == encryptionSegmentSize {
+			if err := s.seal(false); err != nil {
+				return n - len(p), err
+			}
+		}
+		k := encryptionSegmentSize - len(s.buf)
+		if k > len(p) {
+			k = len(p)
+		}
+		s.buf = append(s.buf, p[:k]...)
+		p = p[k:]
+	}
+	return n, nil
+}
+
+func (s *segmentWriter) seal(last bool) error {
+	s.out = s.aead.Seal(s.out[:0], segmentNonce(s.index), s.buf, segmentAD(last))
+	s.buf = s.buf[:0]
+	s.index++
+	_, err := s.w.Write(s.out)
+	return err
+}
+
+func (s *segmentWriter) Close() error {
+	return s.seal(true)
+}
+
+// segmentReader decrypts the segments which segmentWriter wrote.
+type segmentReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	segment []byte
+	plain   []byte
+	buf     []byte
+	index   uint64
+	done    bool
+}
+
+func (s *segmentReader) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		if err := s.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+func (s *segmentReader) open() error {
+	n, err := io.ReadFull(s.r, s.segment)
+	last := err == io.ErrUnexpectedEOF
+	switch {
+	case err == nil:
+		if _, err := s.r.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	case err == io.EOF:
+		return errors.New("the encrypted blob is truncated")
+	case !last:
+		return err
+	}
+	s.plain, err = s.aead.Open(s.plain[:0], segmentNonce(s.index), s.segment[:n], segmentAD(last))
+	if err != nil {
+		return errors.New("the encrypted blob is corrupt or truncated")
+	}
+	s.buf, s.index, s.done = s.plain, s.index+1, last
+	return nil
+}
+
+// encoded is the data of an upload, compressed and encrypted, with the
+// Content-Encoding and metadata to store with it.
+type encoded struct {
+	io.ReadCloser
+	contentEncoding string
+	metadata        map[string]string
+}
+
+// encode compresses r with compression, if not empty, and then encrypts
+// it with e, if not nil. Content-Encoding is only set for a blob which is
+// compressed but not encrypted, as otherwise the data is not gzip or zstd
+// to anything but azgo. The caller must Close the result.
+func encode(r io.Reader, compression string, e *Encryption) (*encoded, error) {
+	result := &encoded{metadata: map[string]string{}}
+	var key []byte
+	if e != nil {
+		var data *encryptionData
+		var err error
+		if key, data, err = e.newDataKey(); err != nil {
+			return nil, err
+		}
+		b, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		result.metadata[encryptionMetadata] = string(b)
+	}
+	if compression != "" {
+		if err := checkCompression(compression); err != nil {
+			return nil, err
+		}
+		result.metadata[compressionMetadata] = compression
+		if e == nil {
+			result.contentEncoding = compression
+		}
+	}
+
+	// each writer writes to the one before it, and they are closed in
+	// reverse so the compressed data is flushed before the last segment
+	var w io.Writer
+	pr, pw := io.Pipe()
+	writers := []io.WriteCloser{}
+	w = pw
+	if key != nil {
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		sw := &segmentWriter{w: w, aead: aead}
+		writers, w = append(writers, sw), sw
+	}
+	if compression != "" {
+		cw, err := newCompressor(w, compression)
+		if err != nil {
+			return nil, err
+		}
+		writers, w = append(writers, cw), cw
+	}
+	go func() {
+		_, err := io.Copy(w, r)
+		for i := len(writers) - 1; i >= 0; i-- {
+			if closeErr := writers[i].Close(); err == nil {
+				err = closeErr
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	result.ReadCloser = pr
+	return result, nil
+}
+
+// checkCompression returns an error if compression is not one of
+// Compressions.
+func checkCompression(compression string) error {
+	for _, c := range Compressions {
+		if c == compression {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown compression %q (want one of %s)", compression, strings.Join(Compressions, ", "))
+}
+
+func newCompressor(w io.Writer, compression string) (io.WriteCloser, error) {
+	if compression == "zstd" {
+		return zstd.NewWriter(w)
+	}
+	return gzip.NewWriter(w), nil
+}
+
+// encodedBy reports whether metadata says azgo encoded the blob.
+func encodedBy(metadata map[string]string) bool {
+	return metadata[encryptionMetadata] != "" || metadata[compressionMetadata] != ""
+}
+
+// decode returns the data of a blob with metadata read from r, decrypted
+// and decompressed as its metadata says. e is only needed for a blob which
+// is encrypted. The caller must Close the result.
+func decode(r io.Reader, metadata map[string]string, e *Encryption) (io.ReadCloser, error) {
+	if value := metadata[encryptionMetadata]; value != "" {
+		if e == nil {
+			return nil, fmt.Errorf("the blob is encrypted: %w", config.Missing("blob_encryption_key_file"))
+		}
+		data := &encryptionData{}
+		if err := json.Unmarshal([]byte(value), data); err != nil {
+			return nil, fmt.Errorf("invalid %s metadata: %w", encryptionMetadata, err)
+		}
+		key, err := e.dataKey(data)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		r = &segmentReader{
+			r:       bufio.NewReader(r),
+			aead:    aead,
+			segment: make([]byte, data.SegmentSize+aead.Overhead()),
+		}
+	}
+	switch compression := metadata[compressionMetadata]; compression {
+	case "":
+		return io.NopCloser(r), nil
+	case "gzip":
+		return gzip.NewReader(r)
+	case "zstd":
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("unknown compression %q", compression)
+	}
+}
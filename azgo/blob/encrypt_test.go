@@ -0,0 +1,218 @@
+package blob
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/blue-eight/azgo/azgo/config"
+	"github.com/blue-eight/azgo/azgo/internal/fakestorage"
+	"github.com/blue-eight/azgo/azgo/internal/testutil"
+)
+
+// writeKey writes a random key to a file in a temporary directory, in hex.
+func writeKey(t *testing.T) string {
+	t.Helper()
+	key := make([]byte, 32)
+	rand.Read(key)
+	file := filepath.Join(t.TempDir(), "export.key")
+	if err := os.WriteFile(file, []byte(hex.EncodeToString(key)+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// useEncryption makes the active profile that of s with the encryption
+// and compression settings.
+func useEncryption(t *testing.T, s *fakestorage.BlobServer, keyFile, passphrase, compression string) {
+	t.Helper()
+	p := s.Profile()
+	p.BlobEncryptionKeyFile, p.BlobEncryptionPassphrase, p.BlobCompression = keyFile, passphrase, compression
+	testutil.UseProfile(t, p)
+}
+
+// putRaw overwrites the data of the blob main/name, keeping its metadata.
+func putRaw(t *testing.T, s *fakestorage.BlobServer, name string, data []byte) {
+	t.Helper()
+	b := s.Blob("main", name)
+	serviceURL, err := BlobFromConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := serviceURL.NewContainerURL("main").NewBlockBlobURL(name)
+	headers := azblob.BlobHTTPHeaders{ContentType: b.ContentType, ContentEncoding: b.ContentEncoding}
+	if _, err := u.Upload(context.Background(), bytes.NewReader(data), headers, b.Metadata, azblob.BlobAccessConditions{}, azblob.DefaultAccessTier, nil, azblob.ClientProvidedKeyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncryptedKeyValue(t *testing.T) {
+	ctx := context.Background()
+	s := newServer(t)
+	s.CreateContainer("main")
+	keyFile := writeKey(t)
+	value := strings.Repeat("customer 1234 exported 5 rows\n", 100)
+
+	for _, test := range []struct {
+		name, keyFile, passphrase, compression string
+	}{
+		{"key file", keyFile, "", ""},
+		{"passphrase", "", "correct horse battery staple", ""},
+		{"key file and zstd", keyFile, "", "zstd"},
+		{"passphrase and gzip", "", "correct horse battery staple", "gzip"},
+	} {
+		useEncryption(t, s, test.keyFile, test.passphrase, test.compression)
+		if err := InsertKeyValue(ctx, "main", "export", value); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		b := s.Blob("main", "export")
+		if strings.Contains(string(b.Data), "customer") || b.Metadata[encryptionMetadata] == "" || b.ContentEncoding != "" {
+			t.Errorf("%s: stored %d bytes with metadata %v and Content-Encoding %q, want them encrypted", test.name, len(b.Data), b.Metadata, b.ContentEncoding)
+		}
+		if test.compression != "" && (len(b.Data) > len(value)/4 || b.Metadata[compressionMetadata] != test.compression) {
+			t.Errorf("%s: stored %d bytes with metadata %v, want them compressed", test.name, len(b.Data), b.Metadata)
+		}
+		if got, _, err := Get(ctx, "main", "export"); err != nil || got != value {
+			t.Errorf("%s: Get = %d bytes, %v, want the value", test.name, len(got), err)
+		}
+	}
+
+	useEncryption(t, s, keyFile, "", "")
+	if err := InsertKeyValue(ctx, "main", "export", value); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name, keyFile, passphrase string
+		want                      string
+	}{
+		{"no key", "", "", "blob_encryption_key_file is not set"},
+		{"another key file", writeKey(t), "", "not encrypted with the key"},
+		{"a passphrase", "", "correct horse battery staple", "encrypted with a key file"},
+	} {
+		useEncryption(t, s, test.keyFile, test.passphrase, "")
+		if _, _, err := Get(ctx, "main", "export"); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("Get with %s error = %v, want %q", test.name, err, test.want)
+		}
+	}
+	useEncryption(t, s, "", "the wrong passphrase", "")
+	if err := InsertKeyValue(ctx, "main", "export", value); err != nil {
+		t.Fatal(err)
+	}
+	useEncryption(t, s, "", "correct horse battery staple", "")
+	if _, _, err := Get(ctx, "main", "export"); err == nil || !strings.Contains(err.Error(), "wrong key or passphrase") {
+		t.Errorf("Get with the wrong passphrase error = %v", err)
+	}
+}
+
+func TestEncryptedUpload(t *testing.T) {
+	ctx := context.Background()
+	s := newServer(t)
+	s.CreateContainer("main")
+	dir := t.TempDir()
+	// more than two segments, so the last is partial
+	data := make([]byte, 2*encryptionSegmentSize+1000)
+	rand.Read(data)
+	file := filepath.Join(dir, "export.csv")
+	if err := os.WriteFile(file, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	encryption := &Encryption{KeyFile: writeKey(t)}
+	download := func(name string) ([]byte, error) {
+		out := filepath.Join(dir, "downloaded")
+		// small blocks exercise decoding across ranges
+		err := Download(ctx, "main", name, out, &TransferOptions{BlockSize: 100 << 10, Encryption: encryption})
+		if err != nil {
+			return nil, err
+		}
+		return os.ReadFile(out)
+	}
+
+	if err := Upload(ctx, "main", "export.csv", file, &TransferOptions{Encryption: encryption}); err != nil {
+		t.Fatal(err)
+	}
+	b := s.Blob("main", "export.csv")
+	if len(b.Data) != len(data)+3*16 || b.ContentType != "text/csv; charset=utf-8" {
+		t.Errorf("stored %d bytes of %s, want %d bytes of text/csv in 3 segments", len(b.Data), b.ContentType, len(data)+3*16)
+	}
+	if got, err := download("export.csv"); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("Download = %d bytes, %v, want the %d bytes uploaded", len(got), err, len(data))
+	}
+
+	// a blob cut short, even at a segment boundary, or changed fails
+	segment := encryptionSegmentSize + 16
+	flipped := append([]byte{}, b.Data...)
+	flipped[segment+10] ^= 1
+	for name, stored := range map[string][]byte{
+		"truncated": b.Data[:2*segment],
+		"changed":   flipped,
+		"reordered": append(append(append([]byte{}, b.Data[segment:2*segment]...), b.Data[:segment]...), b.Data[2*segment:]...),
+	} {
+		putRaw(t, s, "export.csv", stored)
+		if _, err := download("export.csv"); err == nil {
+			t.Errorf("Download of a %s blob returned no error", name)
+		}
+	}
+
+	// a blob which is only compressed has a Content-Encoding, so other
+	// clients can read it too
+	text := bytes.Repeat([]byte("id,name\n1,ada\n"), 1<<15)
+	if err := os.WriteFile(file, text, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Upload(ctx, "main", "export.csv.gz", file, &TransferOptions{Compression: "gzip"}); err != nil {
+		t.Fatal(err)
+	}
+	b = s.Blob("main", "export.csv.gz")
+	if b.ContentEncoding != "gzip" || len(b.Data) > len(text)/10 {
+		t.Errorf("stored %d bytes with Content-Encoding %q, want them gzipped", len(b.Data), b.ContentEncoding)
+	}
+	if zr, err := gzip.NewReader(bytes.NewReader(b.Data)); err != nil {
+		t.Error(err)
+	} else if got, err := io.ReadAll(zr); err != nil || !bytes.Equal(got, text) {
+		t.Errorf("gunzip of the blob = %d bytes, %v", len(got), err)
+	}
+	if got, err := download("export.csv.gz"); err != nil || !bytes.Equal(got, text) {
+		t.Errorf("Download of a gzipped blob = %d bytes, %v, want %d bytes", len(got), err, len(text))
+	}
+
+	if err := Upload(ctx, "main", "export.csv.bz2", file, &TransferOptions{Compression: "bzip2"}); err == nil {
+		t.Error("Upload with bzip2 returned no error")
+	}
+}
+
+func TestReadKeyFile(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	dir := t.TempDir()
+	for name, content := range map[string][]byte{
+		"raw":    key,
+		"hex":    []byte(hex.EncodeToString(key) + "\n"),
+		"base64": []byte(base64.StdEncoding.EncodeToString(key) + "\n"),
+		"short":  key[:16],
+	} {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, content, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readKeyFile(file)
+		if name == "short" {
+			if err == nil {
+				t.Error("readKeyFile of a 16-byte key returned no error")
+			}
+		} else if err != nil || !bytes.Equal(got, key) {
+			t.Errorf("readKeyFile of a %s key = %x, %v, want %x", name, got, err, key)
+		}
+	}
+	if p := (&config.Profile{}); EncryptionFromProfile(p) != nil {
+		t.Error("EncryptionFromProfile of a profile without a key is not nil")
+	}
+}
@@ -0,0 +1,221 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/google/uuid"
+)
+
+// DefaultLockDuration is the default LockOptions.Duration.
+const DefaultLockDuration = 30 * time.Second
+
+// ErrLocked is returned by AcquireLock when another holder has the lock.
+var ErrLocked = errors.New("locked by another holder")
+
+var (
+	// lockRetryInterval is how often AcquireLock tries again while it
+	// waits for another holder; tests shorten it.
+	lockRetryInterval = 2 * time.Second
+	// renewEvery returns how often a lease lasting duration is renewed,
+	// which leaves time for a failed renewal to be retried; tests replace
+	// it.
+	renewEvery = func(duration time.Duration) time.Duration { return duration / 3 }
+)
+
+// LockOptions configures AcquireLock.
+type LockOptions struct {
+	// Duration is how long the lease on the lock lasts unless renewed, from
+	// 15s to 60s, which defaults to DefaultLockDuration. If a holder dies
+	// without releasing the lock, others can take it after this long.
+	Duration time.Duration
+	// Wait is how long to wait for another holder to release the lock. If
+	// it is 0, AcquireLock fails straight away with ErrLocked.
+	Wait time.Duration
+}
+
+// Lock is a lock held by AcquireLock, as a lease on a blob which is
+// renewed in the background until Release.
+type Lock struct {
+	blobURL  azblob.BlobURL
+	leaseID  string
+	duration time.Duration
+
+	stop context.CancelFunc
+	done chan struct{}
+	lost chan struct{}
+	err  error
+}
+
+// AcquireLock takes the lock called name in the container, which defaults
+// to "main" if empty, by acquiring a lease on the blob name, which is
+// created empty if needed. The lease is renewed in the background until
+// Release, and Lost is closed if that fails.
+func AcquireLock(ctx context.Context, container, name string, options *LockOptions) (*Lock, error) {
+	if container == "" {
+		container = "main"
+	}
+	o := LockOptions{}
+	if options != nil {
+		o = *options
+	}
+	if o.Duration == 0 {
+		o.Duration = DefaultLockDuration
+	}
+	if o.Duration < 15*time.Second || o.Duration > 60*time.Second {
+		return nil, fmt.Errorf("lock duration %s is not between 15s and 60s", o.Duration)
+	}
+
+	serviceURL, err := BlobFromConfig()
+	if err != nil {
+		return nil, err
+	}
+	blobURL := serviceURL.NewContainerURL(container).NewBlockBlobURL(name)
+
+	// a blob which exists, leased or not, is fine
+	ac := azblob.BlobAccessConditions{ModifiedAccessConditions: azblob.ModifiedAccessConditions{IfNoneMatch: azblob.ETagAny}}
+	_, err = blobURL.Upload(ctx, bytes.NewReader(nil), azblob.BlobHTTPHeaders{}, azblob.Metadata{}, ac, azblob.DefaultAccessTier, nil, azblob.ClientProvidedKeyOptions{})
+	if code := storageCode(err); err != nil && code != azblob.ServiceCodeBlobAlreadyExists && code != azblob.ServiceCodeLeaseIDMissing {
+		return nil, err
+	}
+
+	l := &Lock{
+		blobURL:  blobURL.BlobURL,
+		leaseID:  uuid.New().String(),
+		duration: o.Duration,
+		done:     make(chan struct{}),
+		lost:     make(chan struct{}),
+	}
+	deadline := time.Now().Add(o.Wait)
+	for {
+		_, err := l.blobURL.AcquireLease(ctx, l.leaseID, int32(o.Duration/time.Second), azblob.ModifiedAccessConditions{})
+		if err == nil {
+			break
+		}
+		if storageCode(err) != azblob.ServiceCodeLeaseAlreadyPresent {
+			return nil, err
+		}
+		if !time.Now().Before(deadline) {
+			return nil, fmt.Errorf("%s/%s: %w", container, name, ErrLocked)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(lockRetryInterval):
+		}
+	}
+	renewCtx, stop := context.WithCancel(context.Background())
+	l.stop = stop
+	go l.renew(renewCtx, renewEvery(o.Duration))
+	return l, nil
+}
+
+// renew renews the lease every interval until ctx is cancelled by
+// Release. It gives up on the lock if the service refuses, or if no
+// renewal succeeds before the lease would expire.
+func (l *Lock) renew(ctx context.Context, interval time.Duration) {
+	defer close(l.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	renewed := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// a renewal is no use once the lease has expired
+		expiry := renewed.Add(l.duration)
+		renewCtx, cancel := context.WithDeadline(ctx, expiry)
+		_, err := l.blobURL.RenewLease(renewCtx, l.leaseID, azblob.ModifiedAccessConditions{})
+		cancel()
+		if err == nil {
+			renewed = time.Now()
+			continue
+		}
+		if ctx.Err() == nil && (storageCode(err) != "" || !time.Now().Before(expiry)) {
+			l.err = fmt.Errorf("lost the lock: %w", err)
+			close(l.lost)
+			return
+		}
+	}
+}
+
+// Lost is closed if the lock is lost because its lease could not be
+// renewed, after which Err says why.
+func (l *Lock) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// Err returns why the lock was lost, or nil if it has not been.
+func (l *Lock) Err() error {
+	select {
+	case <-l.lost:
+		return l.err
+	default:
+		return nil
+	}
+}
+
+// Release stops renewing the lease and releases it, so another holder
+// can take the lock straight away. It returns Err if the lock was lost.
+func (l *Lock) Release(ctx context.Context) error {
+	l.stop()
+	<-l.done
+	if err := l.Err(); err != nil {
+		return err
+	}
+	_, err := l.blobURL.ReleaseLease(ctx, l.leaseID, azblob.ModifiedAccessConditions{})
+	return err
+}
+
+// RunLocked runs command, with the standard input and output of this
+// process, while holding the lock called name in the container, and
+// releases it when the command exits. If the lock is lost the command is
+// killed. The container defaults to "main" if empty.
+func RunLocked(ctx context.Context, container, name string, options *LockOptions, command []string) error {
+	if len(command) == 0 {
+		return errors.New("no command to run")
+	}
+	lock, err := AcquireLock(ctx, container, name, options)
+	if err != nil {
+		return err
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-lock.Lost():
+			cancel()
+		case <-runCtx.Done():
+		}
+	}()
+	cmd := exec.CommandContext(runCtx, command[0], command[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = stdin, stdout, stderr
+	err = cmd.Run()
+
+	// release even if ctx was cancelled, so others need not wait for the
+	// lease to expire
+	releaseCtx, cancelRelease := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelRelease()
+	if releaseErr := lock.Release(releaseCtx); releaseErr != nil && (err == nil || lock.Err() != nil) {
+		err = releaseErr
+	}
+	return err
+}
+
+// storageCode returns the service code of a StorageError, or "" for any
+// other error.
+func storageCode(err error) azblob.ServiceCodeType {
+	var storageErr azblob.StorageError
+	if errors.As(err, &storageErr) {
+		return storageErr.ServiceCode()
+	}
+	return ""
+}
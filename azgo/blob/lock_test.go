@@ -0,0 +1,143 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// fastLocks makes locks renew and retry every few milliseconds.
+func fastLocks(t *testing.T) {
+	retry, renew := lockRetryInterval, renewEvery
+	lockRetryInterval = 10 * time.Millisecond
+	renewEvery = func(time.Duration) time.Duration { return 10 * time.Millisecond }
+	t.Cleanup(func() { lockRetryInterval, renewEvery = retry, renew })
+}
+
+func TestLock(t *testing.T) {
+	ctx := context.Background()
+	s := newServer(t)
+	s.CreateContainer("locks")
+	fastLocks(t)
+
+	lock, err := AcquireLock(ctx, "locks", "nightly", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := s.Blob("locks", "nightly"); b == nil || b.LeaseID == "" || len(b.Data) != 0 {
+		t.Fatalf("lock blob = %+v, want an empty leased blob", b)
+	}
+	if _, err := AcquireLock(ctx, "locks", "nightly", &LockOptions{Duration: 15 * time.Second}); !errors.Is(err, ErrLocked) {
+		t.Errorf("AcquireLock of a held lock error = %v, want ErrLocked", err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	renewals := 0
+	for _, r := range s.Requests() {
+		if r.Header.Get("x-ms-lease-action") == "renew" {
+			renewals++
+		}
+	}
+	if renewals == 0 {
+		t.Error("the lease was not renewed")
+	}
+
+	// a waiting holder gets the lock once it is released
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		if err := lock.Release(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+	next, err := AcquireLock(ctx, "locks", "nightly", &LockOptions{Wait: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lock.Err() != nil {
+		t.Errorf("Err of a released lock = %v", lock.Err())
+	}
+
+	// breaking the lease loses the lock
+	serviceURL, err := BlobFromConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := serviceURL.NewContainerURL("locks").NewBlobURL("nightly").BreakLease(ctx, 0, azblob.ModifiedAccessConditions{}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-next.Lost():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the lock was not lost after its lease was broken")
+	}
+	if err := next.Release(ctx); storageCode(err) != azblob.ServiceCodeLeaseIDMismatchWithLeaseOperation {
+		t.Errorf("Release of a lost lock error = %v, want LeaseIdMismatchWithLeaseOperation", err)
+	}
+
+	if _, err := AcquireLock(ctx, "locks", "nightly", &LockOptions{Duration: time.Minute + time.Second}); err == nil {
+		t.Error("AcquireLock accepted a duration over 60s")
+	}
+}
+
+func TestRunLocked(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip(err)
+	}
+	ctx := context.Background()
+	s := newServer(t)
+	s.CreateContainer("main")
+	fastLocks(t)
+	out := &bytes.Buffer{}
+	stdin, stdout, stderr = strings.NewReader("input"), out, out
+	defer func() { stdin, stdout, stderr = os.Stdin, os.Stdout, os.Stderr }()
+
+	if err := RunLocked(ctx, "", "job", nil, []string{"sh", "-c", `cat; echo " and $0"`, "arg"}); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "input and arg\n" {
+		t.Errorf("output = %q", out)
+	}
+	if b := s.Blob("main", "job"); b == nil || b.LeaseID != "" {
+		t.Errorf("lock blob after RunLocked = %+v, want it released", b)
+	}
+
+	err := RunLocked(ctx, "main", "job", nil, []string{"sh", "-c", "exit 3"})
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+		t.Errorf("RunLocked of a failing command error = %v, want exit status 3", err)
+	}
+	if s.Blob("main", "job").LeaseID != "" {
+		t.Error("the lock was not released after the command failed")
+	}
+
+	// losing the lock kills the command
+	start := time.Now()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- RunLocked(ctx, "main", "job", nil, []string{"sleep", "10"})
+	}()
+	serviceURL, err := BlobFromConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobURL := serviceURL.NewContainerURL("main").NewBlobURL("job")
+	for {
+		if _, err := blobURL.BreakLease(ctx, 0, azblob.ModifiedAccessConditions{}); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := <-errs; err == nil || !strings.Contains(err.Error(), "lost the lock") {
+		t.Errorf("RunLocked after losing the lock error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the command ran for %s after the lock was lost", elapsed)
+	}
+}
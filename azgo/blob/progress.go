@@ -0,0 +1,153 @@
+package blob
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progressInterval is how often a progress indicator is redrawn.
+var progressInterval = 250 * time.Millisecond
+
+// progress writes a progress indicator for a transfer of total bytes, or
+// -1 if unknown, on a single line of w which it redraws as bytes are
+// added. A nil *progress, from a nil w, does nothing.
+type progress struct {
+	mu    sync.Mutex
+	w     io.Writer
+	name  string
+	total int64
+	n     int64
+	start time.Time
+	drawn time.Time
+}
+
+func newProgress(w io.Writer, name string, total int64) *progress {
+	if w == nil {
+		return nil
+	}
+	return &progress{w: w, name: name, total: total, start: time.Now()}
+}
+
+func (p *progress) add(n int) {
+	if p == nil || n == 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.n += int64(n)
+	if time.Since(p.drawn) >= progressInterval {
+		p.draw()
+	}
+}
+
+// done draws the final state and ends the line.
+func (p *progress) done() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.draw()
+	fmt.Fprintln(p.w)
+}
+
+func (p *progress) draw() {
+	p.drawn = time.Now()
+	line := p.name + ": " + FormatSize(p.n)
+	if p.total >= 0 {
+		percent := int64(100)
+		if p.total > 0 {
+			percent = p.n * 100 / p.total
+		}
+		line += fmt.Sprintf(" / %s (%d%%)", FormatSize(p.total), percent)
+	}
+	if seconds := time.Since(p.start).Seconds(); seconds > 0 {
+		line += fmt.Sprintf(" %s/s", FormatSize(int64(float64(p.n)/seconds)))
+	}
+	// the trailing spaces clear what is left of a longer previous line
+	fmt.Fprintf(p.w, "\r%-60s", line)
+}
+
+func (p *progress) reader(r io.Reader) io.Reader {
+	if p == nil {
+		return r
+	}
+	return progressReader{r, p}
+}
+
+func (p *progress) writer(w io.Writer) io.Writer {
+	if p == nil {
+		return w
+	}
+	return progressWriter{w, p}
+}
+
+type progressReader struct {
+	r io.Reader
+	p *progress
+}
+
+func (r progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.p.add(n)
+	return n, err
+}
+
+type progressWriter struct {
+	w io.Writer
+	p *progress
+}
+
+func (w progressWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.p.add(n)
+	return n, err
+}
+
+var sizeUnits = []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB"}
+
+// FormatSize formats n bytes in binary units, e.g. 1536 as "1.5 KiB".
+func FormatSize(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	size, unit := float64(n), 0
+	for size >= 1024 && unit < len(sizeUnits)-1 {
+		size /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f %s", size, sizeUnits[unit])
+}
+
+// ParseSize parses a size in bytes such as "4194304", "512KiB", "8MiB" or
+// "1G", where K, M, G and T are binary units with or without "iB" or "B".
+// Units are case-insensitive, so "8mib" and "100mb" are accepted too.
+func ParseSize(s string) (int64, error) {
+	number := strings.TrimSpace(s)
+	unit := strings.TrimLeft(number, "0123456789")
+	number = strings.TrimSuffix(number, unit)
+	unit = strings.TrimSpace(unit)
+	shift := uint(0)
+	switch strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(unit), "B"), "I") {
+	case "":
+	case "K":
+		shift = 10
+	case "M":
+		shift = 20
+	case "G":
+		shift = 30
+	case "T":
+		shift = 40
+	default:
+		return 0, fmt.Errorf("invalid size %q: unknown unit %q (expected K, M, G or T, optionally followed by iB or B)", s, unit)
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n < 0 || n > (1<<63-1)>>shift {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n << shift, nil
+}
@@ -0,0 +1,232 @@
+package blob
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/blue-eight/azgo/azgo/output"
+)
+
+// Headers are the HTTP headers of a blob which the service returns when
+// it is downloaded.
+type Headers struct {
+	ContentType        string `json:",omitempty"`
+	CacheControl       string `json:",omitempty"`
+	ContentEncoding    string `json:",omitempty"`
+	ContentLanguage    string `json:",omitempty"`
+	ContentDisposition string `json:",omitempty"`
+}
+
+// Properties are the properties, metadata and index tags of a blob.
+type Properties struct {
+	Container     string
+	Name          string
+	ContentLength int64
+	ContentMD5    []byte `json:",omitempty"`
+	LastModified  time.Time
+	ETag          string
+	Headers
+	Metadata map[string]string
+	Tags     map[string]string
+}
+
+// blobURL returns the URL of the blob at path in the container, which
+// defaults to "main" if empty, for the active profile.
+func blobURL(container, path string) (azblob.BlobURL, error) {
+	if container == "" {
+		container = "main"
+	}
+	serviceURL, err := BlobFromConfig()
+	if err != nil {
+		return azblob.BlobURL{}, err
+	}
+	return serviceURL.NewContainerURL(container).NewBlobURL(path), nil
+}
+
+// GetProperties returns the properties, metadata and index tags of the
+// blob at path in the container, which defaults to "main" if empty.
+func GetProperties(ctx context.Context, container, path string) (*Properties, error) {
+	if container == "" {
+		container = "main"
+	}
+	u, err := blobURL(container, path)
+	if err != nil {
+		return nil, err
+	}
+	props, err := u.GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return nil, err
+	}
+	p := &Properties{
+		Container:     container,
+		Name:          path,
+		ContentLength: props.ContentLength(),
+		ContentMD5:    props.ContentMD5(),
+		LastModified:  props.LastModified(),
+		ETag:          string(props.ETag()),
+		Headers: Headers{
+			ContentType:        props.ContentType(),
+			CacheControl:       props.CacheControl(),
+			ContentEncoding:    props.ContentEncoding(),
+			ContentLanguage:    props.ContentLanguage(),
+			ContentDisposition: props.ContentDisposition(),
+		},
+		Metadata: props.NewMetadata(),
+		Tags:     map[string]string{},
+	}
+	// reading tags needs its own permission, so we only ask when there are any
+	if props.TagCount() > 0 {
+		tags, err := u.GetTags(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, tag := range tags.BlobTagSet {
+			p.Tags[tag.Key] = tag.Value
+		}
+	}
+	return p, nil
+}
+
+// Show prints the Properties of the blob at path in the container via
+// output.Print. The container defaults to "main" if empty.
+func Show(ctx context.Context, container, path string) error {
+	p, err := GetProperties(ctx, container, path)
+	if err != nil {
+		return err
+	}
+	return output.Print(p)
+}
+
+// reservedMetadataPrefix begins the metadata keys which azgo keeps on a
+// blob it encoded, such as azgoencryption, without which the blob cannot
+// be read.
+const reservedMetadataPrefix = "azgo"
+
+// SetMetadata sets the metadata of the blob at path in the container,
+// replacing all of it, or with merge only the given keys, where an empty
+// value removes a key. Keys beginning with "azgo" are kept either way, and
+// cannot be set. The container defaults to "main" if empty.
+func SetMetadata(ctx context.Context, container, path string, metadata map[string]string, merge bool) error {
+	for key := range metadata {
+		if strings.HasPrefix(strings.ToLower(key), reservedMetadataPrefix) {
+			return fmt.Errorf("metadata key %q is reserved for azgo", key)
+		}
+	}
+	u, err := blobURL(container, path)
+	if err != nil {
+		return err
+	}
+	props, err := u.GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return err
+	}
+	m := azblob.Metadata{}
+	for key, value := range props.NewMetadata() {
+		if merge || strings.HasPrefix(key, reservedMetadataPrefix) {
+			m[key] = value
+		}
+	}
+	for key, value := range metadata {
+		key = strings.ToLower(key)
+		if value == "" {
+			delete(m, key)
+		} else {
+			m[key] = value
+		}
+	}
+	// fail rather than lose a change made since we read the metadata
+	ac := azblob.BlobAccessConditions{ModifiedAccessConditions: azblob.ModifiedAccessConditions{IfMatch: props.ETag()}}
+	_, err = u.SetMetadata(ctx, m, ac, azblob.ClientProvidedKeyOptions{})
+	return err
+}
+
+// SetHeaders sets the non-empty HTTP headers in h on the blob at path in
+// the container, keeping the others, including its Content-MD5. The
+// container defaults to "main" if empty.
+func SetHeaders(ctx context.Context, container, path string, h Headers) error {
+	u, err := blobURL(container, path)
+	if err != nil {
+		return err
+	}
+	// the service clears any header which is not set, so we send them all
+	props, err := u.GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return err
+	}
+	headers := props.NewHTTPHeaders()
+	for _, header := range []struct {
+		value string
+		field *string
+	}{
+		{h.ContentType, &headers.ContentType},
+		{h.CacheControl, &headers.CacheControl},
+		{h.ContentEncoding, &headers.ContentEncoding},
+		{h.ContentLanguage, &headers.ContentLanguage},
+		{h.ContentDisposition, &headers.ContentDisposition},
+	} {
+		if header.value != "" {
+			*header.field = header.value
+		}
+	}
+	ac := azblob.BlobAccessConditions{ModifiedAccessConditions: azblob.ModifiedAccessConditions{IfMatch: props.ETag()}}
+	_, err = u.SetHTTPHeaders(ctx, headers, ac)
+	return err
+}
+
+// SetTags sets the index tags of the blob at path in the container,
+// replacing any it has. The container defaults to "main" if empty.
+func SetTags(ctx context.Context, container, path string, tags map[string]string) error {
+	u, err := blobURL(container, path)
+	if err != nil {
+		return err
+	}
+	_, err = u.SetTags(ctx, nil, nil, nil, azblob.BlobTagsMap(tags))
+	return err
+}
+
+// FindByTags finds the blobs in every container of the account whose
+// index tags match a filter expression such as
+// "build" = '1234' AND "stage" = 'release', or with
+// @container = 'name' to search one container. It prints each
+// azblob.FilterBlobItem, with the tags named in the expression, via
+// output.Print. New tags take a little while to be searchable.
+func FindByTags(ctx context.Context, expression string) error {
+	serviceURL, err := BlobFromConfig()
+	if err != nil {
+		return err
+	}
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		res, err := serviceURL.FindBlobsByTags(ctx, nil, nil, &expression, marker, nil)
+		if err != nil {
+			return err
+		}
+		marker = azblob.Marker{Val: res.NextMarker}
+		if res.NextMarker == nil {
+			empty := ""
+			marker.Val = &empty
+		}
+		for _, item := range res.Blobs {
+			if err := output.Print(item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ParseKeyValues parses "key=value" arguments, as taken by the commands
+// which set metadata and tags.
+func ParseKeyValues(args []string) (map[string]string, error) {
+	m := map[string]string{}
+	for _, arg := range args {
+		i := strings.Index(arg, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid %q: want key=value", arg)
+		}
+		m[arg[:i]] = arg[i+1:]
+	}
+	return m, nil
+}
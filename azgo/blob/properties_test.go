@@ -0,0 +1,151 @@
+package blob
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/blue-eight/azgo/azgo/internal/testutil"
+)
+
+func TestProperties(t *testing.T) {
+	ctx := context.Background()
+	s := newServer(t)
+	s.PutBlob("main", "report.json", []byte(`{}`), "application/json")
+	md5 := s.Blob("main", "report.json").ContentMD5
+
+	if err := SetMetadata(ctx, "", "report.json", map[string]string{"owner": "ops", "stage": "draft"}, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetMetadata(ctx, "main", "report.json", map[string]string{"Stage": "final", "owner": ""}, true); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(s.Blob("main", "report.json").Metadata); got != "map[stage:final]" {
+		t.Errorf("merged metadata = %s, want map[stage:final]", got)
+	}
+	if err := SetMetadata(ctx, "main", "report.json", map[string]string{"a": "1"}, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(s.Blob("main", "report.json").Metadata); got != "map[a:1]" {
+		t.Errorf("replaced metadata = %s, want map[a:1]", got)
+	}
+
+	if err := SetHeaders(ctx, "main", "report.json", Headers{CacheControl: "max-age=60", ContentEncoding: "gzip"}); err != nil {
+		t.Fatal(err)
+	}
+	b := s.Blob("main", "report.json")
+	if b.ContentType != "application/json" || b.CacheControl != "max-age=60" || b.ContentEncoding != "gzip" || string(b.ContentMD5) != string(md5) {
+		t.Errorf("SetHeaders changed the blob to %+v", b)
+	}
+
+	if err := SetTags(ctx, "main", "report.json", map[string]string{"project": "azgo", "build": "42"}); err != nil {
+		t.Fatal(err)
+	}
+	p, err := GetProperties(ctx, "", "report.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Container != "main" || p.ContentLength != 2 || p.ContentType != "application/json" || p.CacheControl != "max-age=60" {
+		t.Errorf("GetProperties = %+v", p)
+	}
+	if got := fmt.Sprint(p.Metadata, p.Tags); got != "map[a:1] map[build:42 project:azgo]" {
+		t.Errorf("metadata and tags = %s", got)
+	}
+
+	if err := SetTags(ctx, "main", "report.json", map[string]string{}); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := GetProperties(ctx, "main", "report.json"); err != nil || len(p.Tags) != 0 {
+		t.Errorf("tags after clearing them = %v, %v", p, err)
+	}
+}
+
+func TestSetMetadataEncrypted(t *testing.T) {
+	ctx := context.Background()
+	s := newServer(t)
+	s.CreateContainer("main")
+	useEncryption(t, s, writeKey(t), "", "zstd")
+	if err := InsertKeyValue(ctx, "main", "secret", "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, merge := range []bool{false, true} {
+		if err := SetMetadata(ctx, "main", "secret", map[string]string{"owner": "ops"}, merge); err != nil {
+			t.Fatal(err)
+		}
+		if got, _, err := Get(ctx, "main", "secret"); err != nil || got != "hunter2" {
+			t.Errorf("Get after SetMetadata with merge %t = %q, %v", merge, got, err)
+		}
+	}
+	if m := s.Blob("main", "secret").Metadata; m["owner"] != "ops" || m[encryptionMetadata] == "" || m[compressionMetadata] != "zstd" {
+		t.Errorf("metadata = %v, want owner and the azgo keys", m)
+	}
+	for _, key := range []string{encryptionMetadata, "AzgoCompression"} {
+		if err := SetMetadata(ctx, "main", "secret", map[string]string{key: ""}, true); err == nil {
+			t.Errorf("SetMetadata of %s returned no error", key)
+		}
+	}
+}
+
+func TestUploadMetadataTags(t *testing.T) {
+	s := newServer(t)
+	s.CreateContainer("main")
+	file := filepath.Join(t.TempDir(), "app.zip")
+	if err := os.WriteFile(file, []byte("zip"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	options := &TransferOptions{Metadata: map[string]string{"commit": "abc123"}, Tags: map[string]string{"stage": "release"}}
+	if err := Upload(context.Background(), "main", "builds/app.zip", file, options); err != nil {
+		t.Fatal(err)
+	}
+	b := s.Blob("main", "builds/app.zip")
+	if got := fmt.Sprint(b.Metadata, b.Tags); got != "map[commit:abc123] map[stage:release]" {
+		t.Errorf("uploaded metadata and tags = %s", got)
+	}
+}
+
+func TestFindByTags(t *testing.T) {
+	ctx := context.Background()
+	s := newServer(t)
+	s.PageSize = 1
+	for _, blob := range []struct{ container, name, stage, build string }{
+		{"main", "a", "release", "1"},
+		{"main", "b", "draft", "2"},
+		{"other", "c", "release", "3"},
+		{"other", "d", "release", "10"},
+	} {
+		s.PutBlob(blob.container, blob.name, nil, "")
+		if err := SetTags(ctx, blob.container, blob.name, map[string]string{"stage": blob.stage, "build": blob.build}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := map[string]string{
+		`"stage" = 'release'`:                         "[main/a other/c other/d]",
+		`"stage" = 'release' AND "build" >= '2'`:      "[other/c]",
+		`@container = 'main' AND "stage" = 'release'`: "[main/a]",
+		`"stage" = 'archived'`:                        "[]",
+	}
+	for expression, want := range tests {
+		out := testutil.CaptureOutput(t)
+		if err := FindByTags(ctx, expression); err != nil {
+			t.Fatalf("FindByTags(%s): %v", expression, err)
+		}
+		got := []string{}
+		for _, r := range testutil.Records(t, out) {
+			got = append(got, fmt.Sprint(r["ContainerName"], "/", r["Name"]))
+		}
+		if fmt.Sprint(got) != want {
+			t.Errorf("FindByTags(%s) = %v, want %s", expression, got, want)
+		}
+	}
+
+	if _, err := ParseKeyValues([]string{"a=1", "b"}); err == nil {
+		t.Error("ParseKeyValues accepted an argument without =")
+	}
+	if m, err := ParseKeyValues([]string{"a=1=2", "b="}); err != nil || fmt.Sprint(m) != "map[a:1=2 b:]" {
+		t.Errorf("ParseKeyValues = %v, %v", m, err)
+	}
+}
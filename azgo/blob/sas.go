@@ -0,0 +1,238 @@
+package blob
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/blue-eight/azgo/azgo/config"
+	"github.com/blue-eight/azgo/azgo/output"
+)
+
+// DefaultSASExpiry is how long a SAS lasts by default.
+const DefaultSASExpiry = time.Hour
+
+// SASOptions configures SASURL.
+type SASOptions struct {
+	// Permissions are the letters of what the SAS allows, from racwdxlt
+	// for a container or racwdxt for a blob: read, add, create, write,
+	// delete, delete a version, list and tags. They default to "r", or
+	// the policy's if there is a Policy.
+	Permissions string
+	// Expiry is how long the SAS lasts from now. It defaults to
+	// DefaultSASExpiry, or the policy's expiry if there is a Policy.
+	Expiry time.Duration
+	// IPRange limits the SAS to a client address, e.g. "203.0.113.7", or
+	// range, e.g. "203.0.113.0-203.0.113.255".
+	IPRange string
+	// Protocol is "https", the default, or "https,http".
+	Protocol string
+	// Policy is the ID of a stored access policy of the container, which
+	// can revoke the SAS or change what it allows later.
+	Policy string
+}
+
+// SASURL returns the URL of the container, or of the blob in it if blob is
+// not empty, with a service SAS signed locally by the account key of the
+// active profile, so it can be handed out without the key. The container
+// defaults to "main" if empty.
+func SASURL(container, blob string, options *SASOptions) (string, error) {
+	if container == "" {
+		container = "main"
+	}
+	o := SASOptions{}
+	if options != nil {
+		o = *options
+	}
+
+	u, credential, err := blobAccount(config.Active())
+	if err != nil {
+		return "", err
+	}
+	key, ok := credential.(*azblob.SharedKeyCredential)
+	if !ok {
+		return "", fmt.Errorf("signing a SAS needs the account key, but the profile has a SAS")
+	}
+
+	values := azblob.BlobSASSignatureValues{
+		Protocol:      azblob.SASProtocolHTTPS,
+		Permissions:   o.Permissions,
+		Identifier:    o.Policy,
+		ContainerName: container,
+		BlobName:      blob,
+	}
+	if o.Policy == "" && values.Permissions == "" {
+		values.Permissions = "r"
+	}
+	letters := "racwdxlt"
+	if blob != "" {
+		letters = "racwdxt"
+	}
+	if strings.Trim(values.Permissions, letters) != "" {
+		return "", fmt.Errorf("invalid SAS permissions %q: want letters from %s", values.Permissions, letters)
+	}
+	if o.Expiry < 0 {
+		return "", fmt.Errorf("the SAS expiry %s is in the past", o.Expiry)
+	}
+	if o.Expiry > 0 || o.Policy == "" {
+		if o.Expiry == 0 {
+			o.Expiry = DefaultSASExpiry
+		}
+		values.ExpiryTime = time.Now().UTC().Add(o.Expiry)
+	}
+	switch o.Protocol {
+	case "", string(azblob.SASProtocolHTTPS):
+	case string(azblob.SASProtocolHTTPSandHTTP):
+		values.Protocol = azblob.SASProtocolHTTPSandHTTP
+	default:
+		return "", fmt.Errorf("invalid SAS protocol %q: want https or https,http", o.Protocol)
+	}
+	if values.IPRange, err = parseIPRange(o.IPRange); err != nil {
+		return "", err
+	}
+
+	sas, err := values.NewSASQueryParameters(key)
+	if err != nil {
+		return "", fmt.Errorf("invalid SAS: %w", err)
+	}
+	containerURL := azblob.NewServiceURL(*u, nil).NewContainerURL(container)
+	sasURL := containerURL.URL()
+	if blob != "" {
+		sasURL = containerURL.NewBlobURL(blob).URL()
+	}
+	sasURL.RawQuery = sas.Encode()
+	return sasURL.String(), nil
+}
+
+// parseIPRange parses "" (any address), an address, or "start-end".
+func parseIPRange(s string) (azblob.IPRange, error) {
+	r := azblob.IPRange{}
+	if s == "" {
+		return r, nil
+	}
+	parts := strings.SplitN(s, "-", 2)
+	r.Start = net.ParseIP(parts[0])
+	if len(parts) == 2 {
+		r.End = net.ParseIP(parts[1])
+	}
+	if r.Start == nil || (len(parts) == 2 && r.End == nil) {
+		return r, fmt.Errorf("invalid IP range %q: want an address or start-end", s)
+	}
+	return r, nil
+}
+
+// AccessPolicy is a stored access policy of a container, which a SAS can
+// refer to so that what it allows can be changed, or it can be revoked,
+// without changing the account key. A container has at most five.
+type AccessPolicy struct {
+	ID string
+	// Permissions are letters from racwdl: read, add, create, write,
+	// delete and list.
+	Permissions string
+	Start       *time.Time `json:",omitempty"`
+	Expiry      *time.Time `json:",omitempty"`
+}
+
+// accessPolicies returns the public access level and the stored access
+// policies of the container.
+func accessPolicies(ctx context.Context, containerURL azblob.ContainerURL) (azblob.PublicAccessType, []azblob.SignedIdentifier, error) {
+	res, err := containerURL.GetAccessPolicy(ctx, azblob.LeaseAccessConditions{})
+	if err != nil {
+		return azblob.PublicAccessNone, nil, err
+	}
+	return res.BlobPublicAccess(), res.Items, nil
+}
+
+// ListAccessPolicies prints the stored access policies of the container
+// as AccessPolicy via output.Print. The container defaults to "main" if
+// empty.
+func ListAccessPolicies(ctx context.Context, container string) error {
+	if container == "" {
+		container = "main"
+	}
+	serviceURL, err := BlobFromConfig()
+	if err != nil {
+		return err
+	}
+	_, items, err := accessPolicies(ctx, serviceURL.NewContainerURL(container))
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		policy := AccessPolicy{ID: item.ID, Start: item.AccessPolicy.Start, Expiry: item.AccessPolicy.Expiry}
+		if item.AccessPolicy.Permission != nil {
+			policy.Permissions = *item.AccessPolicy.Permission
+		}
+		if err := output.Print(policy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetAccessPolicy adds the stored access policy to the container, or
+// replaces the one with its ID, which changes what any SAS using it
+// allows. The container defaults to "main" if empty.
+func SetAccessPolicy(ctx context.Context, container string, policy AccessPolicy) error {
+	if policy.ID == "" {
+		return fmt.Errorf("an access policy needs an ID")
+	}
+	permissions := azblob.AccessPolicyPermission{}
+	if err := permissions.Parse(policy.Permissions); err != nil {
+		return fmt.Errorf("invalid access policy permissions %q: want letters from racwdl", policy.Permissions)
+	}
+	item := azblob.SignedIdentifier{ID: policy.ID}
+	item.AccessPolicy.Start, item.AccessPolicy.Expiry = policy.Start, policy.Expiry
+	if s := permissions.String(); s != "" {
+		item.AccessPolicy.Permission = &s
+	}
+	return updateAccessPolicies(ctx, container, func(items []azblob.SignedIdentifier) ([]azblob.SignedIdentifier, error) {
+		for i := range items {
+			if items[i].ID == policy.ID {
+				items[i] = item
+				return items, nil
+			}
+		}
+		return append(items, item), nil
+	})
+}
+
+// DeleteAccessPolicy deletes the stored access policy id of the container,
+// which revokes any SAS using it. The container defaults to "main" if
+// empty.
+func DeleteAccessPolicy(ctx context.Context, container, id string) error {
+	return updateAccessPolicies(ctx, container, func(items []azblob.SignedIdentifier) ([]azblob.SignedIdentifier, error) {
+		for i := range items {
+			if items[i].ID == id {
+				return append(items[:i], items[i+1:]...), nil
+			}
+		}
+		return nil, fmt.Errorf("no access policy %q", id)
+	})
+}
+
+// updateAccessPolicies replaces the stored access policies of the
+// container with what update makes of them, keeping its public access
+// level, which is set by the same request.
+func updateAccessPolicies(ctx context.Context, container string, update func([]azblob.SignedIdentifier) ([]azblob.SignedIdentifier, error)) error {
+	if container == "" {
+		container = "main"
+	}
+	serviceURL, err := BlobFromConfig()
+	if err != nil {
+		return err
+	}
+	containerURL := serviceURL.NewContainerURL(container)
+	access, items, err := accessPolicies(ctx, containerURL)
+	if err != nil {
+		return err
+	}
+	if items, err = update(items); err != nil {
+		return fmt.Errorf("%s: %w", container, err)
+	}
+	_, err = containerURL.SetAccessPolicy(ctx, access, items, azblob.ContainerAccessConditions{})
+	return err
+}
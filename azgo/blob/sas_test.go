@@ -0,0 +1,118 @@
+package blob
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/blue-eight/azgo/azgo/config"
+	"github.com/blue-eight/azgo/azgo/internal/fakestorage"
+	"github.com/blue-eight/azgo/azgo/internal/testutil"
+)
+
+func TestSASURL(t *testing.T) {
+	s := newServer(t)
+
+	sasURL, err := SASURL("", "reports/q3.pdf", &SASOptions{Permissions: "wr", Expiry: 2 * time.Hour, IPRange: "203.0.113.0-203.0.113.255"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(sasURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := s.Endpoint() + "/main/reports/q3.pdf"; u.Scheme+"://"+u.Host+u.Path != want {
+		t.Errorf("SAS URL %s, want it for %s", sasURL, want)
+	}
+	q := u.Query()
+	if got := fmt.Sprint(q.Get("sp"), " ", q.Get("sr"), " ", q.Get("spr"), " ", q.Get("sip")); got != "rw b https 203.0.113.0-203.0.113.255" {
+		t.Errorf("sp sr spr sip = %s", got)
+	}
+	expiry, err := time.Parse(time.RFC3339, q.Get("se"))
+	if err != nil || expiry.Before(time.Now().Add(2*time.Hour-time.Minute)) || expiry.After(time.Now().Add(2*time.Hour)) {
+		t.Errorf("se = %s, %v, want in 2h", q.Get("se"), err)
+	}
+	if q.Get("sig") == "" || q.Get("si") != "" {
+		t.Errorf("sig = %q, si = %q", q.Get("sig"), q.Get("si"))
+	}
+
+	// a policy supplies the permissions and expiry
+	sasURL, err = SASURL("shared", "", &SASOptions{Policy: "partners", Protocol: "https,http"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ = url.Parse(sasURL)
+	q = u.Query()
+	if u.Path != "/"+fakestorage.Account+"/shared" || q.Get("sr") != "c" || q.Get("si") != "partners" || q.Get("spr") != "https,http" || q.Get("sp") != "" || q.Get("se") != "" {
+		t.Errorf("container SAS with a policy = %s", sasURL)
+	}
+
+	for _, options := range []SASOptions{
+		{Permissions: "l"},
+		{Permissions: "rq"},
+		{Protocol: "http"},
+		{IPRange: "203.0.113.0-"},
+		{Expiry: -time.Hour},
+	} {
+		if _, err := SASURL("main", "a", &options); err == nil {
+			t.Errorf("SASURL with %+v returned no error", options)
+		}
+	}
+
+	testutil.UseProfile(t, &config.Profile{StorageConnectionString: "BlobEndpoint=https://acct.blob.core.windows.net;SharedAccessSignature=sv=2020-08-04&sig=x"})
+	if _, err := SASURL("main", "a", nil); err == nil {
+		t.Error("SASURL with a SAS profile returned no error")
+	}
+}
+
+func TestAccessPolicies(t *testing.T) {
+	ctx := context.Background()
+	s := newServer(t)
+	serviceURL, err := BlobFromConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := serviceURL.NewContainerURL("shared").Create(ctx, azblob.Metadata{}, azblob.PublicAccessBlob); err != nil {
+		t.Fatal(err)
+	}
+
+	expiry := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, policy := range []AccessPolicy{
+		{ID: "partners", Permissions: "rl", Expiry: &expiry},
+		{ID: "uploads", Permissions: "cw", Expiry: &expiry},
+		{ID: "partners", Permissions: "lr"},
+	} {
+		if err := SetAccessPolicy(ctx, "shared", policy); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := SetAccessPolicy(ctx, "shared", AccessPolicy{ID: "bad", Permissions: "x"}); err == nil {
+		t.Error("SetAccessPolicy with an invalid permission returned no error")
+	}
+
+	out := testutil.CaptureOutput(t)
+	if err := ListAccessPolicies(ctx, "shared"); err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, r := range testutil.Records(t, out) {
+		got = append(got, fmt.Sprint(r["ID"], ":", r["Permissions"], ":", r["Expiry"]))
+	}
+	if want := "[partners:rl:<nil> uploads:cw:2030-01-02T03:04:05Z]"; fmt.Sprint(got) != want {
+		t.Errorf("policies = %v, want %s", got, want)
+	}
+
+	if err := DeleteAccessPolicy(ctx, "shared", "partners"); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteAccessPolicy(ctx, "shared", "partners"); err == nil {
+		t.Error("DeleteAccessPolicy of a missing policy returned no error")
+	}
+	c := s.Container("shared")
+	if len(c.AccessPolicies) != 1 || c.AccessPolicies[0].ID != "uploads" || c.PublicAccess != "blob" {
+		t.Errorf("container = %+v, want only the uploads policy and blob public access", c)
+	}
+}
@@ -0,0 +1,516 @@
+package blob
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// ServeOptions configures Serve and NewHandler.
+type ServeOptions struct {
+	// Writable lets clients upload blobs with PUT and delete them with
+	// DELETE. Otherwise only GET and HEAD are allowed.
+	Writable bool
+	// Compression and Encryption encode blobs uploaded with PUT, and
+	// Encryption decrypts blobs for GET, as for Upload and Download. Both
+	// default to the settings of the active profile.
+	Compression string
+	Encryption  *Encryption
+}
+
+// ServeRequest is a request to Serve, as it logs it.
+type ServeRequest struct {
+	Time   time.Time
+	Method string
+	Path   string
+	Status int
+	// Size is the number of bytes in the response body.
+	Size     int64
+	Duration time.Duration
+}
+
+// Serve serves the container, which defaults to "main" if empty, over
+// plain HTTP at addr (e.g. "localhost:8080") until ctx is cancelled. Each
+// request is logged to stderr as a line of JSON, a ServeRequest, as it is
+// served; it does not go through output.Print, which may hold every record
+// until the command ends. See NewHandler.
+func Serve(ctx context.Context, container, addr string, options *ServeOptions) error {
+	if container == "" {
+		container = "main"
+	}
+	serviceURL, err := BlobFromConfig()
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stderr, "serving %s at http://%s/\n", container, ln.Addr())
+
+	server := &http.Server{Handler: logRequests(NewHandler(serviceURL.NewContainerURL(container), options), stderr)}
+	go func() {
+		<-ctx.Done()
+		// requests in progress get a moment to finish
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if server.Shutdown(shutdownCtx) != nil {
+			server.Close()
+		}
+	}()
+	if err := server.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return ctx.Err()
+}
+
+// NewHandler returns an http.Handler which serves the blobs of a container
+// like a file server: GET /dir/name.html is the blob "dir/name.html", and
+// GET /dir/ is its index.html, or else a listing of the blobs and virtual
+// directories under "dir/". Range, If-None-Match and If-Modified-Since are
+// passed on to the service, and blobs are served with their ETag and
+// Content-Type. Blobs which azgo compressed or encrypted are decoded, and
+// served whole.
+func NewHandler(containerURL azblob.ContainerURL, options *ServeOptions) http.Handler {
+	o := ServeOptions{}
+	if options != nil {
+		o = *options
+	}
+	transfer := (&TransferOptions{Compression: o.Compression, Encryption: o.Encryption}).withDefaults()
+	o.Compression, o.Encryption = transfer.Compression, transfer.Encryption
+	return &handler{containerURL: containerURL, options: o}
+}
+
+type handler struct {
+	containerURL azblob.ContainerURL
+	options      ServeOptions
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	switch {
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		if name == "" || strings.HasSuffix(name, "/") {
+			h.serveDirectory(w, r, name)
+		} else {
+			h.serveBlob(w, r, name)
+		}
+	case h.options.Writable && (r.Method == http.MethodPut || r.Method == http.MethodDelete):
+		if name == "" || strings.HasSuffix(name, "/") {
+			http.Error(w, "a directory cannot be written", http.StatusMethodNotAllowed)
+		} else if r.Method == http.MethodPut {
+			h.put(w, r, name)
+		} else {
+			h.delete(w, r, name)
+		}
+	default:
+		w.Header().Set("Allow", h.allow())
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *handler) allow() string {
+	if h.options.Writable {
+		return "GET, HEAD, PUT, DELETE"
+	}
+	return "GET, HEAD"
+}
+
+// serveBlob serves the blob name, or a range of it.
+func (h *handler) serveBlob(w http.ResponseWriter, r *http.Request, name string) {
+	ctx := r.Context()
+	blobURL := h.containerURL.NewBlobURL(name)
+	ac := azblob.BlobAccessConditions{ModifiedAccessConditions: azblob.ModifiedAccessConditions{
+		IfNoneMatch: azblob.ETag(r.Header.Get("If-None-Match")),
+	}}
+	if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && ac.IfNoneMatch == azblob.ETagNone {
+		ac.IfModifiedSince = since
+	}
+	props, err := blobURL.GetProperties(ctx, ac, azblob.ClientProvidedKeyOptions{})
+	if statusCode(err) == http.StatusNotFound {
+		// a virtual directory without the trailing slash
+		if h.exists(ctx, name+"/") {
+			http.Redirect(w, r, path.Base(name)+"/", http.StatusMovedPermanently)
+			return
+		}
+	}
+	var storageErr azblob.StorageError
+	if errors.As(err, &storageErr) && statusCode(err) == http.StatusNotModified {
+		w.Header().Set("ETag", storageErr.Response().Header.Get("ETag"))
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+
+	header := w.Header()
+	header.Set("ETag", string(props.ETag()))
+	header.Set("Last-Modified", props.LastModified().UTC().Format(http.TimeFormat))
+	header.Set("Content-Type", serveContentType(name, props.ContentType()))
+	for key, value := range map[string]string{
+		"Cache-Control":       props.CacheControl(),
+		"Content-Encoding":    props.ContentEncoding(),
+		"Content-Language":    props.ContentLanguage(),
+		"Content-Disposition": props.ContentDisposition(),
+	} {
+		if value != "" {
+			header.Set(key, value)
+		}
+	}
+	if metadata := props.NewMetadata(); encodedBy(metadata) {
+		header.Del("Content-Encoding")
+		h.serveDecoded(w, r, blobURL, props.ETag(), metadata)
+		return
+	}
+
+	size := props.ContentLength()
+	header.Set("Accept-Ranges", "bytes")
+
+	offset, count, status := int64(0), size, http.StatusOK
+	if rng := r.Header.Get("Range"); rng != "" && ifRange(r, props) {
+		var ok bool
+		if offset, count, ok = parseRange(rng, size); !ok {
+			header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			http.Error(w, http.StatusText(http.StatusRequestedRangeNotSatisfiable), http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		if count != size {
+			status = http.StatusPartialContent
+			header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+count-1, size))
+		}
+	}
+	header.Set("Content-Length", strconv.FormatInt(count, 10))
+	if r.Method == http.MethodHead || count == 0 {
+		w.WriteHeader(status)
+		return
+	}
+
+	// the range must be of the blob whose headers were sent
+	ac = azblob.BlobAccessConditions{ModifiedAccessConditions: azblob.ModifiedAccessConditions{IfMatch: props.ETag()}}
+	res, err := blobURL.Download(ctx, offset, count, ac, false, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		header.Del("Content-Length")
+		serveError(w, err)
+		return
+	}
+	body := res.Body(azblob.RetryReaderOptions{MaxRetryRequests: 3})
+	defer body.Close()
+	w.WriteHeader(status)
+	// the client may hang up, which leaves nothing to report it to
+	io.Copy(w, body)
+}
+
+// serveDecoded serves the whole of a blob which azgo encoded, decoded as
+// its metadata says. Its size is not known until it is decoded, so there
+// is no Content-Length, and a Range is ignored.
+func (h *handler) serveDecoded(w http.ResponseWriter, r *http.Request, blobURL azblob.BlobURL, etag azblob.ETag, metadata map[string]string) {
+	if r.Method == http.MethodHead {
+		return
+	}
+	ac := azblob.BlobAccessConditions{ModifiedAccessConditions: azblob.ModifiedAccessConditions{IfMatch: etag}}
+	res, err := blobURL.Download(r.Context(), 0, azblob.CountToEnd, ac, false, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	body := res.Body(azblob.RetryReaderOptions{MaxRetryRequests: 3})
+	defer body.Close()
+	decoded, err := decode(body, metadata, h.options.Encryption)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer decoded.Close()
+	// a blob which fails to decode part way through can only be cut short
+	io.Copy(w, decoded)
+}
+
+// serveContentType returns the content type of the blob name, or the one
+// for its extension if it has none more specific than
+// application/octet-stream.
+func serveContentType(name, contentType string) string {
+	if contentType == "" || contentType == "application/octet-stream" {
+		if byExtension := mime.TypeByExtension(path.Ext(name)); byExtension != "" {
+			return byExtension
+		}
+	}
+	if contentType == "" {
+		return "application/octet-stream"
+	}
+	return contentType
+}
+
+// ifRange reports whether the Range of r applies, which it does unless
+// If-Range names an older ETag or time.
+func ifRange(r *http.Request, props *azblob.BlobGetPropertiesResponse) bool {
+	value := r.Header.Get("If-Range")
+	if value == "" {
+		return true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return !props.LastModified().Truncate(time.Second).After(t)
+	}
+	return value == string(props.ETag())
+}
+
+// parseRange parses a Range header of a single range, e.g. bytes=0-99,
+// bytes=100- or bytes=-100, into the offset and count of bytes of a blob
+// of size. A header it does not understand, such as one of several ranges,
+// is the whole blob, as RFC 7233 allows.
+func parseRange(rng string, size int64) (int64, int64, bool) {
+	spec := strings.TrimPrefix(rng, "bytes=")
+	if spec == rng || strings.Contains(spec, ",") {
+		return 0, size, true
+	}
+	i := strings.Index(spec, "-")
+	if i < 0 {
+		return 0, size, true
+	}
+	first, last := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+	if first == "" {
+		// the last n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, size > 0
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, 0, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end - start + 1, true
+}
+
+// directoryTemplate is the listing of a virtual directory.
+var directoryTemplate = template.Must(template.New("directory").Parse(`<!doctype html>
+<meta charset="utf-8">
+<title>{{.Name}}</title>
+<h1>{{.Name}}</h1>
+<table>
+{{if .Parent}}<tr><td><a href="../">../</a></td></tr>
+{{end}}{{range .Entries}}<tr><td><a href="{{.URL}}">{{.Name}}</a></td><td>{{if not .Directory}}{{.Size}}{{end}}</td><td>{{if not .Directory}}{{.LastModified.Format "2006-01-02 15:04:05"}}{{end}}</td></tr>
+{{end}}</table>
+`))
+
+type directoryEntry struct {
+	Name         string
+	URL          string
+	Directory    bool
+	Size         int64
+	LastModified time.Time
+}
+
+// serveDirectory serves the index.html of the virtual directory prefix, or
+// else a listing of it.
+func (h *handler) serveDirectory(w http.ResponseWriter, r *http.Request, prefix string) {
+	ctx := r.Context()
+	if h.exists(ctx, prefix+"index.html") {
+		h.serveBlob(w, r, prefix+"index.html")
+		return
+	}
+	entries := []directoryEntry{}
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		list, err := h.containerURL.ListBlobsHierarchySegment(ctx, marker, "/", azblob.ListBlobsSegmentOptions{Prefix: prefix})
+		if err != nil {
+			serveError(w, err)
+			return
+		}
+		marker = list.NextMarker
+		for _, p := range list.Segment.BlobPrefixes {
+			entries = append(entries, directoryEntry{Name: strings.TrimPrefix(p.Name, prefix), Directory: true})
+		}
+		for _, item := range list.Segment.BlobItems {
+			e := directoryEntry{Name: strings.TrimPrefix(item.Name, prefix), LastModified: item.Properties.LastModified}
+			if item.Properties.ContentLength != nil {
+				e.Size = *item.Properties.ContentLength
+			}
+			entries = append(entries, e)
+		}
+	}
+	if len(entries) == 0 && prefix != "" {
+		http.NotFound(w, r)
+		return
+	}
+	for i := range entries {
+		// a name with a colon would otherwise look like a scheme
+		entries[i].URL = (&url.URL{Path: entries[i].Name}).String()
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method == http.MethodHead {
+		return
+	}
+	directoryTemplate.Execute(w, map[string]interface{}{
+		"Name":    "/" + prefix,
+		"Parent":  prefix != "",
+		"Entries": entries,
+	})
+}
+
+// exists reports whether there is a blob name, or any blob under name if
+// it ends with "/".
+func (h *handler) exists(ctx context.Context, name string) bool {
+	if strings.HasSuffix(name, "/") {
+		list, err := h.containerURL.ListBlobsFlatSegment(ctx, azblob.Marker{}, azblob.ListBlobsSegmentOptions{Prefix: name, MaxResults: 1})
+		return err == nil && len(list.Segment.BlobItems) > 0
+	}
+	_, err := h.containerURL.NewBlobURL(name).GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	return err == nil
+}
+
+// put uploads the body of r to the blob name, with the Content-Type of r
+// or else one detected, and the If-Match and If-None-Match of r. The body
+// is compressed and encrypted as the options say.
+func (h *handler) put(w http.ResponseWriter, r *http.Request, name string) {
+	var body io.Reader = r.Body
+	o := TransferOptions{ContentType: r.Header.Get("Content-Type"), Compression: h.options.Compression, Encryption: h.options.Encryption}
+	if o.encodes() {
+		e, err := encodeUpload(body, r.ContentLength, &o, name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer e.Close()
+		body = e
+	}
+	br := bufio.NewReader(body)
+	if o.ContentType == "" {
+		o.ContentType = detectContentType(br, name)
+	}
+	res, err := azblob.UploadStreamToBlockBlob(r.Context(), br, h.containerURL.NewBlockBlobURL(name), azblob.UploadStreamToBlockBlobOptions{
+		BufferSize:       DefaultBlockSize,
+		MaxBuffers:       DefaultConcurrency,
+		BlobHTTPHeaders:  azblob.BlobHTTPHeaders{ContentType: o.ContentType, ContentEncoding: o.contentEncoding},
+		Metadata:         o.Metadata,
+		AccessConditions: requestConditions(r),
+	})
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	w.Header().Set("ETag", string(res.ETag()))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// delete deletes the blob name, with the If-Match of r.
+func (h *handler) delete(w http.ResponseWriter, r *http.Request, name string) {
+	_, err := h.containerURL.NewBlobURL(name).Delete(r.Context(), azblob.DeleteSnapshotsOptionNone, requestConditions(r))
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func requestConditions(r *http.Request) azblob.BlobAccessConditions {
+	return azblob.BlobAccessConditions{ModifiedAccessConditions: azblob.ModifiedAccessConditions{
+		IfMatch:     azblob.ETag(r.Header.Get("If-Match")),
+		IfNoneMatch: azblob.ETag(r.Header.Get("If-None-Match")),
+	}}
+}
+
+// statusCode returns the HTTP status of a StorageError, or 0.
+func statusCode(err error) int {
+	var storageErr azblob.StorageError
+	if errors.As(err, &storageErr) && storageErr.Response() != nil {
+		return storageErr.Response().StatusCode
+	}
+	return 0
+}
+
+// serveError writes the status of a StorageError, such as 404 or 412, with
+// its service code, or 502 Bad Gateway for any other error.
+func serveError(w http.ResponseWriter, err error) {
+	status := statusCode(err)
+	if status == 0 {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	message := string(storageCode(err))
+	if message == "" {
+		message = http.StatusText(status)
+	}
+	http.Error(w, message, status)
+}
+
+// loggingWriter records the status and size of a response.
+type loggingWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (w *loggingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *loggingWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// logRequests writes each request to next to w as a line of JSON, a
+// ServeRequest.
+func logRequests(next http.Handler, w io.Writer) http.Handler {
+	mu := sync.Mutex{}
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		lw := &loggingWriter{ResponseWriter: rw}
+		next.ServeHTTP(lw, r)
+		if lw.status == 0 {
+			lw.status = http.StatusOK
+		}
+		b, err := json.Marshal(ServeRequest{
+			Time:     start.UTC(),
+			Method:   r.Method,
+			Path:     r.URL.Path,
+			Status:   lw.status,
+			Size:     lw.size,
+			Duration: time.Since(start),
+		})
+		if err != nil {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		// like trace, a log which cannot be written is not worth failing
+		// the request for
+		w.Write(append(b, '\n'))
+	})
+}
@@ -0,0 +1,223 @@
+package blob
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blue-eight/azgo/azgo/internal/fakestorage"
+	"github.com/blue-eight/azgo/azgo/internal/testutil"
+)
+
+// newSite serves the container site of a new fake with a handler.
+func newSite(t *testing.T, options *ServeOptions) (*fakestorage.BlobServer, *httptest.Server) {
+	t.Helper()
+	s := newServer(t)
+	s.CreateContainer("site")
+	s.PutBlob("site", "index.html", []byte("<h1>home</h1>"), "text/html")
+	s.PutBlob("site", "style.css", []byte("body { margin: 0 }"), "")
+	s.PutBlob("site", "docs/guide.txt", []byte("0123456789"), "text/plain")
+	s.PutBlob("site", "docs/a:b.txt", []byte("colon"), "text/plain")
+	serviceURL, err := BlobFromConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	site := httptest.NewServer(NewHandler(serviceURL.NewContainerURL("site"), options))
+	t.Cleanup(site.Close)
+	return s, site
+}
+
+// request makes a request to the site and returns the response and body.
+func request(t *testing.T, method, url string, header map[string]string, body string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, string(b)
+}
+
+func TestHandler(t *testing.T) {
+	s, site := newSite(t, nil)
+
+	res, body := request(t, "GET", site.URL+"/style.css", nil, "")
+	etag := s.Blob("site", "style.css").ETag
+	if res.StatusCode != 200 || body != "body { margin: 0 }" || res.Header.Get("ETag") != etag || !strings.HasPrefix(res.Header.Get("Content-Type"), "text/css") {
+		t.Errorf("GET style.css = %d %q with %v", res.StatusCode, body, res.Header)
+	}
+	if res, _ := request(t, "GET", site.URL+"/style.css", map[string]string{"If-None-Match": etag}, ""); res.StatusCode != 304 || res.Header.Get("ETag") != etag {
+		t.Errorf("GET with If-None-Match = %d with ETag %q, want 304", res.StatusCode, res.Header.Get("ETag"))
+	}
+	if res, body := request(t, "HEAD", site.URL+"/docs/guide.txt", nil, ""); res.StatusCode != 200 || body != "" || res.ContentLength != 10 {
+		t.Errorf("HEAD = %d %q with length %d", res.StatusCode, body, res.ContentLength)
+	}
+
+	for _, test := range []struct {
+		rng, ifRange string
+		status       int
+		body         string
+		contentRange string
+	}{
+		{"bytes=2-5", "", 206, "2345", "bytes 2-5/10"},
+		{"bytes=7-", "", 206, "789", "bytes 7-9/10"},
+		{"bytes=-3", "", 206, "789", "bytes 7-9/10"},
+		{"bytes=8-100", "", 206, "89", "bytes 8-9/10"},
+		{"bytes=0-1,4-5", "", 200, "0123456789", ""},
+		{"bytes=10-", "", 416, "", "bytes */10"},
+		{"bytes=2-5", `"an old etag"`, 200, "0123456789", ""},
+	} {
+		header := map[string]string{"Range": test.rng}
+		if test.ifRange != "" {
+			header["If-Range"] = test.ifRange
+		}
+		res, body := request(t, "GET", site.URL+"/docs/guide.txt", header, "")
+		if test.status == 416 {
+			body = ""
+		}
+		if res.StatusCode != test.status || body != test.body || res.Header.Get("Content-Range") != test.contentRange {
+			t.Errorf("GET %s = %d %q %q, want %d %q %q", test.rng, res.StatusCode, body, res.Header.Get("Content-Range"), test.status, test.body, test.contentRange)
+		}
+	}
+
+	// a directory serves its index.html, or else a listing
+	if res, body := request(t, "GET", site.URL+"/", nil, ""); res.StatusCode != 200 || body != "<h1>home</h1>" {
+		t.Errorf("GET / = %d %q, want index.html", res.StatusCode, body)
+	}
+	res, body = request(t, "GET", site.URL+"/docs", nil, "")
+	if res.StatusCode != 200 || res.Request.URL.Path != "/docs/" || !strings.Contains(body, `<a href="guide.txt">guide.txt</a>`) || !strings.Contains(body, `<a href="./a:b.txt">a:b.txt</a>`) || !strings.Contains(body, `href="../"`) {
+		t.Errorf("GET /docs = %d at %s:\n%s", res.StatusCode, res.Request.URL.Path, body)
+	}
+	for _, path := range []string{"/missing.txt", "/missing/"} {
+		if res, _ := request(t, "GET", site.URL+path, nil, ""); res.StatusCode != 404 {
+			t.Errorf("GET %s = %d, want 404", path, res.StatusCode)
+		}
+	}
+
+	// it is read-only unless it is writable
+	if res, _ := request(t, "PUT", site.URL+"/new.txt", nil, "new"); res.StatusCode != 405 || res.Header.Get("Allow") != "GET, HEAD" {
+		t.Errorf("PUT to a read-only site = %d, want 405", res.StatusCode)
+	}
+	if s.Blob("site", "new.txt") != nil {
+		t.Error("PUT to a read-only site wrote the blob")
+	}
+}
+
+func TestWritableHandler(t *testing.T) {
+	s, site := newSite(t, &ServeOptions{Writable: true})
+
+	res, _ := request(t, "PUT", site.URL+"/docs/new.txt", nil, "plain text")
+	b := s.Blob("site", "docs/new.txt")
+	if res.StatusCode != 201 || b == nil || string(b.Data) != "plain text" || b.ContentType != "text/plain; charset=utf-8" || res.Header.Get("ETag") != b.ETag {
+		t.Errorf("PUT = %d, wrote %+v", res.StatusCode, b)
+	}
+	if res, _ := request(t, "PUT", site.URL+"/docs/new.txt", map[string]string{"If-None-Match": "*"}, "again"); res.StatusCode != 409 {
+		t.Errorf("PUT with If-None-Match * of an existing blob = %d, want 409", res.StatusCode)
+	}
+	if res, _ := request(t, "DELETE", site.URL+"/docs/new.txt", map[string]string{"If-Match": `"an old etag"`}, ""); res.StatusCode != 412 {
+		t.Errorf("DELETE with an old If-Match = %d, want 412", res.StatusCode)
+	}
+	if res, _ := request(t, "DELETE", site.URL+"/docs/new.txt", nil, ""); res.StatusCode != 204 || s.Blob("site", "docs/new.txt") != nil {
+		t.Errorf("DELETE = %d, want 204 and the blob gone", res.StatusCode)
+	}
+	if res, _ := request(t, "DELETE", site.URL+"/docs/new.txt", nil, ""); res.StatusCode != 404 {
+		t.Errorf("DELETE of a missing blob = %d, want 404", res.StatusCode)
+	}
+}
+
+func TestEncryptedHandler(t *testing.T) {
+	encryption := &Encryption{KeyFile: writeKey(t)}
+	s, site := newSite(t, &ServeOptions{Writable: true, Compression: "gzip", Encryption: encryption})
+
+	if res, _ := request(t, "PUT", site.URL+"/notes/secret.txt", nil, "the plans"); res.StatusCode != 201 {
+		t.Fatalf("PUT = %d, want 201", res.StatusCode)
+	}
+	b := s.Blob("site", "notes/secret.txt")
+	if strings.Contains(string(b.Data), "plans") || b.Metadata[encryptionMetadata] == "" || b.Metadata[compressionMetadata] != "gzip" || b.ContentType != "text/plain; charset=utf-8" {
+		t.Errorf("PUT stored %q of %s with metadata %v, want it encrypted", b.Data, b.ContentType, b.Metadata)
+	}
+	res, body := request(t, "GET", site.URL+"/notes/secret.txt", map[string]string{"Range": "bytes=0-3"}, "")
+	if res.StatusCode != 200 || body != "the plans" || res.Header.Get("Content-Encoding") != "" || res.Header.Get("Accept-Ranges") != "" {
+		t.Errorf("GET = %d %q with %v, want the whole blob decoded", res.StatusCode, body, res.Header)
+	}
+
+	serviceURL, err := BlobFromConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	noKey := httptest.NewServer(NewHandler(serviceURL.NewContainerURL("site"), nil))
+	defer noKey.Close()
+	if res, body := request(t, "GET", noKey.URL+"/notes/secret.txt", nil, ""); res.StatusCode != 500 || !strings.Contains(body, "encrypted") {
+		t.Errorf("GET without the key = %d %q, want an error", res.StatusCode, body)
+	}
+}
+
+func TestServe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	newSite(t, nil)
+	errOut := &syncBuffer{}
+	stderr = errOut
+	defer func() { stderr = os.Stderr }()
+	out := testutil.CaptureOutput(t)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- Serve(ctx, "site", "127.0.0.1:0", nil)
+	}()
+	address := regexp.MustCompile(`http://\S+/`)
+	for deadline := time.Now().Add(5 * time.Second); address.FindString(errOut.String()) == ""; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Serve wrote %q, want its address", errOut)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if res, body := request(t, "GET", address.FindString(errOut.String())+"style.css", nil, ""); res.StatusCode != 200 || body != "body { margin: 0 }" {
+		t.Errorf("GET = %d %q", res.StatusCode, body)
+	}
+
+	cancel()
+	select {
+	case err := <-errs:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Serve error after cancel = %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after cancel")
+	}
+	if out.Len() != 0 {
+		t.Errorf("Serve printed %q, want requests logged to stderr", out)
+	}
+	records := []map[string]interface{}{}
+	for _, line := range strings.Split(errOut.String(), "\n") {
+		if strings.HasPrefix(line, "{") {
+			record := map[string]interface{}{}
+			if err := json.Unmarshal([]byte(line), &record); err != nil {
+				t.Fatal(err)
+			}
+			records = append(records, record)
+		}
+	}
+	if len(records) != 1 || records[0]["Method"] != "GET" || records[0]["Path"] != "/style.css" || records[0]["Status"] != 200.0 || records[0]["Size"] != 18.0 {
+		t.Errorf("Serve logged %v, want the request", records)
+	}
+}
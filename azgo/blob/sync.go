@@ -0,0 +1,385 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/blue-eight/azgo/azgo/output"
+)
+
+// SyncOptions configures Sync.
+type SyncOptions struct {
+	// Download syncs the directory from the container, rather than the
+	// container from the directory.
+	Download bool
+	// Delete deletes files or blobs on the destination which are not on
+	// the source.
+	Delete bool
+	// DryRun prints what would change without changing anything.
+	DryRun bool
+	// Include, if not empty, limits the sync to paths which match one of
+	// its globs. Exclude leaves out paths which match one of its globs.
+	// A glob matches the path relative to the directory and prefix, with
+	// forward slashes, or its last element, e.g. "*.log" or "logs/*".
+	Include []string
+	Exclude []string
+	// Transfer configures each upload or download.
+	Transfer *TransferOptions
+}
+
+// SyncAction is a change made by Sync, or one it would make with DryRun.
+type SyncAction struct {
+	Action string `json:"action"`
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Reason string `json:"reason"`
+	DryRun bool   `json:"dry_run,omitempty"`
+}
+
+// syncMD5Metadata is the MD5 of the file which Sync records on a blob it
+// compressed or encrypted, as the Content-MD5 of the stored blob is that
+// of the encoded data. The size is recorded by encodeUpload.
+const syncMD5Metadata = "azgomd5"
+
+// syncFile is what Sync compares of a local file or blob. Size is that of
+// the data after any decoding, or -1 if unknown, as it is for a blob which
+// Upload encoded. MD5 is nil if unknown, as it is for local files until
+// needed.
+type syncFile struct {
+	Size    int64
+	ModTime time.Time
+	MD5     []byte
+}
+
+// Sync makes the blobs under remote, which is "container" or
+// "container/prefix", match the files under dir, or the other way round
+// with options.Download. A file is transferred if it is missing, its size
+// differs, its Content-MD5 differs, or, when the blob has no Content-MD5,
+// the source was modified later. Uploads are compressed and encrypted,
+// and downloads decoded, as with Upload and Download. Each change is
+// printed as a SyncAction via output.Print. Blobs are uploaded with a
+// Content-MD5, and files are downloaded with the blob's last-modified
+// time, so an unchanged tree transfers nothing the next time.
+func Sync(ctx context.Context, dir, remote string, options *SyncOptions) error {
+	o := SyncOptions{}
+	if options != nil {
+		o = *options
+	}
+	transfer := o.Transfer.withDefaults()
+	for _, glob := range append(append([]string{}, o.Include...), o.Exclude...) {
+		if _, err := path.Match(glob, ""); err != nil {
+			return fmt.Errorf("invalid glob %q: %w", glob, err)
+		}
+	}
+
+	container, prefix := splitRemote(remote)
+	serviceURL, err := BlobFromConfig()
+	if err != nil {
+		return err
+	}
+	containerURL := serviceURL.NewContainerURL(container)
+
+	local, err := localFiles(dir, !o.Download)
+	if err != nil {
+		return err
+	}
+	blobs, err := remoteFiles(ctx, containerURL, prefix)
+	if err != nil {
+		return err
+	}
+	source, destination := local, blobs
+	if o.Download {
+		source, destination = blobs, local
+		for name := range blobs {
+			if o.matches(name) && !relative(path.Clean(name)) {
+				return fmt.Errorf("blob %q would be written outside %s", prefix+name, dir)
+			}
+		}
+	}
+
+	for _, name := range syncPaths(local, blobs) {
+		if !o.matches(name) {
+			continue
+		}
+		action := SyncAction{Path: name, DryRun: o.DryRun}
+		src, inSource := source[name]
+		dst, inDestination := destination[name]
+		switch {
+		case !inSource && o.Delete:
+			action.Action, action.Size, action.Reason = "delete", dst.Size, "extraneous"
+		case !inSource:
+			continue
+		case !inDestination:
+			action.Reason = "missing"
+		default:
+			if action.Reason, err = changed(src, dst, filepath.Join(dir, filepath.FromSlash(name)), o.Download); err != nil {
+				return err
+			}
+			if action.Reason == "" {
+				continue
+			}
+		}
+		if action.Action == "" {
+			action.Action, action.Size = "upload", src.Size
+			if o.Download {
+				action.Action = "download"
+			}
+		}
+
+		if !o.DryRun {
+			file := filepath.Join(dir, filepath.FromSlash(name))
+			blobURL := containerURL.NewBlockBlobURL(prefix + name)
+			if err := syncOne(ctx, action.Action, o.Download, blobURL, prefix+name, file, transfer); err != nil {
+				return fmt.Errorf("%s %s: %w", action.Action, name, err)
+			}
+		}
+		if err := output.Print(action); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitRemote splits "container/prefix" and makes a non-empty prefix end
+// with a slash.
+func splitRemote(remote string) (string, string) {
+	remote = strings.TrimPrefix(remote, "/")
+	i := strings.Index(remote, "/")
+	if i < 0 {
+		return remote, ""
+	}
+	prefix := strings.Trim(remote[i+1:], "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return remote[:i], prefix
+}
+
+// relative reports whether the cleaned slash-separated path stays under
+// the directory or prefix it is relative to.
+func relative(clean string) bool {
+	return !path.IsAbs(clean) && clean != "." && clean != ".." && !strings.HasPrefix(clean, "../")
+}
+
+// matches reports whether the path is included and not excluded.
+func (o *SyncOptions) matches(name string) bool {
+	match := func(globs []string) bool {
+		for _, glob := range globs {
+			if ok, _ := path.Match(glob, name); ok {
+				return true
+			}
+			if ok, _ := path.Match(glob, path.Base(name)); ok {
+				return true
+			}
+		}
+		return false
+	}
+	if len(o.Include) > 0 && !match(o.Include) {
+		return false
+	}
+	return !match(o.Exclude)
+}
+
+// syncPaths returns the sorted union of the paths of a and b.
+func syncPaths(a, b map[string]syncFile) []string {
+	names := []string{}
+	for name := range a {
+		names = append(names, name)
+	}
+	for name := range b {
+		if _, ok := a[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// changed returns why src should replace dst, or "" if it should not.
+// file is the local one of the two, whose MD5 is computed only when the
+// sizes match and the blob has a Content-MD5 to compare it with.
+func changed(src, dst syncFile, file string, download bool) (string, error) {
+	if src.Size >= 0 && dst.Size >= 0 && src.Size != dst.Size {
+		return "size", nil
+	}
+	blob := src
+	if !download {
+		blob = dst
+	}
+	if blob.MD5 != nil {
+		sum, err := fileMD5(file)
+		if err != nil {
+			return "", err
+		}
+		if !bytes.Equal(sum, blob.MD5) {
+			return "md5", nil
+		}
+		return "", nil
+	}
+	if src.ModTime.After(dst.ModTime) {
+		return "newer", nil
+	}
+	return "", nil
+}
+
+// localFiles returns the regular files under dir by slash-separated
+// relative path. A missing dir has no files unless it must exist.
+func localFiles(dir string, mustExist bool) (map[string]syncFile, error) {
+	files := map[string]syncFile{}
+	err := filepath.WalkDir(dir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = syncFile{Size: info.Size(), ModTime: info.ModTime()}
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) && !mustExist {
+		return files, nil
+	}
+	return files, err
+}
+
+// remoteFiles returns the blobs under prefix by their name after prefix.
+func remoteFiles(ctx context.Context, containerURL azblob.ContainerURL, prefix string) (map[string]syncFile, error) {
+	files := map[string]syncFile{}
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		list, err := containerURL.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{
+			Prefix:  prefix,
+			Details: azblob.BlobListingDetails{Metadata: true},
+		})
+		if err != nil {
+			return nil, err
+		}
+		marker = list.NextMarker
+		for _, item := range list.Segment.BlobItems {
+			// names ending in a slash are directory markers, which have
+			// no file to sync with
+			name := strings.TrimPrefix(item.Name, prefix)
+			if name == "" || strings.HasSuffix(name, "/") {
+				continue
+			}
+			f := syncFile{ModTime: item.Properties.LastModified}
+			if item.Properties.ContentLength != nil {
+				f.Size = *item.Properties.ContentLength
+			}
+			if len(item.Properties.ContentMD5) > 0 {
+				f.MD5 = item.Properties.ContentMD5
+			}
+			if metadata := map[string]string(item.Metadata); encodedBy(metadata) {
+				f = decodedFile(f, metadata)
+			}
+			files[name] = f
+		}
+	}
+	return files, nil
+}
+
+// decodedFile returns f, a blob which azgo encoded, with the size and MD5
+// which Sync recorded in its metadata, or unknown ones if it has none.
+func decodedFile(f syncFile, metadata map[string]string) syncFile {
+	f.Size, f.MD5 = -1, nil
+	if size, err := strconv.ParseInt(metadata[sizeMetadata], 10, 64); err == nil {
+		f.Size = size
+	}
+	if sum, err := base64.StdEncoding.DecodeString(metadata[syncMD5Metadata]); err == nil && len(sum) == md5.Size {
+		f.MD5 = sum
+	}
+	return f
+}
+
+func fileMD5(file string) ([]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// syncOne carries out a single upload, download or delete of Sync, where
+// a delete is of the file when downloading and of the blob otherwise.
+func syncOne(ctx context.Context, action string, download bool, blobURL azblob.BlockBlobURL, name, file string, o TransferOptions) error {
+	switch action {
+	case "upload":
+		return syncUpload(ctx, blobURL, name, file, o)
+	case "download":
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return err
+		}
+		props, err := downloadBlob(ctx, blobURL.BlobURL, name, file, o)
+		if err != nil {
+			return err
+		}
+		return os.Chtimes(file, time.Now(), props.LastModified())
+	case "delete":
+		if download {
+			return os.Remove(file)
+		}
+		_, err := blobURL.Delete(ctx, azblob.DeleteSnapshotsOptionInclude, azblob.BlobAccessConditions{})
+		return err
+	}
+	return fmt.Errorf("unknown sync action %q", action)
+}
+
+// syncUpload uploads file with its MD5 as the blob's Content-MD5, which
+// costs a second read of the file but lets the next Sync skip it. A file
+// which is compressed or encrypted has its size and MD5 recorded in the
+// blob's metadata instead.
+func syncUpload(ctx context.Context, blobURL azblob.BlockBlobURL, name, file string, o TransferOptions) error {
+	sum, err := fileMD5(file)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !o.encodes() {
+		return uploadStream(ctx, blobURL, name, f, info.Size(), file, o, sum)
+	}
+	metadata := map[string]string{syncMD5Metadata: base64.StdEncoding.EncodeToString(sum)}
+	for key, value := range o.Metadata {
+		metadata[key] = value
+	}
+	o.Metadata = metadata
+	e, err := encodeUpload(f, info.Size(), &o, name, file)
+	if err != nil {
+		return err
+	}
+	defer e.Close()
+	return uploadStream(ctx, blobURL, name, e, -1, file, o, nil)
+}
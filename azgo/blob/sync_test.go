@@ -0,0 +1,236 @@
+package blob
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blue-eight/azgo/azgo/internal/testutil"
+)
+
+// writeFiles writes the files, by slash-separated path, under dir.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, data := range files {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// actions runs Sync and returns its actions as "action path reason".
+func actions(t *testing.T, dir, remote string, options *SyncOptions) []string {
+	t.Helper()
+	out := testutil.CaptureOutput(t)
+	if err := Sync(context.Background(), dir, remote, options); err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, r := range testutil.Records(t, out) {
+		got = append(got, fmt.Sprint(r["action"], " ", r["path"], " ", r["reason"]))
+	}
+	return got
+}
+
+func TestSyncUpload(t *testing.T) {
+	s := newServer(t)
+	s.CreateContainer("main")
+	s.PutBlob("main", "site/stale.html", []byte("old"), "text/html")
+	s.PutBlob("main", "site/same.txt", []byte("same"), "text/plain")
+	s.PutBlob("main", "site/changed.txt", []byte("1234"), "text/plain")
+	s.PutBlob("main", "other/untouched.txt", []byte("x"), "text/plain")
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"same.txt":       "same",
+		"changed.txt":    "5678",
+		"new/page.html":  "<html></html>",
+		"debug.log":      "noise",
+		"tmp/scratch.js": "1",
+	})
+	options := &SyncOptions{Delete: true, DryRun: true, Exclude: []string{"*.log", "tmp/*"}}
+
+	plan := actions(t, dir, "main/site", options)
+	want := "[upload changed.txt md5 upload new/page.html missing delete stale.html extraneous]"
+	if got := fmt.Sprint(plan); got != want {
+		t.Errorf("dry run = %s, want %s", got, want)
+	}
+	if s.Blob("main", "site/new/page.html") != nil || s.Blob("main", "site/stale.html") == nil {
+		t.Fatal("the dry run changed the container")
+	}
+
+	options.DryRun = false
+	if got := fmt.Sprint(actions(t, dir, "main/site/", options)); got != want {
+		t.Errorf("sync = %s, want %s", got, want)
+	}
+	page := s.Blob("main", "site/new/page.html")
+	if page == nil || string(page.Data) != "<html></html>" || page.ContentType != "text/html; charset=utf-8" || page.ContentMD5 == nil {
+		t.Errorf("uploaded page = %+v", page)
+	}
+	if b := s.Blob("main", "site/changed.txt"); b == nil || string(b.Data) != "5678" {
+		t.Errorf("changed.txt = %+v", b)
+	}
+	if s.Blob("main", "site/stale.html") != nil || s.Blob("main", "site/debug.log") != nil {
+		t.Error("sync kept the stale blob or uploaded an excluded file")
+	}
+	if s.Blob("main", "other/untouched.txt") == nil {
+		t.Error("sync deleted a blob outside its prefix")
+	}
+
+	if got := actions(t, dir, "main/site", options); len(got) != 0 {
+		t.Errorf("a second sync = %v, want no changes", got)
+	}
+}
+
+func TestSyncDownloadOutsideDir(t *testing.T) {
+	for _, name := range []string{"../escape", "nested/../../escape", "/etc/escape"} {
+		s := newServer(t)
+		s.PutBlob("main", "a.txt", []byte("aaa"), "text/plain")
+		s.PutBlob("main", name, []byte("x"), "text/plain")
+		root := t.TempDir()
+		dir := filepath.Join(root, "download")
+
+		testutil.CaptureOutput(t)
+		err := Sync(context.Background(), dir, "main", &SyncOptions{Download: true})
+		if err == nil || !strings.Contains(err.Error(), "outside") {
+			t.Errorf("sync of %q = %v, want an error", name, err)
+		}
+		if _, err := os.Stat(filepath.Join(root, "escape")); err == nil {
+			t.Errorf("sync of %q wrote outside the directory", name)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "a.txt")); err == nil {
+			t.Errorf("sync of %q downloaded a.txt before failing", name)
+		}
+	}
+}
+
+func TestSyncDownload(t *testing.T) {
+	s := newServer(t)
+	s.PutBlob("main", "a.txt", []byte("aaa"), "text/plain")
+	s.PutBlob("main", "nested/b.json", []byte("{}"), "application/json")
+	s.PutBlob("main", "nested/", nil, "")
+	dir := filepath.Join(t.TempDir(), "download")
+	options := &SyncOptions{Download: true, Include: []string{"*.txt", "nested/*"}}
+
+	want := "[download a.txt missing download nested/b.json missing]"
+	if got := fmt.Sprint(actions(t, dir, "main", options)); got != want {
+		t.Errorf("sync = %s, want %s", got, want)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "nested", "b.json"))
+	if err != nil || string(b) != "{}" {
+		t.Fatalf("nested/b.json = %q, %v", b, err)
+	}
+	info, err := os.Stat(filepath.Join(dir, "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastModified := s.Blob("main", "a.txt").LastModified; !info.ModTime().Equal(lastModified) {
+		t.Errorf("a.txt modified %s, want the blob's %s", info.ModTime(), lastModified)
+	}
+	if got := actions(t, dir, "main", options); len(got) != 0 {
+		t.Errorf("a second sync = %v, want no changes", got)
+	}
+
+	// a blob without a Content-MD5 is compared by time
+	changedBlob := s.PutBlob("main", "a.txt", []byte("bbb"), "text/plain")
+	changedBlob.ContentMD5 = nil
+	changedBlob.LastModified = changedBlob.LastModified.Add(time.Hour)
+	writeFiles(t, dir, map[string]string{"extra.txt": "x"})
+	options.Delete = true
+	want = "[download a.txt newer delete extra.txt extraneous]"
+	if got := fmt.Sprint(actions(t, dir, "main", options)); got != want {
+		t.Errorf("sync = %s, want %s", got, want)
+	}
+	entries, _ := os.ReadDir(dir)
+	names := []string{}
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	if got := strings.Join(names, ","); got != "a.txt,nested" {
+		t.Errorf("%s has %s, want a.txt,nested", dir, got)
+	}
+}
+
+func TestSyncChanged(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"f": "data"})
+	file := filepath.Join(dir, "f")
+	sum, _ := fileMD5(file)
+	now := time.Now()
+	tests := []struct {
+		src, dst syncFile
+		download bool
+		want     string
+	}{
+		{syncFile{Size: 4}, syncFile{Size: 5}, false, "size"},
+		{syncFile{Size: 4}, syncFile{Size: 4, MD5: sum}, false, ""},
+		{syncFile{Size: 4}, syncFile{Size: 4, MD5: []byte("other")}, false, "md5"},
+		{syncFile{Size: 4, MD5: []byte("other")}, syncFile{Size: 4}, true, "md5"},
+		{syncFile{Size: 4, ModTime: now}, syncFile{Size: 4, ModTime: now.Add(-time.Hour)}, false, "newer"},
+		{syncFile{Size: 4, ModTime: now.Add(-time.Hour)}, syncFile{Size: 4, ModTime: now}, true, ""},
+	}
+	for i, test := range tests {
+		got, err := changed(test.src, test.dst, file, test.download)
+		if err != nil || got != test.want {
+			t.Errorf("%d: changed = %q, %v, want %q", i, got, err, test.want)
+		}
+	}
+
+	for remote, want := range map[string]string{"main": "main ", "main/site": "main site/", "/main/a/b/": "main a/b/"} {
+		if container, prefix := splitRemote(remote); container+" "+prefix != want {
+			t.Errorf("splitRemote(%s) = %s %s, want %s", remote, container, prefix, want)
+		}
+	}
+}
+
+func TestSyncEncrypted(t *testing.T) {
+	ctx := context.Background()
+	s := newServer(t)
+	s.CreateContainer("main")
+	useEncryption(t, s, writeKey(t), "", "gzip")
+	dir := t.TempDir()
+	files := map[string]string{"a.txt": "aaa", "nested/b.json": `{"b": true}`}
+	writeFiles(t, dir, files)
+
+	want := "[upload a.txt missing upload nested/b.json missing]"
+	if got := fmt.Sprint(actions(t, dir, "main/site", nil)); got != want {
+		t.Errorf("sync = %s, want %s", got, want)
+	}
+	b := s.Blob("main", "site/a.txt")
+	if string(b.Data) == "aaa" || b.Metadata[encryptionMetadata] == "" || b.Metadata[sizeMetadata] != "3" {
+		t.Errorf("site/a.txt stored %q with metadata %v, want it encrypted", b.Data, b.Metadata)
+	}
+	if got := actions(t, dir, "main/site", nil); len(got) != 0 {
+		t.Errorf("a second sync = %v, want no changes", got)
+	}
+
+	// a blob which Upload encoded has no size to compare, so it is
+	// compared by time
+	if err := Upload(ctx, "main", "site/c.txt", filepath.Join(dir, "a.txt"), nil); err != nil {
+		t.Fatal(err)
+	}
+	down := filepath.Join(t.TempDir(), "download")
+	options := &SyncOptions{Download: true}
+	want = "[download a.txt missing download c.txt missing download nested/b.json missing]"
+	if got := fmt.Sprint(actions(t, down, "main/site", options)); got != want {
+		t.Errorf("sync = %s, want %s", got, want)
+	}
+	files["c.txt"] = "aaa"
+	for name, data := range files {
+		if b, err := os.ReadFile(filepath.Join(down, filepath.FromSlash(name))); err != nil || string(b) != data {
+			t.Errorf("%s = %q, %v, want %q", name, b, err, data)
+		}
+	}
+	if got := actions(t, down, "main/site", options); len(got) != 0 {
+		t.Errorf("a second sync = %v, want no changes", got)
+	}
+}
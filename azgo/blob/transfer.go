@@ -0,0 +1,378 @@
+package blob
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/blue-eight/azgo/azgo/config"
+)
+
+// Defaults for TransferOptions. With them a transfer holds at most about
+// 64 MiB in memory, and an upload can be up to 50,000 blocks of 8 MiB.
+const (
+	DefaultBlockSize   = 8 << 20
+	DefaultConcurrency = 8
+)
+
+// stdin and stdout are used by Upload and Download for the file "-", by
+// Append and Tail, and by Tree, stderr by List, and all three by
+// RunLocked; tests replace them.
+var (
+	stdin  io.Reader = os.Stdin
+	stdout io.Writer = os.Stdout
+	stderr io.Writer = os.Stderr
+)
+
+// TransferOptions configures Upload and Download.
+type TransferOptions struct {
+	// BlockSize is the size of each block uploaded or range downloaded,
+	// which defaults to DefaultBlockSize. Uploads use at least 1 MiB.
+	BlockSize int64
+	// Concurrency is how many blocks are transferred at once, which
+	// defaults to DefaultConcurrency.
+	Concurrency int
+	// ContentType is the content type of an upload. If empty it is
+	// detected from the extension of the blob or file, or else the data.
+	ContentType string
+	// Metadata and Tags are the metadata and index tags of an upload.
+	Metadata map[string]string
+	Tags     map[string]string
+	// Progress is where a progress indicator is written, e.g. os.Stderr.
+	// There is none if it is nil.
+	Progress io.Writer
+	// Version is the snapshot or version a download reads.
+	Version BlobVersion
+	// Compression ("gzip" or "zstd") compresses an upload, and Encryption
+	// encrypts it on the client side. Both default to the settings of the
+	// active profile (see EncryptionFromProfile). A download is decrypted
+	// and decompressed whatever they are, but an encrypted blob needs the
+	// Encryption it was uploaded with.
+	Compression string
+	Encryption  *Encryption
+
+	// contentEncoding is the Content-Encoding of an upload which Upload
+	// compressed.
+	contentEncoding string
+}
+
+func (o *TransferOptions) withDefaults() TransferOptions {
+	options := TransferOptions{}
+	if o != nil {
+		options = *o
+	}
+	if options.Compression == "" {
+		options.Compression = config.Active().BlobCompression
+	}
+	if options.Encryption == nil {
+		options.Encryption = EncryptionFromProfile(config.Active())
+	}
+	if options.BlockSize <= 0 {
+		options.BlockSize = DefaultBlockSize
+	}
+	if options.Concurrency <= 0 {
+		options.Concurrency = DefaultConcurrency
+	}
+	return options
+}
+
+// Upload streams file, or the standard input if file is "-", to the Block
+// Blob at path in the container. Blocks are read and uploaded in parallel,
+// so the file is never held in memory. The container defaults to "main"
+// if empty.
+func Upload(ctx context.Context, container, path, file string, options *TransferOptions) error {
+	if container == "" {
+		container = "main"
+	}
+	o := options.withDefaults()
+
+	serviceURL, err := BlobFromConfig()
+	if err != nil {
+		return err
+	}
+
+	var r io.Reader = stdin
+	size := int64(-1)
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		r, size = f, info.Size()
+	}
+
+	blobURL := serviceURL.NewContainerURL(container).NewBlockBlobURL(path)
+	if o.encodes() {
+		e, err := encodeUpload(r, size, &o, path, file)
+		if err != nil {
+			return err
+		}
+		defer e.Close()
+		r, size = e, -1
+	}
+	return uploadStream(ctx, blobURL, path, r, size, file, o, nil)
+}
+
+// encodes reports whether an upload with o is compressed or encrypted.
+func (o *TransferOptions) encodes() bool {
+	return o.Compression != "" || o.Encryption != nil
+}
+
+// encodeUpload encodes r as o asks, and sets the metadata and
+// Content-Encoding of o to upload along with it, including size, the
+// length of r, unless it is -1 for unknown. Unless o has a content type, it
+// is detected from names or the data before it is encoded. The caller must
+// Close the result.
+func encodeUpload(r io.Reader, size int64, o *TransferOptions, names ...string) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	if o.ContentType == "" {
+		o.ContentType = detectContentType(br, names...)
+	}
+	e, err := encode(br, o.Compression, o.Encryption)
+	if err != nil {
+		return nil, err
+	}
+	metadata := map[string]string{}
+	for key, value := range o.Metadata {
+		metadata[key] = value
+	}
+	for key, value := range e.metadata {
+		metadata[key] = value
+	}
+	if size >= 0 {
+		metadata[sizeMetadata] = strconv.FormatInt(size, 10)
+	}
+	o.Metadata, o.contentEncoding = metadata, e.contentEncoding
+	return e, nil
+}
+
+// uploadStream uploads size bytes (or -1 if unknown) from r to the blob
+// path at blobURL, detecting the content type from path or the file name if
+// o has none. The blob gets contentMD5, if known, as its Content-MD5.
+func uploadStream(ctx context.Context, blobURL azblob.BlockBlobURL, path string, r io.Reader, size int64, file string, o TransferOptions, contentMD5 []byte) error {
+	br := bufio.NewReader(r)
+	contentType := o.ContentType
+	if contentType == "" {
+		contentType = detectContentType(br, path, file)
+	}
+
+	p := newProgress(o.Progress, "upload "+path, size)
+	_, err := azblob.UploadStreamToBlockBlob(ctx, p.reader(br), blobURL, azblob.UploadStreamToBlockBlobOptions{
+		BufferSize:      int(o.BlockSize),
+		MaxBuffers:      o.Concurrency,
+		BlobHTTPHeaders: azblob.BlobHTTPHeaders{ContentType: contentType, ContentEncoding: o.contentEncoding, ContentMD5: contentMD5},
+		Metadata:        o.Metadata,
+		BlobTagsMap:     o.Tags,
+	})
+	p.done()
+	return err
+}
+
+// detectContentType returns the content type for the extension of the
+// blob path or the file name, or else sniffs it from the start of r.
+func detectContentType(r *bufio.Reader, names ...string) string {
+	for _, name := range names {
+		if contentType := mime.TypeByExtension(filepath.Ext(name)); contentType != "" {
+			return contentType
+		}
+	}
+	// Peek returns what it has along with io.EOF for short files
+	head, _ := r.Peek(512)
+	return http.DetectContentType(head)
+}
+
+// Download streams the blob at path in the container to file, or the
+// standard output if file is "-". Ranges are downloaded in parallel and
+// written in order, so at most about Concurrency blocks are held in
+// memory. A file is written under a temporary name next to it and renamed
+// once complete. The container defaults to "main" if empty.
+func Download(ctx context.Context, container, path, file string, options *TransferOptions) error {
+	if container == "" {
+		container = "main"
+	}
+	o := options.withDefaults()
+
+	serviceURL, err := BlobFromConfig()
+	if err != nil {
+		return err
+	}
+	blobURL, err := o.Version.url(serviceURL.NewContainerURL(container).NewBlobURL(path))
+	if err != nil {
+		return err
+	}
+	_, err = downloadBlob(ctx, blobURL, path, file, o)
+	return err
+}
+
+// downloadBlob downloads the blob path at blobURL to file, or stdout if
+// file is "-", as Download does, and returns the properties of the blob.
+func downloadBlob(ctx context.Context, blobURL azblob.BlobURL, path, file string, o TransferOptions) (props *azblob.BlobGetPropertiesResponse, err error) {
+	props, err = blobURL.GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	w := stdout
+	if file != "-" {
+		f, err := createTemp(file)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err == nil {
+				err = os.Rename(f.Name(), file)
+			}
+			if err != nil {
+				os.Remove(f.Name())
+			}
+		}()
+		w = f
+	}
+
+	p := newProgress(o.Progress, "download "+path, props.ContentLength())
+	defer p.done()
+	metadata := props.NewMetadata()
+	if !encodedBy(metadata) {
+		return props, downloadRanges(ctx, blobURL, props.ContentLength(), props.ETag(), p.writer(w), o)
+	}
+
+	// the blob is decoded as it is downloaded, with the progress of the
+	// blob as stored
+	d := newDecodeWriter(w, metadata, o.Encryption)
+	err = d.close(downloadRanges(ctx, blobURL, props.ContentLength(), props.ETag(), p.writer(d), o))
+	return props, err
+}
+
+// decodeWriter decodes the data of a blob which azgo encoded as it is
+// written, and writes the result to another writer.
+type decodeWriter struct {
+	pw      *io.PipeWriter
+	decoded chan error
+}
+
+// newDecodeWriter returns a decodeWriter which decodes a blob with
+// metadata to w. The caller must call close.
+func newDecodeWriter(w io.Writer, metadata map[string]string, e *Encryption) *decodeWriter {
+	pr, pw := io.Pipe()
+	d := &decodeWriter{pw: pw, decoded: make(chan error, 1)}
+	go func() {
+		r, err := decode(pr, metadata, e)
+		if err == nil {
+			_, err = io.Copy(w, r)
+			r.Close()
+		}
+		pr.CloseWithError(err)
+		d.decoded <- err
+	}()
+	return d
+}
+
+func (d *decodeWriter) Write(p []byte) (int, error) {
+	return d.pw.Write(p)
+}
+
+// close ends the data, which failed with err if it is not nil, waits for
+// the rest to be decoded, and returns err or else any error decoding.
+func (d *decodeWriter) close(err error) error {
+	d.pw.CloseWithError(err)
+	if decodeErr := <-d.decoded; err == nil {
+		err = decodeErr
+	}
+	return err
+}
+
+// createTemp creates a temporary file in the directory of file.
+func createTemp(file string) (*os.File, error) {
+	dir, name := filepath.Split(file)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := os.CreateTemp(dir, "."+name+".azgo-*")
+	if err != nil {
+		return nil, err
+	}
+	// CreateTemp uses 0600, which is not what we want for a download
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+// downloadRanges downloads size bytes of the blob in blocks of
+// o.BlockSize, o.Concurrency at a time, and writes them to w in order.
+// Every range must match etag, so a blob which changes during the
+// download is an error rather than a mix of old and new data.
+func downloadRanges(ctx context.Context, blobURL azblob.BlobURL, size int64, etag azblob.ETag, w io.Writer, o TransferOptions) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type block struct {
+		data []byte
+		err  error
+	}
+	// pending holds a channel per block in order; its capacity bounds the
+	// number of blocks downloading or waiting to be written
+	pending := make(chan chan block, o.Concurrency)
+	go func() {
+		defer close(pending)
+		for offset := int64(0); offset < size; offset += o.BlockSize {
+			result := make(chan block, 1)
+			select {
+			case pending <- result:
+			case <-ctx.Done():
+				return
+			}
+			count := o.BlockSize
+			if size-offset < count {
+				count = size - offset
+			}
+			go func(offset, count int64) {
+				data, err := downloadRange(ctx, blobURL, offset, count, etag)
+				result <- block{data, err}
+			}(offset, count)
+		}
+	}()
+
+	for result := range pending {
+		b := <-result
+		if b.err != nil {
+			return b.err
+		}
+		if _, err := w.Write(b.data); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+func downloadRange(ctx context.Context, blobURL azblob.BlobURL, offset, count int64, etag azblob.ETag) ([]byte, error) {
+	ac := azblob.BlobAccessConditions{ModifiedAccessConditions: azblob.ModifiedAccessConditions{IfMatch: etag}}
+	res, err := blobURL.Download(ctx, offset, count, ac, false, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return nil, err
+	}
+	body := res.Body(azblob.RetryReaderOptions{MaxRetryRequests: 3})
+	defer body.Close()
+	data := make([]byte, count)
+	if _, err := io.ReadFull(body, data); err != nil {
+		return nil, fmt.Errorf("reading bytes %d-%d: %w", offset, offset+count-1, err)
+	}
+	return data, nil
+}
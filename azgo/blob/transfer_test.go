@@ -0,0 +1,180 @@
+package blob
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// randomData returns n bytes which are the same on every run.
+func randomData(n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(b)
+	return b
+}
+
+func TestUploadDownload(t *testing.T) {
+	ctx := context.Background()
+	s := newServer(t)
+	s.CreateContainer("main")
+	data := randomData(3<<20 + 12345)
+	file := filepath.Join(t.TempDir(), "artifact.wasm")
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	progress := &bytes.Buffer{}
+	options := &TransferOptions{BlockSize: 1 << 20, Concurrency: 3, Progress: progress}
+	if err := Upload(ctx, "", "builds/artifact.wasm", file, options); err != nil {
+		t.Fatal(err)
+	}
+	stored := s.Blob("main", "builds/artifact.wasm")
+	if stored == nil || !bytes.Equal(stored.Data, data) {
+		t.Fatal("the uploaded blob does not match the file")
+	}
+	if stored.ContentType != "application/wasm" {
+		t.Errorf("ContentType = %q, want application/wasm", stored.ContentType)
+	}
+	blocks := 0
+	for _, r := range s.Requests() {
+		if r.URL.Query().Get("comp") == "block" {
+			blocks++
+		}
+	}
+	if blocks != 4 {
+		t.Errorf("Upload staged %d blocks, want 4", blocks)
+	}
+	if !strings.Contains(progress.String(), "upload builds/artifact.wasm: 3.0 MiB / 3.0 MiB (100%)") {
+		t.Errorf("progress = %q", progress)
+	}
+
+	// ranges which do not divide the blob evenly, into a new file
+	downloaded := filepath.Join(t.TempDir(), "out", "artifact.wasm")
+	if err := os.Mkdir(filepath.Dir(downloaded), 0755); err != nil {
+		t.Fatal(err)
+	}
+	before := len(s.Requests())
+	if err := Download(ctx, "main", "builds/artifact.wasm", downloaded, &TransferOptions{BlockSize: 1000000, Concurrency: 2}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(downloaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("the downloaded file does not match the blob")
+	}
+	ranges := 0
+	for _, r := range s.Requests()[before:] {
+		if r.Method == "GET" && r.Header.Get("x-ms-range") != "" {
+			ranges++
+		}
+	}
+	if ranges != 4 {
+		t.Errorf("Download made %d ranged requests, want 4", ranges)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(downloaded)); len(entries) != 1 {
+		t.Errorf("Download left %d files behind, want 1", len(entries))
+	}
+}
+
+func TestUploadDownloadStdio(t *testing.T) {
+	ctx := context.Background()
+	s := newServer(t)
+	s.CreateContainer("main")
+	data := randomData(2<<20 + 1)
+
+	stdin = bytes.NewReader(data)
+	out := &bytes.Buffer{}
+	stdout = out
+	defer func() { stdin, stdout = os.Stdin, os.Stdout }()
+
+	if err := Upload(ctx, "main", "stream", "-", &TransferOptions{BlockSize: 1 << 20}); err != nil {
+		t.Fatal(err)
+	}
+	stored := s.Blob("main", "stream")
+	if stored == nil || !bytes.Equal(stored.Data, data) {
+		t.Fatal("the uploaded blob does not match the standard input")
+	}
+	if stored.ContentType != "application/octet-stream" {
+		t.Errorf("ContentType = %q, want it sniffed as application/octet-stream", stored.ContentType)
+	}
+
+	if err := Download(ctx, "main", "stream", "-", &TransferOptions{BlockSize: 300000, Concurrency: 4}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Errorf("downloaded %d bytes which do not match the blob", out.Len())
+	}
+
+	s.PutBlob("main", "empty", nil, "text/plain")
+	out.Reset()
+	if err := Download(ctx, "main", "empty", "-", nil); err != nil || out.Len() != 0 {
+		t.Errorf("Download of an empty blob = %q, %v", out, err)
+	}
+}
+
+func TestDownloadMissing(t *testing.T) {
+	s := newServer(t)
+	s.CreateContainer("main")
+	dir := t.TempDir()
+	err := Download(context.Background(), "main", "missing", filepath.Join(dir, "missing"), nil)
+	if storageCode(err) != azblob.ServiceCodeBlobNotFound {
+		t.Errorf("Download of a missing blob error = %v, want BlobNotFound", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Download of a missing blob left %d files behind", len(entries))
+	}
+}
+
+func TestDetectContentType(t *testing.T) {
+	tests := []struct {
+		names []string
+		data  string
+		want  string
+	}{
+		{[]string{"report.json", "-"}, "", "application/json"},
+		{[]string{"report", "report.html"}, "", "text/html; charset=utf-8"},
+		{[]string{"image", "-"}, "\x89PNG\r\n\x1a\n", "image/png"},
+		{[]string{"notes", "-"}, "plain text", "text/plain; charset=utf-8"},
+	}
+	for _, test := range tests {
+		r := bufio.NewReader(strings.NewReader(test.data))
+		if got := detectContentType(r, test.names...); got != test.want {
+			t.Errorf("detectContentType(%q, %v) = %q, want %q", test.data, test.names, got, test.want)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for s, want := range map[string]int64{
+		"4194304": 4194304,
+		"512KiB":  512 << 10,
+		"8MiB":    8 << 20,
+		"8 MB":    8 << 20,
+		"1G":      1 << 30,
+		"2TiB":    2 << 40,
+		"8mib":    8 << 20,
+		"100mb":   100 << 20,
+		"64k":     64 << 10,
+	} {
+		if got, err := ParseSize(s); err != nil || got != want {
+			t.Errorf("ParseSize(%q) = %d, %v, want %d", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "MiB", "8XB", "-1", "1.5GiB"} {
+		if _, err := ParseSize(s); err == nil {
+			t.Errorf("ParseSize(%q) returned no error", s)
+		}
+	}
+	if got := FormatSize(1536); got != "1.5 KiB" {
+		t.Errorf("FormatSize(1536) = %s", got)
+	}
+}
@@ -0,0 +1,200 @@
+package blob
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/blue-eight/azgo/azgo/output"
+)
+
+// dirPrefix makes a non-empty prefix end with a slash, so it names a
+// virtual directory rather than the start of a name.
+func dirPrefix(prefix string) string {
+	prefix = strings.TrimPrefix(prefix, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return prefix
+}
+
+// treeItem is a blob or a virtual directory in a Tree.
+type treeItem struct {
+	name string
+	dir  bool
+	size int64
+}
+
+// treeLister lists one virtual directory a page at a time.
+type treeLister struct {
+	containerURL azblob.ContainerURL
+	prefix       string
+	marker       azblob.Marker
+	items        []treeItem
+}
+
+// next returns the next item, and false once there are no more.
+func (l *treeLister) next(ctx context.Context) (treeItem, bool, error) {
+	for len(l.items) == 0 && l.marker.NotDone() {
+		res, err := l.containerURL.ListBlobsHierarchySegment(ctx, l.marker, "/", azblob.ListBlobsSegmentOptions{Prefix: l.prefix})
+		if err != nil {
+			return treeItem{}, false, err
+		}
+		l.marker = res.NextMarker
+		for _, item := range hierarchyItems(res.Segment) {
+			switch item := item.(type) {
+			case VirtualDirectory:
+				l.items = append(l.items, treeItem{name: item.Name, dir: true})
+			case azblob.BlobItemInternal:
+				size := int64(0)
+				if item.Properties.ContentLength != nil {
+					size = *item.Properties.ContentLength
+				}
+				l.items = append(l.items, treeItem{name: item.Name, size: size})
+			}
+		}
+	}
+	if len(l.items) == 0 {
+		return treeItem{}, false, nil
+	}
+	item := l.items[0]
+	l.items = l.items[1:]
+	return item, true, nil
+}
+
+// Tree prints the blobs under prefix in the container to the standard
+// output as a tree of virtual directories, like the tree command, down
+// to depth levels (or all of them if depth is 0). It lists one directory
+// at a time, so it starts printing straight away, and a small depth
+// avoids listing the whole container. The container defaults to "main" if
+// empty.
+func Tree(ctx context.Context, container, prefix string, depth int) error {
+	if container == "" {
+		container = "main"
+	}
+	prefix = dirPrefix(prefix)
+	serviceURL, err := BlobFromConfig()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "%s/%s\n", container, prefix)
+	t := tree{containerURL: serviceURL.NewContainerURL(container), depth: depth}
+	if err := t.walk(ctx, prefix, "", 1); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "\n%d directories, %d blobs, %s\n", t.dirs, t.blobs, FormatSize(t.bytes))
+	return nil
+}
+
+type tree struct {
+	containerURL azblob.ContainerURL
+	depth        int
+	dirs, blobs  int
+	bytes        int64
+}
+
+// walk prints the items of the virtual directory prefix at level, each
+// after the next is known so the last one can be drawn as such.
+func (t *tree) walk(ctx context.Context, prefix, indent string, level int) error {
+	l := &treeLister{containerURL: t.containerURL, prefix: prefix}
+	item, ok, err := l.next(ctx)
+	for ok && err == nil {
+		next, more, nextErr := l.next(ctx)
+		if nextErr != nil {
+			return nextErr
+		}
+		branch, childIndent := "├── ", "│   "
+		if !more {
+			branch, childIndent = "└── ", "    "
+		}
+		name := strings.TrimPrefix(item.name, prefix)
+		if item.dir {
+			t.dirs++
+			fmt.Fprintf(stdout, "%s%s%s\n", indent, branch, name)
+			if t.depth == 0 || level < t.depth {
+				if err := t.walk(ctx, item.name, indent+childIndent, level+1); err != nil {
+					return err
+				}
+			}
+		} else {
+			t.blobs++
+			t.bytes += item.size
+			fmt.Fprintf(stdout, "%s%s%s (%s)\n", indent, branch, name, FormatSize(item.size))
+		}
+		item, ok = next, more
+	}
+	return err
+}
+
+// Usage is the number and total size of the blobs under a prefix.
+type Usage struct {
+	Prefix string `json:"prefix"`
+	Blobs  int64  `json:"blobs"`
+	Bytes  int64  `json:"bytes"`
+	Size   string `json:"size"`
+}
+
+// DiskUsage sums the sizes of the blobs under prefix in the container by
+// virtual directory, down to depth levels below prefix, like du. Each blob
+// counts towards every directory it is under, up to depth. It prints a
+// Usage for each directory in name order, and then one for prefix itself,
+// via output.Print. The container defaults to "main" if empty.
+func DiskUsage(ctx context.Context, container, prefix string, depth int) error {
+	if container == "" {
+		container = "main"
+	}
+	prefix = dirPrefix(prefix)
+	serviceURL, err := BlobFromConfig()
+	if err != nil {
+		return err
+	}
+	containerURL := serviceURL.NewContainerURL(container)
+
+	total := &Usage{Prefix: prefix}
+	dirs := map[string]*Usage{}
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		list, err := containerURL.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{Prefix: prefix})
+		if err != nil {
+			return err
+		}
+		marker = list.NextMarker
+		for _, item := range list.Segment.BlobItems {
+			size := int64(0)
+			if item.Properties.ContentLength != nil {
+				size = *item.Properties.ContentLength
+			}
+			total.Blobs++
+			total.Bytes += size
+			parts := strings.Split(strings.TrimPrefix(item.Name, prefix), "/")
+			for level := 1; level <= depth && level < len(parts); level++ {
+				dir := prefix + path.Join(parts[:level]...) + "/"
+				if dirs[dir] == nil {
+					dirs[dir] = &Usage{Prefix: dir}
+				}
+				dirs[dir].Blobs++
+				dirs[dir].Bytes += size
+			}
+		}
+	}
+
+	names := []string{}
+	for name := range dirs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range append(names, "") {
+		usage := total
+		if name != "" {
+			usage = dirs[name]
+		}
+		usage.Size = FormatSize(usage.Bytes)
+		if err := output.Print(usage); err != nil {
+			return err
+		}
+	}
+	return nil
+}
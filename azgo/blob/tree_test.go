@@ -0,0 +1,97 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/blue-eight/azgo/azgo/internal/testutil"
+)
+
+func TestTree(t *testing.T) {
+	ctx := context.Background()
+	s := newServer(t)
+	s.PageSize = 2
+	for name, size := range map[string]int{
+		"site/index.html":      512,
+		"site/css/main.css":    1536,
+		"site/css/print.css":   10,
+		"site/js/app/main.js":  2048,
+		"site/robots.txt":      20,
+		"elsewhere/ignore.txt": 1,
+	} {
+		s.PutBlob("main", name, make([]byte, size), "text/plain")
+	}
+	out := &bytes.Buffer{}
+	stdout = out
+	defer func() { stdout = os.Stdout }()
+
+	if err := Tree(ctx, "main", "site", 0); err != nil {
+		t.Fatal(err)
+	}
+	want := `main/site/
+├── css/
+│   ├── main.css (1.5 KiB)
+│   └── print.css (10 B)
+├── index.html (512 B)
+├── js/
+│   └── app/
+│       └── main.js (2.0 KiB)
+└── robots.txt (20 B)
+
+3 directories, 5 blobs, 4.0 KiB
+`
+	if out.String() != want {
+		t.Errorf("Tree printed\n%s\nwant\n%s", out, want)
+	}
+
+	out.Reset()
+	if err := Tree(ctx, "main", "site/", 1); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.String(); strings.Contains(got, "main.css") || !strings.Contains(got, "├── css/\n├── index.html") {
+		t.Errorf("Tree with depth 1 printed\n%s", got)
+	}
+}
+
+func TestDiskUsage(t *testing.T) {
+	ctx := context.Background()
+	s := newServer(t)
+	s.PageSize = 2
+	for name, size := range map[string]int{
+		"logs/2021/01/a.log": 1000,
+		"logs/2021/02/b.log": 2000,
+		"logs/2022/01/c.log": 4000,
+		"logs/README":        8,
+		"other":              16,
+	} {
+		s.PutBlob("main", name, make([]byte, size), "text/plain")
+	}
+
+	usage := func(prefix string, depth int) string {
+		out := testutil.CaptureOutput(t)
+		if err := DiskUsage(ctx, "main", prefix, depth); err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, r := range testutil.Records(t, out) {
+			got = append(got, fmt.Sprint(r["prefix"], "=", r["blobs"], "/", r["bytes"]))
+		}
+		return strings.Join(got, " ")
+	}
+	if got, want := usage("logs", 1), "logs/2021/=2/3000 logs/2022/=1/4000 logs/=4/7008"; got != want {
+		t.Errorf("DiskUsage(logs, 1) = %s, want %s", got, want)
+	}
+	if got, want := usage("", 2), "logs/=4/7008 logs/2021/=2/3000 logs/2022/=1/4000 =5/7024"; got != want {
+		t.Errorf("DiskUsage(\"\", 2) = %s, want %s", got, want)
+	}
+	if got, want := usage("logs", 3), "logs/2021/=2/3000 logs/2021/01/=1/1000 logs/2021/02/=1/2000 logs/2022/=1/4000 logs/2022/01/=1/4000 logs/=4/7008"; got != want {
+		t.Errorf("DiskUsage(logs, 3) = %s, want %s", got, want)
+	}
+	if got, want := usage("logs/", 0), "logs/=4/7008"; got != want {
+		t.Errorf("DiskUsage(logs/, 0) = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,176 @@
+package blob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/blue-eight/azgo/azgo/output"
+)
+
+// copyPollInterval is how often a copy which is still pending is checked;
+// tests shorten it.
+var copyPollInterval = time.Second
+
+// BlobVersion picks a snapshot or a version of a blob. The zero value is
+// the current blob.
+type BlobVersion struct {
+	// Snapshot is the time of a snapshot, as CreateSnapshot returns it.
+	Snapshot string `json:",omitempty"`
+	// VersionID is the ID of a version, which the service keeps when
+	// versioning is enabled on the account.
+	VersionID string `json:",omitempty"`
+}
+
+// url returns the URL of the snapshot or version v of the blob at u.
+func (v BlobVersion) url(u azblob.BlobURL) (azblob.BlobURL, error) {
+	switch {
+	case v.Snapshot != "" && v.VersionID != "":
+		return u, errors.New("pick a snapshot or a version, not both")
+	case v.Snapshot != "":
+		return u.WithSnapshot(v.Snapshot), nil
+	case v.VersionID != "":
+		return u.WithVersionID(v.VersionID), nil
+	}
+	return u, nil
+}
+
+// VersionItem is a blob, or a snapshot, version or soft-deleted copy of
+// one, as ListVersions prints it.
+type VersionItem struct {
+	Name string
+	BlobVersion
+	// Current is true for the current blob, which has no Snapshot.
+	Current       bool
+	Deleted       bool
+	ContentLength int64
+	LastModified  time.Time
+	ETag          string
+}
+
+// CreateSnapshot creates a read-only snapshot of the blob at path in the
+// container, which defaults to "main" if empty, and returns its time.
+func CreateSnapshot(ctx context.Context, container, path string) (string, error) {
+	u, err := blobURL(container, path)
+	if err != nil {
+		return "", err
+	}
+	res, err := u.CreateSnapshot(ctx, azblob.Metadata{}, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return "", err
+	}
+	return res.Snapshot(), nil
+}
+
+// ListVersions prints the blob at path in the container with its
+// snapshots, versions and soft-deleted copies as VersionItem via
+// output.Print, oldest first. The container defaults to "main" if empty.
+func ListVersions(ctx context.Context, container, path string) error {
+	if container == "" {
+		container = "main"
+	}
+	serviceURL, err := BlobFromConfig()
+	if err != nil {
+		return err
+	}
+	containerURL := serviceURL.NewContainerURL(container)
+	segment := azblob.ListBlobsSegmentOptions{
+		Prefix:  path,
+		Details: azblob.BlobListingDetails{Snapshots: true, Versions: true, Deleted: true},
+	}
+	found := false
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		list, err := containerURL.ListBlobsFlatSegment(ctx, marker, segment)
+		if err != nil {
+			return err
+		}
+		marker = list.NextMarker
+		for _, item := range list.Segment.BlobItems {
+			if item.Name != path {
+				continue
+			}
+			found = true
+			v := VersionItem{
+				Name:         item.Name,
+				BlobVersion:  BlobVersion{Snapshot: item.Snapshot},
+				Current:      item.Snapshot == "" && !item.Deleted && (item.IsCurrentVersion == nil || *item.IsCurrentVersion),
+				Deleted:      item.Deleted,
+				LastModified: item.Properties.LastModified,
+				ETag:         string(item.Properties.Etag),
+			}
+			if item.Properties.ContentLength != nil {
+				v.ContentLength = *item.Properties.ContentLength
+			}
+			if item.VersionID != nil {
+				v.VersionID = *item.VersionID
+			}
+			if err := output.Print(v); err != nil {
+				return err
+			}
+		}
+	}
+	if !found {
+		return fmt.Errorf("%s/%s has no versions, snapshots or soft-deleted copies", container, path)
+	}
+	return nil
+}
+
+// Promote makes a copy of the snapshot or version of the blob at path in
+// the container the current blob, e.g. to recover from an overwrite. The
+// container defaults to "main" if empty.
+func Promote(ctx context.Context, container, path string, version BlobVersion) error {
+	if version == (BlobVersion{}) {
+		return errors.New("pick a snapshot or a version to promote")
+	}
+	u, err := blobURL(container, path)
+	if err != nil {
+		return err
+	}
+	source, err := version.url(u)
+	if err != nil {
+		return err
+	}
+	res, err := u.StartCopyFromURL(ctx, source.URL(), nil, azblob.ModifiedAccessConditions{}, azblob.BlobAccessConditions{}, azblob.DefaultAccessTier, nil)
+	if err != nil {
+		return err
+	}
+	return waitForCopy(ctx, u, res.CopyID(), res.CopyStatus())
+}
+
+// waitForCopy waits for the copy copyID to the blob at u, whose status was
+// status, to finish, and aborts it if ctx is cancelled first.
+func waitForCopy(ctx context.Context, u azblob.BlobURL, copyID string, status azblob.CopyStatusType) error {
+	for status == azblob.CopyStatusPending {
+		select {
+		case <-ctx.Done():
+			// otherwise the service carries on copying
+			abortCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			u.AbortCopyFromURL(abortCtx, copyID, azblob.LeaseAccessConditions{})
+			return ctx.Err()
+		case <-time.After(copyPollInterval):
+		}
+		props, err := u.GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+		if err != nil {
+			return err
+		}
+		if status = props.CopyStatus(); status == azblob.CopyStatusFailed || status == azblob.CopyStatusAborted {
+			return fmt.Errorf("copy %s: %s", status, props.CopyStatusDescription())
+		}
+	}
+	return nil
+}
+
+// Undelete restores the soft-deleted blob at path in the container, and
+// its soft-deleted snapshots, which needs soft delete to be enabled on the
+// account. The container defaults to "main" if empty.
+func Undelete(ctx context.Context, container, path string) error {
+	u, err := blobURL(container, path)
+	if err != nil {
+		return err
+	}
+	_, err = u.Undelete(ctx)
+	return err
+}
@@ -0,0 +1,151 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/blue-eight/azgo/azgo/internal/testutil"
+)
+
+// download returns the snapshot or version of the blob main/report.
+func download(t *testing.T, version BlobVersion) string {
+	t.Helper()
+	out := &bytes.Buffer{}
+	stdout = out
+	defer func() { stdout = os.Stdout }()
+	if err := Download(context.Background(), "main", "report", "-", &TransferOptions{Version: version}); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+// versions returns the VersionItems ListVersions prints for main/report.
+func versions(t *testing.T) []map[string]interface{} {
+	t.Helper()
+	out := testutil.CaptureOutput(t)
+	if err := ListVersions(context.Background(), "main", "report"); err != nil {
+		t.Fatal(err)
+	}
+	return testutil.Records(t, out)
+}
+
+func TestSnapshots(t *testing.T) {
+	ctx := context.Background()
+	s := newServer(t)
+	s.SoftDelete = true
+	s.CreateContainer("main")
+
+	if err := InsertKeyValue(ctx, "main", "report", "first draft"); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := CreateSnapshot(ctx, "main", "report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := InsertKeyValue(ctx, "main", "report", "overwritten"); err != nil {
+		t.Fatal(err)
+	}
+	if got := download(t, BlobVersion{Snapshot: snapshot}); got != "first draft" {
+		t.Errorf("snapshot = %q, want the first draft", got)
+	}
+
+	got := []string{}
+	for _, v := range versions(t) {
+		got = append(got, fmt.Sprint(v["Snapshot"] != nil, v["Current"], v["Deleted"], v["ContentLength"]))
+	}
+	// the overwritten blob is kept as a soft-deleted snapshot
+	if want := "[true false false 11 true false true 11 false true false 11]"; fmt.Sprint(got) != want {
+		t.Errorf("versions = %v, want %s", got, want)
+	}
+
+	if err := Promote(ctx, "main", "report", BlobVersion{Snapshot: snapshot}); err != nil {
+		t.Fatal(err)
+	}
+	if value, _, err := Get(ctx, "main", "report"); err != nil || value != "first draft" {
+		t.Errorf("after Promote Get = %q, %v, want the first draft", value, err)
+	}
+
+	if err := Delete(ctx, "main", "report", nil); storageCode(err) != azblob.ServiceCodeSnapshotsPresent {
+		t.Errorf("Delete of a blob with snapshots error = %v, want SnapshotsPresent", err)
+	}
+	if err := Delete(ctx, "main", "report", &DeleteOptions{IncludeSnapshots: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Get(ctx, "main", "report"); storageCode(err) != azblob.ServiceCodeBlobNotFound {
+		t.Errorf("Get after Delete error = %v, want BlobNotFound", err)
+	}
+	if err := Undelete(ctx, "main", "report"); err != nil {
+		t.Fatal(err)
+	}
+	if value, _, err := Get(ctx, "main", "report"); err != nil || value != "first draft" {
+		t.Errorf("after Undelete Get = %q, %v, want the first draft", value, err)
+	}
+	if got := download(t, BlobVersion{Snapshot: snapshot}); got != "first draft" {
+		t.Errorf("snapshot after Undelete = %q, want the first draft", got)
+	}
+
+	if err := Undelete(ctx, "main", "missing"); storageCode(err) != azblob.ServiceCodeBlobNotFound {
+		t.Errorf("Undelete of a missing blob error = %v, want BlobNotFound", err)
+	}
+}
+
+func TestVersions(t *testing.T) {
+	ctx := context.Background()
+	s := newServer(t)
+	s.Versioning = true
+	s.CreateContainer("main")
+
+	for _, value := range []string{"v1", "v2", "v3"} {
+		if err := InsertKeyValue(ctx, "main", "report", value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	items := versions(t)
+	if len(items) != 3 || items[0]["Current"] != false || items[2]["Current"] != true || items[0]["VersionID"] == nil {
+		t.Fatalf("versions = %v, want 3 with the last current", items)
+	}
+	first := items[0]["VersionID"].(string)
+	if got := download(t, BlobVersion{VersionID: first}); got != "v1" {
+		t.Errorf("first version = %q, want v1", got)
+	}
+
+	// an accidental overwrite is undone by promoting the version before it
+	if err := Promote(ctx, "main", "report", BlobVersion{VersionID: first}); err != nil {
+		t.Fatal(err)
+	}
+	if value, _, err := Get(ctx, "main", "report"); err != nil || value != "v1" {
+		t.Errorf("after Promote Get = %q, %v, want v1", value, err)
+	}
+	if items := versions(t); len(items) != 4 {
+		t.Errorf("after Promote versions = %v, want 4", items)
+	}
+
+	if err := Delete(ctx, "main", "report", &DeleteOptions{Version: BlobVersion{VersionID: first}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Delete(ctx, "main", "report", nil); err != nil {
+		t.Fatal(err)
+	}
+	items = versions(t)
+	if len(items) != 3 {
+		t.Errorf("after Delete versions = %v, want the 3 which were not deleted", items)
+	}
+	for _, v := range items {
+		if v["Current"] != false || v["VersionID"] == first {
+			t.Errorf("after Delete version %v", v)
+		}
+	}
+
+	for _, version := range []BlobVersion{{}, {Snapshot: "2021-01-01T00:00:00.0000000Z", VersionID: first}} {
+		if err := Promote(ctx, "main", "report", version); err == nil {
+			t.Errorf("Promote of %+v returned no error", version)
+		}
+	}
+	if err := ListVersions(ctx, "main", "missing"); err == nil {
+		t.Error("ListVersions of a missing blob returned no error")
+	}
+}
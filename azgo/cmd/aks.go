@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/blue-eight/azgo/azgo/aks"
+	"github.com/blue-eight/azgo/azgo/output"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	subscriptionID := ""
+
+	var mainCmd = &cobra.Command{
+		Use:   "aks",
+		Short: "...",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return cmd.Usage()
+		},
+	}
+	mainCmd.PersistentFlags().StringVar(&subscriptionID, "subscription", "", "subscription ID (default from the profile, $AZURE_SUBSCRIPTION or the az CLI)")
+
+	mainCmd.AddCommand(&cobra.Command{
+		Use:   "run-command [resource-group] [cluster] [command]",
+		Short: "...",
+		Args:  cobra.MinimumNArgs(3),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			id, err := subscription(subscriptionID)
+			if err != nil {
+				return err
+			}
+			res, err := aks.RunCommand(cmd.Context(), id, args[0], args[1], strings.Join(args[2:], " "))
+			if err != nil {
+				return err
+			}
+			return output.Print(json.RawMessage(res))
+		},
+	})
+
+	rootCmd.AddCommand(mainCmd)
+
+}
@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"github.com/blue-eight/azgo/azgo/arm"
+	"github.com/blue-eight/azgo/azgo/config"
+	"github.com/spf13/cobra"
+)
+
+// subscription returns the --subscription flag if set, or else the
+// subscription from the profile or the az CLI.
+func subscription(flag string) (string, error) {
+	if flag != "" {
+		return flag, nil
+	}
+	return config.Active().ResolveSubscription()
+}
+
+func init() {
+	subscriptionID := ""
+
+	var mainCmd = &cobra.Command{
+		Use:   "arm",
+		Short: "...",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return cmd.Usage()
+		},
+	}
+	mainCmd.PersistentFlags().StringVar(&subscriptionID, "subscription", "", "subscription ID (default from the profile, $AZURE_SUBSCRIPTION or the az CLI)")
+
+	options := &arm.ListOptions{}
+	resourceListCmd := &cobra.Command{
+		Use:   "resource-list",
+		Short: "...",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			id, err := subscription(subscriptionID)
+			if err != nil {
+				return err
+			}
+			return arm.List(cmd.Context(), id, options)
+		},
+	}
+	resourceListCmd.Flags().StringVar(&options.ResourceGroup, "resource-group", "", "only list resources in this resource group")
+	resourceListCmd.Flags().StringVar(&options.Type, "type", "", "only list resources of this type, e.g. Microsoft.Compute/virtualMachines")
+	resourceListCmd.Flags().StringArrayVar(&options.Tags, "tag", nil, "only list resources with this tag, as name or name=value (repeatable)")
+	mainCmd.AddCommand(resourceListCmd)
+
+	rootCmd.AddCommand(mainCmd)
+
+}
@@ -1,9 +1,17 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"os"
+	"strings"
+	"time"
 
+	"github.com/Azure/azure-storage-blob-go/azblob"
 	"github.com/blue-eight/azgo/azgo/blob"
+	"github.com/blue-eight/azgo/azgo/config"
+	"github.com/blue-eight/azgo/azgo/output"
 	"github.com/spf13/cobra"
 )
 
@@ -20,81 +28,654 @@ func init() {
 		Use:   "container-list",
 		Short: "...",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return blob.ListContainers()
+			return blob.ListContainers(cmd.Context())
 		},
 	})
 
-	mainCmd.AddCommand(&cobra.Command{
+	containerOptions := &blob.ContainerOptions{}
+	containerCreateCmd := &cobra.Command{
 		Use:   "container-create [name]",
 		Short: "...",
 		Args:  cobra.MinimumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return blob.CreateContainer(args[0])
+			return blob.CreateContainer(cmd.Context(), args[0], containerOptions)
+		},
+	}
+	containerCreateCmd.Flags().StringVar(&containerOptions.PublicAccess, "public", "none", "anonymous read access: "+strings.Join(blob.PublicAccessLevels, ", "))
+	containerCreateCmd.Flags().StringToStringVar(&containerOptions.Metadata, "meta", nil, "metadata of the container as key=value (repeatable)")
+	mainCmd.AddCommand(containerCreateCmd)
+
+	mainCmd.AddCommand(&cobra.Command{
+		Use:   "container-show [name]",
+		Short: "...",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return blob.ShowContainer(cmd.Context(), args[0])
 		},
 	})
 
+	mainCmd.AddCommand(&cobra.Command{
+		Use:   "container-set-acl [name] [none|blob|container]",
+		Short: "...",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return blob.SetContainerAccess(cmd.Context(), args[0], args[1])
+		},
+	})
+
+	var containerMerge bool
+	containerSetMetaCmd := &cobra.Command{
+		Use:   "container-set-meta [name] [key=value...]",
+		Short: "...",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			metadata, err := blob.ParseKeyValues(args[1:])
+			if err != nil {
+				return err
+			}
+			return blob.SetContainerMetadata(cmd.Context(), args[0], metadata, containerMerge)
+		},
+	}
+	containerSetMetaCmd.Flags().BoolVar(&containerMerge, "merge", false, "only change the given keys, removing those with an empty value")
+	mainCmd.AddCommand(containerSetMetaCmd)
+
 	mainCmd.AddCommand(&cobra.Command{
 		Use:   "container-delete [name]",
 		Short: "...",
 		Args:  cobra.MinimumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return blob.DeleteContainer(args[0])
+			return blob.DeleteContainer(cmd.Context(), args[0])
 		},
 	})
 
-	mainCmd.AddCommand(&cobra.Command{
+	var ifNotExists bool
+	insertCmd := &cobra.Command{
 		Use:   "insert-kv [container] [key] [value]",
 		Short: "...",
 		Args:  cobra.MinimumNArgs(3),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return blob.InsertKeyValue(args[0], args[1], args[2])
+			if ifNotExists {
+				return blob.InsertKeyValueIfNotExists(cmd.Context(), args[0], args[1], args[2])
+			}
+			return blob.InsertKeyValue(cmd.Context(), args[0], args[1], args[2])
 		},
-	})
+	}
+	insertCmd.Flags().BoolVar(&ifNotExists, "if-not-exists", false, "fail rather than overwrite an existing key")
+	mainCmd.AddCommand(insertCmd)
 
-	mainCmd.AddCommand(&cobra.Command{
+	var showETag bool
+	getCmd := &cobra.Command{
 		Use:   "get [container] [key]",
 		Short: "...",
 		Args:  cobra.MinimumNArgs(2),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			value, err := blob.Get(args[0], args[1])
+			value, etag, err := blob.Get(cmd.Context(), args[0], args[1])
 			if err != nil {
 				return err
 			}
+			if showETag {
+				return output.Print(map[string]string{"key": args[1], "value": value, "etag": string(etag)})
+			}
 			fmt.Printf("%s\n", value)
 			return nil
 		},
-	})
+	}
+	getCmd.Flags().BoolVar(&showETag, "etag", false, "print the key, value and ETag, for use with cas")
+	mainCmd.AddCommand(getCmd)
 
 	mainCmd.AddCommand(&cobra.Command{
+		Use:   "cas [container] [key] [expected-etag] [value]",
+		Short: "...",
+		Args:  cobra.ExactArgs(4),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			etag, err := blob.CompareAndSwap(cmd.Context(), args[0], args[1], azblob.ETag(args[2]), args[3])
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s\n", etag)
+			return nil
+		},
+	})
+
+	deleteOptions := &blob.DeleteOptions{}
+	deleteCmd := &cobra.Command{
 		Use:   "delete [container] [key]",
 		Short: "...",
 		Args:  cobra.MinimumNArgs(2),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			err := blob.Delete(args[0], args[1])
+			err := blob.Delete(cmd.Context(), args[0], args[1], deleteOptions)
 			if err != nil {
 				return err
 			}
 			return nil
 		},
-	})
+	}
+	deleteCmd.Flags().BoolVar(&deleteOptions.IncludeSnapshots, "include-snapshots", false, "delete the blob's snapshots with it")
+	versionFlags(deleteCmd, &deleteOptions.Version)
+	mainCmd.AddCommand(deleteCmd)
 
-	mainCmd.AddCommand(&cobra.Command{
+	rmCmd := &cobra.Command{
+		Use:   "rm [container]",
+		Short: "...",
+		Args:  cobra.ExactArgs(1),
+	}
+	rmOptions := bulkFlags(rmCmd)
+	rmCmd.RunE = func(cmd *cobra.Command, args []string) error {
+		options, err := rmOptions()
+		if err != nil {
+			return err
+		}
+		return blob.Remove(cmd.Context(), args[0], options)
+	}
+	mainCmd.AddCommand(rmCmd)
+
+	setTierCmd := &cobra.Command{
+		Use:   "set-tier [container] [tier]",
+		Short: "...",
+		Args:  cobra.ExactArgs(2),
+	}
+	setTierOptions := bulkFlags(setTierCmd)
+	setTierCmd.RunE = func(cmd *cobra.Command, args []string) error {
+		options, err := setTierOptions()
+		if err != nil {
+			return err
+		}
+		return blob.SetTier(cmd.Context(), args[0], args[1], options)
+	}
+	mainCmd.AddCommand(setTierCmd)
+
+	listOptions := &blob.ListOptions{}
+	listCmd := &cobra.Command{
 		Use:   "list [container]",
 		Short: "...",
 		Args:  cobra.MinimumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return blob.List(args[0])
+			return blob.List(cmd.Context(), args[0], listOptions)
+		},
+	}
+	listCmd.Flags().StringVar(&listOptions.Prefix, "prefix", "", "only list blobs whose names start with this prefix")
+	listCmd.Flags().StringVar(&listOptions.Delimiter, "delimiter", "", "list virtual directories split by this delimiter, e.g. /")
+	listCmd.Flags().StringSliceVar(&listOptions.Include, "include", nil, "details to include: copy, deleted, metadata, snapshots, tags, uncommittedblobs, versions")
+	listCmd.Flags().IntVar(&listOptions.Max, "max", 0, "list at most this many items, and print the marker to resume from on stderr")
+	listCmd.Flags().StringVar(&listOptions.Marker, "marker", "", "resume a listing from this marker")
+	mainCmd.AddCommand(listCmd)
+
+	var treeDepth int
+	treeCmd := &cobra.Command{
+		Use:   "tree [container] [?prefix]",
+		Short: "...",
+		Args:  cobra.RangeArgs(1, 2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			prefix := ""
+			if len(args) == 2 {
+				prefix = args[1]
+			}
+			return blob.Tree(cmd.Context(), args[0], prefix, treeDepth)
+		},
+	}
+	treeCmd.Flags().IntVar(&treeDepth, "depth", 0, "descend at most this many directories (default all)")
+	mainCmd.AddCommand(treeCmd)
+
+	var duDepth int
+	duCmd := &cobra.Command{
+		Use:   "du [container] [?prefix]",
+		Short: "...",
+		Args:  cobra.RangeArgs(1, 2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			prefix := ""
+			if len(args) == 2 {
+				prefix = args[1]
+			}
+			return blob.DiskUsage(cmd.Context(), args[0], prefix, duDepth)
+		},
+	}
+	duCmd.Flags().IntVarP(&duDepth, "depth", "d", 1, "sum each directory down to this many levels below the prefix (0 for the total only)")
+	mainCmd.AddCommand(duCmd)
+
+	mainCmd.AddCommand(transferCommand("upload [container] [path] [file|-]", blob.Upload))
+	mainCmd.AddCommand(transferCommand("download [container] [path] [file|-]", blob.Download))
+	mainCmd.AddCommand(syncCommand())
+
+	var (
+		copyOptions       = &blob.CopyOptions{}
+		copySourceProfile string
+	)
+	copyCmd := &cobra.Command{
+		Use:   "copy [src-url] [dst-container]/[path]",
+		Short: "...",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if copySourceProfile != "" {
+				profile, err := config.Load(copySourceProfile)
+				if err != nil {
+					return err
+				}
+				copyOptions.SourceProfile = profile
+			}
+			return blob.Copy(cmd.Context(), args[0], args[1], copyOptions)
+		},
+	}
+	copyCmd.Flags().StringVar(&copySourceProfile, "source-profile", "", "profile of the source account, whose key signs a SAS for the source (default the active profile)")
+	copyCmd.Flags().BoolVar(&copyOptions.Sync, "sync", false, "copy each blob in one request, for blobs up to 256MiB, rather than waiting for the copy")
+	copyCmd.Flags().IntVar(&copyOptions.Concurrency, "concurrency", blob.DefaultConcurrency, "number of blobs copied at once")
+	copyCmd.Flags().StringVar(&copyOptions.Manifest, "manifest", "", "file recording the blobs copied, so an interrupted copy can resume")
+	mainCmd.AddCommand(copyCmd)
+
+	mainCmd.AddCommand(&cobra.Command{
+		Use:   "show [container] [path]",
+		Short: "...",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return blob.Show(cmd.Context(), args[0], args[1])
+		},
+	})
+
+	var merge bool
+	setMetadataCmd := &cobra.Command{
+		Use:   "set-metadata [container] [path] [key=value...]",
+		Short: "...",
+		Args:  cobra.MinimumNArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			metadata, err := blob.ParseKeyValues(args[2:])
+			if err != nil {
+				return err
+			}
+			return blob.SetMetadata(cmd.Context(), args[0], args[1], metadata, merge)
+		},
+	}
+	setMetadataCmd.Flags().BoolVar(&merge, "merge", false, "only change the given keys, removing those with an empty value")
+	mainCmd.AddCommand(setMetadataCmd)
+
+	headers := blob.Headers{}
+	setHeadersCmd := &cobra.Command{
+		Use:   "set-headers [container] [path]",
+		Short: "...",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return blob.SetHeaders(cmd.Context(), args[0], args[1], headers)
+		},
+	}
+	setHeadersCmd.Flags().StringVar(&headers.ContentType, "content-type", "", "Content-Type, e.g. application/json")
+	setHeadersCmd.Flags().StringVar(&headers.CacheControl, "cache-control", "", "Cache-Control, e.g. max-age=3600")
+	setHeadersCmd.Flags().StringVar(&headers.ContentEncoding, "content-encoding", "", "Content-Encoding, e.g. gzip")
+	setHeadersCmd.Flags().StringVar(&headers.ContentLanguage, "content-language", "", "Content-Language, e.g. en-GB")
+	setHeadersCmd.Flags().StringVar(&headers.ContentDisposition, "content-disposition", "", "Content-Disposition, e.g. attachment")
+	mainCmd.AddCommand(setHeadersCmd)
+
+	mainCmd.AddCommand(&cobra.Command{
+		Use:   "set-tags [container] [path] [key=value...]",
+		Short: "...",
+		Args:  cobra.MinimumNArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			tags, err := blob.ParseKeyValues(args[2:])
+			if err != nil {
+				return err
+			}
+			return blob.SetTags(cmd.Context(), args[0], args[1], tags)
+		},
+	})
+
+	mainCmd.AddCommand(&cobra.Command{
+		Use:   "find [expression]",
+		Short: "...",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return blob.FindByTags(cmd.Context(), args[0])
+		},
+	})
+
+	sasOptions := &blob.SASOptions{}
+	sasCmd := &cobra.Command{
+		Use:   "sas [container] [?blob]",
+		Short: "...",
+		Args:  cobra.RangeArgs(1, 2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name := ""
+			if len(args) == 2 {
+				name = args[1]
+			}
+			sasURL, err := blob.SASURL(args[0], name, sasOptions)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s\n", sasURL)
+			return nil
+		},
+	}
+	sasCmd.Flags().StringVar(&sasOptions.Permissions, "permissions", "", "what the SAS allows, from racwdxlt, e.g. rw (default r, or the policy's)")
+	sasCmd.Flags().DurationVar(&sasOptions.Expiry, "expiry", 0, "how long the SAS lasts, e.g. 1h or 168h (default 1h, or the policy's)")
+	sasCmd.Flags().StringVar(&sasOptions.IPRange, "ip", "", "only allow this client address or start-end range")
+	sasCmd.Flags().StringVar(&sasOptions.Protocol, "protocol", "https", "https, or https,http")
+	sasCmd.Flags().StringVar(&sasOptions.Policy, "policy", "", "stored access policy of the container to use, so the SAS can be revoked")
+	mainCmd.AddCommand(sasCmd)
+
+	mainCmd.AddCommand(&cobra.Command{
+		Use:   "policy-list [container]",
+		Short: "...",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return blob.ListAccessPolicies(cmd.Context(), args[0])
+		},
+	})
+
+	var (
+		policyPermissions string
+		policyExpiry      time.Duration
+	)
+	policySetCmd := &cobra.Command{
+		Use:   "policy-set [container] [id]",
+		Short: "...",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			policy := blob.AccessPolicy{ID: args[1], Permissions: policyPermissions}
+			if policyExpiry > 0 {
+				expiry := time.Now().UTC().Add(policyExpiry).Truncate(time.Second)
+				policy.Expiry = &expiry
+			}
+			return blob.SetAccessPolicy(cmd.Context(), args[0], policy)
+		},
+	}
+	policySetCmd.Flags().StringVar(&policyPermissions, "permissions", "r", "what a SAS using the policy allows, from racwdl")
+	policySetCmd.Flags().DurationVar(&policyExpiry, "expiry", 0, "how long the policy lasts, e.g. 720h (default each SAS sets its own expiry)")
+	mainCmd.AddCommand(policySetCmd)
+
+	mainCmd.AddCommand(&cobra.Command{
+		Use:   "policy-delete [container] [id]",
+		Short: "...",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return blob.DeleteAccessPolicy(cmd.Context(), args[0], args[1])
 		},
 	})
 
+	mainCmd.AddCommand(&cobra.Command{
+		Use:   "snapshot [container] [path]",
+		Short: "...",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			snapshot, err := blob.CreateSnapshot(cmd.Context(), args[0], args[1])
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s\n", snapshot)
+			return nil
+		},
+	})
+
+	mainCmd.AddCommand(&cobra.Command{
+		Use:   "versions [container] [path]",
+		Short: "...",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return blob.ListVersions(cmd.Context(), args[0], args[1])
+		},
+	})
+
+	promoteVersion := &blob.BlobVersion{}
+	promoteCmd := &cobra.Command{
+		Use:   "promote [container] [path]",
+		Short: "...",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return blob.Promote(cmd.Context(), args[0], args[1], *promoteVersion)
+		},
+	}
+	versionFlags(promoteCmd, promoteVersion)
+	mainCmd.AddCommand(promoteCmd)
+
+	mainCmd.AddCommand(&cobra.Command{
+		Use:   "undelete [container] [path]",
+		Short: "...",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return blob.Undelete(cmd.Context(), args[0], args[1])
+		},
+	})
+
+	var (
+		appendMaxSize string
+		appendOptions = &blob.AppendOptions{}
+	)
+	appendCmd := &cobra.Command{
+		Use:   "append [container] [name]",
+		Short: "...",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			size, err := blob.ParseSize(appendMaxSize)
+			if err != nil {
+				return fmt.Errorf("--max-size: %w", err)
+			}
+			appendOptions.MaxSize = size
+			return blob.Append(cmd.Context(), args[0], args[1], appendOptions)
+		},
+	}
+	appendCmd.Flags().StringVar(&appendMaxSize, "max-size", "1GiB", "size after which to roll over to name.1, name.2 and so on")
+	appendCmd.Flags().DurationVar(&appendOptions.FlushInterval, "flush-interval", blob.DefaultAppendFlushInterval, "longest a line waits to be appended")
+	mainCmd.AddCommand(appendCmd)
+
+	tailOptions := &blob.TailOptions{}
+	tailCmd := &cobra.Command{
+		Use:   "tail [container] [name]",
+		Short: "...",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return blob.Tail(cmd.Context(), args[0], args[1], tailOptions)
+		},
+	}
+	tailCmd.Flags().BoolVarP(&tailOptions.Follow, "follow", "f", false, "keep printing what is appended, following rollovers")
+	tailCmd.Flags().IntVarP(&tailOptions.Lines, "lines", "n", 10, "number of last lines to print first")
+	mainCmd.AddCommand(tailCmd)
+
+	mainCmd.AddCommand(archiveCommand("archive [container]/[prefix]", blob.Archive))
+	mainCmd.AddCommand(archiveCommand("extract [container]/[prefix]", blob.Extract))
+
+	var (
+		serveOptions = &blob.ServeOptions{}
+		serveAddr    string
+	)
+	serveCmd := &cobra.Command{
+		Use:         "serve [container]",
+		Short:       "...",
+		Args:        cobra.ExactArgs(1),
+		Annotations: map[string]string{stopsOnSignal: "true"},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			err := blob.Serve(cmd.Context(), args[0], serveAddr, serveOptions)
+			if errors.Is(err, context.Canceled) {
+				// a signal is how serve is meant to stop
+				return nil
+			}
+			return err
+		},
+	}
+	serveCmd.Flags().StringVar(&serveAddr, "addr", "localhost:8080", "address to listen on, e.g. :8080 for every interface")
+	serveCmd.Flags().BoolVar(&serveOptions.Writable, "writable", false, "let clients upload blobs with PUT and delete them with DELETE")
+	mainCmd.AddCommand(serveCmd)
+
+	lockOptions := &blob.LockOptions{}
+	lockCmd := &cobra.Command{
+		Use:   "lock [container] [name] -- [command...]",
+		Short: "...",
+		Args:  cobra.MinimumNArgs(3),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if cmd.ArgsLenAtDash() != 2 {
+				return fmt.Errorf("the command must follow --, e.g. %s main nightly -- ./backup.sh", cmd.CommandPath())
+			}
+			return blob.RunLocked(cmd.Context(), args[0], args[1], lockOptions, args[2:])
+		},
+	}
+	lockCmd.Flags().DurationVar(&lockOptions.Duration, "duration", blob.DefaultLockDuration, "lease duration from 15s to 60s, after which a dead holder's lock can be taken")
+	lockCmd.Flags().DurationVar(&lockOptions.Wait, "wait", 0, "how long to wait for another holder, e.g. 5m (default fail straight away)")
+	mainCmd.AddCommand(lockCmd)
+
 	mainCmd.AddCommand(&cobra.Command{
 		Use:   "test",
 		Short: "...",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return blob.Test()
+			return blob.Test(cmd.Context())
 		},
 	})
 
 	rootCmd.AddCommand(mainCmd)
 
 }
+
+// versionFlags adds the --snapshot and --version-id flags, which pick the
+// snapshot or version of a blob cmd acts on, to cmd.
+func versionFlags(cmd *cobra.Command, v *blob.BlobVersion) {
+	cmd.Flags().StringVar(&v.Snapshot, "snapshot", "", "snapshot of the blob, as listed by versions")
+	cmd.Flags().StringVar(&v.VersionID, "version-id", "", "version of the blob, as listed by versions")
+}
+
+// transferFlags adds the flags for blob.TransferOptions to cmd, and
+// returns a function which makes the options from them.
+func transferFlags(cmd *cobra.Command) func() (*blob.TransferOptions, error) {
+	var (
+		blockSize   string
+		concurrency int
+		contentType string
+		metadata    map[string]string
+		tags        map[string]string
+		noProgress  bool
+		version     blob.BlobVersion
+		compression string
+		keyFile     string
+	)
+	cmd.Flags().StringVar(&blockSize, "block-size", "8MiB", "size of each block transferred, e.g. 4MiB or 100MiB")
+	cmd.Flags().IntVar(&concurrency, "concurrency", blob.DefaultConcurrency, "number of blocks transferred at once")
+	if strings.HasPrefix(cmd.Use, "upload") {
+		cmd.Flags().StringVar(&contentType, "content-type", "", "content type of the blob (default detected from the name or data)")
+		cmd.Flags().StringToStringVar(&metadata, "metadata", nil, "metadata of the blob as key=value (repeatable)")
+		cmd.Flags().StringToStringVar(&tags, "tag", nil, "index tag of the blob as key=value (repeatable)")
+		cmd.Flags().StringVar(&compression, "compress", "", "compress the blob with gzip or zstd (default blob_compression of the profile)")
+	}
+	if strings.HasPrefix(cmd.Use, "download") {
+		versionFlags(cmd, &version)
+	}
+	if !strings.HasPrefix(cmd.Use, "sync") {
+		cmd.Flags().StringVar(&keyFile, "key-file", "", "file of the 32-byte key which encrypts the blob on the client side (default blob_encryption_key_file of the profile)")
+	}
+	cmd.Flags().BoolVar(&noProgress, "no-progress", false, "do not show progress on stderr")
+	return func() (*blob.TransferOptions, error) {
+		size, err := blob.ParseSize(blockSize)
+		if err != nil {
+			return nil, fmt.Errorf("--block-size: %w", err)
+		}
+		options := &blob.TransferOptions{
+			BlockSize:   size,
+			Concurrency: concurrency,
+			ContentType: contentType,
+			Metadata:    metadata,
+			Tags:        tags,
+			Version:     version,
+			Compression: compression,
+		}
+		if keyFile != "" {
+			options.Encryption = &blob.Encryption{KeyFile: keyFile}
+		}
+		if !noProgress {
+			options.Progress = os.Stderr
+		}
+		return options, nil
+	}
+}
+
+// bulkFlags adds the flags for blob.BulkOptions to cmd, rm or set-tier,
+// and returns a function which makes the options from them.
+func bulkFlags(cmd *cobra.Command) func() (*blob.BulkOptions, error) {
+	var (
+		options    = &blob.BulkOptions{}
+		olderThan  string
+		noProgress bool
+	)
+	cmd.Flags().StringVar(&options.Prefix, "prefix", "", "only blobs whose names start with this prefix")
+	cmd.Flags().StringVar(&olderThan, "older-than", "", "only blobs last modified longer ago than this, e.g. 30d, 2w or 36h")
+	cmd.Flags().StringToStringVar(&options.Tags, "tag", nil, "only blobs with this index tag as key=value (repeatable)")
+	if strings.HasPrefix(cmd.Use, "rm") {
+		cmd.Flags().BoolVar(&options.IncludeSnapshots, "include-snapshots", false, "delete each blob's snapshots with it")
+		cmd.Flags().BoolVar(&options.All, "all", false, "remove every blob in the container when no other filter is given")
+	}
+	cmd.Flags().BoolVar(&options.DryRun, "dry-run", false, "print the blobs which match without changing them")
+	cmd.Flags().IntVar(&options.Concurrency, "concurrency", blob.DefaultConcurrency, "number of batches of 256 blobs sent at once")
+	cmd.Flags().BoolVar(&noProgress, "no-progress", false, "do not show progress on stderr")
+	return func() (*blob.BulkOptions, error) {
+		if olderThan != "" {
+			age, err := blob.ParseAge(olderThan)
+			if err != nil {
+				return nil, fmt.Errorf("--older-than: %w", err)
+			}
+			options.OlderThan = age
+		}
+		if !noProgress {
+			options.Progress = os.Stderr
+		}
+		return options, nil
+	}
+}
+
+// transferCommand returns an upload or download command for transfer.
+func transferCommand(use string, transfer func(ctx context.Context, container, path, file string, options *blob.TransferOptions) error) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   use,
+		Short: "...",
+		Args:  cobra.ExactArgs(3),
+	}
+	transferOptions := transferFlags(cmd)
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		options, err := transferOptions()
+		if err != nil {
+			return err
+		}
+		return transfer(cmd.Context(), args[0], args[1], args[2], options)
+	}
+	return cmd
+}
+
+// archiveCommand returns the archive or extract command for run.
+func archiveCommand(use string, run func(ctx context.Context, remote string, options *blob.ArchiveOptions) error) *cobra.Command {
+	var (
+		options   = &blob.ArchiveOptions{}
+		blockSize string
+	)
+	cmd := &cobra.Command{
+		Use:   use,
+		Short: "...",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			size, err := blob.ParseSize(blockSize)
+			if err != nil {
+				return fmt.Errorf("--block-size: %w", err)
+			}
+			options.BlockSize = size
+			return run(cmd.Context(), args[0], options)
+		},
+	}
+	if strings.HasPrefix(use, "archive") {
+		cmd.Flags().StringVar(&options.Format, "format", "tar.gz", "archive format: "+strings.Join(blob.ArchiveFormats, ", "))
+	}
+	cmd.Flags().StringVar(&blockSize, "block-size", "8MiB", "blobs up to this size are transferred concurrently, and larger ones in blocks of it")
+	cmd.Flags().IntVar(&options.Concurrency, "concurrency", blob.DefaultConcurrency, "number of blobs or blocks transferred at once")
+	return cmd
+}
+
+func syncCommand() *cobra.Command {
+	options := &blob.SyncOptions{}
+	cmd := &cobra.Command{
+		Use:   "sync [local-dir] [container]/[prefix]",
+		Short: "...",
+		Args:  cobra.ExactArgs(2),
+	}
+	transferOptions := transferFlags(cmd)
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		var err error
+		if options.Transfer, err = transferOptions(); err != nil {
+			return err
+		}
+		return blob.Sync(cmd.Context(), args[0], args[1], options)
+	}
+	cmd.Flags().BoolVar(&options.Download, "download", false, "sync the local directory from the container instead")
+	cmd.Flags().BoolVar(&options.Delete, "delete", false, "delete files or blobs on the destination which are not on the source")
+	cmd.Flags().BoolVar(&options.DryRun, "dry-run", false, "print the changes without making them")
+	cmd.Flags().StringArrayVar(&options.Include, "include", nil, "only sync paths matching this glob, e.g. '*.json' (repeatable)")
+	cmd.Flags().StringArrayVar(&options.Exclude, "exclude", nil, "do not sync paths matching this glob, e.g. 'tmp/*' (repeatable)")
+	return cmd
+}
@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/blue-eight/azgo/azgo/config"
+	"github.com/blue-eight/azgo/azgo/output"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	var mainCmd = &cobra.Command{
+		Use:   "config",
+		Short: "...",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return cmd.Usage()
+		},
+	}
+
+	mainCmd.AddCommand(&cobra.Command{
+		Use:   "path",
+		Short: "...",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			fmt.Printf("%s\n", config.Path())
+			return nil
+		},
+	})
+
+	mainCmd.AddCommand(&cobra.Command{
+		Use:   "profile-list",
+		Short: "...",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := config.Read(config.Path())
+			if err != nil {
+				return err
+			}
+			for _, name := range c.ProfileNames() {
+				err := output.Print(map[string]interface{}{
+					"name":    name,
+					"default": name == c.DefaultProfile,
+				})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+
+	mainCmd.AddCommand(&cobra.Command{
+		Use:   "show",
+		Short: "...",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			profile := config.Active()
+			return output.Print(map[string]interface{}{
+				"name":     profile.Name,
+				"settings": profile.Redacted(),
+			})
+		},
+	})
+
+	rootCmd.AddCommand(mainCmd)
+
+}
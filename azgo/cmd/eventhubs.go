@@ -19,7 +19,7 @@ func init() {
 		Short: "...",
 		Args:  cobra.MinimumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return eventhubs.Send(args[0])
+			return eventhubs.Send(cmd.Context(), args[0])
 		},
 	})
 
@@ -27,7 +27,7 @@ func init() {
 		Use:   "send-stdin",
 		Short: "...",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return eventhubs.SendStdin()
+			return eventhubs.SendStdin(cmd.Context())
 		},
 	})
 
@@ -35,7 +35,7 @@ func init() {
 		Use:   "receive",
 		Short: "...",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return eventhubs.Receive()
+			return eventhubs.Receive(cmd.Context())
 		},
 	})
 
@@ -43,7 +43,7 @@ func init() {
 		Use:   "test",
 		Short: "...",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return eventhubs.Test()
+			return eventhubs.Test(cmd.Context())
 		},
 	})
 
@@ -16,5 +16,5 @@ func init() {
 }
 
 func Hello(cmd *cobra.Command, args []string) error {
-	return table.ListTables()
+	return table.ListTables(cmd.Context())
 }
@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/blue-eight/azgo/azgo/kv"
+	"github.com/blue-eight/azgo/azgo/output"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	backend := ""
+	name := ""
+
+	var mainCmd = &cobra.Command{
+		Use:   "kv",
+		Short: "...",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return cmd.Usage()
+		},
+	}
+	mainCmd.PersistentFlags().StringVar(&backend, "backend", "blob", "key/value backend: blob, table or postgres")
+	mainCmd.PersistentFlags().StringVar(&name, "name", "", "container or table holding the keys (defaults to main for blob, kv otherwise)")
+
+	mainCmd.AddCommand(&cobra.Command{
+		Use:   "put [key] [value]",
+		Short: "...",
+		Args:  cobra.MinimumNArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := kv.New(backend, name)
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+			return store.Put(cmd.Context(), args[0], args[1])
+		},
+	})
+
+	mainCmd.AddCommand(&cobra.Command{
+		Use:   "get [key]",
+		Short: "...",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := kv.New(backend, name)
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+			value, err := store.Get(cmd.Context(), args[0])
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s\n", value)
+			return nil
+		},
+	})
+
+	mainCmd.AddCommand(&cobra.Command{
+		Use:   "delete [key]",
+		Short: "...",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := kv.New(backend, name)
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+			return store.Delete(cmd.Context(), args[0])
+		},
+	})
+
+	mainCmd.AddCommand(&cobra.Command{
+		Use:   "list [?prefix]",
+		Short: "...",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			prefix := ""
+			if len(args) == 1 {
+				prefix = args[0]
+			}
+			store, err := kv.New(backend, name)
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+			keys, err := store.List(cmd.Context(), prefix)
+			if err != nil {
+				return err
+			}
+			for _, key := range keys {
+				if err := output.Print(map[string]string{"key": key}); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+
+	mainCmd.AddCommand(&cobra.Command{
+		Use:   "exists [key]",
+		Short: "...",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := kv.New(backend, name)
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+			exists, err := store.Exists(cmd.Context(), args[0])
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%t\n", exists)
+			return nil
+		},
+	})
+
+	rootCmd.AddCommand(mainCmd)
+
+}
@@ -18,7 +18,7 @@ func init() {
 		Use:   "table-list",
 		Short: "...",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return postgres.ListTables()
+			return postgres.ListTables(cmd.Context())
 		},
 	})
 
@@ -33,7 +33,7 @@ func init() {
 					valueType = args[1]
 				}
 			}
-			return postgres.CreateTable(args[0], valueType)
+			return postgres.CreateTable(cmd.Context(), args[0], valueType)
 		},
 	})
 
@@ -42,7 +42,7 @@ func init() {
 		Short: "...",
 		Args:  cobra.MinimumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return postgres.DeleteTable(args[0])
+			return postgres.DeleteTable(cmd.Context(), args[0])
 		},
 	})
 
@@ -52,7 +52,7 @@ func init() {
 		Args:  cobra.MinimumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			// TODO: consider making batchSize configurable here
-			return postgres.InsertStdinBulk(args[0], 100)
+			return postgres.InsertStdinBulk(cmd.Context(), args[0], 100)
 		},
 	})
 
@@ -61,7 +61,7 @@ func init() {
 		Short: "...",
 		Args:  cobra.MinimumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return postgres.QueryString(args[0])
+			return postgres.QueryString(cmd.Context(), args[0])
 		},
 	})
 
@@ -70,7 +70,7 @@ func init() {
 		Short: "...",
 		Args:  cobra.MinimumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return postgres.QueryJSON(args[0])
+			return postgres.QueryJSON(cmd.Context(), args[0])
 		},
 	})
 
@@ -79,7 +79,7 @@ func init() {
 		Short: "...",
 		Args:  cobra.MinimumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return postgres.QueryKeyValue(args[0])
+			return postgres.QueryKeyValue(cmd.Context(), args[0])
 		},
 	})
 
@@ -87,7 +87,7 @@ func init() {
 		Use:   "test",
 		Short: "...",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return postgres.Test()
+			return postgres.Test(cmd.Context())
 		},
 	})
 
@@ -1,24 +1,111 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/blue-eight/azgo/azgo/config"
+	"github.com/blue-eight/azgo/azgo/output"
+	"github.com/blue-eight/azgo/azgo/trace"
 	"github.com/spf13/cobra"
 )
 
+var (
+	profileName  string
+	outputFormat string
+	columns      []string
+	timeout      time.Duration
+	traceHTTP    bool
+
+	// commandCtx is the context passed to the running command, including
+	// any --timeout, so Execute can tell why it was cancelled.
+	commandCtx    context.Context
+	cancelTimeout context.CancelFunc = func() {}
+)
+
+// stopsOnSignal is the Annotations key which marks a command, such as blob
+// serve, that runs until it is interrupted, so a signal ends it without an
+// error.
+const stopsOnSignal = "stops-on-signal"
+
 var rootCmd = &cobra.Command{
 	Use:   "cli",
 	Short: "...",
 	Long:  ``,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		profile, err := config.Load(profileName)
+		if err != nil {
+			return err
+		}
+		config.SetActive(profile)
+		if traceHTTP {
+			trace.SetOutput(os.Stderr)
+		}
+		if timeout > 0 {
+			ctx, cancel := context.WithTimeout(cmd.Context(), timeout)
+			cancelTimeout = cancel
+			cmd.SetContext(ctx)
+		}
+		commandCtx = cmd.Context()
+		return output.Configure(outputFormat, columns)
+	},
 	Run: func(cmd *cobra.Command, args []string) {
 		cmd.Usage()
 	},
 }
 
+func init() {
+	rootCmd.PersistentFlags().StringVar(&profileName, "profile", "", "profile from ~/.config/azgo/config.yaml (default $AZGO_PROFILE or default_profile)")
+	rootCmd.PersistentFlags().StringVarP(&outputFormat, "output", "o", output.JSONL, "output format: "+strings.Join(output.Formats, ", "))
+	rootCmd.PersistentFlags().StringSliceVar(&columns, "columns", nil, "comma-separated fields to output, e.g. Name,Properties.ContentLength")
+	rootCmd.PersistentFlags().DurationVar(&timeout, "timeout", 0, "cancel the command after this long, e.g. 30s or 5m (default no timeout)")
+	rootCmd.PersistentFlags().BoolVar(&traceHTTP, "trace", false, "log each HTTP request to Azure as JSON to stderr")
+}
+
+// Execute runs the root command with a context which is cancelled on
+// SIGINT or SIGTERM, or after --timeout. Every command passes this context
+// down, so listings, queries and pagers stop at the next request, and the
+// process exits with 130 even if the command returns no error. A second
+// signal kills the process straight away.
 func Execute() {
-	if err := rootCmd.Execute(); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	cmd, err := rootCmd.ExecuteContextC(ctx)
+	cancelTimeout()
+	// records printed before an error are still flushed, as they are for jsonl
+	if flushErr := output.Flush(); err == nil {
+		err = flushErr
+	}
+
+	code := 1
+	interrupted := ctx.Err() != nil
+	stop()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil && interrupted && (cmd == nil || cmd.Annotations[stopsOnSignal] == ""):
+		err, code = errors.New("interrupted"), 130
+	case err == nil:
+		return
+	case errors.As(err, &exitErr) && exitErr.ExitCode() > 0:
+		// a command run by azgo, e.g. by blob lock, which failed
+		code = exitErr.ExitCode()
+	case interrupted:
+		err = fmt.Errorf("interrupted: %w", err)
+		code = 130
+	case commandCtx != nil && errors.Is(commandCtx.Err(), context.DeadlineExceeded):
+		err = fmt.Errorf("timed out after %s: %w", timeout, err)
 	}
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(code)
 }
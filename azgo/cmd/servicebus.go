@@ -20,7 +20,7 @@ func init() {
 		Use:   "queue-list",
 		Short: "...",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return servicebus.ListQueues()
+			return servicebus.ListQueues(cmd.Context())
 		},
 	})
 
@@ -29,7 +29,7 @@ func init() {
 		Short: "...",
 		Args:  cobra.MinimumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return servicebus.CreateQueue(args[0])
+			return servicebus.CreateQueue(cmd.Context(), args[0])
 		},
 	})
 
@@ -38,7 +38,7 @@ func init() {
 		Short: "...",
 		Args:  cobra.MinimumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return servicebus.DeleteQueue(args[0])
+			return servicebus.DeleteQueue(cmd.Context(), args[0])
 		},
 	})
 
@@ -47,7 +47,7 @@ func init() {
 		Short: "...",
 		Args:  cobra.MinimumNArgs(2),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return servicebus.Send(args[0], args[1])
+			return servicebus.Send(cmd.Context(), args[0], args[1])
 		},
 	})
 
@@ -56,7 +56,7 @@ func init() {
 		Short: "...",
 		Args:  cobra.MinimumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			val, err := servicebus.Receive(args[0])
+			val, err := servicebus.Receive(cmd.Context(), args[0])
 			if err != nil {
 				return err
 			}
@@ -69,7 +69,7 @@ func init() {
 		Use:   "test",
 		Short: "...",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return servicebus.Test()
+			return servicebus.Test(cmd.Context())
 		},
 	})
 
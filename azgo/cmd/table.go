@@ -1,9 +1,7 @@
 package cmd
 
 import (
-	"encoding/json"
-	"fmt"
-
+	"github.com/blue-eight/azgo/azgo/output"
 	"github.com/blue-eight/azgo/azgo/table"
 	"github.com/spf13/cobra"
 )
@@ -21,7 +19,7 @@ func init() {
 		Use:   "table-list",
 		Short: "...",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return table.ListTables()
+			return table.ListTables(cmd.Context())
 		},
 	})
 
@@ -30,7 +28,7 @@ func init() {
 		Short: "...",
 		Args:  cobra.MinimumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return table.CreateTable(args[0])
+			return table.CreateTable(cmd.Context(), args[0])
 		},
 	})
 
@@ -39,7 +37,7 @@ func init() {
 		Short: "...",
 		Args:  cobra.MinimumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return table.DeleteTable(args[0])
+			return table.DeleteTable(cmd.Context(), args[0])
 		},
 	})
 
@@ -48,7 +46,7 @@ func init() {
 		Short: "...",
 		Args:  cobra.MinimumNArgs(3),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return table.InsertKeyValue(args[0], args[1], args[2])
+			return table.InsertKeyValue(cmd.Context(), args[0], args[1], args[2])
 		},
 	})
 
@@ -57,7 +55,7 @@ func init() {
 		Short: "...",
 		Args:  cobra.MinimumNArgs(3),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return table.UpsertKeyValue(args[0], args[1], args[2])
+			return table.UpsertKeyValue(cmd.Context(), args[0], args[1], args[2])
 		},
 	})
 
@@ -66,7 +64,7 @@ func init() {
 		Short: "...",
 		Args:  cobra.MinimumNArgs(2),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return table.InsertJSON(args[0], []byte(args[1]))
+			return table.InsertJSON(cmd.Context(), args[0], []byte(args[1]))
 		},
 	})
 
@@ -75,7 +73,7 @@ func init() {
 		Short: "...",
 		Args:  cobra.MinimumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return table.InsertStdin(args[0])
+			return table.InsertStdin(cmd.Context(), args[0])
 		},
 	})
 
@@ -84,16 +82,11 @@ func init() {
 		Short: "...",
 		Args:  cobra.MinimumNArgs(3),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			resp, err := table.Get(args[0], args[1], args[2])
-			if err != nil {
-				return err
-			}
-			b, err := json.Marshal(resp)
+			resp, err := table.Get(cmd.Context(), args[0], args[1], args[2])
 			if err != nil {
 				return err
 			}
-			fmt.Printf("%s\n", b)
-			return nil
+			return output.Print(resp)
 		},
 	})
 
@@ -102,16 +95,11 @@ func init() {
 		Short: "...",
 		Args:  cobra.MinimumNArgs(3),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			resp, err := table.Delete(args[0], args[1], args[2])
-			if err != nil {
-				return err
-			}
-			b, err := json.Marshal(resp)
+			resp, err := table.Delete(cmd.Context(), args[0], args[1], args[2])
 			if err != nil {
 				return err
 			}
-			fmt.Printf("%s\n", b)
-			return nil
+			return output.Print(resp)
 		},
 	})
 
@@ -124,7 +112,7 @@ func init() {
 			if len(args) == 2 {
 				filter = args[1]
 			}
-			return table.Query(args[0], filter)
+			return table.Query(cmd.Context(), args[0], filter)
 		},
 	})
 
@@ -133,7 +121,7 @@ func init() {
 		Short: "...",
 		Args:  cobra.MinimumNArgs(2),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return table.QueryDelete(args[0], args[1])
+			return table.QueryDelete(cmd.Context(), args[0], args[1])
 		},
 	})
 
@@ -0,0 +1,67 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// azureCLIDir returns the directory in which the az CLI keeps its profile:
+// $AZURE_CONFIG_DIR if set, or else ~/.azure.
+func azureCLIDir() string {
+	if dir := os.Getenv("AZURE_CONFIG_DIR"); dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".azure"
+	}
+	return filepath.Join(home, ".azure")
+}
+
+// AzureCLISubscription returns the ID of the default subscription in the
+// az CLI profile, i.e. the one shown by `az account show`.
+func AzureCLISubscription() (string, error) {
+	path := filepath.Join(azureCLIDir(), "azureProfile.json")
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("%s not found: run az login", path)
+	}
+	if err != nil {
+		return "", err
+	}
+	// the az CLI writes the file with a UTF-8 byte order mark
+	b = bytes.TrimPrefix(b, []byte("\xef\xbb\xbf"))
+
+	profile := struct {
+		Subscriptions []struct {
+			ID        string `json:"id"`
+			IsDefault bool   `json:"isDefault"`
+		} `json:"subscriptions"`
+	}{}
+	if err := json.Unmarshal(b, &profile); err != nil {
+		return "", fmt.Errorf("%s: %w", path, err)
+	}
+	for _, s := range profile.Subscriptions {
+		if s.IsDefault {
+			return s.ID, nil
+		}
+	}
+	return "", fmt.Errorf("%s has no default subscription: run az account set", path)
+}
+
+// ResolveSubscription returns p.Subscription or, if it is empty, the
+// default subscription of the az CLI.
+func (p *Profile) ResolveSubscription() (string, error) {
+	if p.Subscription != "" {
+		return p.Subscription, nil
+	}
+	id, err := AzureCLISubscription()
+	if err != nil {
+		return "", fmt.Errorf("%w; the az CLI default was not found either: %v", Missing("subscription"), err)
+	}
+	return id, nil
+}
@@ -0,0 +1,42 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testAzureProfile = "\xef\xbb\xbf" + `{"installationId":"1","subscriptions":[
+  {"id":"11111111-1111-1111-1111-111111111111","name":"dev","isDefault":false},
+  {"id":"22222222-2222-2222-2222-222222222222","name":"prod","isDefault":true}
+]}`
+
+func TestResolveSubscription(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("AZURE_CONFIG_DIR", dir)
+	if err := os.WriteFile(filepath.Join(dir, "azureProfile.json"), []byte(testAzureProfile), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := (&Profile{}).ResolveSubscription()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "22222222-2222-2222-2222-222222222222" {
+		t.Errorf("ResolveSubscription from the az CLI = %q, want the default subscription", id)
+	}
+
+	id, err = (&Profile{Subscription: "from-profile"}).ResolveSubscription()
+	if err != nil || id != "from-profile" {
+		t.Errorf("ResolveSubscription = %q, %v, want the profile's subscription", id, err)
+	}
+}
+
+func TestResolveSubscriptionMissing(t *testing.T) {
+	t.Setenv("AZURE_CONFIG_DIR", t.TempDir())
+	_, err := (&Profile{}).ResolveSubscription()
+	if err == nil || !strings.Contains(err.Error(), "AZURE_SUBSCRIPTION") || !strings.Contains(err.Error(), "az login") {
+		t.Errorf("ResolveSubscription without a subscription error = %v", err)
+	}
+}
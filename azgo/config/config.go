@@ -0,0 +1,246 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Profile holds the settings for a single environment (e.g. dev, staging
+// or prod). Any field can be overridden by its environment variable, which
+// is listed next to it.
+type Profile struct {
+	Name string `yaml:"-" json:"-"`
+
+	StorageAccountName string `yaml:"storage_account_name,omitempty" json:"storage_account_name,omitempty"` // AZGO_STORAGE_ACCOUNT_NAME
+	StorageAccountKey  string `yaml:"storage_account_key,omitempty" json:"storage_account_key,omitempty"`   // AZGO_STORAGE_ACCOUNT_KEY
+
+	// StorageConnectionString takes precedence over the account name and key,
+	// and BlobEndpoint replaces the default https://{account}.blob.core.windows.net,
+	// which lets us point the blob package at Azurite or another emulator.
+	StorageConnectionString string `yaml:"storage_connection_string,omitempty" json:"storage_connection_string,omitempty"` // AZGO_STORAGE_CONNECTION_STRING
+	BlobEndpoint            string `yaml:"blob_endpoint,omitempty" json:"blob_endpoint,omitempty"`                         // AZGO_BLOB_ENDPOINT
+
+	// BlobEncryptionKeyFile or BlobEncryptionPassphrase turns on client-side
+	// encryption of blob uploads and key-values, and BlobCompression
+	// ("gzip" or "zstd") compresses them.
+	BlobEncryptionKeyFile    string `yaml:"blob_encryption_key_file,omitempty" json:"blob_encryption_key_file,omitempty"`     // AZGO_BLOB_ENCRYPTION_KEY_FILE
+	BlobEncryptionPassphrase string `yaml:"blob_encryption_passphrase,omitempty" json:"blob_encryption_passphrase,omitempty"` // AZGO_BLOB_ENCRYPTION_PASSPHRASE
+	BlobCompression          string `yaml:"blob_compression,omitempty" json:"blob_compression,omitempty"`                     // AZGO_BLOB_COMPRESSION
+
+	TableAccount string `yaml:"table_account,omitempty" json:"table_account,omitempty"` // AZGO_TABLE_ACCOUNT
+	TableKey     string `yaml:"table_key,omitempty" json:"table_key,omitempty"`         // AZGO_TABLE_KEY
+	TableType    string `yaml:"table_type,omitempty" json:"table_type,omitempty"`       // AZGO_TABLE_TYPE
+
+	// TableConnectionString and TableEndpoint do the same for the table package.
+	TableConnectionString string `yaml:"table_connection_string,omitempty" json:"table_connection_string,omitempty"` // AZGO_TABLE_CONNECTION_STRING
+	TableEndpoint         string `yaml:"table_endpoint,omitempty" json:"table_endpoint,omitempty"`                   // AZGO_TABLE_ENDPOINT
+
+	PostgresURL string `yaml:"postgres_url,omitempty" json:"postgres_url,omitempty"` // POSTGRES_URL
+
+	ServiceBusConnectionString string `yaml:"servicebus_connection_string,omitempty" json:"servicebus_connection_string,omitempty"` // AZGO_SERVICEBUS_CONNECTION_STRING
+	EventHubsConnectionString  string `yaml:"eventhubs_connection_string,omitempty" json:"eventhubs_connection_string,omitempty"`   // AZGO_EVENTHUBS_CONNECTION_STRING
+
+	// Subscription is used by the arm and aks commands. When it is not set
+	// we use the default subscription of the az CLI (see ResolveSubscription).
+	Subscription string `yaml:"subscription,omitempty" json:"subscription,omitempty"` // AZURE_SUBSCRIPTION
+}
+
+// Config is the shape of the configuration file:
+//
+//	default_profile: dev
+//	profiles:
+//	  dev:
+//	    storage_account_name: azgodev
+//	    storage_account_key: ...
+//	  prod:
+//	    postgres_url: postgres://...
+type Config struct {
+	DefaultProfile string              `yaml:"default_profile,omitempty"`
+	Profiles       map[string]*Profile `yaml:"profiles"`
+}
+
+// setting ties a Profile field to its key in the configuration file and its
+// environment variable.
+type setting struct {
+	key   string
+	env   string
+	value *string
+}
+
+func (p *Profile) settings() []setting {
+	return []setting{
+		{"storage_account_name", "AZGO_STORAGE_ACCOUNT_NAME", &p.StorageAccountName},
+		{"storage_account_key", "AZGO_STORAGE_ACCOUNT_KEY", &p.StorageAccountKey},
+		{"storage_connection_string", "AZGO_STORAGE_CONNECTION_STRING", &p.StorageConnectionString},
+		{"blob_endpoint", "AZGO_BLOB_ENDPOINT", &p.BlobEndpoint},
+		{"blob_encryption_key_file", "AZGO_BLOB_ENCRYPTION_KEY_FILE", &p.BlobEncryptionKeyFile},
+		{"blob_encryption_passphrase", "AZGO_BLOB_ENCRYPTION_PASSPHRASE", &p.BlobEncryptionPassphrase},
+		{"blob_compression", "AZGO_BLOB_COMPRESSION", &p.BlobCompression},
+		{"table_account", "AZGO_TABLE_ACCOUNT", &p.TableAccount},
+		{"table_key", "AZGO_TABLE_KEY", &p.TableKey},
+		{"table_type", "AZGO_TABLE_TYPE", &p.TableType},
+		{"table_connection_string", "AZGO_TABLE_CONNECTION_STRING", &p.TableConnectionString},
+		{"table_endpoint", "AZGO_TABLE_ENDPOINT", &p.TableEndpoint},
+		{"postgres_url", "POSTGRES_URL", &p.PostgresURL},
+		{"servicebus_connection_string", "AZGO_SERVICEBUS_CONNECTION_STRING", &p.ServiceBusConnectionString},
+		{"eventhubs_connection_string", "AZGO_EVENTHUBS_CONNECTION_STRING", &p.EventHubsConnectionString},
+		{"subscription", "AZURE_SUBSCRIPTION", &p.Subscription},
+	}
+}
+
+// ApplyEnv overrides the fields of p with any of their environment
+// variables which are set.
+func (p *Profile) ApplyEnv() {
+	for _, s := range p.settings() {
+		if value := os.Getenv(s.env); value != "" {
+			*s.value = value
+		}
+	}
+}
+
+// Missing returns an error explaining how to set the setting named key,
+// for use by constructors when a required value is empty.
+func Missing(key string) error {
+	for _, s := range (&Profile{}).settings() {
+		if s.key == key {
+			return fmt.Errorf("%s is not set: add it to the profile in %s or set %s", s.key, Path(), s.env)
+		}
+	}
+	return fmt.Errorf("%s is not set", key)
+}
+
+// Path returns the location of the configuration file. This is
+// $AZGO_CONFIG if set, or else config.yaml under $XDG_CONFIG_HOME/azgo
+// (which defaults to ~/.config/azgo).
+func Path() string {
+	if path := os.Getenv("AZGO_CONFIG"); path != "" {
+		return path
+	}
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return filepath.Join(".config", "azgo", "config.yaml")
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "azgo", "config.yaml")
+}
+
+// Read parses the configuration file at path. A missing file is not an
+// error and returns an empty *Config.
+func Read(path string) (*Config, error) {
+	c := &Config{Profiles: map[string]*Profile{}}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if c.Profiles == nil {
+		c.Profiles = map[string]*Profile{}
+	}
+	for name, p := range c.Profiles {
+		if p == nil {
+			p = &Profile{}
+			c.Profiles[name] = p
+		}
+		p.Name = name
+	}
+	return c, nil
+}
+
+// ProfileNames returns the names of the profiles in c in sorted order.
+func (c *Config) ProfileNames() []string {
+	names := []string{}
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Profile returns a copy of the named profile with environment variable
+// overrides applied. If name is empty we use AZGO_PROFILE, then
+// default_profile, then "default". Only an explicitly chosen profile has
+// to exist; otherwise we fall back to an empty profile so the environment
+// variables alone are enough.
+func (c *Config) Profile(name string) (*Profile, error) {
+	explicit := name != ""
+	if name == "" {
+		name = os.Getenv("AZGO_PROFILE")
+		explicit = name != ""
+	}
+	if name == "" {
+		name = c.DefaultProfile
+		explicit = name != ""
+	}
+	if name == "" {
+		name = "default"
+	}
+
+	p := &Profile{Name: name}
+	if found, ok := c.Profiles[name]; ok {
+		*p = *found
+	} else if explicit {
+		return nil, fmt.Errorf("profile %q not found in %s (have %v)", name, Path(), c.ProfileNames())
+	}
+	p.ApplyEnv()
+	return p, nil
+}
+
+// Load reads the configuration file from Path and returns the named
+// profile (see Config.Profile).
+func Load(name string) (*Profile, error) {
+	c, err := Read(Path())
+	if err != nil {
+		return nil, err
+	}
+	return c.Profile(name)
+}
+
+// FromEnv returns a profile populated only from environment variables.
+func FromEnv() *Profile {
+	p := &Profile{Name: "env"}
+	p.ApplyEnv()
+	return p
+}
+
+var active *Profile
+
+// SetActive sets the profile returned by Active. The CLI calls this once
+// the --profile flag has been parsed.
+func SetActive(p *Profile) {
+	active = p
+}
+
+// Active returns the profile set by SetActive or, if none has been set,
+// FromEnv. The package-level functions in blob, table, postgres,
+// servicebus and eventhubs use this to find their settings.
+func Active() *Profile {
+	if active == nil {
+		return FromEnv()
+	}
+	return active
+}
+
+// Redacted returns a copy of p with keys, passwords and connection strings
+// replaced so it can be printed.
+func (p *Profile) Redacted() *Profile {
+	r := *p
+	for _, value := range []*string{&r.StorageAccountKey, &r.StorageConnectionString, &r.BlobEncryptionPassphrase, &r.TableKey, &r.TableConnectionString, &r.PostgresURL, &r.ServiceBusConnectionString, &r.EventHubsConnectionString} {
+		if *value != "" {
+			*value = "***"
+		}
+	}
+	return &r
+}
@@ -0,0 +1,100 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testConfig = `
+default_profile: dev
+profiles:
+  dev:
+    storage_account_name: azgodev
+    storage_account_key: devkey
+    postgres_url: postgres://localhost/dev
+  prod:
+    storage_account_name: azgoprod
+    table_type: storage
+`
+
+func writeConfig(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(testConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AZGO_CONFIG", path)
+	t.Setenv("AZGO_PROFILE", "")
+	for _, s := range (&Profile{}).settings() {
+		t.Setenv(s.env, "")
+	}
+	return path
+}
+
+func TestLoadDefaultProfile(t *testing.T) {
+	writeConfig(t)
+	p, err := Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Name != "dev" || p.StorageAccountName != "azgodev" || p.PostgresURL != "postgres://localhost/dev" {
+		t.Errorf("Load(\"\") = %+v", p)
+	}
+}
+
+func TestLoadNamedProfileWithEnvOverride(t *testing.T) {
+	writeConfig(t)
+	t.Setenv("AZGO_STORAGE_ACCOUNT_KEY", "fromenv")
+	p, err := Load("prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.StorageAccountName != "azgoprod" || p.TableType != "storage" || p.StorageAccountKey != "fromenv" {
+		t.Errorf("Load(prod) = %+v", p)
+	}
+	if p.PostgresURL != "" {
+		t.Errorf("prod inherited postgres_url %q", p.PostgresURL)
+	}
+}
+
+func TestLoadProfileFromEnv(t *testing.T) {
+	writeConfig(t)
+	t.Setenv("AZGO_PROFILE", "prod")
+	p, err := Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Name != "prod" {
+		t.Errorf("AZGO_PROFILE=prod loaded %q", p.Name)
+	}
+}
+
+func TestLoadUnknownProfile(t *testing.T) {
+	writeConfig(t)
+	_, err := Load("staging")
+	if err == nil || !strings.Contains(err.Error(), "staging") {
+		t.Errorf("Load(staging) error = %v", err)
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	t.Setenv("AZGO_CONFIG", filepath.Join(t.TempDir(), "missing.yaml"))
+	t.Setenv("AZGO_PROFILE", "")
+	t.Setenv("POSTGRES_URL", "postgres://env")
+	p, err := Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.PostgresURL != "postgres://env" {
+		t.Errorf("PostgresURL = %q, want the environment variable", p.PostgresURL)
+	}
+}
+
+func TestMissing(t *testing.T) {
+	err := Missing("postgres_url")
+	if !strings.Contains(err.Error(), "POSTGRES_URL") {
+		t.Errorf("Missing(postgres_url) = %v, want it to name POSTGRES_URL", err)
+	}
+}
@@ -0,0 +1,97 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Azurite (and the older Storage Emulator) use a well-known account name
+// and key, see: https://docs.microsoft.com/en-us/azure/storage/common/storage-use-azurite#http-connection-strings
+const (
+	DevelopmentAccountName   = "devstoreaccount1"
+	DevelopmentAccountKey    = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+	developmentBlobEndpoint  = "http://127.0.0.1:10000/devstoreaccount1"
+	developmentTableEndpoint = "http://127.0.0.1:10002/devstoreaccount1"
+)
+
+// StorageConnection is the parsed form of an Azure Storage connection string.
+// Either AccountKey or SharedAccessSignature is set. The endpoints are always
+// filled in, from BlobEndpoint/TableEndpoint if given, or else from the
+// protocol, account name and EndpointSuffix.
+type StorageConnection struct {
+	AccountName           string
+	AccountKey            string
+	SharedAccessSignature string
+	BlobEndpoint          string
+	TableEndpoint         string
+}
+
+// ParseStorageConnectionString parses connection strings as shown in the
+// Azure Portal, e.g.
+//
+//	DefaultEndpointsProtocol=https;AccountName=...;AccountKey=...;EndpointSuffix=core.windows.net
+//
+// along with the explicit endpoint form used by Azurite and other emulators
+//
+//	DefaultEndpointsProtocol=http;AccountName=devstoreaccount1;AccountKey=...;BlobEndpoint=http://127.0.0.1:10000/devstoreaccount1;
+//
+// and the UseDevelopmentStorage=true shortcut for a local Azurite.
+func ParseStorageConnectionString(connStr string) (*StorageConnection, error) {
+	values := map[string]string{}
+	for _, part := range strings.Split(connStr, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		i := strings.Index(part, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("malformed connection string: expected key=value but found %q", part)
+		}
+		values[strings.ToLower(part[:i])] = part[i+1:]
+	}
+
+	if strings.EqualFold(values["usedevelopmentstorage"], "true") {
+		c := &StorageConnection{
+			AccountName:   DevelopmentAccountName,
+			AccountKey:    DevelopmentAccountKey,
+			BlobEndpoint:  developmentBlobEndpoint,
+			TableEndpoint: developmentTableEndpoint,
+		}
+		if proxy := values["developmentstorageproxyuri"]; proxy != "" {
+			proxy = strings.TrimSuffix(proxy, "/")
+			c.BlobEndpoint = proxy + ":10000/" + DevelopmentAccountName
+			c.TableEndpoint = proxy + ":10002/" + DevelopmentAccountName
+		}
+		return c, nil
+	}
+
+	c := &StorageConnection{
+		AccountName:           values["accountname"],
+		AccountKey:            values["accountkey"],
+		SharedAccessSignature: strings.TrimPrefix(values["sharedaccesssignature"], "?"),
+		BlobEndpoint:          strings.TrimSuffix(values["blobendpoint"], "/"),
+		TableEndpoint:         strings.TrimSuffix(values["tableendpoint"], "/"),
+	}
+	if c.AccountKey == "" && c.SharedAccessSignature == "" {
+		return nil, fmt.Errorf("malformed connection string: AccountKey or SharedAccessSignature is required")
+	}
+	if c.AccountName == "" && (c.AccountKey != "" || c.BlobEndpoint == "" || c.TableEndpoint == "") {
+		return nil, fmt.Errorf("malformed connection string: AccountName is required")
+	}
+
+	protocol := values["defaultendpointsprotocol"]
+	if protocol == "" {
+		protocol = "https"
+	}
+	suffix := values["endpointsuffix"]
+	if suffix == "" {
+		suffix = "core.windows.net"
+	}
+	if c.BlobEndpoint == "" {
+		c.BlobEndpoint = fmt.Sprintf("%s://%s.blob.%s", protocol, c.AccountName, suffix)
+	}
+	if c.TableEndpoint == "" {
+		c.TableEndpoint = fmt.Sprintf("%s://%s.table.%s", protocol, c.AccountName, suffix)
+	}
+	return c, nil
+}
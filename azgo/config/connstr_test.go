@@ -0,0 +1,77 @@
+package config
+
+import "testing"
+
+func TestParseStorageConnectionString(t *testing.T) {
+	tests := []struct {
+		connStr string
+		want    StorageConnection
+	}{
+		{
+			"UseDevelopmentStorage=true",
+			StorageConnection{
+				AccountName:   DevelopmentAccountName,
+				AccountKey:    DevelopmentAccountKey,
+				BlobEndpoint:  "http://127.0.0.1:10000/devstoreaccount1",
+				TableEndpoint: "http://127.0.0.1:10002/devstoreaccount1",
+			},
+		},
+		{
+			"UseDevelopmentStorage=true;DevelopmentStorageProxyUri=http://azurite",
+			StorageConnection{
+				AccountName:   DevelopmentAccountName,
+				AccountKey:    DevelopmentAccountKey,
+				BlobEndpoint:  "http://azurite:10000/devstoreaccount1",
+				TableEndpoint: "http://azurite:10002/devstoreaccount1",
+			},
+		},
+		{
+			"DefaultEndpointsProtocol=https;AccountName=acct;AccountKey=a2V5;EndpointSuffix=core.chinacloudapi.cn",
+			StorageConnection{
+				AccountName:   "acct",
+				AccountKey:    "a2V5",
+				BlobEndpoint:  "https://acct.blob.core.chinacloudapi.cn",
+				TableEndpoint: "https://acct.table.core.chinacloudapi.cn",
+			},
+		},
+		{
+			"DefaultEndpointsProtocol=http;AccountName=devstoreaccount1;AccountKey=a2V5;BlobEndpoint=http://localhost:10000/devstoreaccount1/;",
+			StorageConnection{
+				AccountName:   "devstoreaccount1",
+				AccountKey:    "a2V5",
+				BlobEndpoint:  "http://localhost:10000/devstoreaccount1",
+				TableEndpoint: "http://devstoreaccount1.table.core.windows.net",
+			},
+		},
+		{
+			"BlobEndpoint=https://acct.blob.core.windows.net;TableEndpoint=https://acct.table.core.windows.net;SharedAccessSignature=sv=2020-08-04&sig=abc",
+			StorageConnection{
+				SharedAccessSignature: "sv=2020-08-04&sig=abc",
+				BlobEndpoint:          "https://acct.blob.core.windows.net",
+				TableEndpoint:         "https://acct.table.core.windows.net",
+			},
+		},
+	}
+	for _, test := range tests {
+		got, err := ParseStorageConnectionString(test.connStr)
+		if err != nil {
+			t.Errorf("ParseStorageConnectionString(%q): %v", test.connStr, err)
+			continue
+		}
+		if *got != test.want {
+			t.Errorf("ParseStorageConnectionString(%q) = %+v, want %+v", test.connStr, *got, test.want)
+		}
+	}
+}
+
+func TestParseStorageConnectionStringErrors(t *testing.T) {
+	for _, connStr := range []string{
+		"AccountName=acct",
+		"AccountKey=a2V5",
+		"garbage",
+	} {
+		if _, err := ParseStorageConnectionString(connStr); err == nil {
+			t.Errorf("ParseStorageConnectionString(%q) returned no error", connStr)
+		}
+	}
+}
@@ -4,12 +4,14 @@ import (
 	"bufio"
 	"context"
 	"fmt"
-	"log"
+	"io"
 	"os"
-	"os/signal"
-	"syscall"
+	"sync"
+	"time"
 
 	eventhub "github.com/Azure/azure-event-hubs-go/v3"
+	"github.com/blue-eight/azgo/azgo/config"
+	"github.com/blue-eight/azgo/azgo/smoke"
 )
 
 // EventHubFromEnv creates a new *eventhub.Hub authenticated via the
@@ -17,7 +19,24 @@ import (
 // hub should be pre-created and specified as part of the connection
 // string.
 func EventHubFromEnv() (*eventhub.Hub, error) {
-	connStr := mustGetEnv("AZGO_EVENTHUBS_CONNECTION_STRING")
+	return EventHubFromProfile(config.FromEnv())
+}
+
+// EventHubFromConfig creates a new *eventhub.Hub for the active profile
+// (see config.Active), which is what the functions in this package use.
+func EventHubFromConfig() (*eventhub.Hub, error) {
+	return EventHubFromProfile(config.Active())
+}
+
+// EventHubFromProfile creates a new *eventhub.Hub authenticated via the
+// eventhubs_connection_string of the profile, which must include the
+// EntityPath of the event hub. It returns an error if the connection
+// string is missing.
+func EventHubFromProfile(p *config.Profile) (*eventhub.Hub, error) {
+	connStr := p.EventHubsConnectionString
+	if connStr == "" {
+		return nil, config.Missing("eventhubs_connection_string")
+	}
 	hub, err := eventhub.NewHubFromConnectionString(connStr)
 	if err != nil {
 		return nil, err
@@ -25,15 +44,37 @@ func EventHubFromEnv() (*eventhub.Hub, error) {
 	return hub, nil
 }
 
+// hub is the part of *eventhub.Hub the functions in this package use.
+type hub interface {
+	Send(ctx context.Context, event *eventhub.Event, opts ...eventhub.SendOption) error
+	GetRuntimeInformation(ctx context.Context) (*eventhub.HubRuntimeInformation, error)
+	Receive(ctx context.Context, partitionID string, handler eventhub.Handler, opts ...eventhub.ReceiveOption) (*eventhub.ListenerHandle, error)
+	Close(ctx context.Context) error
+}
+
+// newHub returns the hub for the active profile, and is replaced in tests.
+var newHub = func() (hub, error) {
+	h, err := EventHubFromConfig()
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// stdin and stdout are used by SendStdin and Receive, and replaced in tests.
+var (
+	stdin  io.Reader = os.Stdin
+	stdout io.Writer = os.Stdout
+)
+
 // Send sends a message to the event hub via the NewEventFromString
 // method.
-func Send(message string) error {
-	hub, err := EventHubFromEnv()
+func Send(ctx context.Context, message string) error {
+	hub, err := newHub()
 	if err != nil {
 		return err
 	}
 
-	ctx := context.Background()
 	err = hub.Send(ctx, eventhub.NewEventFromString(message))
 	if err != nil {
 		return err
@@ -43,13 +84,12 @@ func Send(message string) error {
 
 // SendStdin sends a stream of events from the standard input to the
 // event hub via the NewEventFromString method.
-func SendStdin() error {
-	hub, err := EventHubFromEnv()
+func SendStdin(ctx context.Context) error {
+	hub, err := newHub()
 	if err != nil {
 		return err
 	}
-	scanner := bufio.NewScanner(os.Stdin)
-	ctx := context.Background()
+	scanner := bufio.NewScanner(stdin)
 	for scanner.Scan() {
 		err = hub.Send(ctx, eventhub.NewEventFromString(scanner.Text()))
 		if err != nil {
@@ -63,19 +103,24 @@ func SendStdin() error {
 }
 
 // Receive receives events from the event hub, marshals them to JSON,
-// and writes them to the standard output.
-func Receive() error {
-	hub, err := EventHubFromEnv()
+// and writes them to the standard output. It runs until ctx is done,
+// which the CLI does on SIGINT/SIGTERM or after --timeout, and then
+// closes the hub and returns nil.
+func Receive(ctx context.Context) error {
+	hub, err := newHub()
 	if err != nil {
 		return err
 	}
 
+	// partitions are received concurrently, so we write one event at a time
+	var mu sync.Mutex
 	handler := func(c context.Context, event *eventhub.Event) error {
-		fmt.Printf("%s\n", event.Data)
-		return nil
+		mu.Lock()
+		defer mu.Unlock()
+		_, err := fmt.Fprintf(stdout, "%s\n", event.Data)
+		return err
 	}
 
-	ctx := context.Background()
 	runtimeInfo, err := hub.GetRuntimeInformation(ctx)
 	if err != nil {
 		return err
@@ -92,12 +137,13 @@ func Receive() error {
 		}
 	}
 
-	// Wait for a signal to quit
-	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
-	<-signalChan
+	// Wait until we are cancelled (e.g. by a signal) to quit
+	<-ctx.Done()
 
-	err = hub.Close(ctx)
+	// ctx is already done, so we give Close its own short deadline
+	closeCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = hub.Close(closeCtx)
 	if err != nil {
 		return err
 	}
@@ -105,14 +151,72 @@ func Receive() error {
 	return nil
 }
 
-func mustGetEnv(key string) string {
-	value := os.Getenv(key)
-	if value == "" {
-		log.Fatalf("Require environment variable: %s\n", key)
+// readBackTimeout is how long Test waits for the event it sent.
+var readBackTimeout = 30 * time.Second
+
+// Test is a smoke test of the event hub. An event hub cannot be created
+// with its connection string, so it listens on every partition of the
+// existing hub, sends an event with a unique marker, waits for it to come
+// back, and closes the hub, printing each step via output.Print (see
+// package smoke). It returns an error if any step failed.
+func Test(ctx context.Context) error {
+	test := smoke.New("eventhubs")
+	marker := smoke.Name("azgo smoke test", " ")
+
+	var h hub
+	connected := test.Step(ctx, "connect", func(ctx context.Context) error {
+		var err error
+		h, err = newHub()
+		return err
+	})
+	if !connected {
+		return test.Err()
 	}
-	return value
-}
 
-func Test() error {
-	return nil
+	var partitions []string
+	test.Step(ctx, "runtime information", func(ctx context.Context) error {
+		info, err := h.GetRuntimeInformation(ctx)
+		if err != nil {
+			return err
+		}
+		if len(info.PartitionIDs) == 0 {
+			return fmt.Errorf("%s has no partitions", info.Path)
+		}
+		partitions = info.PartitionIDs
+		return nil
+	})
+
+	received := make(chan struct{})
+	var once sync.Once
+	handler := func(c context.Context, event *eventhub.Event) error {
+		if string(event.Data) == marker {
+			once.Do(func() { close(received) })
+		}
+		return nil
+	}
+	test.Step(ctx, "receive", func(ctx context.Context) error {
+		for _, partitionID := range partitions {
+			if _, err := h.Receive(ctx, partitionID, handler, eventhub.ReceiveWithLatestOffset()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	test.Step(ctx, "send", func(ctx context.Context) error {
+		return h.Send(ctx, eventhub.NewEventFromString(marker))
+	})
+	test.Step(ctx, "read back", func(ctx context.Context) error {
+		select {
+		case <-received:
+			return nil
+		case <-time.After(readBackTimeout):
+			return fmt.Errorf("the event was not received within %s", readBackTimeout)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	test.Cleanup(ctx, "close", func(ctx context.Context) error {
+		return h.Close(ctx)
+	})
+	return test.Err()
 }
@@ -0,0 +1,190 @@
+package eventhubs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	eventhub "github.com/Azure/azure-event-hubs-go/v3"
+	"github.com/blue-eight/azgo/azgo/config"
+	"github.com/blue-eight/azgo/azgo/internal/testutil"
+)
+
+// fakeHub delivers each sent event to the listener of one partition, in
+// turn, and keeps every event it is sent.
+type fakeHub struct {
+	mu         sync.Mutex
+	partitions []string
+	handlers   []eventhub.Handler
+	sent       []string
+	next       int
+	closed     bool
+	sendErr    error
+}
+
+func (f *fakeHub) Send(ctx context.Context, event *eventhub.Event, opts ...eventhub.SendOption) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.sendErr != nil {
+		return f.sendErr
+	}
+	f.sent = append(f.sent, string(event.Data))
+	if len(f.handlers) > 0 {
+		handler := f.handlers[f.next%len(f.handlers)]
+		f.next++
+		return handler(ctx, event)
+	}
+	return nil
+}
+
+func (f *fakeHub) GetRuntimeInformation(ctx context.Context) (*eventhub.HubRuntimeInformation, error) {
+	return &eventhub.HubRuntimeInformation{
+		Path:           "fake",
+		PartitionCount: len(f.partitions),
+		PartitionIDs:   f.partitions,
+	}, nil
+}
+
+func (f *fakeHub) Receive(ctx context.Context, partitionID string, handler eventhub.Handler, opts ...eventhub.ReceiveOption) (*eventhub.ListenerHandle, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.handlers = append(f.handlers, handler)
+	return nil, nil
+}
+
+func (f *fakeHub) Close(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return nil
+}
+
+func (f *fakeHub) listeners() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.handlers)
+}
+
+func useFake(t *testing.T) *fakeHub {
+	f := &fakeHub{partitions: []string{"0", "1"}}
+	previous := newHub
+	newHub = func() (hub, error) { return f, nil }
+	t.Cleanup(func() { newHub = previous })
+	return f
+}
+
+func TestSend(t *testing.T) {
+	ctx := context.Background()
+	f := useFake(t)
+
+	if err := Send(ctx, "one"); err != nil {
+		t.Fatal(err)
+	}
+	stdin = strings.NewReader("two\nthree\n")
+	defer func() { stdin = os.Stdin }()
+	if err := SendStdin(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(f.sent, ","); got != "one,two,three" {
+		t.Errorf("sent %s, want one,two,three", got)
+	}
+
+	f.sendErr = errors.New("link detached")
+	if err := Send(ctx, "four"); !errors.Is(err, f.sendErr) {
+		t.Errorf("Send error = %v, want %v", err, f.sendErr)
+	}
+	stdin = strings.NewReader("five\n")
+	if err := SendStdin(ctx); !errors.Is(err, f.sendErr) {
+		t.Errorf("SendStdin error = %v, want %v", err, f.sendErr)
+	}
+}
+
+func TestReceive(t *testing.T) {
+	f := useFake(t)
+	out := &bytes.Buffer{}
+	stdout = out
+	defer func() { stdout = os.Stdout }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- Receive(ctx) }()
+
+	for f.listeners() < len(f.partitions) {
+		time.Sleep(time.Millisecond)
+	}
+	for _, message := range []string{"a", "b", "c"} {
+		if err := f.Send(ctx, eventhub.NewEventFromString(message)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Receive returned %v after cancel, want nil", err)
+	}
+	if out.String() != "a\nb\nc\n" {
+		t.Errorf("Receive printed %q", out)
+	}
+	if !f.closed {
+		t.Error("Receive did not close the hub")
+	}
+}
+
+func TestMissingConnectionString(t *testing.T) {
+	testutil.UseProfile(t, &config.Profile{})
+	if err := Send(context.Background(), "x"); err == nil {
+		t.Error("Send without eventhubs_connection_string returned no error")
+	}
+}
+
+func TestSmoke(t *testing.T) {
+	ctx := context.Background()
+	f := useFake(t)
+
+	out := testutil.CaptureOutput(t)
+	if err := Test(ctx); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+	records := testutil.Records(t, out)
+	steps := []string{"connect", "runtime information", "receive", "send", "read back", "close"}
+	if len(records) != len(steps) {
+		t.Fatalf("Test printed %d steps, want %d:\n%s", len(records), len(steps), out)
+	}
+	for i, step := range steps {
+		if records[i]["step"] != step || records[i]["status"] != "pass" || records[i]["service"] != "eventhubs" {
+			t.Errorf("step %d = %v, want %s to pass", i, records[i], step)
+		}
+	}
+	if !f.closed || len(f.sent) != 1 || !strings.HasPrefix(f.sent[0], "azgo smoke test ") {
+		t.Errorf("Test sent %q and closed the hub: %v", f.sent, f.closed)
+	}
+
+	// a hub without partitions fails and skips the rest, but is still closed
+	f = useFake(t)
+	f.partitions = nil
+	out.Reset()
+	if err := Test(ctx); err == nil || !strings.Contains(err.Error(), "runtime information") {
+		t.Errorf("Test of a hub without partitions error = %v", err)
+	}
+	records = testutil.Records(t, out)
+	if len(records) != len(steps) || records[1]["status"] != "fail" || records[5]["status"] != "pass" {
+		t.Errorf("Test of a hub without partitions printed %v", records)
+	}
+	if !f.closed {
+		t.Error("Test did not close the hub after a failure")
+	}
+
+	testutil.UseProfile(t, &config.Profile{})
+	newHub = func() (hub, error) { return EventHubFromConfig() }
+	out.Reset()
+	if err := Test(ctx); err == nil {
+		t.Error("Test without a connection string returned no error")
+	}
+	if records := testutil.Records(t, out); len(records) != 1 || records[0]["status"] != "fail" {
+		t.Errorf("Test without a connection string printed %v, want connect to fail", records)
+	}
+}
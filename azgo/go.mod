@@ -4,27 +4,32 @@ go 1.16
 
 require (
 	github.com/Azure/azure-event-hubs-go/v3 v3.3.10
-	github.com/Azure/azure-sdk-for-go/sdk/armcore v0.8.0 // indirect
-	github.com/Azure/azure-sdk-for-go/sdk/azcore v0.19.0 // indirect
-	github.com/Azure/azure-sdk-for-go/sdk/azidentity v0.11.0 // indirect
-	github.com/Azure/azure-sdk-for-go/sdk/containerservice/armcontainerservice v0.2.0 // indirect
+	github.com/Azure/azure-pipeline-go v0.2.3
+	github.com/Azure/azure-sdk-for-go/sdk/azcore v0.19.0
+	github.com/Azure/azure-sdk-for-go/sdk/azidentity v0.11.0
+	github.com/Azure/azure-sdk-for-go/sdk/containerservice/armcontainerservice v0.2.0
 	github.com/Azure/azure-sdk-for-go/sdk/data/aztables v0.1.0
 	github.com/Azure/azure-sdk-for-go/sdk/internal v0.7.1 // indirect
-	github.com/Azure/azure-sdk-for-go/sdk/resources/armresources v0.3.0 // indirect
-	github.com/Azure/azure-sdk-for-go/sdk/to v0.1.4 // indirect
+	github.com/Azure/azure-sdk-for-go/sdk/resources/armresources v0.3.0
 	github.com/Azure/azure-service-bus-go v0.10.14
 	github.com/Azure/azure-storage-blob-go v0.14.0
 	github.com/Azure/go-amqp v0.13.9 // indirect
 	github.com/Azure/go-autorest/autorest v0.11.19 // indirect
 	github.com/Azure/go-autorest/autorest/adal v0.9.14 // indirect
 	github.com/form3tech-oss/jwt-go v3.2.3+incompatible // indirect
+	github.com/golang/protobuf v1.5.2 // indirect
 	github.com/google/uuid v1.2.0
 	github.com/jpillora/backoff v1.0.0 // indirect
-	github.com/klauspost/compress v1.13.1 // indirect
+	github.com/json-iterator/go v1.1.11 // indirect
+	github.com/klauspost/compress v1.13.1
 	github.com/lib/pq v1.10.2
-	github.com/spf13/cobra v1.2.1
-	golang.org/x/crypto v0.0.0-20210711020723-a769d52b0f97 // indirect
+	github.com/mitchellh/mapstructure v1.4.1 // indirect
+	github.com/modern-go/reflect2 v1.0.1 // indirect
+	github.com/spf13/cobra v1.6.1
+	golang.org/x/crypto v0.0.0-20210711020723-a769d52b0f97
 	golang.org/x/net v0.0.0-20210929193557-e81a3d93ecf6 // indirect
 	golang.org/x/text v0.3.7 // indirect
+	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
+	gopkg.in/yaml.v3 v3.0.1
 	nhooyr.io/websocket v1.8.7 // indirect
 )
@@ -0,0 +1,266 @@
+package cassette
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/blue-eight/azgo/azgo/internal/testutil"
+	"github.com/blue-eight/azgo/azgo/trace"
+)
+
+// Request is the recorded part of an HTTP request. Requests are matched on
+// Method and URL; the body is kept for reference.
+type Request struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	Body   string `json:"body,omitempty"`
+}
+
+// Response is a recorded HTTP response.
+type Response struct {
+	Status  int         `json:"status"`
+	Headers http.Header `json:"headers,omitempty"`
+	Body    string      `json:"body,omitempty"`
+}
+
+// Interaction is a request and the response it got.
+type Interaction struct {
+	Request  Request  `json:"request"`
+	Response Response `json:"response"`
+}
+
+// Cassette is the contents of a cassette file.
+type Cassette struct {
+	Interactions []Interaction `json:"interactions"`
+}
+
+// scrubbed are the headers never written to a cassette.
+var scrubbed = []string{"Authorization", "Cookie", "Set-Cookie", "X-Ms-Client-Request-Id", "X-Ms-Correlation-Request-Id", "X-Ms-Routing-Request-Id"}
+
+// Recorder records or replays the HTTP interactions of a single test.
+type Recorder struct {
+	t         testing.TB
+	path      string
+	recording bool
+	next      *http.Client
+
+	mu           sync.Mutex
+	replacements []string // real, fake pairs for strings.NewReplacer
+	cassette     Cassette
+	used         []bool
+}
+
+// New returns a Recorder for the cassette at path, e.g.
+// testdata/cassettes/list-resources.json. It records if AZGO_RECORD is set
+// and otherwise replays. The cassette is written, or checked for unused
+// interactions, when the test ends.
+func New(t testing.TB, path string) *Recorder {
+	t.Helper()
+	r := &Recorder{t: t, path: path, recording: os.Getenv("AZGO_RECORD") != "", next: http.DefaultClient}
+	if !r.recording {
+		b, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("cassette %s not found: record it with AZGO_RECORD=1", path)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(b, &r.cassette); err != nil {
+			t.Fatalf("cassette %s: %v", path, err)
+		}
+		r.used = make([]bool, len(r.cassette.Interactions))
+	}
+	t.Cleanup(r.finish)
+	return r
+}
+
+// Recording reports whether r is recording rather than replaying.
+func (r *Recorder) Recording() bool {
+	return r.recording
+}
+
+// Value returns the environment variable env when recording, and fake
+// when replaying. The real value is replaced by fake in the cassette.
+// Recording fails the test if env is not set.
+func (r *Recorder) Value(env, fake string) string {
+	r.t.Helper()
+	if !r.recording {
+		return fake
+	}
+	real := os.Getenv(env)
+	if real == "" {
+		r.t.Fatalf("%s must be set to record %s", env, r.path)
+	}
+	if real != fake {
+		r.mu.Lock()
+		r.replacements = append(r.replacements, real, fake)
+		r.mu.Unlock()
+	}
+	return real
+}
+
+// Credential returns the DefaultAzureCredential when recording, and a
+// fake token credential when replaying.
+func (r *Recorder) Credential() azcore.TokenCredential {
+	r.t.Helper()
+	if !r.recording {
+		return testutil.Credential{}
+	}
+	cred, err := azidentity.NewDefaultAzureCredential(nil)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	return cred
+}
+
+// Do sends req to Azure and records the interaction, or replays the next
+// unused interaction with the same method and URL.
+func (r *Recorder) Do(req *http.Request) (*http.Response, error) {
+	if r.recording {
+		return r.record(req)
+	}
+	return r.replay(req)
+}
+
+// scrub replaces the real values in s with their fakes.
+func (r *Recorder) scrub(s string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return strings.NewReplacer(r.replacements...).Replace(s)
+}
+
+// key returns the URL of a request as it is written to a cassette: scrubbed,
+// redacted, and with its query parameters in a fixed order.
+func (r *Recorder) key(u *url.URL) string {
+	k := *u
+	k.RawQuery = k.Query().Encode()
+	return r.scrub(trace.RedactURL(&k))
+}
+
+func (r *Recorder) record(req *http.Request) (*http.Response, error) {
+	body := ""
+	if req.Body != nil {
+		b, err := io.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(b))
+		body = string(b)
+	}
+	res, err := r.next.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	b, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = io.NopCloser(bytes.NewReader(b))
+
+	headers := http.Header{}
+	for name, values := range res.Header {
+		for _, value := range values {
+			headers.Add(name, r.scrub(value))
+		}
+	}
+	for _, name := range scrubbed {
+		headers.Del(name)
+	}
+	interaction := Interaction{
+		Request:  Request{Method: req.Method, URL: r.key(req.URL), Body: r.scrub(body)},
+		Response: Response{Status: res.StatusCode, Headers: headers, Body: r.scrub(string(b))},
+	}
+	r.mu.Lock()
+	r.cassette.Interactions = append(r.cassette.Interactions, interaction)
+	r.mu.Unlock()
+	return res, nil
+}
+
+func (r *Recorder) replay(req *http.Request) (*http.Response, error) {
+	key := r.key(req.URL)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, interaction := range r.cassette.Interactions {
+		if r.used[i] || interaction.Request.Method != req.Method || interaction.Request.URL != key {
+			continue
+		}
+		r.used[i] = true
+		headers := interaction.Response.Headers.Clone()
+		if headers == nil {
+			headers = http.Header{}
+		}
+		// the service's Retry-After is for the service, not the cassette
+		headers.Del("Retry-After")
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", interaction.Response.Status, http.StatusText(interaction.Response.Status)),
+			StatusCode:    interaction.Response.Status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        headers,
+			Body:          io.NopCloser(strings.NewReader(interaction.Response.Body)),
+			ContentLength: int64(len(interaction.Response.Body)),
+			Request:       req,
+		}, nil
+	}
+	r.t.Errorf("cassette %s has no response for %s %s", r.path, req.Method, key)
+	return nil, fmt.Errorf("cassette %s has no response for %s %s", r.path, req.Method, key)
+}
+
+// finish writes the cassette when a recording test passes, and otherwise
+// reports the interactions the test did not replay.
+func (r *Recorder) finish() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.recording && r.t.Failed() {
+		r.t.Logf("not writing cassette %s as the test failed", r.path)
+		return
+	}
+	if !r.recording {
+		for i, used := range r.used {
+			if !used {
+				request := r.cassette.Interactions[i].Request
+				r.t.Errorf("cassette %s: %s %s was not replayed", r.path, request.Method, request.URL)
+			}
+		}
+		return
+	}
+	b, err := json.MarshalIndent(r.cassette, "", "  ")
+	if err != nil {
+		r.t.Error(err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+		r.t.Error(err)
+		return
+	}
+	if err := os.WriteFile(r.path, append(b, '\n'), 0644); err != nil {
+		r.t.Error(err)
+	}
+}
+
+// ARMConnection returns a connection to Azure Resource Manager which sends
+// its requests through r. Resource provider registration is turned off so
+// the interactions are the same every time.
+func (r *Recorder) ARMConnection(options *arm.ConnectionOptions) *arm.Connection {
+	if options == nil {
+		options = &arm.ConnectionOptions{}
+	}
+	options.HTTPClient = r
+	options.DisableRPRegistration = true
+	return arm.NewDefaultConnection(r.Credential(), options)
+}
@@ -0,0 +1,124 @@
+package cassette
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeT runs a Recorder's cleanups when finish is called, and collects the
+// errors it reports instead of failing the test.
+type fakeT struct {
+	testing.TB
+	cleanups []func()
+	errors   []string
+}
+
+func (f *fakeT) Cleanup(fn func()) { f.cleanups = append(f.cleanups, fn) }
+
+func (f *fakeT) Errorf(format string, args ...interface{}) {
+	f.errors = append(f.errors, fmt.Sprintf(format, args...))
+}
+
+func (f *fakeT) Failed() bool { return len(f.errors) > 0 }
+
+func (f *fakeT) finish() {
+	for _, fn := range f.cleanups {
+		fn()
+	}
+}
+
+func get(t *testing.T, r *Recorder, url string) string {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer real-token")
+	res, err := r.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("%d %s", res.StatusCode, b)
+}
+
+func TestRecordReplay(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", "session=secret")
+		w.Header().Set("Retry-After", "30")
+		fmt.Fprintf(w, `{"path":%q}`, r.URL.Path)
+	}))
+	defer server.Close()
+	path := filepath.Join(t.TempDir(), "cassettes", "test.json")
+
+	t.Setenv("AZGO_RECORD", "1")
+	t.Setenv("TEST_SUBSCRIPTION", "real-subscription")
+	recording := &fakeT{TB: t}
+	r := New(recording, path)
+	subscription := r.Value("TEST_SUBSCRIPTION", "fake-subscription")
+	for _, page := range []string{"1", "2"} {
+		got := get(t, r, server.URL+"/subscriptions/"+subscription+"/resources?sig=secret&page="+page)
+		if want := `200 {"path":"/subscriptions/real-subscription/resources"}`; got != want {
+			t.Errorf("recording got %s, want %s", got, want)
+		}
+	}
+	recording.finish()
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"real-subscription", "real-token", "session=secret", "sig=secret"} {
+		if strings.Contains(string(b), secret) {
+			t.Errorf("cassette contains %q:\n%s", secret, b)
+		}
+	}
+
+	t.Setenv("AZGO_RECORD", "")
+	replaying := &fakeT{TB: t}
+	r = New(replaying, path)
+	subscription = r.Value("TEST_SUBSCRIPTION", "fake-subscription")
+	// the requests are matched on their URL, whatever the order
+	base := server.URL + "/subscriptions/" + subscription + "/resources?sig=other&page="
+	if got := get(t, r, base+"2"); got != `200 {"path":"/subscriptions/fake-subscription/resources"}` {
+		t.Errorf("replay got %s", got)
+	}
+	if _, err := r.Do(httptest.NewRequest(http.MethodGet, server.URL+"/missing", nil)); err == nil {
+		t.Error("replaying a request missing from the cassette returned no error")
+	}
+	replaying.finish()
+	if len(replaying.errors) != 2 || !strings.Contains(replaying.errors[0], "/missing") || !strings.Contains(replaying.errors[1], "page=1") {
+		t.Errorf("replay reported %q, want the missing request and the unused page 1", replaying.errors)
+	}
+}
+
+func TestReplayDropsRetryAfter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.json")
+	cassette := `{"interactions":[{"request":{"method":"GET","url":"https://example.com/op"},
+		"response":{"status":202,"headers":{"Retry-After":["30"],"Location":["https://example.com/op"]}}}]}`
+	if err := os.WriteFile(path, []byte(cassette), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AZGO_RECORD", "")
+	r := New(t, path)
+	res, err := r.Do(httptest.NewRequest(http.MethodGet, "https://example.com/op", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusAccepted || res.Header.Get("Location") != "https://example.com/op" {
+		t.Errorf("replayed %d %v", res.StatusCode, res.Header)
+	}
+	if res.Header.Get("Retry-After") != "" {
+		t.Error("replay kept Retry-After")
+	}
+}
@@ -0,0 +1,26 @@
+/*
+Package cassette records the HTTP interactions of a test against Azure to
+a cassette file, and replays them later so the test runs offline.
+
+A Recorder is a policy.Transporter, so it plugs into any azcore pipeline
+(arm.ConnectionOptions.HTTPClient, aztables.ClientOptions.Transporter) in
+the same place as trace.Transport. Tests replay by default and fail if the
+cassette is missing, or if they make a request it has no response for or
+leave some of its interactions unused. To record against Azure instead, set
+AZGO_RECORD along with the environment variables the test names:
+
+	AZGO_RECORD=1 AZURE_SUBSCRIPTION=... go test ./arm -run Cassette
+
+Recording scrubs the cassette: Authorization, cookies and other
+credentials are dropped, secrets in URLs are redacted as in trace.RedactURL,
+and each real value the test asked for with Value (a subscription ID, an
+account name) is replaced by its fake, which is what the test uses when
+replaying.
+
+The cassettes checked in under arm, aks and table testdata are synthetic:
+they were written by hand from the REST API reference rather than recorded,
+so they pin down the request shapes we send and the paging we follow, not
+the exact responses Azure returns today. Re-record them with AZGO_RECORD
+when an account is available, and drop this note once they are real.
+*/
+package cassette
@@ -0,0 +1,1676 @@
+package fakestorage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blue-eight/azgo/azgo/config"
+)
+
+// Account is the storage account name the fakes serve, which is the same
+// as Azurite's.
+const Account = config.DevelopmentAccountName
+
+// Blob is a blob stored in a BlobServer.
+type Blob struct {
+	Name               string
+	BlobType           string // BlockBlob or AppendBlob
+	Data               []byte
+	ContentType        string
+	ContentMD5         []byte
+	CacheControl       string
+	ContentEncoding    string
+	ContentLanguage    string
+	ContentDisposition string
+	Metadata           map[string]string
+	Tags               map[string]string
+	ETag               string
+	LastModified       time.Time
+	// AccessTier is Hot, Cool or Archive, or empty for the account's
+	// default, Hot. A blob in Archive cannot be read.
+	AccessTier string
+	// LeaseID is the ID of the blob's lease, if it has one, which expires
+	// at LeaseExpiry or never if that is zero.
+	LeaseID     string
+	LeaseExpiry time.Time
+
+	// Snapshot is the time of a snapshot, and VersionID the ID of a
+	// version, which every blob has while the server has Versioning on.
+	Snapshot  string
+	VersionID string
+	// CopyID, CopySource and CopyStatus describe the copy which created
+	// the blob, if any.
+	CopyID     string
+	CopySource string
+	CopyStatus string
+	// DeletedTime is when a soft-deleted blob or snapshot was deleted.
+	DeletedTime time.Time
+
+	leaseDuration time.Duration
+	// blocks is the number of blocks appended to an AppendBlob.
+	blocks int
+	// copyPolls is how many more reads a pending copy reports pending for.
+	copyPolls int
+}
+
+// leased reports whether b has a lease which has not expired.
+func (b *Blob) leased() bool {
+	return b != nil && b.LeaseID != "" && (b.LeaseExpiry.IsZero() || time.Now().Before(b.LeaseExpiry))
+}
+
+// Container is a container stored in a BlobServer.
+type Container struct {
+	Name         string
+	Metadata     map[string]string
+	ETag         string
+	LastModified time.Time
+	Blobs        map[string]*Blob
+	// PublicAccess is "container", "blob" or "" for private, and
+	// AccessPolicies are its stored access policies.
+	PublicAccess   string
+	AccessPolicies []SignedIdentifier
+	// HasImmutabilityPolicy and HasLegalHold are only reported, as they
+	// are set through the management API.
+	HasImmutabilityPolicy bool
+	HasLegalHold          bool
+
+	// blocks holds the staged, uncommitted blocks of each blob by ID.
+	blocks map[string]map[string][]byte
+	// snapshots, versions and deleted hold the snapshots, previous
+	// versions, and soft-deleted blobs, snapshots and versions of each
+	// blob, oldest first.
+	snapshots, versions, deleted map[string][]*Blob
+}
+
+// SignedIdentifier is a stored access policy of a Container, with its
+// times as the client sent them.
+type SignedIdentifier struct {
+	ID         string `xml:"Id"`
+	Start      string `xml:"AccessPolicy>Start,omitempty"`
+	Expiry     string `xml:"AccessPolicy>Expiry,omitempty"`
+	Permission string `xml:"AccessPolicy>Permission,omitempty"`
+}
+
+type xmlSignedIdentifiers struct {
+	XMLName xml.Name           `xml:"SignedIdentifiers"`
+	Items   []SignedIdentifier `xml:"SignedIdentifier"`
+}
+
+// BlobServer is an in-memory fake of the Blob Storage REST API.
+type BlobServer struct {
+	*httptest.Server
+
+	// PageSize is the most items a listing returns per request when the
+	// client asks for more (or does not ask). It defaults to 1000.
+	PageSize int
+	// Versioning keeps a blob as a previous version when it is
+	// overwritten or deleted. SoftDelete keeps deleted blobs, snapshots
+	// and versions until they are undeleted, and without Versioning keeps
+	// overwritten blobs as soft-deleted snapshots. Both are off, as they
+	// are for a new account.
+	Versioning bool
+	SoftDelete bool
+	// CopyPolls is how many reads of its properties an asynchronous copy
+	// reports as pending for before it succeeds, so that clients wait for
+	// it. Copies complete straight away if it is 0.
+	CopyPolls int
+
+	mu         sync.Mutex
+	containers map[string]*Container
+	requests   []*http.Request
+	version    int
+	lastStamp  time.Time
+}
+
+// NewBlobServer starts and returns a new BlobServer. The caller should
+// Close it when finished.
+func NewBlobServer() *BlobServer {
+	s := &BlobServer{
+		PageSize:   1000,
+		containers: map[string]*Container{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Endpoint returns the blob endpoint of the fake account.
+func (s *BlobServer) Endpoint() string {
+	return s.URL + "/" + Account
+}
+
+// Profile returns a profile which points the blob package at the fake.
+func (s *BlobServer) Profile() *config.Profile {
+	return &config.Profile{
+		Name:               "fakestorage",
+		StorageAccountName: Account,
+		StorageAccountKey:  config.DevelopmentAccountKey,
+		BlobEndpoint:       s.Endpoint(),
+	}
+}
+
+// CreateContainer creates a container directly, bypassing the API.
+func (s *BlobServer) CreateContainer(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.createContainer(name, nil)
+}
+
+// PutBlob creates or replaces a blob directly, bypassing the API. The
+// container is created if it does not exist.
+func (s *BlobServer) PutBlob(container, name string, data []byte, contentType string) *Blob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.containers[container]
+	if !ok {
+		c = s.createContainer(container, nil)
+	}
+	sum := md5.Sum(data)
+	b := &Blob{
+		Name:        name,
+		BlobType:    "BlockBlob",
+		Data:        data,
+		ContentType: contentType,
+		ContentMD5:  sum[:],
+		Metadata:    map[string]string{},
+		Tags:        map[string]string{},
+	}
+	s.store(c, name, b)
+	return b
+}
+
+// Blob returns a copy of the named blob, or nil if it does not exist.
+func (s *BlobServer) Blob(container, name string) *Blob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.containers[container]
+	if !ok {
+		return nil
+	}
+	b, ok := c.Blobs[name]
+	if !ok {
+		return nil
+	}
+	blob := *b
+	blob.Metadata = copyMap(b.Metadata)
+	blob.Tags = copyMap(b.Tags)
+	return &blob
+}
+
+// Container returns a copy of the container name, without its blobs, or
+// nil if it does not exist.
+func (s *BlobServer) Container(name string) *Container {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.containers[name]
+	if !ok {
+		return nil
+	}
+	container := *c
+	container.Metadata = copyMap(c.Metadata)
+	container.AccessPolicies = append([]SignedIdentifier{}, c.AccessPolicies...)
+	container.Blobs, container.blocks = nil, nil
+	container.snapshots, container.versions, container.deleted = nil, nil, nil
+	return &container
+}
+
+// SetHolds sets HasImmutabilityPolicy and HasLegalHold of the container,
+// which the API only reports.
+func (s *BlobServer) SetHolds(container string, immutabilityPolicy, legalHold bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.containers[container]; ok {
+		c.HasImmutabilityPolicy, c.HasLegalHold = immutabilityPolicy, legalHold
+	}
+}
+
+// Containers returns the sorted names of the containers.
+func (s *BlobServer) Containers() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := []string{}
+	for name := range s.containers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Requests returns the requests the server has received, in order.
+func (s *BlobServer) Requests() []*http.Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*http.Request(nil), s.requests...)
+}
+
+func (s *BlobServer) createContainer(name string, metadata map[string]string) *Container {
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+	c := &Container{
+		Name:      name,
+		Metadata:  metadata,
+		Blobs:     map[string]*Blob{},
+		blocks:    map[string]map[string][]byte{},
+		snapshots: map[string][]*Blob{},
+		versions:  map[string][]*Blob{},
+		deleted:   map[string][]*Blob{},
+	}
+	s.touch(&c.ETag, &c.LastModified)
+	s.containers[name] = c
+	return c
+}
+
+// touch gives an item a new ETag and Last-Modified time.
+func (s *BlobServer) touch(etag *string, lastModified *time.Time) {
+	s.version++
+	*etag = fmt.Sprintf("\"0x%X\"", 0x8D000000000000+s.version)
+	*lastModified = time.Now().UTC().Truncate(time.Second)
+}
+
+// stamp returns a new snapshot time or version ID, which is later than
+// any before it.
+func (s *BlobServer) stamp() string {
+	t := time.Now().UTC().Truncate(100 * time.Nanosecond)
+	if !t.After(s.lastStamp) {
+		t = s.lastStamp.Add(100 * time.Nanosecond)
+	}
+	s.lastStamp = t
+	return t.Format("2006-01-02T15:04:05.0000000Z")
+}
+
+// store makes b the current blob name of c, with a new ETag and version,
+// keeping the lease of any blob it replaces.
+func (s *BlobServer) store(c *Container, name string, b *Blob) {
+	if old := c.Blobs[name]; old != nil {
+		b.LeaseID, b.LeaseExpiry, b.leaseDuration = old.LeaseID, old.LeaseExpiry, old.leaseDuration
+		s.keep(c, name, old)
+	}
+	// a soft-deleted blob which is replaced becomes a soft-deleted snapshot
+	for _, deleted := range c.deleted[name] {
+		if deleted.Snapshot == "" && deleted.VersionID == "" {
+			deleted.Snapshot = s.stamp()
+		}
+	}
+	s.touch(&b.ETag, &b.LastModified)
+	b.VersionID = ""
+	if s.Versioning {
+		b.VersionID = s.stamp()
+	}
+	c.Blobs[name] = b
+}
+
+// keep keeps old, the state of the blob name of c before it is
+// overwritten, as a previous version with Versioning on, or else as a
+// soft-deleted snapshot with SoftDelete on.
+func (s *BlobServer) keep(c *Container, name string, old *Blob) {
+	kept := *old
+	kept.LeaseID, kept.LeaseExpiry = "", time.Time{}
+	switch {
+	case s.Versioning && kept.VersionID != "":
+		c.versions[name] = append(c.versions[name], &kept)
+	case s.SoftDelete:
+		kept.Snapshot, kept.VersionID, kept.DeletedTime = s.stamp(), "", time.Now().UTC()
+		c.deleted[name] = append(c.deleted[name], &kept)
+	}
+}
+
+func (s *BlobServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, r.Clone(r.Context()))
+
+	w.Header().Set("x-ms-request-id", strconv.Itoa(len(s.requests)))
+	w.Header().Set("x-ms-version", r.Header.Get("x-ms-version"))
+	w.Header().Set("Date", time.Now().UTC().Format(http.TimeFormat))
+
+	container, name, ok := splitPath(r.URL.Path)
+	if !ok {
+		writeBlobError(w, http.StatusBadRequest, "InvalidUri", "unknown account in "+r.URL.Path)
+		return
+	}
+	s.route(w, r, container, name)
+}
+
+// route serves a request for the container and blob name, either of
+// which may be empty, on its own or as part of a batch.
+func (s *BlobServer) route(w http.ResponseWriter, r *http.Request, container, name string) {
+	query := r.URL.Query()
+	switch {
+	case container == "" && query.Get("comp") == "list":
+		s.listContainers(w, r)
+	case container == "" && query.Get("comp") == "blobs":
+		s.findBlobs(w, r)
+	case container == "":
+		writeBlobError(w, http.StatusBadRequest, "UnsupportedQueryParameter", "unsupported service operation")
+	case name == "" && query.Get("restype") == "container":
+		s.serveContainer(w, r, container)
+	case name == "":
+		writeBlobError(w, http.StatusBadRequest, "UnsupportedQueryParameter", "unsupported container operation")
+	default:
+		s.serveBlob(w, r, container, name)
+	}
+}
+
+// splitPath returns the container and blob name of a request path, and
+// false if the path is not in the fake account.
+func splitPath(p string) (string, string, bool) {
+	p = strings.TrimPrefix(p, "/")
+	if p != Account && !strings.HasPrefix(p, Account+"/") {
+		return "", "", false
+	}
+	p = strings.TrimPrefix(strings.TrimPrefix(p, Account), "/")
+	if i := strings.Index(p, "/"); i >= 0 {
+		return p[:i], p[i+1:], true
+	}
+	return p, "", true
+}
+
+func (s *BlobServer) serveContainer(w http.ResponseWriter, r *http.Request, name string) {
+	c, exists := s.containers[name]
+	if r.Method == http.MethodPut && r.URL.Query().Get("comp") == "" {
+		if exists {
+			writeBlobError(w, http.StatusConflict, "ContainerAlreadyExists", "The specified container already exists.")
+			return
+		}
+		c = s.createContainer(name, readMetadata(r.Header))
+		c.PublicAccess = r.Header.Get("x-ms-blob-public-access")
+		setItemHeaders(w, c.ETag, c.LastModified)
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	if !exists {
+		writeBlobError(w, http.StatusNotFound, "ContainerNotFound", "The specified container does not exist.")
+		return
+	}
+	switch {
+	case r.Method == http.MethodDelete:
+		delete(s.containers, name)
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == http.MethodGet && r.URL.Query().Get("comp") == "list":
+		s.listBlobs(w, r, c)
+	case r.Method == http.MethodPost && r.URL.Query().Get("comp") == "batch":
+		s.batch(w, r, c)
+	case r.Method == http.MethodPut && r.URL.Query().Get("comp") == "acl":
+		policies := xmlSignedIdentifiers{}
+		if err := xml.NewDecoder(r.Body).Decode(&policies); err != nil && err != io.EOF {
+			writeBlobError(w, http.StatusBadRequest, "InvalidXmlDocument", err.Error())
+			return
+		}
+		if len(policies.Items) > 5 {
+			writeBlobError(w, http.StatusBadRequest, "InvalidXmlDocument", "A container can have at most 5 stored access policies.")
+			return
+		}
+		c.PublicAccess, c.AccessPolicies = r.Header.Get("x-ms-blob-public-access"), policies.Items
+		s.touch(&c.ETag, &c.LastModified)
+		setItemHeaders(w, c.ETag, c.LastModified)
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodGet && r.URL.Query().Get("comp") == "acl":
+		if c.PublicAccess != "" {
+			w.Header().Set("x-ms-blob-public-access", c.PublicAccess)
+		}
+		setItemHeaders(w, c.ETag, c.LastModified)
+		writeXML(w, xmlSignedIdentifiers{Items: c.AccessPolicies})
+	case r.Method == http.MethodPut && r.URL.Query().Get("comp") == "metadata":
+		c.Metadata = readMetadata(r.Header)
+		s.touch(&c.ETag, &c.LastModified)
+		setItemHeaders(w, c.ETag, c.LastModified)
+		w.WriteHeader(http.StatusOK)
+	case (r.Method == http.MethodGet || r.Method == http.MethodHead) && r.URL.Query().Get("comp") == "":
+		writeMetadata(w, c.Metadata)
+		setItemHeaders(w, c.ETag, c.LastModified)
+		if c.PublicAccess != "" {
+			w.Header().Set("x-ms-blob-public-access", c.PublicAccess)
+		}
+		w.Header().Set("x-ms-lease-status", "unlocked")
+		w.Header().Set("x-ms-lease-state", "available")
+		w.Header().Set("x-ms-has-immutability-policy", strconv.FormatBool(c.HasImmutabilityPolicy))
+		w.Header().Set("x-ms-has-legal-hold", strconv.FormatBool(c.HasLegalHold))
+		w.WriteHeader(http.StatusOK)
+	default:
+		writeBlobError(w, http.StatusBadRequest, "UnsupportedQueryParameter", "unsupported container operation")
+	}
+}
+
+func (s *BlobServer) serveBlob(w http.ResponseWriter, r *http.Request, container, name string) {
+	c, ok := s.containers[container]
+	if !ok {
+		writeBlobError(w, http.StatusNotFound, "ContainerNotFound", "The specified container does not exist.")
+		return
+	}
+	if query := r.URL.Query(); query.Get("snapshot") != "" || query.Get("versionid") != "" {
+		s.serveBlobVersion(w, r, c, name)
+		return
+	}
+	if r.Method == http.MethodPut && r.URL.Query().Get("comp") == "undelete" {
+		s.undelete(w, c, name)
+		return
+	}
+	b, exists := c.Blobs[name]
+	// blocks are staged whatever the conditions, which apply to the commit
+	if comp := r.URL.Query().Get("comp"); comp != "block" && comp != "lease" && (!checkConditions(w, r, b) || !checkLease(w, r, b)) {
+		return
+	}
+	if r.Method == http.MethodPut {
+		switch r.URL.Query().Get("comp") {
+		case "":
+			if r.Header.Get("x-ms-copy-source") != "" {
+				s.copyBlob(w, r, c, name)
+			} else {
+				s.putBlob(w, r, c, name)
+			}
+			return
+		case "block":
+			s.putBlock(w, r, c, name)
+			return
+		case "blocklist":
+			s.putBlockList(w, r, c, name)
+			return
+		}
+	}
+	if !exists {
+		writeBlobError(w, http.StatusNotFound, "BlobNotFound", "The specified blob does not exist.")
+		return
+	}
+	switch comp := r.URL.Query().Get("comp"); {
+	case r.Method == http.MethodPut && comp == "metadata":
+		s.keep(c, name, b)
+		b.Metadata = readMetadata(r.Header)
+		s.touch(&b.ETag, &b.LastModified)
+		if s.Versioning {
+			b.VersionID = s.stamp()
+		}
+		setItemHeaders(w, b.ETag, b.LastModified)
+		setVersionHeader(w, b)
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodPut && comp == "snapshot":
+		snapshot := *b
+		snapshot.Snapshot, snapshot.LeaseID, snapshot.LeaseExpiry = s.stamp(), "", time.Time{}
+		if metadata := readMetadata(r.Header); len(metadata) > 0 {
+			snapshot.Metadata = metadata
+		}
+		c.snapshots[name] = append(c.snapshots[name], &snapshot)
+		setItemHeaders(w, b.ETag, b.LastModified)
+		w.Header().Set("x-ms-snapshot", snapshot.Snapshot)
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && comp == "properties":
+		readBlobHeaders(r.Header, b)
+		s.touch(&b.ETag, &b.LastModified)
+		setItemHeaders(w, b.ETag, b.LastModified)
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodPut && comp == "appendblock":
+		s.appendBlock(w, r, b)
+	case r.Method == http.MethodPut && comp == "tier":
+		switch tier := r.Header.Get("x-ms-access-tier"); tier {
+		case "Hot", "Cool", "Archive":
+			b.AccessTier = tier
+			w.WriteHeader(http.StatusOK)
+		default:
+			writeBlobError(w, http.StatusBadRequest, "InvalidHeaderValue", "The value for the x-ms-access-tier header is not valid.")
+		}
+	case r.Method == http.MethodPut && comp == "lease":
+		s.lease(w, r, b)
+	case r.Method == http.MethodPut && comp == "tags":
+		tags := xmlTags{}
+		if err := xml.NewDecoder(r.Body).Decode(&tags); err != nil {
+			writeBlobError(w, http.StatusBadRequest, "InvalidXmlDocument", err.Error())
+			return
+		}
+		b.Tags = map[string]string{}
+		for _, tag := range tags.TagSet {
+			b.Tags[tag.Key] = tag.Value
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet && comp == "tags":
+		writeXML(w, tagsXML(b.Tags))
+	case comp != "":
+		writeBlobError(w, http.StatusBadRequest, "UnsupportedQueryParameter", "unsupported blob operation "+comp)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		s.getBlob(w, r, b)
+	case r.Method == http.MethodDelete:
+		s.deleteBlob(w, r, c, name)
+	default:
+		writeBlobError(w, http.StatusBadRequest, "UnsupportedHttpVerb", "unsupported blob operation")
+	}
+}
+
+// deleteBlob deletes the blob name of c and its snapshots, or only its
+// snapshots, as x-ms-delete-snapshots says, keeping the blob as a
+// previous version with Versioning on and what is deleted with SoftDelete
+// on.
+func (s *BlobServer) deleteBlob(w http.ResponseWriter, r *http.Request, c *Container, name string) {
+	option := r.Header.Get("x-ms-delete-snapshots")
+	if option == "" && len(c.snapshots[name]) > 0 {
+		writeBlobError(w, http.StatusConflict, "SnapshotsPresent", "This operation is not permitted because the blob has snapshots.")
+		return
+	}
+	now := time.Now().UTC()
+	if s.SoftDelete {
+		for _, snapshot := range c.snapshots[name] {
+			snapshot.DeletedTime = now
+			c.deleted[name] = append(c.deleted[name], snapshot)
+		}
+	}
+	delete(c.snapshots, name)
+	if option != "only" {
+		b := c.Blobs[name]
+		delete(c.Blobs, name)
+		b.LeaseID, b.LeaseExpiry = "", time.Time{}
+		switch {
+		case s.Versioning && b.VersionID != "":
+			c.versions[name] = append(c.versions[name], b)
+		case s.SoftDelete:
+			b.DeletedTime = now
+			c.deleted[name] = append(c.deleted[name], b)
+		}
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// accessTier returns the access tier of b, which is Hot unless it is set.
+func accessTier(b *Blob) string {
+	if b.AccessTier == "" {
+		return "Hot"
+	}
+	return b.AccessTier
+}
+
+// maxBatchRequests is the most subrequests a batch may have.
+const maxBatchRequests = 256
+
+// batch serves a Blob Batch request to c, a multipart/mixed body of
+// subrequests which are each served as if on their own, in order. The
+// response has a part for each with its Content-ID.
+func (s *BlobServer) batch(w http.ResponseWriter, r *http.Request, c *Container) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || params["boundary"] == "" {
+		writeBlobError(w, http.StatusBadRequest, "InvalidInput", "The batch request is not multipart/mixed.")
+		return
+	}
+	type subresponse struct {
+		id string
+		w  *httptest.ResponseRecorder
+	}
+	responses := []subresponse{}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeBlobError(w, http.StatusBadRequest, "InvalidInput", err.Error())
+			return
+		}
+		if len(responses) == maxBatchRequests {
+			writeBlobError(w, http.StatusBadRequest, "ExceedsMaxBatchRequestCount", "The batch operation exceeds the maximum number of subrequests.")
+			return
+		}
+		sub, err := http.ReadRequest(bufio.NewReader(part))
+		if err != nil {
+			writeBlobError(w, http.StatusBadRequest, "InvalidInput", err.Error())
+			return
+		}
+		rec := httptest.NewRecorder()
+		container, name, ok := splitPath(sub.URL.Path)
+		switch {
+		case !ok || container != c.Name || name == "":
+			writeBlobError(rec, http.StatusBadRequest, "InvalidInput", "A subrequest of a container batch must be for a blob in the container.")
+		case sub.Method != http.MethodDelete && !(sub.Method == http.MethodPut && sub.URL.Query().Get("comp") == "tier"):
+			writeBlobError(rec, http.StatusBadRequest, "InvalidInput", "A batch may only delete blobs or set their tier.")
+		default:
+			s.route(rec, sub, container, name)
+		}
+		responses = append(responses, subresponse{part.Header.Get("Content-ID"), rec})
+	}
+
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	for _, res := range responses {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {"application/http"},
+			"Content-ID":   {res.id},
+		})
+		if err != nil {
+			writeBlobError(w, http.StatusInternalServerError, "InternalError", err.Error())
+			return
+		}
+		res.w.Result().Write(pw)
+	}
+	mw.Close()
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(body.Bytes())
+}
+
+// serveBlobVersion reads or deletes a snapshot or version of the blob name
+// of c. The current version can be read by its ID too.
+func (s *BlobServer) serveBlobVersion(w http.ResponseWriter, r *http.Request, c *Container, name string) {
+	query := r.URL.Query()
+	list, id, key := c.snapshots, query.Get("snapshot"), func(b *Blob) string { return b.Snapshot }
+	if id == "" {
+		list, id, key = c.versions, query.Get("versionid"), func(b *Blob) string { return b.VersionID }
+	}
+	i := 0
+	for i < len(list[name]) && key(list[name][i]) != id {
+		i++
+	}
+	read := (r.Method == http.MethodGet || r.Method == http.MethodHead) && query.Get("comp") == ""
+	switch {
+	case i < len(list[name]) && read:
+		s.getBlob(w, r, list[name][i])
+	case i < len(list[name]) && r.Method == http.MethodDelete:
+		b := list[name][i]
+		list[name] = append(list[name][:i:i], list[name][i+1:]...)
+		if len(list[name]) == 0 {
+			delete(list, name)
+		}
+		if s.SoftDelete {
+			b.DeletedTime = time.Now().UTC()
+			c.deleted[name] = append(c.deleted[name], b)
+		}
+		w.WriteHeader(http.StatusAccepted)
+	case i < len(list[name]):
+		writeBlobError(w, http.StatusBadRequest, "UnsupportedQueryParameter", "unsupported operation on a snapshot or version")
+	case read && c.Blobs[name] != nil && c.Blobs[name].VersionID == query.Get("versionid"):
+		s.getBlob(w, r, c.Blobs[name])
+	default:
+		writeBlobError(w, http.StatusNotFound, "BlobNotFound", "The specified blob does not exist.")
+	}
+}
+
+// undelete restores the soft-deleted snapshots and versions of the blob
+// name of c, and the blob itself unless another has replaced it.
+func (s *BlobServer) undelete(w http.ResponseWriter, c *Container, name string) {
+	if len(c.deleted[name]) == 0 && c.Blobs[name] == nil {
+		writeBlobError(w, http.StatusNotFound, "BlobNotFound", "The specified blob does not exist.")
+		return
+	}
+	for _, b := range c.deleted[name] {
+		b.DeletedTime = time.Time{}
+		switch {
+		case b.Snapshot != "":
+			c.snapshots[name] = append(c.snapshots[name], b)
+		case b.VersionID != "":
+			c.versions[name] = append(c.versions[name], b)
+		default:
+			c.Blobs[name] = b
+		}
+	}
+	delete(c.deleted, name)
+	sort.Slice(c.snapshots[name], func(i, j int) bool { return c.snapshots[name][i].Snapshot < c.snapshots[name][j].Snapshot })
+	sort.Slice(c.versions[name], func(i, j int) bool { return c.versions[name][i].VersionID < c.versions[name][j].VersionID })
+	w.WriteHeader(http.StatusOK)
+}
+
+// copyBlob copies the blob at x-ms-copy-source, which can be a snapshot
+// or version, or in another account, to the blob name of c. The data is
+// copied straight away, though an asynchronous copy reports pending for
+// CopyPolls reads.
+func (s *BlobServer) copyBlob(w http.ResponseWriter, r *http.Request, c *Container, name string) {
+	source := r.Header.Get("x-ms-copy-source")
+	src, status, code := s.copySource(source, r.Header.Get("x-ms-source-if-match"))
+	if src == nil {
+		message := "The specified blob does not exist."
+		if status == http.StatusPreconditionFailed {
+			message = "The source condition specified using HTTP conditional header(s) is not met."
+		}
+		writeBlobError(w, status, code, message)
+		return
+	}
+	b := *src
+	b.Name, b.Snapshot, b.DeletedTime = name, "", time.Time{}
+	b.LeaseID, b.LeaseExpiry, b.leaseDuration = "", time.Time{}, 0
+	b.Metadata, b.Tags = copyMap(src.Metadata), readTags(r.Header)
+	if metadata := readMetadata(r.Header); len(metadata) > 0 {
+		b.Metadata = metadata
+	}
+	s.version++
+	b.CopyID, b.CopySource, b.CopyStatus = fmt.Sprintf("copy-%d", s.version), strings.SplitN(source, "?", 2)[0], "success"
+	if s.CopyPolls > 0 && r.Header.Get("x-ms-requires-sync") != "true" {
+		b.CopyStatus, b.copyPolls = "pending", s.CopyPolls
+	}
+	s.store(c, name, &b)
+	setItemHeaders(w, b.ETag, b.LastModified)
+	setVersionHeader(w, &b)
+	w.Header().Set("x-ms-copy-id", b.CopyID)
+	w.Header().Set("x-ms-copy-status", b.CopyStatus)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// copySource returns the blob, snapshot or version which a copy source
+// URL refers to, checking its ETag against ifMatch, or else the status and
+// error code to fail the copy with. A source in this account is read
+// directly, and any other with a GET, as the service does.
+func (s *BlobServer) copySource(source, ifMatch string) (*Blob, int, string) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, http.StatusBadRequest, "InvalidHeaderValue"
+	}
+	var src *Blob
+	if strings.HasPrefix(source, s.Endpoint()+"/") {
+		src = s.localBlob(u)
+	} else if src, err = fetchBlob(source, ifMatch); err != nil {
+		return nil, http.StatusPreconditionFailed, "SourceConditionNotMet"
+	}
+	switch {
+	case src == nil:
+		return nil, http.StatusNotFound, "CannotVerifyCopySource"
+	case ifMatch != "" && ifMatch != src.ETag:
+		return nil, http.StatusPreconditionFailed, "SourceConditionNotMet"
+	}
+	return src, 0, ""
+}
+
+// localBlob returns the blob, snapshot or version of this account at u, or
+// nil if there is none.
+func (s *BlobServer) localBlob(u *url.URL) *Blob {
+	path := strings.TrimPrefix(u.Path, "/"+Account+"/")
+	i := strings.Index(path, "/")
+	if i < 0 || s.containers[path[:i]] == nil {
+		return nil
+	}
+	c, name := s.containers[path[:i]], path[i+1:]
+	snapshot, versionID := u.Query().Get("snapshot"), u.Query().Get("versionid")
+	if b := c.Blobs[name]; b != nil && snapshot == "" && (versionID == "" || versionID == b.VersionID) {
+		return b
+	}
+	for _, b := range append(append([]*Blob{}, c.snapshots[name]...), c.versions[name]...) {
+		if (snapshot != "" && b.Snapshot == snapshot) || (snapshot == "" && versionID != "" && b.VersionID == versionID) {
+			return b
+		}
+	}
+	return nil
+}
+
+// fetchBlob reads a copy source in another account. It returns nil if the
+// source does not exist or cannot be read, and an error if it does not
+// match ifMatch.
+func fetchBlob(source, ifMatch string) (*Blob, error) {
+	req, err := http.NewRequest(http.MethodGet, source, nil)
+	if err != nil {
+		return nil, nil
+	}
+	req.Header.Set("x-ms-version", "2020-04-08")
+	if ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusPreconditionFailed {
+		return nil, fmt.Errorf("source %s", res.Status)
+	}
+	data, err := io.ReadAll(res.Body)
+	if err != nil || res.StatusCode != http.StatusOK {
+		return nil, nil
+	}
+	b := &Blob{
+		BlobType:           res.Header.Get("x-ms-blob-type"),
+		Data:               data,
+		ContentType:        res.Header.Get("Content-Type"),
+		CacheControl:       res.Header.Get("Cache-Control"),
+		ContentEncoding:    res.Header.Get("Content-Encoding"),
+		ContentLanguage:    res.Header.Get("Content-Language"),
+		ContentDisposition: res.Header.Get("Content-Disposition"),
+		Metadata:           readMetadata(res.Header),
+		ETag:               res.Header.Get("ETag"),
+	}
+	if b.BlobType == "" {
+		b.BlobType = "BlockBlob"
+	}
+	b.ContentMD5, _ = base64.StdEncoding.DecodeString(res.Header.Get("Content-MD5"))
+	if len(b.ContentMD5) == 0 {
+		b.ContentMD5 = nil
+	}
+	return b, nil
+}
+
+// setVersionHeader sets the x-ms-version-id header of a write to b.
+func setVersionHeader(w http.ResponseWriter, b *Blob) {
+	if b.VersionID != "" {
+		w.Header().Set("x-ms-version-id", b.VersionID)
+	}
+}
+
+// checkConditions checks the If-Match and If-None-Match headers against
+// b, which is nil if the blob does not exist, and writes the error the
+// service would if they fail.
+func checkConditions(w http.ResponseWriter, r *http.Request, b *Blob) bool {
+	etag := ""
+	if b != nil {
+		etag = b.ETag
+	}
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && (b == nil || (ifMatch != "*" && ifMatch != etag)) {
+		writeBlobError(w, http.StatusPreconditionFailed, "ConditionNotMet", "The condition specified using HTTP conditional header(s) is not met.")
+		return false
+	}
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	switch {
+	case ifNoneMatch == "" || b == nil:
+		return true
+	case ifNoneMatch == "*" && r.Method == http.MethodPut:
+		writeBlobError(w, http.StatusConflict, "BlobAlreadyExists", "The specified blob already exists.")
+		return false
+	case ifNoneMatch == "*" || ifNoneMatch == etag:
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			w.Header().Set("ETag", etag)
+			w.WriteHeader(http.StatusNotModified)
+		} else {
+			writeBlobError(w, http.StatusPreconditionFailed, "ConditionNotMet", "The condition specified using HTTP conditional header(s) is not met.")
+		}
+		return false
+	}
+	return true
+}
+
+// checkLease checks the x-ms-lease-id header against the lease of b, which
+// is nil if the blob does not exist, and writes the error the service would
+// if a write lacks the ID of an active lease or any request has another.
+func checkLease(w http.ResponseWriter, r *http.Request, b *Blob) bool {
+	id := r.Header.Get("x-ms-lease-id")
+	write := r.Method != http.MethodGet && r.Method != http.MethodHead
+	switch {
+	case id == "" && write && b.leased():
+		writeBlobError(w, http.StatusPreconditionFailed, "LeaseIdMissing", "There is currently a lease on the blob and no lease ID was specified in the request.")
+	case id != "" && !b.leased():
+		writeBlobError(w, http.StatusPreconditionFailed, "LeaseNotPresentWithBlobOperation", "There is currently no lease on the blob.")
+	case id != "" && id != b.LeaseID:
+		writeBlobError(w, http.StatusPreconditionFailed, "LeaseIdMismatchWithBlobOperation", "The lease ID specified did not match the lease ID for the blob.")
+	default:
+		return true
+	}
+	return false
+}
+
+// lease acquires, renews, releases or breaks the lease of b. A break takes
+// effect straight away, whatever the break period.
+func (s *BlobServer) lease(w http.ResponseWriter, r *http.Request, b *Blob) {
+	id := r.Header.Get("x-ms-lease-id")
+	switch action := r.Header.Get("x-ms-lease-action"); action {
+	case "acquire":
+		seconds, err := strconv.Atoi(r.Header.Get("x-ms-lease-duration"))
+		if err != nil || (seconds != -1 && (seconds < 15 || seconds > 60)) {
+			writeBlobError(w, http.StatusBadRequest, "InvalidHeaderValue", "The lease duration must be -1 or between 15 and 60 seconds.")
+			return
+		}
+		id = r.Header.Get("x-ms-proposed-lease-id")
+		if id == "" {
+			id = fmt.Sprintf("lease-%d", s.version)
+		}
+		if b.leased() && b.LeaseID != id {
+			writeBlobError(w, http.StatusConflict, "LeaseAlreadyPresent", "There is already a lease present.")
+			return
+		}
+		b.LeaseID, b.leaseDuration = id, 0
+		if seconds > 0 {
+			b.leaseDuration = time.Duration(seconds) * time.Second
+		}
+		w.Header().Set("x-ms-lease-id", id)
+		w.WriteHeader(http.StatusCreated)
+		b.LeaseExpiry = time.Time{}
+	case "renew", "release":
+		// an expired lease can still be renewed or released by its holder
+		if b.LeaseID == "" || b.LeaseID != id {
+			writeBlobError(w, http.StatusConflict, "LeaseIdMismatchWithLeaseOperation", "The lease ID specified did not match the lease ID for the blob.")
+			return
+		}
+		if action == "release" {
+			b.LeaseID = ""
+		}
+		w.Header().Set("x-ms-lease-id", id)
+		w.WriteHeader(http.StatusOK)
+	case "break":
+		if !b.leased() {
+			writeBlobError(w, http.StatusConflict, "LeaseNotPresentWithLeaseOperation", "There is currently no lease on the blob.")
+			return
+		}
+		b.LeaseID = ""
+		w.Header().Set("x-ms-lease-time", "0")
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		writeBlobError(w, http.StatusBadRequest, "InvalidHeaderValue", "unsupported lease action "+action)
+		return
+	}
+	if b.LeaseID != "" && b.leaseDuration > 0 {
+		b.LeaseExpiry = time.Now().Add(b.leaseDuration)
+	}
+}
+
+// leaseStatus returns the lease status and state of b for listings and
+// downloads.
+func leaseStatus(b *Blob) (string, string) {
+	if b.leased() {
+		return "locked", "leased"
+	}
+	if b.LeaseID != "" {
+		return "unlocked", "expired"
+	}
+	return "unlocked", "available"
+}
+
+func (s *BlobServer) putBlob(w http.ResponseWriter, r *http.Request, c *Container, name string) {
+	blobType := r.Header.Get("x-ms-blob-type")
+	if blobType != "BlockBlob" && blobType != "AppendBlob" {
+		writeBlobError(w, http.StatusBadRequest, "InvalidHeaderValue", "unsupported blob type "+blobType)
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeBlobError(w, http.StatusBadRequest, "InvalidInput", err.Error())
+		return
+	}
+	if blobType == "AppendBlob" && len(data) > 0 {
+		writeBlobError(w, http.StatusBadRequest, "InvalidHeaderValue", "an append blob is created empty")
+		return
+	}
+	b := &Blob{Name: name, BlobType: blobType, Data: data, Metadata: readMetadata(r.Header), Tags: readTags(r.Header)}
+	readBlobHeaders(r.Header, b)
+	// a single-request upload gets a Content-MD5 even if the client sets none
+	if b.ContentMD5 == nil && blobType == "BlockBlob" {
+		sum := md5.Sum(data)
+		b.ContentMD5 = sum[:]
+	}
+	s.store(c, name, b)
+	setItemHeaders(w, b.ETag, b.LastModified)
+	setVersionHeader(w, b)
+	if b.ContentMD5 != nil {
+		w.Header().Set("Content-MD5", base64.StdEncoding.EncodeToString(b.ContentMD5))
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// maxAppendBlocks is the most blocks an append blob can have.
+const maxAppendBlocks = 50000
+
+// appendBlock appends the body to the append blob b, checking the
+// append position and maximum size conditions.
+func (s *BlobServer) appendBlock(w http.ResponseWriter, r *http.Request, b *Blob) {
+	if b.BlobType != "AppendBlob" {
+		writeBlobError(w, http.StatusConflict, "InvalidBlobType", "The blob type is invalid for this operation.")
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeBlobError(w, http.StatusBadRequest, "InvalidInput", err.Error())
+		return
+	}
+	size := int64(len(b.Data))
+	if len(data) > 4<<20 {
+		writeBlobError(w, http.StatusRequestEntityTooLarge, "RequestBodyTooLarge", "The request body is too large.")
+		return
+	}
+	if maxSize := r.Header.Get("x-ms-blob-condition-maxsize"); maxSize != "" && size+int64(len(data)) > atoi64(maxSize) {
+		writeBlobError(w, http.StatusPreconditionFailed, "MaxBlobSizeConditionNotMet", "The max blob size condition specified was not met.")
+		return
+	}
+	if position := r.Header.Get("x-ms-blob-condition-appendpos"); position != "" && size != atoi64(position) {
+		writeBlobError(w, http.StatusPreconditionFailed, "AppendPositionConditionNotMet", "The append position condition specified was not met.")
+		return
+	}
+	if b.blocks >= maxAppendBlocks {
+		writeBlobError(w, http.StatusConflict, "BlockCountExceedsLimit", "The committed block count cannot exceed the maximum limit of 50,000 blocks.")
+		return
+	}
+	b.Data = append(b.Data, data...)
+	b.blocks++
+	s.touch(&b.ETag, &b.LastModified)
+	setItemHeaders(w, b.ETag, b.LastModified)
+	w.Header().Set("x-ms-blob-append-offset", strconv.FormatInt(size, 10))
+	w.Header().Set("x-ms-blob-committed-block-count", strconv.Itoa(b.blocks))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *BlobServer) putBlock(w http.ResponseWriter, r *http.Request, c *Container, name string) {
+	id := r.URL.Query().Get("blockid")
+	if id == "" {
+		writeBlobError(w, http.StatusBadRequest, "InvalidQueryParameterValue", "missing blockid")
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeBlobError(w, http.StatusBadRequest, "InvalidInput", err.Error())
+		return
+	}
+	if c.blocks[name] == nil {
+		c.blocks[name] = map[string][]byte{}
+	}
+	c.blocks[name][id] = data
+	w.WriteHeader(http.StatusCreated)
+}
+
+// putBlockList commits staged blocks. Only uncommitted (or latest) blocks
+// are supported, as a committed blob keeps no blocks of its own.
+func (s *BlobServer) putBlockList(w http.ResponseWriter, r *http.Request, c *Container, name string) {
+	list := struct {
+		IDs []string `xml:",any"`
+	}{}
+	if err := xml.NewDecoder(r.Body).Decode(&list); err != nil {
+		writeBlobError(w, http.StatusBadRequest, "InvalidXmlDocument", err.Error())
+		return
+	}
+	data := []byte{}
+	for _, id := range list.IDs {
+		block, ok := c.blocks[name][id]
+		if !ok {
+			writeBlobError(w, http.StatusBadRequest, "InvalidBlockList", "The specified block list is invalid.")
+			return
+		}
+		data = append(data, block...)
+	}
+	delete(c.blocks, name)
+
+	// like the service, the blob has no Content-MD5 unless the client sets one
+	b := &Blob{Name: name, BlobType: "BlockBlob", Data: data, Metadata: readMetadata(r.Header), Tags: readTags(r.Header)}
+	readBlobHeaders(r.Header, b)
+	s.store(c, name, b)
+	setItemHeaders(w, b.ETag, b.LastModified)
+	setVersionHeader(w, b)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *BlobServer) getBlob(w http.ResponseWriter, r *http.Request, b *Blob) {
+	if r.Method == http.MethodGet && b.AccessTier == "Archive" {
+		writeBlobError(w, http.StatusConflict, "BlobArchived", "This operation is not permitted on an archived blob.")
+		return
+	}
+	data := b.Data
+	status := http.StatusOK
+	if rng := r.Header.Get("x-ms-range"); rng != "" || r.Header.Get("Range") != "" {
+		if rng == "" {
+			rng = r.Header.Get("Range")
+		}
+		start, end, ok := parseRange(rng, int64(len(b.Data)))
+		if !ok {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", len(b.Data)))
+			writeBlobError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The range specified is invalid for the current size of the resource.")
+			return
+		}
+		data = b.Data[start : end+1]
+		status = http.StatusPartialContent
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(b.Data)))
+	}
+	setItemHeaders(w, b.ETag, b.LastModified)
+	writeMetadata(w, b.Metadata)
+	w.Header().Set("Content-Type", b.ContentType)
+	for header, value := range map[string]string{
+		"Cache-Control":       b.CacheControl,
+		"Content-Encoding":    b.ContentEncoding,
+		"Content-Language":    b.ContentLanguage,
+		"Content-Disposition": b.ContentDisposition,
+	} {
+		if value != "" {
+			w.Header().Set(header, value)
+		}
+	}
+	if len(b.Tags) > 0 {
+		w.Header().Set("x-ms-tag-count", strconv.Itoa(len(b.Tags)))
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("x-ms-blob-type", b.BlobType)
+	w.Header().Set("x-ms-access-tier", accessTier(b))
+	if b.BlobType == "AppendBlob" {
+		w.Header().Set("x-ms-blob-committed-block-count", strconv.Itoa(b.blocks))
+	}
+	leaseStatus, leaseState := leaseStatus(b)
+	w.Header().Set("x-ms-lease-status", leaseStatus)
+	w.Header().Set("x-ms-lease-state", leaseState)
+	setVersionHeader(w, b)
+	if b.CopyStatus == "pending" {
+		if b.copyPolls == 0 {
+			b.CopyStatus = "success"
+		} else {
+			b.copyPolls--
+		}
+	}
+	if b.CopyStatus != "" {
+		w.Header().Set("x-ms-copy-id", b.CopyID)
+		w.Header().Set("x-ms-copy-source", b.CopySource)
+		w.Header().Set("x-ms-copy-status", b.CopyStatus)
+	}
+	if status == http.StatusOK && b.ContentMD5 != nil {
+		w.Header().Set("Content-MD5", base64.StdEncoding.EncodeToString(b.ContentMD5))
+	}
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		w.Write(data)
+	}
+}
+
+// parseRange parses "bytes=start-" or "bytes=start-end" and returns the
+// inclusive offsets within size.
+func parseRange(rng string, size int64) (int64, int64, bool) {
+	spec := strings.TrimPrefix(rng, "bytes=")
+	parts := strings.SplitN(spec, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if parts[1] != "" {
+		end, err = strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false
+		}
+		if end > size-1 {
+			end = size - 1
+		}
+	}
+	return start, end, true
+}
+
+type xmlProperties struct {
+	LastModified  string `xml:"Last-Modified"`
+	Etag          string `xml:"Etag"`
+	ContentLength *int   `xml:"Content-Length,omitempty"`
+	ContentType   string `xml:"Content-Type,omitempty"`
+	ContentMD5    string `xml:"Content-MD5,omitempty"`
+	BlobType      string `xml:"BlobType,omitempty"`
+	LeaseStatus   string `xml:"LeaseStatus"`
+	LeaseState    string `xml:"LeaseState"`
+	DeletedTime   string `xml:"DeletedTime,omitempty"`
+	AccessTier    string `xml:"AccessTier,omitempty"`
+}
+
+type xmlTag struct {
+	Key   string `xml:"Key"`
+	Value string `xml:"Value"`
+}
+
+type xmlTags struct {
+	XMLName xml.Name `xml:"Tags"`
+	TagSet  []xmlTag `xml:"TagSet>Tag"`
+}
+
+func tagsXML(tags map[string]string) *xmlTags {
+	keys := []string{}
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	x := &xmlTags{TagSet: []xmlTag{}}
+	for _, key := range keys {
+		x.TagSet = append(x.TagSet, xmlTag{key, tags[key]})
+	}
+	return x
+}
+
+type xmlMetadata struct {
+	Inner string `xml:",innerxml"`
+}
+
+type xmlContainer struct {
+	Name       string        `xml:"Name"`
+	Properties xmlProperties `xml:"Properties"`
+	Metadata   *xmlMetadata  `xml:"Metadata,omitempty"`
+}
+
+type xmlBlob struct {
+	Name             string        `xml:"Name"`
+	Deleted          bool          `xml:"Deleted,omitempty"`
+	Snapshot         string        `xml:"Snapshot,omitempty"`
+	VersionID        string        `xml:"VersionId,omitempty"`
+	IsCurrentVersion *bool         `xml:"IsCurrentVersion,omitempty"`
+	Properties       xmlProperties `xml:"Properties"`
+	Metadata         *xmlMetadata  `xml:"Metadata,omitempty"`
+	Tags             *xmlTags      `xml:"Tags,omitempty"`
+}
+
+type xmlBlobPrefix struct {
+	Name string `xml:"Name"`
+}
+
+type xmlContainerList struct {
+	XMLName         xml.Name       `xml:"EnumerationResults"`
+	ServiceEndpoint string         `xml:"ServiceEndpoint,attr"`
+	Prefix          string         `xml:"Prefix,omitempty"`
+	Marker          string         `xml:"Marker,omitempty"`
+	MaxResults      int            `xml:"MaxResults,omitempty"`
+	Containers      []xmlContainer `xml:"Containers>Container"`
+	NextMarker      string         `xml:"NextMarker"`
+}
+
+type xmlBlobList struct {
+	XMLName         xml.Name `xml:"EnumerationResults"`
+	ServiceEndpoint string   `xml:"ServiceEndpoint,attr"`
+	ContainerName   string   `xml:"ContainerName,attr"`
+	Prefix          string   `xml:"Prefix,omitempty"`
+	Marker          string   `xml:"Marker,omitempty"`
+	MaxResults      int      `xml:"MaxResults,omitempty"`
+	Delimiter       string   `xml:"Delimiter,omitempty"`
+	Blobs           struct {
+		Items []interface{}
+	} `xml:"Blobs"`
+	NextMarker string `xml:"NextMarker"`
+}
+
+func (s *BlobServer) listContainers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	prefix, marker := query.Get("prefix"), query.Get("marker")
+	includeMetadata := strings.Contains(query.Get("include"), "metadata")
+
+	names := []string{}
+	for name := range s.containers {
+		if strings.HasPrefix(name, prefix) && name >= marker {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	result := xmlContainerList{
+		ServiceEndpoint: s.Endpoint() + "/",
+		Prefix:          prefix,
+		Marker:          marker,
+		MaxResults:      atoi(query.Get("maxresults")),
+		Containers:      []xmlContainer{},
+	}
+	names, result.NextMarker = page(names, s.pageSize(query))
+	for _, name := range names {
+		c := s.containers[name]
+		item := xmlContainer{
+			Name: name,
+			Properties: xmlProperties{
+				LastModified: c.LastModified.Format(http.TimeFormat),
+				Etag:         c.ETag,
+				LeaseStatus:  "unlocked",
+				LeaseState:   "available",
+			},
+		}
+		if includeMetadata {
+			item.Metadata = metadataXML(c.Metadata)
+		}
+		result.Containers = append(result.Containers, item)
+	}
+	writeXML(w, result)
+}
+
+// listBlobs lists the blobs of c, and with include their snapshots,
+// previous versions and soft-deleted blobs. Pages are of blob names, so
+// each name is listed with all of its snapshots and versions.
+func (s *BlobServer) listBlobs(w http.ResponseWriter, r *http.Request, c *Container) {
+	query := r.URL.Query()
+	prefix, marker, delimiter := query.Get("prefix"), query.Get("marker"), query.Get("delimiter")
+	include := map[string]bool{}
+	for _, item := range strings.Split(query.Get("include"), ",") {
+		include[item] = true
+	}
+
+	// with a delimiter, names below the next delimiter collapse into a
+	// single BlobPrefix, which is listed in name order with the blobs
+	entries := map[string][]*Blob{}
+	for name, b := range c.Blobs {
+		entries[name] = append(entries[name], b)
+	}
+	if include["snapshots"] {
+		for name, snapshots := range c.snapshots {
+			entries[name] = append(entries[name], snapshots...)
+		}
+	}
+	if include["versions"] {
+		for name, versions := range c.versions {
+			entries[name] = append(entries[name], versions...)
+		}
+	}
+	if include["deleted"] {
+		for name, deleted := range c.deleted {
+			for _, b := range deleted {
+				if (b.Snapshot == "" || include["snapshots"]) && (b.Snapshot != "" || b.VersionID == "" || include["versions"]) {
+					entries[name] = append(entries[name], b)
+				}
+			}
+		}
+	}
+	names := []string{}
+	seen := map[string]bool{}
+	for name := range entries {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if delimiter != "" {
+			if i := strings.Index(name[len(prefix):], delimiter); i >= 0 {
+				name = name[:len(prefix)+i+len(delimiter)]
+			}
+		}
+		if name >= marker && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	result := xmlBlobList{
+		ServiceEndpoint: s.Endpoint() + "/",
+		ContainerName:   c.Name,
+		Prefix:          prefix,
+		Marker:          marker,
+		MaxResults:      atoi(query.Get("maxresults")),
+		Delimiter:       delimiter,
+	}
+	names, result.NextMarker = page(names, s.pageSize(query))
+	for _, name := range names {
+		if _, ok := entries[name]; !ok || (delimiter != "" && strings.HasSuffix(name, delimiter)) {
+			result.Blobs.Items = append(result.Blobs.Items, struct {
+				XMLName xml.Name `xml:"BlobPrefix"`
+				xmlBlobPrefix
+			}{xmlBlobPrefix: xmlBlobPrefix{Name: name}})
+			continue
+		}
+		// snapshots and versions are listed oldest first, then the blob
+		sort.SliceStable(entries[name], func(i, j int) bool {
+			return listOrder(entries[name][i], c.Blobs[name]) < listOrder(entries[name][j], c.Blobs[name])
+		})
+		for _, b := range entries[name] {
+			result.Blobs.Items = append(result.Blobs.Items, struct {
+				XMLName xml.Name `xml:"Blob"`
+				xmlBlob
+			}{xmlBlob: blobXML(b, b == c.Blobs[name], include)})
+		}
+	}
+	writeXML(w, result)
+}
+
+// listOrder returns the key a listing orders the snapshots and versions of
+// a blob by, where current is the current blob.
+func listOrder(b, current *Blob) string {
+	switch {
+	case b.Snapshot != "":
+		return "1" + b.Snapshot
+	case b == current:
+		return "3"
+	case b.VersionID != "":
+		return "2" + b.VersionID
+	}
+	return "4"
+}
+
+// blobXML returns the listing of b, which is the current blob if current.
+func blobXML(b *Blob, current bool, include map[string]bool) xmlBlob {
+	length := len(b.Data)
+	leaseStatus, leaseState := leaseStatus(b)
+	item := xmlBlob{
+		Name:     b.Name,
+		Deleted:  !b.DeletedTime.IsZero(),
+		Snapshot: b.Snapshot,
+		Properties: xmlProperties{
+			LastModified:  b.LastModified.Format(http.TimeFormat),
+			Etag:          b.ETag,
+			ContentLength: &length,
+			ContentType:   b.ContentType,
+			ContentMD5:    base64.StdEncoding.EncodeToString(b.ContentMD5),
+			BlobType:      b.BlobType,
+			LeaseStatus:   leaseStatus,
+			LeaseState:    leaseState,
+			AccessTier:    accessTier(b),
+		},
+	}
+	if item.Deleted {
+		item.Properties.DeletedTime = b.DeletedTime.Format(http.TimeFormat)
+	}
+	if b.VersionID != "" && b.Snapshot == "" {
+		item.VersionID = b.VersionID
+		item.IsCurrentVersion = &current
+	}
+	if include["metadata"] {
+		item.Metadata = metadataXML(b.Metadata)
+	}
+	if include["tags"] && len(b.Tags) > 0 {
+		item.Tags = tagsXML(b.Tags)
+	}
+	return item
+}
+
+type xmlFilterBlob struct {
+	Name          string   `xml:"Name"`
+	ContainerName string   `xml:"ContainerName"`
+	Tags          *xmlTags `xml:"Tags"`
+}
+
+type xmlFilterResults struct {
+	XMLName         xml.Name        `xml:"EnumerationResults"`
+	ServiceEndpoint string          `xml:"ServiceEndpoint,attr"`
+	Where           string          `xml:"Where"`
+	Blobs           []xmlFilterBlob `xml:"Blobs>Blob"`
+	NextMarker      string          `xml:"NextMarker"`
+}
+
+// findBlobs serves Find Blobs by Tags. Like the service, it returns the
+// tags which the expression names rather than all of them.
+func (s *BlobServer) findBlobs(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	where, err := parseTagFilter(query.Get("where"))
+	if err != nil {
+		writeBlobError(w, http.StatusBadRequest, "InvalidQueryParameterValue", err.Error())
+		return
+	}
+
+	// the marker and ordering are by container and then blob name
+	keys := []string{}
+	matches := map[string]xmlFilterBlob{}
+	for _, c := range s.containers {
+		for _, b := range c.Blobs {
+			if !where.match(c.Name, b.Tags) {
+				continue
+			}
+			key := c.Name + "/" + b.Name
+			if key < query.Get("marker") {
+				continue
+			}
+			tags := map[string]string{}
+			for _, clause := range where {
+				if value, ok := b.Tags[clause.key]; ok {
+					tags[clause.key] = value
+				}
+			}
+			keys = append(keys, key)
+			matches[key] = xmlFilterBlob{Name: b.Name, ContainerName: c.Name, Tags: tagsXML(tags)}
+		}
+	}
+	sort.Strings(keys)
+
+	result := xmlFilterResults{ServiceEndpoint: s.Endpoint() + "/", Where: query.Get("where"), Blobs: []xmlFilterBlob{}}
+	keys, result.NextMarker = page(keys, s.pageSize(query))
+	for _, key := range keys {
+		result.Blobs = append(result.Blobs, matches[key])
+	}
+	writeXML(w, result)
+}
+
+// tagFilter is a tag filter expression: clauses joined by AND.
+type tagFilter []tagClause
+
+// tagClause compares a tag, or the container name for "@container", with
+// a value.
+type tagClause struct {
+	key, op, value string
+}
+
+// parseTagFilter parses expressions such as
+// "build" = '42' AND "stage" >= 'b' AND @container = 'main'.
+func parseTagFilter(where string) (tagFilter, error) {
+	filter := tagFilter{}
+	for _, clause := range regexp.MustCompile(`(?i)\s+AND\s+`).Split(strings.TrimSpace(where), -1) {
+		m := regexp.MustCompile(`^("[^"]*"|@container)\s*(=|>=|<=|>|<)\s*'([^']*)'$`).FindStringSubmatch(clause)
+		if m == nil {
+			return nil, fmt.Errorf("unsupported tag filter %q", clause)
+		}
+		filter = append(filter, tagClause{strings.Trim(m[1], `"`), m[2], m[3]})
+	}
+	return filter, nil
+}
+
+func (f tagFilter) match(container string, tags map[string]string) bool {
+	for _, clause := range f {
+		value, ok := tags[clause.key], true
+		if clause.key == "@container" {
+			value = container
+		} else {
+			_, ok = tags[clause.key]
+		}
+		if !ok {
+			return false
+		}
+		var matched bool
+		switch clause.op {
+		case "=":
+			matched = value == clause.value
+		case ">":
+			matched = value > clause.value
+		case ">=":
+			matched = value >= clause.value
+		case "<":
+			matched = value < clause.value
+		case "<=":
+			matched = value <= clause.value
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *BlobServer) pageSize(query url.Values) int {
+	size := s.PageSize
+	if max := atoi(query.Get("maxresults")); max > 0 && max < size {
+		size = max
+	}
+	return size
+}
+
+// page returns the first size names and the marker of the next page.
+func page(names []string, size int) ([]string, string) {
+	if len(names) <= size {
+		return names, ""
+	}
+	return names[:size], names[size]
+}
+
+func atoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+func atoi64(s string) int64 {
+	n, _ := strconv.ParseInt(s, 10, 64)
+	return n
+}
+
+// readBlobHeaders sets the HTTP headers of b from a request, clearing any
+// which are missing as the service does.
+func readBlobHeaders(h http.Header, b *Blob) {
+	b.ContentType = h.Get("x-ms-blob-content-type")
+	if b.ContentType == "" {
+		b.ContentType = "application/octet-stream"
+	}
+	b.ContentMD5, _ = base64.StdEncoding.DecodeString(h.Get("x-ms-blob-content-md5"))
+	if len(b.ContentMD5) == 0 {
+		b.ContentMD5 = nil
+	}
+	b.CacheControl = h.Get("x-ms-blob-cache-control")
+	b.ContentEncoding = h.Get("x-ms-blob-content-encoding")
+	b.ContentLanguage = h.Get("x-ms-blob-content-language")
+	b.ContentDisposition = h.Get("x-ms-blob-content-disposition")
+}
+
+// readTags reads the x-ms-tags header of an upload, "k1=v1&k2=v2".
+func readTags(h http.Header) map[string]string {
+	tags := map[string]string{}
+	values, _ := url.ParseQuery(h.Get("x-ms-tags"))
+	for key := range values {
+		tags[key] = values.Get(key)
+	}
+	return tags
+}
+
+func copyMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func readMetadata(h http.Header) map[string]string {
+	metadata := map[string]string{}
+	for key, values := range h {
+		key = strings.ToLower(key)
+		if strings.HasPrefix(key, "x-ms-meta-") && len(values) > 0 {
+			metadata[strings.TrimPrefix(key, "x-ms-meta-")] = values[0]
+		}
+	}
+	return metadata
+}
+
+func writeMetadata(w http.ResponseWriter, metadata map[string]string) {
+	for key, value := range metadata {
+		w.Header().Set("x-ms-meta-"+key, value)
+	}
+}
+
+func metadataXML(metadata map[string]string) *xmlMetadata {
+	keys := []string{}
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	b := &bytes.Buffer{}
+	for _, key := range keys {
+		fmt.Fprintf(b, "<%s>", key)
+		xml.EscapeText(b, []byte(metadata[key]))
+		fmt.Fprintf(b, "</%s>", key)
+	}
+	return &xmlMetadata{Inner: b.String()}
+}
+
+func setItemHeaders(w http.ResponseWriter, etag string, lastModified time.Time) {
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	b, err := xml.Marshal(v)
+	if err != nil {
+		writeBlobError(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, xml.Header)
+	w.Write(b)
+}
+
+// writeBlobError writes an error in the shape of the Blob service, which
+// azblob turns into an azblob.StorageError with the code as ServiceCode.
+func writeBlobError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("x-ms-error-code", code)
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	b := &bytes.Buffer{}
+	xml.EscapeText(b, []byte(message))
+	fmt.Fprintf(w, "%s<Error><Code>%s</Code><Message>%s</Message></Error>", xml.Header, code, b)
+}
@@ -0,0 +1,29 @@
+/*
+Package fakestorage provides in-memory fakes of the Blob Storage and Table
+Storage REST APIs for hermetic tests.
+
+Each fake is an *httptest.Server which speaks enough of the wire protocol
+for the real SDK clients (azblob and aztables) to work against it, in the
+path-style form Azurite uses: http://127.0.0.1:port/devstoreaccount1/...
+Requests are not authenticated, so any key works.
+
+A test points the package under test at a fake via its Profile:
+
+	s := fakestorage.NewBlobServer()
+	defer s.Close()
+	config.SetActive(s.Profile())
+
+	err := blob.CreateContainer(ctx, "main", nil)
+
+The fakes keep only what the azgo packages use: block blobs, uploaded whole
+or as staged blocks, and append blobs, with metadata, headers and index
+tags, If-Match, If-None-Match and append conditions, leases, snapshots,
+versions and soft delete (see BlobServer.Versioning), copies within the
+account or from another fake, which may report as pending for a while
+(CopyPolls), access tiers, batches of deletes and tier changes,
+container access policies, flat and hierarchical listings with markers,
+table entities with a subset of OData filters, and continuation tokens.
+Page sizes are small and configurable (PageSize) so pagination is
+exercised without thousands of items.
+*/
+package fakestorage
@@ -0,0 +1,278 @@
+package fakestorage
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// token is a lexical token of an OData filter. Quoted tokens are string
+// literals, including typed ones such as datetime'...' and guid'...'.
+type token struct {
+	text   string
+	quoted bool
+}
+
+func tokenize(s string) ([]token, error) {
+	tokens := []token{}
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(' || c == ')' || c == ',' || c == '=':
+			tokens = append(tokens, token{text: string(c)})
+			i++
+		case c == '\'':
+			text, n, err := readQuoted(s[i:])
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{text: text, quoted: true})
+			i += n
+		default:
+			j := i
+			for j < len(s) && !strings.ContainsRune(" \t(),='", rune(s[j])) {
+				j++
+			}
+			// a typed literal like datetime'2021-01-01T00:00:00Z'
+			if j < len(s) && s[j] == '\'' {
+				text, n, err := readQuoted(s[j:])
+				if err != nil {
+					return nil, err
+				}
+				tokens = append(tokens, token{text: text, quoted: true})
+				i = j + n
+				continue
+			}
+			tokens = append(tokens, token{text: s[i:j]})
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+// readQuoted reads a single-quoted string, in which a doubled quote is an
+// escaped quote, and returns its value and length.
+func readQuoted(s string) (string, int, error) {
+	b := &strings.Builder{}
+	for i := 1; i < len(s); i++ {
+		if s[i] != '\'' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+1 < len(s) && s[i+1] == '\'' {
+			b.WriteByte('\'')
+			i++
+			continue
+		}
+		return b.String(), i + 1, nil
+	}
+	return "", 0, fmt.Errorf("unterminated string in filter %q", s)
+}
+
+// operand is a property name or a literal value in a comparison.
+type operand struct {
+	property string
+	literal  interface{}
+}
+
+func (o operand) value(entity Entity) (interface{}, bool) {
+	if o.property == "" {
+		return o.literal, true
+	}
+	v, ok := entity[o.property]
+	return v, ok
+}
+
+// filter is a parsed OData filter: and, or and not of comparisons with eq,
+// ne, gt, ge, lt and le. A nil *filter matches everything.
+type filter struct {
+	op          string
+	left, right *filter // and, or, not (left only)
+	a, b        operand // comparisons
+}
+
+func parseFilter(s string) (*filter, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	tokens, err := tokenize(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{tokens: tokens}
+	f, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in filter %q", p.tokens[p.pos].text, s)
+	}
+	return f, nil
+}
+
+type filterParser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *filterParser) peek() (token, bool) {
+	if p.pos >= len(p.tokens) {
+		return token{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+func (p *filterParser) keyword(word string) bool {
+	t, ok := p.peek()
+	if ok && !t.quoted && t.text == word {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) or() (*filter, error) {
+	left, err := p.and()
+	for err == nil && p.keyword("or") {
+		var right *filter
+		right, err = p.and()
+		left = &filter{op: "or", left: left, right: right}
+	}
+	return left, err
+}
+
+func (p *filterParser) and() (*filter, error) {
+	left, err := p.unary()
+	for err == nil && p.keyword("and") {
+		var right *filter
+		right, err = p.unary()
+		left = &filter{op: "and", left: left, right: right}
+	}
+	return left, err
+}
+
+func (p *filterParser) unary() (*filter, error) {
+	if p.keyword("not") {
+		f, err := p.unary()
+		return &filter{op: "not", left: f}, err
+	}
+	if p.keyword("(") {
+		f, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.keyword(")") {
+			return nil, fmt.Errorf("missing ) in filter")
+		}
+		return f, nil
+	}
+	a, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	op, ok := p.peek()
+	if !ok {
+		return nil, fmt.Errorf("missing operator in filter")
+	}
+	switch op.text {
+	case "eq", "ne", "gt", "ge", "lt", "le":
+		p.pos++
+	default:
+		return nil, fmt.Errorf("unsupported operator %q in filter", op.text)
+	}
+	b, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	return &filter{op: op.text, a: a, b: b}, nil
+}
+
+func (p *filterParser) operand() (operand, error) {
+	t, ok := p.peek()
+	if !ok {
+		return operand{}, fmt.Errorf("missing operand in filter")
+	}
+	p.pos++
+	if t.quoted {
+		return operand{literal: t.text}, nil
+	}
+	switch t.text {
+	case "true", "false":
+		return operand{literal: t.text == "true"}, nil
+	case "null":
+		return operand{literal: nil}, nil
+	}
+	if n, err := strconv.ParseFloat(strings.TrimSuffix(t.text, "L"), 64); err == nil {
+		return operand{literal: n}, nil
+	}
+	return operand{property: t.text}, nil
+}
+
+func (f *filter) match(entity Entity) bool {
+	if f == nil {
+		return true
+	}
+	switch f.op {
+	case "and":
+		return f.left.match(entity) && f.right.match(entity)
+	case "or":
+		return f.left.match(entity) || f.right.match(entity)
+	case "not":
+		return !f.left.match(entity)
+	}
+	a, ok1 := f.a.value(entity)
+	b, ok2 := f.b.value(entity)
+	if !ok1 || !ok2 {
+		return false
+	}
+	c, ok := compare(a, b)
+	if !ok {
+		return f.op == "ne"
+	}
+	switch f.op {
+	case "eq":
+		return c == 0
+	case "ne":
+		return c != 0
+	case "gt":
+		return c > 0
+	case "ge":
+		return c >= 0
+	case "lt":
+		return c < 0
+	case "le":
+		return c <= 0
+	}
+	return false
+}
+
+// compare compares two values of the same type, or reports false if they
+// cannot be compared.
+func compare(a, b interface{}) (int, bool) {
+	switch a := a.(type) {
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b), true
+		}
+	case float64:
+		if b, ok := b.(float64); ok {
+			switch {
+			case a < b:
+				return -1, true
+			case a > b:
+				return 1, true
+			}
+			return 0, true
+		}
+	case bool:
+		if b, ok := b.(bool); ok {
+			if a == b {
+				return 0, true
+			}
+			return 1, true
+		}
+	}
+	return 0, false
+}
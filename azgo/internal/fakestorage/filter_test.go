@@ -0,0 +1,46 @@
+package fakestorage
+
+import "testing"
+
+func TestFilter(t *testing.T) {
+	entity := Entity{"PartitionKey": "main", "RowKey": "it's", "n": 3.0, "ok": true}
+	tests := map[string]bool{
+		"":                                   true,
+		"PartitionKey eq 'main'":             true,
+		"RowKey eq 'it''s'":                  true,
+		"RowKey ge 'a' and RowKey lt 'j'":    true,
+		"n gt 2 and n le 3":                  true,
+		"n gt 3 or ok eq true":               true,
+		"not (PartitionKey eq 'main')":       false,
+		"missing eq 'x'":                     false,
+		"n eq '3'":                           false,
+		"(n lt 1 or n gt 2) and ok eq false": false,
+		"Timestamp ge datetime'2021-01-01Z'": false,
+	}
+	for s, want := range tests {
+		f, err := parseFilter(s)
+		if err != nil {
+			t.Errorf("parseFilter(%q): %v", s, err)
+			continue
+		}
+		if got := f.match(entity); got != want {
+			t.Errorf("%q matched %t, want %t", s, got, want)
+		}
+	}
+
+	for _, s := range []string{"n eq", "RowKey eq 'open", "(n eq 1", "n like 1"} {
+		if _, err := parseFilter(s); err == nil {
+			t.Errorf("parseFilter(%q) returned no error", s)
+		}
+	}
+}
+
+func TestParseEntityKeys(t *testing.T) {
+	key, ok := parseEntityKeys("(PartitionKey='main',RowKey='a%2Fb=c')")
+	if !ok || key != [2]string{"main", "a/b=c"} {
+		t.Errorf("parseEntityKeys = %v, %t", key, ok)
+	}
+	if _, ok := parseEntityKeys("(PartitionKey='main')"); ok {
+		t.Error("parseEntityKeys without a RowKey succeeded")
+	}
+}
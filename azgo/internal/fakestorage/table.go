@@ -0,0 +1,441 @@
+package fakestorage
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blue-eight/azgo/azgo/config"
+)
+
+// Entity is a table entity: its properties keyed by name, including
+// PartitionKey and RowKey.
+type Entity map[string]interface{}
+
+type table struct {
+	name     string
+	entities map[[2]string]Entity
+	etags    map[[2]string]string
+}
+
+// TableServer is an in-memory fake of the Table Storage REST API.
+type TableServer struct {
+	*httptest.Server
+
+	// PageSize is the most entities or tables a query returns per request
+	// when the client asks for more (or does not ask). It defaults to 1000.
+	PageSize int
+
+	mu       sync.Mutex
+	tables   map[string]*table
+	requests []*http.Request
+	version  int
+}
+
+// NewTableServer starts and returns a new TableServer. The caller should
+// Close it when finished.
+func NewTableServer() *TableServer {
+	s := &TableServer{
+		PageSize: 1000,
+		tables:   map[string]*table{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Endpoint returns the table endpoint of the fake account.
+func (s *TableServer) Endpoint() string {
+	return s.URL + "/" + Account
+}
+
+// Profile returns a profile which points the table package at the fake.
+func (s *TableServer) Profile() *config.Profile {
+	return &config.Profile{
+		Name:          "fakestorage",
+		TableAccount:  Account,
+		TableKey:      config.DevelopmentAccountKey,
+		TableType:     "storage",
+		TableEndpoint: s.Endpoint(),
+	}
+}
+
+// CreateTable creates a table directly, bypassing the API.
+func (s *TableServer) CreateTable(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tables[name] = &table{name: name, entities: map[[2]string]Entity{}, etags: map[[2]string]string{}}
+}
+
+// PutEntity creates or replaces an entity directly, bypassing the API. The
+// table is created if it does not exist.
+func (s *TableServer) PutEntity(tableName string, entity Entity) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tables[tableName]
+	if !ok {
+		t = &table{name: tableName, entities: map[[2]string]Entity{}, etags: map[[2]string]string{}}
+		s.tables[tableName] = t
+	}
+	s.store(t, entityKey(entity), entity)
+}
+
+// Entity returns a copy of an entity, or nil if it does not exist.
+func (s *TableServer) Entity(tableName, partitionKey, rowKey string) Entity {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tables[tableName]
+	if !ok {
+		return nil
+	}
+	entity, ok := t.entities[[2]string{partitionKey, rowKey}]
+	if !ok {
+		return nil
+	}
+	return copyEntity(entity)
+}
+
+// Tables returns the sorted names of the tables.
+func (s *TableServer) Tables() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tableNames()
+}
+
+// Requests returns the requests the server has received, in order.
+func (s *TableServer) Requests() []*http.Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*http.Request(nil), s.requests...)
+}
+
+func (s *TableServer) tableNames() []string {
+	names := []string{}
+	for name := range s.tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *TableServer) store(t *table, key [2]string, entity Entity) string {
+	s.version++
+	now := time.Now().UTC()
+	etag := fmt.Sprintf("W/\"datetime'%s'\"", url.QueryEscape(now.Format(time.RFC3339Nano)+strconv.Itoa(s.version)))
+	entity = copyEntity(entity)
+	for name := range entity {
+		if strings.HasPrefix(name, "odata.") {
+			delete(entity, name)
+		}
+	}
+	entity["Timestamp"] = now.Format(time.RFC3339Nano)
+	t.entities[key] = entity
+	t.etags[key] = etag
+	return etag
+}
+
+func (s *TableServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, r.Clone(r.Context()))
+
+	w.Header().Set("x-ms-request-id", strconv.Itoa(len(s.requests)))
+	w.Header().Set("x-ms-version", r.Header.Get("x-ms-version"))
+	w.Header().Set("Date", time.Now().UTC().Format(time.RFC1123))
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if !strings.HasPrefix(path, Account+"/") {
+		writeTableError(w, http.StatusBadRequest, "InvalidUri", "unknown account in "+r.URL.Path)
+		return
+	}
+	path = strings.TrimPrefix(path, Account+"/")
+
+	switch {
+	case path == "Tables" && r.Method == http.MethodPost:
+		s.createTable(w, r)
+	case path == "Tables" && r.Method == http.MethodGet:
+		s.queryTables(w, r)
+	case strings.HasPrefix(path, "Tables('") && r.Method == http.MethodDelete:
+		s.deleteTable(w, strings.TrimSuffix(strings.TrimPrefix(path, "Tables('"), "')"))
+	default:
+		name, keys := path, ""
+		if i := strings.Index(path, "("); i >= 0 {
+			name, keys = path[:i], path[i:]
+		}
+		t, ok := s.tables[name]
+		if !ok {
+			writeTableError(w, http.StatusNotFound, "TableNotFound", "The table specified does not exist.")
+			return
+		}
+		switch {
+		case r.Method == http.MethodPost && keys == "":
+			s.insertEntity(w, r, t)
+		case r.Method == http.MethodGet && (keys == "" || keys == "()"):
+			s.queryEntities(w, r, t)
+		default:
+			key, ok := parseEntityKeys(keys)
+			if !ok {
+				writeTableError(w, http.StatusBadRequest, "InvalidInput", "invalid entity keys "+keys)
+				return
+			}
+			s.serveEntity(w, r, t, key)
+		}
+	}
+}
+
+func (s *TableServer) createTable(w http.ResponseWriter, r *http.Request) {
+	body := struct{ TableName string }{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.TableName == "" {
+		writeTableError(w, http.StatusBadRequest, "InvalidInput", "missing TableName")
+		return
+	}
+	if _, ok := s.tables[body.TableName]; ok {
+		writeTableError(w, http.StatusConflict, "TableAlreadyExists", "The table specified already exists.")
+		return
+	}
+	s.tables[body.TableName] = &table{name: body.TableName, entities: map[[2]string]Entity{}, etags: map[[2]string]string{}}
+	if r.Header.Get("Prefer") == "return-no-content" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"TableName": body.TableName})
+}
+
+func (s *TableServer) deleteTable(w http.ResponseWriter, name string) {
+	name, _ = url.PathUnescape(name)
+	if _, ok := s.tables[name]; !ok {
+		writeTableError(w, http.StatusNotFound, "ResourceNotFound", "The specified resource does not exist.")
+		return
+	}
+	delete(s.tables, name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *TableServer) queryTables(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter, err := parseFilter(query.Get("$filter"))
+	if err != nil {
+		writeTableError(w, http.StatusBadRequest, "InvalidInput", err.Error())
+		return
+	}
+	next := query.Get("NextTableName")
+	values := []interface{}{}
+	size := s.pageSize(query)
+	for _, name := range s.tableNames() {
+		if name < next || !filter.match(Entity{"TableName": name}) {
+			continue
+		}
+		if len(values) == size {
+			w.Header().Set("x-ms-continuation-NextTableName", name)
+			break
+		}
+		values = append(values, map[string]interface{}{"TableName": name})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"value": values})
+}
+
+func (s *TableServer) insertEntity(w http.ResponseWriter, r *http.Request, t *table) {
+	entity := Entity{}
+	if err := json.NewDecoder(r.Body).Decode(&entity); err != nil {
+		writeTableError(w, http.StatusBadRequest, "InvalidInput", err.Error())
+		return
+	}
+	key := entityKey(entity)
+	if _, ok := t.entities[key]; ok {
+		writeTableError(w, http.StatusConflict, "EntityAlreadyExists", "The specified entity already exists.")
+		return
+	}
+	etag := s.store(t, key, entity)
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("Prefer") == "return-no-content" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, http.StatusCreated, s.withETag(t, key))
+}
+
+func (s *TableServer) serveEntity(w http.ResponseWriter, r *http.Request, t *table, key [2]string) {
+	existing, exists := t.entities[key]
+	ifMatch := r.Header.Get("If-Match")
+	if r.Method != http.MethodGet && ifMatch != "" {
+		if !exists {
+			writeTableError(w, http.StatusNotFound, "ResourceNotFound", "The specified resource does not exist.")
+			return
+		}
+		if ifMatch != "*" && ifMatch != t.etags[key] {
+			writeTableError(w, http.StatusPreconditionFailed, "UpdateConditionNotSatisfied", "The update condition specified in the request was not satisfied.")
+			return
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if !exists {
+			writeTableError(w, http.StatusNotFound, "ResourceNotFound", "The specified resource does not exist.")
+			return
+		}
+		w.Header().Set("ETag", t.etags[key])
+		writeJSON(w, http.StatusOK, s.withETag(t, key))
+	case http.MethodPut, http.MethodPatch, "MERGE":
+		entity := Entity{}
+		if err := json.NewDecoder(r.Body).Decode(&entity); err != nil {
+			writeTableError(w, http.StatusBadRequest, "InvalidInput", err.Error())
+			return
+		}
+		if r.Method != http.MethodPut && exists {
+			merged := copyEntity(existing)
+			for name, value := range entity {
+				merged[name] = value
+			}
+			entity = merged
+		}
+		entity["PartitionKey"], entity["RowKey"] = key[0], key[1]
+		w.Header().Set("ETag", s.store(t, key, entity))
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if !exists {
+			writeTableError(w, http.StatusNotFound, "ResourceNotFound", "The specified resource does not exist.")
+			return
+		}
+		delete(t.entities, key)
+		delete(t.etags, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeTableError(w, http.StatusMethodNotAllowed, "UnsupportedHttpVerb", "unsupported entity operation")
+	}
+}
+
+func (s *TableServer) queryEntities(w http.ResponseWriter, r *http.Request, t *table) {
+	query := r.URL.Query()
+	filter, err := parseFilter(query.Get("$filter"))
+	if err != nil {
+		writeTableError(w, http.StatusBadRequest, "InvalidInput", err.Error())
+		return
+	}
+	var selected []string
+	if sel := query.Get("$select"); sel != "" {
+		selected = strings.Split(sel, ",")
+	}
+
+	keys := [][2]string{}
+	for key := range t.entities {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+
+	next := [2]string{query.Get("NextPartitionKey"), query.Get("NextRowKey")}
+	size := s.pageSize(query)
+	values := []interface{}{}
+	for _, key := range keys {
+		if key[0] < next[0] || (key[0] == next[0] && key[1] < next[1]) {
+			continue
+		}
+		if !filter.match(t.entities[key]) {
+			continue
+		}
+		if len(values) == size {
+			w.Header().Set("x-ms-continuation-NextPartitionKey", key[0])
+			w.Header().Set("x-ms-continuation-NextRowKey", key[1])
+			break
+		}
+		entity := s.withETag(t, key)
+		if selected != nil {
+			projected := Entity{"odata.etag": entity["odata.etag"]}
+			for _, name := range selected {
+				if value, ok := entity[strings.TrimSpace(name)]; ok {
+					projected[strings.TrimSpace(name)] = value
+				}
+			}
+			entity = projected
+		}
+		values = append(values, entity)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"value": values})
+}
+
+func (s *TableServer) withETag(t *table, key [2]string) Entity {
+	entity := copyEntity(t.entities[key])
+	entity["odata.etag"] = t.etags[key]
+	return entity
+}
+
+func (s *TableServer) pageSize(query url.Values) int {
+	size := s.PageSize
+	if top := atoi(query.Get("$top")); top > 0 && top < size {
+		size = top
+	}
+	return size
+}
+
+// parseEntityKeys parses "(PartitionKey='p',RowKey='r')".
+func parseEntityKeys(keys string) ([2]string, bool) {
+	keys, err := url.PathUnescape(keys)
+	if err != nil {
+		return [2]string{}, false
+	}
+	tokens, err := tokenize(keys)
+	if err != nil {
+		return [2]string{}, false
+	}
+	values := map[string]string{}
+	for i := 1; i+2 < len(tokens); i += 4 {
+		name, eq, value := tokens[i], tokens[i+1], tokens[i+2]
+		if eq.text != "=" || !value.quoted {
+			return [2]string{}, false
+		}
+		values[name.text] = value.text
+	}
+	pk, ok1 := values["PartitionKey"]
+	rk, ok2 := values["RowKey"]
+	return [2]string{pk, rk}, ok1 && ok2
+}
+
+func entityKey(entity Entity) [2]string {
+	pk, _ := entity["PartitionKey"].(string)
+	rk, _ := entity["RowKey"].(string)
+	return [2]string{pk, rk}
+}
+
+func copyEntity(entity Entity) Entity {
+	c := Entity{}
+	for name, value := range entity {
+		c[name] = value
+	}
+	return c
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		writeTableError(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json;odata=minimalmetadata;streaming=true;charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// writeTableError writes an error in the shape of the Table service.
+func writeTableError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("x-ms-error-code", code)
+	w.Header().Set("Content-Type", "application/json;odata=minimalmetadata;streaming=true;charset=utf-8")
+	w.WriteHeader(status)
+	b, _ := json.Marshal(map[string]interface{}{
+		"odata.error": map[string]interface{}{
+			"code":    code,
+			"message": map[string]string{"lang": "en-US", "value": message},
+		},
+	})
+	w.Write(b)
+}
@@ -0,0 +1,91 @@
+// Package testutil has helpers shared by the package tests.
+package testutil
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/blue-eight/azgo/azgo/config"
+	"github.com/blue-eight/azgo/azgo/output"
+)
+
+// CaptureOutput redirects the standard output.Printer to a buffer in jsonl
+// format until the test ends.
+func CaptureOutput(t testing.TB) *bytes.Buffer {
+	t.Helper()
+	b := &bytes.Buffer{}
+	p, err := output.New(b, output.JSONL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := output.SetStandard(p)
+	t.Cleanup(func() { output.SetStandard(previous) })
+	return b
+}
+
+// UseProfile makes p the active profile until the test ends.
+func UseProfile(t testing.TB, p *config.Profile) {
+	t.Helper()
+	config.SetActive(p)
+	t.Cleanup(func() { config.SetActive(nil) })
+}
+
+// Records decodes jsonl output into one map per line.
+func Records(t testing.TB, b *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	records := []map[string]interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader(b.Bytes()))
+	for decoder.More() {
+		record := map[string]interface{}{}
+		if err := decoder.Decode(&record); err != nil {
+			t.Fatalf("invalid jsonl output %q: %v", b.String(), err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// Token is the bearer token Credential adds to requests.
+const Token = "fake-token"
+
+// Credential is an azcore.TokenCredential which adds a fixed bearer token
+// to each request without contacting Azure AD.
+type Credential struct{}
+
+// GetToken returns Token.
+func (Credential) GetToken(ctx context.Context, options policy.TokenRequestOptions) (*azcore.AccessToken, error) {
+	return &azcore.AccessToken{Token: Token, ExpiresOn: time.Now().Add(time.Hour)}, nil
+}
+
+// NewAuthenticationPolicy returns a policy which sets the Authorization
+// header. Unlike the SDK's bearer token policy, it allows plain http.
+func (Credential) NewAuthenticationPolicy(options runtime.AuthenticationOptions) policy.Policy {
+	return bearerPolicy{}
+}
+
+type bearerPolicy struct{}
+
+func (bearerPolicy) Do(req *policy.Request) (*http.Response, error) {
+	req.Raw().Header.Set("Authorization", "Bearer "+Token)
+	return req.Next()
+}
+
+// ARMConnection returns a connection to a fake Azure Resource Manager at
+// endpoint, keeping any policies in options. It authenticates with
+// Credential and turns off resource provider registration and retries.
+func ARMConnection(endpoint string, options *arm.ConnectionOptions) *arm.Connection {
+	if options == nil {
+		options = &arm.ConnectionOptions{}
+	}
+	options.DisableRPRegistration = true
+	options.Retry.MaxRetries = -1
+	return arm.NewConnection(endpoint, Credential{}, options)
+}
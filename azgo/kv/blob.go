@@ -0,0 +1,99 @@
+package kv
+
+import (
+	"context"
+	"errors"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/blue-eight/azgo/azgo/blob"
+)
+
+// BlobStore is a Store where each key is a text/plain Block Blob in a
+// single container. It stores values the same way as blob.InsertKeyValue,
+// so they are compressed and encrypted as the active profile says.
+type BlobStore struct {
+	containerURL azblob.ContainerURL
+}
+
+// NewBlobStore returns a *BlobStore for the container, which defaults to
+// "main" if empty. The account is taken from blob.BlobFromConfig.
+func NewBlobStore(container string) (*BlobStore, error) {
+	if container == "" {
+		container = "main"
+	}
+	serviceURL, err := blob.BlobFromConfig()
+	if err != nil {
+		return nil, err
+	}
+	return &BlobStore{containerURL: serviceURL.NewContainerURL(container)}, nil
+}
+
+// Put uploads value as the Block Blob named key, with
+// blob.WriteKeyValue.
+func (s *BlobStore) Put(ctx context.Context, key, value string) error {
+	_, err := blob.WriteKeyValue(ctx, s.containerURL, key, value, azblob.BlobAccessConditions{})
+	return err
+}
+
+// Get downloads the Block Blob named key, with blob.ReadKeyValue.
+func (s *BlobStore) Get(ctx context.Context, key string) (string, error) {
+	value, _, err := blob.ReadKeyValue(ctx, s.containerURL, key)
+	if isBlobNotFound(err) {
+		return "", ErrNotFound
+	}
+	return value, err
+}
+
+// Delete deletes the Block Blob named key.
+func (s *BlobStore) Delete(ctx context.Context, key string) error {
+	blobURL := s.containerURL.NewBlockBlobURL(key)
+	_, err := blobURL.Delete(ctx, azblob.DeleteSnapshotsOptionNone, azblob.BlobAccessConditions{})
+	if isBlobNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// List returns the names of the blobs which begin with prefix. The service
+// returns them in lexical order.
+func (s *BlobStore) List(ctx context.Context, prefix string) ([]string, error) {
+	keys := []string{}
+	marker := azblob.Marker{}
+	for marker.NotDone() {
+		listBlob, err := s.containerURL.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{Prefix: prefix})
+		if err != nil {
+			return nil, err
+		}
+		marker = listBlob.NextMarker
+		for _, blobInfo := range listBlob.Segment.BlobItems {
+			keys = append(keys, blobInfo.Name)
+		}
+	}
+	return keys, nil
+}
+
+// Exists reports whether the blob named key exists.
+func (s *BlobStore) Exists(ctx context.Context, key string) (bool, error) {
+	blobURL := s.containerURL.NewBlobURL(key)
+	_, err := blobURL.GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		if isBlobNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Close is a no-op; the BlobStore holds no open connections.
+func (s *BlobStore) Close() error {
+	return nil
+}
+
+func isBlobNotFound(err error) bool {
+	var storageErr azblob.StorageError
+	if errors.As(err, &storageErr) {
+		return storageErr.ServiceCode() == azblob.ServiceCodeBlobNotFound
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+package kv
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/blue-eight/azgo/azgo/blob"
+	"github.com/blue-eight/azgo/azgo/internal/fakestorage"
+	"github.com/blue-eight/azgo/azgo/internal/testutil"
+)
+
+func TestBlobStore(t *testing.T) {
+	s := fakestorage.NewBlobServer()
+	defer s.Close()
+	s.PageSize = 1
+	s.CreateContainer("main")
+	testutil.UseProfile(t, s.Profile())
+
+	store, err := New("blob", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, store)
+
+	if b := s.Blob("main", "a/1"); b == nil || b.ContentType != "text/plain" {
+		t.Errorf("stored blob = %+v, want a text/plain blob in main", b)
+	}
+}
+
+func TestEncryptedBlobStore(t *testing.T) {
+	ctx := context.Background()
+	s := fakestorage.NewBlobServer()
+	defer s.Close()
+	s.CreateContainer("main")
+	p := s.Profile()
+	p.BlobEncryptionPassphrase, p.BlobCompression = "correct horse battery staple", "gzip"
+	testutil.UseProfile(t, p)
+
+	store, err := New("blob", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(ctx, "greeting", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if b := s.Blob("main", "greeting"); strings.Contains(string(b.Data), "hello") || b.Metadata["azgoencryption"] == "" {
+		t.Errorf("stored %q with metadata %v, want it encrypted", b.Data, b.Metadata)
+	}
+
+	// keys are shared with blob insert-kv and get both ways
+	if got, _, err := blob.Get(ctx, "main", "greeting"); err != nil || got != "hello" {
+		t.Errorf("blob.Get of a kv key = %q, %v", got, err)
+	}
+	if err := blob.InsertKeyValue(ctx, "main", "farewell", "goodbye"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := store.Get(ctx, "farewell"); err != nil || got != "goodbye" {
+		t.Errorf("Get of a blob insert-kv key = %q, %v", got, err)
+	}
+}
@@ -0,0 +1,32 @@
+/*
+Package kv provides a single key/value Store interface over the blob, table
+and postgres packages, plus an in-memory implementation.
+
+Each of those packages has its own InsertKeyValue, Get and Delete functions
+with slightly different signatures and output. Store hides those
+differences so a caller can switch backends without changing code:
+
+	store, err := kv.New("blob", "main")
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	err = store.Put(ctx, "greeting", "hello")
+
+In our sample app, we call these via commands in cmd/kv.go, which take a
+--backend flag:
+
+	Available Commands:
+	delete      ...
+	exists      ...
+	get         ...
+	list        ...
+	put         ...
+
+The backends read the same environment variables as the packages they are
+built on, and store values in a compatible shape: blob uses text/plain
+Block Blobs, compressed and encrypted as the profile's blob_compression and
+blob_encryption settings say, table uses the "main" PartitionKey with a
+Value property, and postgres uses a table with key and value columns.
+*/
+package kv
@@ -0,0 +1,47 @@
+package kv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrNotFound is returned by Store.Get when the key does not exist.
+var ErrNotFound = errors.New("key not found")
+
+// Store is a minimal key/value interface which is implemented on top of
+// Blob Storage, Table Storage, PostgreSQL and an in-memory map. Callers
+// should Close a Store when they are done with it.
+type Store interface {
+	// Put creates or replaces the value stored under key.
+	Put(ctx context.Context, key, value string) error
+	// Get returns the value stored under key, or ErrNotFound.
+	Get(ctx context.Context, key string) (string, error)
+	// Delete removes key. Deleting a missing key is not an error.
+	Delete(ctx context.Context, key string) error
+	// List returns the keys which begin with prefix, in key order.
+	List(ctx context.Context, prefix string) ([]string, error)
+	// Exists reports whether key is present.
+	Exists(ctx context.Context, key string) (bool, error)
+	// Close releases any connections held by the Store.
+	Close() error
+}
+
+// Backends lists the names accepted by New. MemoryStore is left out since
+// its keys would not outlive the process; use NewMemoryStore directly.
+var Backends = []string{"blob", "table", "postgres"}
+
+// New returns the Store for the named backend. The name is the container
+// (blob) or table (table, postgres) which holds the keys, and falls back to
+// each backend's own default when empty.
+func New(backend, name string) (Store, error) {
+	switch backend {
+	case "blob":
+		return NewBlobStore(name)
+	case "table":
+		return NewTableStore(name)
+	case "postgres":
+		return NewPostgresStore(name)
+	}
+	return nil, fmt.Errorf("unknown backend %q (expected one of %v)", backend, Backends)
+}
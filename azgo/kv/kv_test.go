@@ -0,0 +1,78 @@
+package kv
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+// testStore checks the behaviour every Store shares, starting from an
+// empty store.
+func testStore(t *testing.T, store Store) {
+	ctx := context.Background()
+
+	for _, key := range []string{"b/2", "a/1", "b/1", "c"} {
+		if err := store.Put(ctx, key, "value-"+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	value, err := store.Get(ctx, "b/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "value-b/1" {
+		t.Errorf("Get(b/1) = %q", value)
+	}
+
+	if _, err := store.Get(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get(missing) error = %v, want ErrNotFound", err)
+	}
+
+	keys, err := store.List(ctx, "b/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"b/1", "b/2"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("List(b/) = %v, want %v", keys, want)
+	}
+
+	if err := store.Delete(ctx, "b/1"); err != nil {
+		t.Fatal(err)
+	}
+	exists, err := store.Exists(ctx, "b/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Error("Exists(b/1) = true after Delete")
+	}
+	if err := store.Delete(ctx, "b/1"); err != nil {
+		t.Errorf("Delete of a missing key returned %v", err)
+	}
+}
+
+func TestPrefixUpperBound(t *testing.T) {
+	tests := map[string]string{
+		"abc":    "abd",
+		"a\xff":  "b",
+		"\xff":   "",
+		"prefix": "prefiy",
+	}
+	for prefix, want := range tests {
+		if got := prefixUpperBound(prefix); got != want {
+			t.Errorf("prefixUpperBound(%q) = %q, want %q", prefix, got, want)
+		}
+	}
+}
+
+func TestNewUnknownBackend(t *testing.T) {
+	if _, err := New("s3", ""); err == nil {
+		t.Error("New(s3) returned no error")
+	}
+}
@@ -0,0 +1,74 @@
+package kv
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MemoryStore is an in-memory Store which is safe for concurrent use.
+// It is mostly useful in tests and as a reference implementation.
+type MemoryStore struct {
+	mu     sync.RWMutex
+	values map[string]string
+}
+
+// NewMemoryStore returns an empty *MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{values: map[string]string{}}
+}
+
+// Put stores value under key.
+func (s *MemoryStore) Put(ctx context.Context, key, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = value
+	return nil
+}
+
+// Get returns the value stored under key, or ErrNotFound.
+func (s *MemoryStore) Get(ctx context.Context, key string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	value, ok := s.values[key]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return value, nil
+}
+
+// Delete removes key.
+func (s *MemoryStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+	return nil
+}
+
+// List returns the sorted keys which begin with prefix.
+func (s *MemoryStore) List(ctx context.Context, prefix string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := []string{}
+	for key := range s.values {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Exists reports whether key is present.
+func (s *MemoryStore) Exists(ctx context.Context, key string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.values[key]
+	return ok, nil
+}
+
+// Close is a no-op.
+func (s *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,112 @@
+package kv
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/blue-eight/azgo/azgo/postgres"
+	"github.com/lib/pq"
+)
+
+// PostgresStore is a Store on top of a table with key and value columns,
+// as created by postgres.CreateTable. As the value is stored as-is, a
+// table of type text is the natural fit (e.g. "postgres table-create kv text").
+// A jsonb table also works, provided every value is valid JSON.
+type PostgresStore struct {
+	db    *sql.DB
+	table string
+}
+
+// NewPostgresStore returns a *PostgresStore for the named table, which
+// defaults to "kv" if empty. The database is taken from postgres.DbFromConfig.
+func NewPostgresStore(table string) (*PostgresStore, error) {
+	if table == "" {
+		table = "kv"
+	}
+	db, err := postgres.DbFromConfig()
+	if err != nil {
+		return nil, err
+	}
+	return &PostgresStore{db: db, table: pq.QuoteIdentifier(table)}, nil
+}
+
+// Close closes the underlying database handle.
+func (s *PostgresStore) Close() error {
+	return s.db.Close()
+}
+
+// Put replaces any rows for key with a single new row. The tables created
+// by postgres.CreateTable have no primary key, so we can't use
+// "on conflict" and instead delete and insert in one transaction.
+func (s *PostgresStore) Put(ctx context.Context, key, value string) error {
+	txn, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := txn.ExecContext(ctx, "delete from "+s.table+" where key = $1;", key); err != nil {
+		txn.Rollback()
+		return err
+	}
+	if _, err := txn.ExecContext(ctx, "insert into "+s.table+" (key, value) values ($1, $2);", key, value); err != nil {
+		txn.Rollback()
+		return err
+	}
+	return txn.Commit()
+}
+
+// Get returns the value for key as text.
+func (s *PostgresStore) Get(ctx context.Context, key string) (string, error) {
+	value := ""
+	err := s.db.QueryRowContext(ctx, "select value::text from "+s.table+" where key = $1 limit 1;", key).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
+// Delete deletes every row for key.
+func (s *PostgresStore) Delete(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, "delete from "+s.table+" where key = $1;", key)
+	return err
+}
+
+// List returns the distinct keys which begin with prefix.
+func (s *PostgresStore) List(ctx context.Context, prefix string) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, "select distinct key from "+s.table+" where key like $1 escape '\\' order by key;", escapeLike(prefix)+"%")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []string{}
+	for rows.Next() {
+		key := ""
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Exists reports whether there is a row for key.
+func (s *PostgresStore) Exists(ctx context.Context, key string) (bool, error) {
+	exists := false
+	err := s.db.QueryRowContext(ctx, "select exists(select 1 from "+s.table+" where key = $1);", key).Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+	return exists, nil
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
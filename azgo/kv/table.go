@@ -0,0 +1,152 @@
+package kv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/data/aztables"
+	"github.com/blue-eight/azgo/azgo/table"
+)
+
+// tablePartitionKey matches the PartitionKey used by table.InsertKeyValue
+// and table.UpsertKeyValue so both can read each other's entities.
+const tablePartitionKey = "main"
+
+// TableStore is a Store where each key is the RowKey of an entity in the
+// "main" partition, and the value is held in its Value property.
+type TableStore struct {
+	client *aztables.Client
+}
+
+// NewTableStore returns a *TableStore for the named table, which defaults
+// to "kv" if empty. The account is taken from table.ServiceClientFromConfig.
+func NewTableStore(name string) (*TableStore, error) {
+	if name == "" {
+		name = "kv"
+	}
+	serviceClient, err := table.ServiceClientFromConfig()
+	if err != nil {
+		return nil, err
+	}
+	return &TableStore{client: serviceClient.NewClient(name)}, nil
+}
+
+type tableEntity struct {
+	PartitionKey string
+	RowKey       string
+	Value        string
+}
+
+// Put upserts the entity for key, replacing any existing Value.
+func (s *TableStore) Put(ctx context.Context, key, value string) error {
+	b, err := json.Marshal(tableEntity{
+		PartitionKey: tablePartitionKey,
+		RowKey:       key,
+		Value:        value,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.client.InsertEntity(ctx, b, &aztables.InsertEntityOptions{UpdateMode: aztables.ReplaceEntity})
+	return err
+}
+
+// Get returns the Value of the entity for key.
+func (s *TableStore) Get(ctx context.Context, key string) (string, error) {
+	resp, err := s.client.GetEntity(ctx, tablePartitionKey, key, nil)
+	if err != nil {
+		if isTableNotFound(err) {
+			return "", ErrNotFound
+		}
+		return "", err
+	}
+	entity := tableEntity{}
+	if err := json.Unmarshal(resp.Value, &entity); err != nil {
+		return "", err
+	}
+	return entity.Value, nil
+}
+
+// Delete deletes the entity for key.
+func (s *TableStore) Delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteEntity(ctx, tablePartitionKey, key, nil)
+	if isTableNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// List returns the RowKeys in the "main" partition which begin with
+// prefix. Tables have no prefix operator, so we use a range filter.
+func (s *TableStore) List(ctx context.Context, prefix string) ([]string, error) {
+	filter := fmt.Sprintf("PartitionKey eq '%s'", tablePartitionKey)
+	if prefix != "" {
+		filter += fmt.Sprintf(" and RowKey ge '%s'", escapeOData(prefix))
+		if upper := prefixUpperBound(prefix); upper != "" {
+			filter += fmt.Sprintf(" and RowKey lt '%s'", escapeOData(upper))
+		}
+	}
+	selectFields := "RowKey"
+	pager := s.client.List(&aztables.ListEntitiesOptions{Filter: &filter, Select: &selectFields})
+	keys := []string{}
+	for pager.NextPage(ctx) {
+		for _, x := range pager.PageResponse().Entities {
+			entity := tableEntity{}
+			if err := json.Unmarshal(x, &entity); err != nil {
+				return nil, err
+			}
+			keys = append(keys, entity.RowKey)
+		}
+	}
+	if err := pager.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Exists reports whether the entity for key exists.
+func (s *TableStore) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := s.Get(ctx, key)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Close is a no-op; the TableStore holds no open connections.
+func (s *TableStore) Close() error {
+	return nil
+}
+
+// prefixUpperBound returns the smallest string which is greater than every
+// string beginning with prefix, or "" if there is no such string.
+func prefixUpperBound(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
+
+func escapeOData(s string) string {
+	return strings.ReplaceAll(s, "'", "''")
+}
+
+func isTableNotFound(err error) bool {
+	var httpErr azcore.HTTPResponse
+	if errors.As(err, &httpErr) {
+		return httpErr.RawResponse().StatusCode == http.StatusNotFound
+	}
+	return false
+}
@@ -0,0 +1,26 @@
+package kv
+
+import (
+	"testing"
+
+	"github.com/blue-eight/azgo/azgo/internal/fakestorage"
+	"github.com/blue-eight/azgo/azgo/internal/testutil"
+)
+
+func TestTableStore(t *testing.T) {
+	s := fakestorage.NewTableServer()
+	defer s.Close()
+	s.PageSize = 1
+	s.CreateTable("kv")
+	testutil.UseProfile(t, s.Profile())
+
+	store, err := New("table", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, store)
+
+	if e := s.Entity("kv", "main", "a/1"); e == nil || e["Value"] != "value-a/1" {
+		t.Errorf("stored entity = %v, want Value value-a/1 in partition main", e)
+	}
+}
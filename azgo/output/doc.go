@@ -0,0 +1,20 @@
+/*
+Package output prints the records returned by list and query commands in a
+format chosen by the user, so every command doesn't have to hand-roll its
+own fmt.Printf of JSON.
+
+The CLI configures the standard Printer from two global flags:
+
+	-o, --output   jsonl (default), json, table, csv or yaml
+	    --columns  comma-separated fields to keep, e.g. Name,Properties.ContentLength
+
+jsonl matches what the commands have always printed: one compact JSON
+object per line, ready for jq. json prints a single indented array, table
+an aligned table for humans, csv a header and one row per record, and yaml
+a list. For table and csv the columns are inferred from the records, with
+nested objects flattened to dotted names (e.g. Properties.Etag).
+
+Packages call output.Print for each record, and the CLI calls output.Flush
+once the command has finished.
+*/
+package output
@@ -0,0 +1,186 @@
+package output
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// field and object hold a JSON object while keeping the order of its keys,
+// so tables, CSV and YAML show fields in the same order as the JSON does
+// (i.e. struct field order rather than sorted).
+type field struct {
+	key   string
+	value interface{}
+}
+
+type object []field
+
+// MarshalJSON writes the object with its keys in order.
+func (o object) MarshalJSON() ([]byte, error) {
+	b := &bytes.Buffer{}
+	b.WriteByte('{')
+	for i, f := range o {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, err := json.Marshal(f.key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(f.value)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(value)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// get returns the value of a dotted path such as Properties.ContentLength.
+// A flattened object holds the dotted keys directly, so we try the whole
+// path first.
+func (o object) get(path string) interface{} {
+	for _, f := range o {
+		if f.key == path {
+			return f.value
+		}
+	}
+	for _, f := range o {
+		if strings.HasPrefix(path, f.key+".") {
+			if child, ok := f.value.(object); ok {
+				return child.get(strings.TrimPrefix(path, f.key+"."))
+			}
+		}
+	}
+	return nil
+}
+
+// toOrdered converts v to its JSON form, decoding objects as object and
+// numbers as json.Number.
+func toOrdered(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	return decodeOrdered(dec)
+}
+
+func decodeOrdered(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('{'):
+		o := object{}
+		for dec.More() {
+			keyTok, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			key, ok := keyTok.(string)
+			if !ok {
+				return nil, fmt.Errorf("unexpected object key %v", keyTok)
+			}
+			value, err := decodeOrdered(dec)
+			if err != nil {
+				return nil, err
+			}
+			o = append(o, field{key, value})
+		}
+		// consume the closing '}'
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		return o, nil
+	case json.Delim('['):
+		a := []interface{}{}
+		for dec.More() {
+			value, err := decodeOrdered(dec)
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, value)
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		return a, nil
+	}
+	return tok, nil
+}
+
+// project returns an object with one field per column. Records which are
+// not objects are left unchanged.
+func project(record interface{}, columns []string) interface{} {
+	o, ok := record.(object)
+	if !ok {
+		return record
+	}
+	projected := make(object, 0, len(columns))
+	for _, column := range columns {
+		projected = append(projected, field{column, o.get(column)})
+	}
+	return projected
+}
+
+// flatten turns nested objects into dotted keys, e.g. Properties.Etag.
+// Arrays are kept whole. A record which isn't an object becomes a single
+// "value" column.
+func flatten(record interface{}) object {
+	o, ok := record.(object)
+	if !ok {
+		return object{{"value", record}}
+	}
+	flat := object{}
+	for _, f := range o {
+		if child, ok := f.value.(object); ok && len(child) > 0 {
+			for _, cf := range flatten(child) {
+				flat = append(flat, field{f.key + "." + cf.key, cf.value})
+			}
+			continue
+		}
+		flat = append(flat, f)
+	}
+	return flat
+}
+
+// toYAML converts an ordered JSON value to a *yaml.Node.
+func toYAML(v interface{}) *yaml.Node {
+	switch v := v.(type) {
+	case object:
+		n := &yaml.Node{Kind: yaml.MappingNode}
+		for _, f := range v {
+			n.Content = append(n.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: f.key}, toYAML(f.value))
+		}
+		return n
+	case []interface{}:
+		n := &yaml.Node{Kind: yaml.SequenceNode}
+		for _, item := range v {
+			n.Content = append(n.Content, toYAML(item))
+		}
+		return n
+	case nil:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}
+	case bool:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: fmt.Sprint(v)}
+	case json.Number:
+		tag := "!!int"
+		if strings.ContainsAny(v.String(), ".eE") {
+			tag = "!!float"
+		}
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: v.String()}
+	case string:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: v}
+	}
+	return &yaml.Node{Kind: yaml.ScalarNode, Value: fmt.Sprint(v)}
+}
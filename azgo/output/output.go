@@ -0,0 +1,298 @@
+package output
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The formats supported by Printer. JSONL is the default, and writes each
+// record as compact JSON on its own line, which is what every command
+// printed before this package existed.
+const (
+	JSONL = "jsonl"
+	JSON  = "json"
+	Table = "table"
+	CSV   = "csv"
+	YAML  = "yaml"
+)
+
+// Formats lists the names accepted by New and Configure.
+var Formats = []string{JSONL, JSON, Table, CSV, YAML}
+
+// Printer writes records in one of the Formats. JSONL records are written
+// as soon as they are printed. The other formats need to see every record
+// (e.g. to align table columns), so they are buffered until Flush.
+//
+// A Printer is safe for concurrent use, as some commands print from
+// receive handlers.
+type Printer struct {
+	mu      sync.Mutex
+	w       io.Writer
+	format  string
+	columns []string
+	records []interface{}
+}
+
+// New returns a *Printer which writes to w. If columns is non-empty, each
+// record is projected to just those fields, which may be dotted paths into
+// nested objects (e.g. Properties.ContentLength).
+func New(w io.Writer, format string, columns []string) (*Printer, error) {
+	if format == "" {
+		format = JSONL
+	}
+	valid := false
+	for _, f := range Formats {
+		valid = valid || f == format
+	}
+	if !valid {
+		return nil, fmt.Errorf("unknown output format %q (expected one of %v)", format, Formats)
+	}
+	return &Printer{w: w, format: format, columns: columns}, nil
+}
+
+// Print writes, or buffers, a single record. The record can be any value
+// which can be marshaled to JSON.
+func (p *Printer) Print(v interface{}) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.format == JSONL && len(p.columns) == 0 {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(p.w, "%s\n", b)
+		return err
+	}
+
+	record, err := toOrdered(v)
+	if err != nil {
+		return err
+	}
+	if len(p.columns) > 0 {
+		record = project(record, p.columns)
+	}
+	if p.format == JSONL {
+		b, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(p.w, "%s\n", b)
+		return err
+	}
+	p.records = append(p.records, record)
+	return nil
+}
+
+// Flush writes any buffered records. For JSON it writes an empty array if
+// nothing was printed, so the output is always valid JSON.
+func (p *Printer) Flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	records := p.records
+	p.records = nil
+	switch p.format {
+	case JSON:
+		if records == nil {
+			records = []interface{}{}
+		}
+		b, err := json.MarshalIndent(records, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(p.w, "%s\n", b)
+		return err
+	case YAML:
+		if len(records) == 0 {
+			return nil
+		}
+		seq := &yaml.Node{Kind: yaml.SequenceNode}
+		for _, record := range records {
+			seq.Content = append(seq.Content, toYAML(record))
+		}
+		enc := yaml.NewEncoder(p.w)
+		enc.SetIndent(2)
+		if err := enc.Encode(seq); err != nil {
+			return err
+		}
+		return enc.Close()
+	case Table, CSV:
+		if len(records) == 0 {
+			return nil
+		}
+		// records were already projected to the columns, if any, so we only
+		// flatten them when we need to infer the columns
+		columns := p.columns
+		rows := make([]object, len(records))
+		for i, record := range records {
+			if o, ok := record.(object); ok && len(columns) > 0 {
+				rows[i] = o
+			} else {
+				rows[i] = flatten(record)
+			}
+		}
+		if len(columns) == 0 {
+			columns = inferColumns(rows)
+		}
+		if p.format == CSV {
+			return writeCSV(p.w, columns, rows)
+		}
+		return writeTable(p.w, columns, rows)
+	}
+	return nil
+}
+
+func writeCSV(w io.Writer, columns []string, rows []object) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(columns); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		values := make([]string, len(columns))
+		for i, column := range columns {
+			values[i] = cell(row.get(column))
+		}
+		if err := cw.Write(values); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeTable(w io.Writer, columns []string, rows []object) error {
+	b := &bytes.Buffer{}
+	tw := tabwriter.NewWriter(b, 0, 4, 2, ' ', 0)
+	header := make([]string, len(columns))
+	for i, column := range columns {
+		header[i] = strings.ToUpper(column)
+	}
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, row := range rows {
+		values := make([]string, len(columns))
+		for i, column := range columns {
+			// tabs and newlines would break the alignment
+			values[i] = strings.NewReplacer("\t", " ", "\n", " ").Replace(cell(row.get(column)))
+		}
+		fmt.Fprintln(tw, strings.Join(values, "\t"))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	// tabwriter pads the last column too, which we don't want
+	for _, line := range strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n") {
+		if _, err := fmt.Fprintln(w, strings.TrimRight(line, " ")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cell formats a single value for a table or CSV: strings as-is, null as
+// empty, and everything else as compact JSON.
+func cell(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+// inferColumns returns the union of the keys of rows, in the order in
+// which they were first seen.
+func inferColumns(rows []object) []string {
+	seen := map[string]bool{}
+	columns := []string{}
+	for _, row := range rows {
+		for _, f := range row {
+			if !seen[f.key] {
+				seen[f.key] = true
+				columns = append(columns, f.key)
+			}
+		}
+	}
+	return columns
+}
+
+var (
+	std     = &Printer{w: os.Stdout, format: JSONL}
+	stdLock sync.Mutex
+)
+
+// Configure sets the format and columns of the standard Printer used by
+// Print and Flush. The CLI calls this once the --output and --columns
+// flags have been parsed.
+func Configure(format string, columns []string) error {
+	p, err := New(os.Stdout, format, columns)
+	if err != nil {
+		return err
+	}
+	stdLock.Lock()
+	std = p
+	stdLock.Unlock()
+	return nil
+}
+
+// SetStandard replaces the standard Printer and returns the previous one,
+// which lets tests capture what a package prints.
+func SetStandard(p *Printer) *Printer {
+	stdLock.Lock()
+	defer stdLock.Unlock()
+	previous := std
+	std = p
+	return previous
+}
+
+func standard() *Printer {
+	stdLock.Lock()
+	defer stdLock.Unlock()
+	return std
+}
+
+// Print prints a record with the standard Printer, which writes to the
+// standard output.
+func Print(v interface{}) error {
+	return standard().Print(v)
+}
+
+// Flush flushes the standard Printer.
+func Flush() error {
+	return standard().Flush()
+}
+
+// Marshal is a convenience for tests and callers that want the output of a
+// single format as a string.
+func Marshal(format string, columns []string, records ...interface{}) (string, error) {
+	b := &bytes.Buffer{}
+	p, err := New(b, format, columns)
+	if err != nil {
+		return "", err
+	}
+	for _, record := range records {
+		if err := p.Print(record); err != nil {
+			return "", err
+		}
+	}
+	if err := p.Flush(); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
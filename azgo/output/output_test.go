@@ -0,0 +1,97 @@
+package output
+
+import (
+	"testing"
+)
+
+type testProperties struct {
+	ContentLength int64
+	ContentType   string
+}
+
+type testItem struct {
+	Name       string
+	Properties testProperties
+	Tags       []string
+}
+
+var testItems = []interface{}{
+	testItem{Name: "a.txt", Properties: testProperties{ContentLength: 10, ContentType: "text/plain"}, Tags: []string{"x"}},
+	testItem{Name: "b, \"quoted\"", Properties: testProperties{ContentLength: 2048}},
+}
+
+func TestFormats(t *testing.T) {
+	tests := []struct {
+		format  string
+		columns []string
+		want    string
+	}{
+		{JSONL, nil, `{"Name":"a.txt","Properties":{"ContentLength":10,"ContentType":"text/plain"},"Tags":["x"]}
+{"Name":"b, \"quoted\"","Properties":{"ContentLength":2048,"ContentType":""},"Tags":null}
+`},
+		{JSONL, []string{"Name", "Properties.ContentLength"}, `{"Name":"a.txt","Properties.ContentLength":10}
+{"Name":"b, \"quoted\"","Properties.ContentLength":2048}
+`},
+		{JSON, []string{"Name"}, `[
+  {
+    "Name": "a.txt"
+  },
+  {
+    "Name": "b, \"quoted\""
+  }
+]
+`},
+		{Table, nil, `NAME         PROPERTIES.CONTENTLENGTH  PROPERTIES.CONTENTTYPE  TAGS
+a.txt        10                        text/plain              ["x"]
+b, "quoted"  2048
+`},
+		{CSV, []string{"Name", "Properties"}, `Name,Properties
+a.txt,"{""ContentLength"":10,""ContentType"":""text/plain""}"
+"b, ""quoted""","{""ContentLength"":2048,""ContentType"":""""}"
+`},
+		{YAML, []string{"Name", "Properties.ContentLength", "Tags"}, `- Name: a.txt
+  Properties.ContentLength: 10
+  Tags:
+    - x
+- Name: b, "quoted"
+  Properties.ContentLength: 2048
+  Tags: null
+`},
+	}
+	for _, test := range tests {
+		got, err := Marshal(test.format, test.columns, testItems...)
+		if err != nil {
+			t.Errorf("%s %v: %v", test.format, test.columns, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s %v:\ngot:\n%s\nwant:\n%s", test.format, test.columns, got, test.want)
+		}
+	}
+}
+
+func TestEmptyJSON(t *testing.T) {
+	got, err := Marshal(JSON, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "[]\n" {
+		t.Errorf("empty JSON = %q, want []", got)
+	}
+}
+
+func TestScalarRecords(t *testing.T) {
+	got, err := Marshal(CSV, nil, "one", "two")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "value\none\ntwo\n"; got != want {
+		t.Errorf("scalar CSV = %q, want %q", got, want)
+	}
+}
+
+func TestUnknownFormat(t *testing.T) {
+	if _, err := New(nil, "xml", nil); err == nil {
+		t.Error("New(xml) returned no error")
+	}
+}
@@ -2,21 +2,41 @@ package postgres
 
 import (
 	"bufio"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os"
 
+	"github.com/blue-eight/azgo/azgo/config"
+	"github.com/blue-eight/azgo/azgo/output"
+	"github.com/blue-eight/azgo/azgo/smoke"
 	"github.com/google/uuid"
 	"github.com/lib/pq"
 	_ "github.com/lib/pq"
 )
 
 // DbFromEnv creates a *sql.DB authenticated by the environment variable
-// POSTGRES_SQL
+// POSTGRES_URL
 func DbFromEnv() (*sql.DB, error) {
-	connStr := mustGetEnv("POSTGRES_URL")
+	return DbFromProfile(config.FromEnv())
+}
+
+// DbFromConfig creates a *sql.DB for the active profile (see config.Active),
+// which is what the functions in this package use.
+func DbFromConfig() (*sql.DB, error) {
+	return DbFromProfile(config.Active())
+}
+
+// DbFromProfile creates a *sql.DB from the postgres_url of the profile. It
+// returns an error if postgres_url is missing.
+func DbFromProfile(p *config.Profile) (*sql.DB, error) {
+	connStr := p.PostgresURL
+	if connStr == "" {
+		return nil, config.Missing("postgres_url")
+	}
 	db, err := sql.Open("postgres", connStr)
 	if err != nil {
 		return nil, err
@@ -24,20 +44,27 @@ func DbFromEnv() (*sql.DB, error) {
 	return db, nil
 }
 
+// openDB opens the database for the active profile, and is replaced in
+// tests along with stdin.
+var (
+	openDB           = DbFromConfig
+	stdin  io.Reader = os.Stdin
+)
+
 // InsertKeyValue inserts a key/value pair into a table. The name
 // of the table defaults to kv.
-func InsertKeyValue(table, key, value string) error {
+func InsertKeyValue(ctx context.Context, table, key, value string) error {
 	if table == "" {
 		table = "kv"
 	}
 
-	db, err := DbFromEnv()
+	db, err := openDB()
 	if err != nil {
 		return err
 	}
 	defer db.Close()
 
-	_, err = db.Exec("insert into "+table+" values ($1, $2);", key, value)
+	_, err = db.ExecContext(ctx, "insert into "+table+" values ($1, $2);", key, value)
 	if err != nil {
 		return err
 	}
@@ -48,15 +75,15 @@ func InsertKeyValue(table, key, value string) error {
 // Exec excutes a command and returns the rows affected, or an error.
 // This is primarily to show RowsAffected() which we have ommitted
 // in other places where Exec is used.
-func Exec(sql string, args ...interface{}) (int64, error) {
+func Exec(ctx context.Context, sql string, args ...interface{}) (int64, error) {
 
-	db, err := DbFromEnv()
+	db, err := openDB()
 	if err != nil {
 		return 0, err
 	}
 	defer db.Close()
 
-	result, err := db.Exec(sql, args)
+	result, err := db.ExecContext(ctx, sql, args...)
 	if err != nil {
 		return 0, err
 	}
@@ -70,18 +97,18 @@ func Exec(sql string, args ...interface{}) (int64, error) {
 
 // Delete deletes from table where the key column matches the
 // key parameter.
-func Delete(table, key string) error {
+func Delete(ctx context.Context, table, key string) error {
 	if table == "" {
 		table = "kv"
 	}
 
-	db, err := DbFromEnv()
+	db, err := openDB()
 	if err != nil {
 		return err
 	}
 	defer db.Close()
 
-	_, err = db.Exec("delete from "+table+" where key = $1;", key)
+	_, err = db.ExecContext(ctx, "delete from "+table+" where key = $1;", key)
 	if err != nil {
 		return err
 	}
@@ -90,22 +117,22 @@ func Delete(table, key string) error {
 }
 
 // QueryKeyValue is a function that is designed to return a Key/Value
-// pair which we marshal to JSON and write to the standard output.
+// pair which we print to the standard output via output.Print.
 // It is partially designed to be an example, and to guarantee output
 // shape when we pair with InsertKeyValue. We also default the query to:
 // select key, value from kv
-func QueryKeyValue(query string) error {
+func QueryKeyValue(ctx context.Context, query string) error {
 	if query == "" {
 		query = "select key, value from kv"
 	}
 
-	db, err := DbFromEnv()
+	db, err := openDB()
 	if err != nil {
 		return err
 	}
 	defer db.Close()
 
-	rows, err := db.Query(query)
+	rows, err := db.QueryContext(ctx, query)
 	if err != nil {
 		return err
 	}
@@ -113,12 +140,12 @@ func QueryKeyValue(query string) error {
 
 	for rows.Next() {
 		k := KeyValue{}
-		rows.Scan(&k.Key, &k.Value)
-		b, err := json.Marshal(&k)
-		if err != nil {
+		if err := rows.Scan(&k.Key, &k.Value); err != nil {
+			return err
+		}
+		if err := output.Print(&k); err != nil {
 			return err
 		}
-		fmt.Printf("%s\n", b)
 	}
 
 	if err := rows.Err(); err != nil {
@@ -132,18 +159,18 @@ func QueryKeyValue(query string) error {
 // single string, which we then print to the standard output.
 // This function is designed for queries that have a single return
 // value (e.g. a json/jsonb column)
-func QueryString(query string) error {
+func QueryString(ctx context.Context, query string) error {
 	if query == "" {
 		query = "select value from kv"
 	}
 
-	db, err := DbFromEnv()
+	db, err := openDB()
 	if err != nil {
 		return err
 	}
 	defer db.Close()
 
-	rows, err := db.Query(query)
+	rows, err := db.QueryContext(ctx, query)
 	if err != nil {
 		return err
 	}
@@ -166,21 +193,21 @@ func QueryString(query string) error {
 }
 
 // QueryJSON selects performs a select from the database (with a default)
-// and builds a JSON map which we write to the standard output.
-func QueryJSON(query string) error {
+// and builds a map per row which we print via output.Print.
+func QueryJSON(ctx context.Context, query string) error {
 	// TODO: we could move this to the cli command and potentially
 	// return an error on an empty string here.
 	if query == "" {
 		query = "select value from kv"
 	}
 
-	db, err := DbFromEnv()
+	db, err := openDB()
 	if err != nil {
 		return err
 	}
 	defer db.Close()
 
-	rows, err := db.Query(query)
+	rows, err := db.QueryContext(ctx, query)
 	if err != nil {
 		return err
 	}
@@ -211,11 +238,9 @@ func QueryJSON(query string) error {
 			dest[column] = *(values[i].(*interface{}))
 		}
 
-		b, err := json.Marshal(dest)
-		if err != nil {
+		if err := output.Print(dest); err != nil {
 			return err
 		}
-		fmt.Printf("%s\n", b)
 	}
 
 	if err := rows.Err(); err != nil {
@@ -226,16 +251,16 @@ func QueryJSON(query string) error {
 }
 
 // ListTables selects all tables from the current database and outputs them
-// in JSON format.
-func ListTables() error {
+// via output.Print.
+func ListTables(ctx context.Context) error {
 	query := "select tablename from pg_tables where schemaname = 'public';"
-	db, err := DbFromEnv()
+	db, err := openDB()
 	if err != nil {
 		return err
 	}
 	defer db.Close()
 
-	rows, err := db.Query(query)
+	rows, err := db.QueryContext(ctx, query)
 	if err != nil {
 		return err
 	}
@@ -245,12 +270,12 @@ func ListTables() error {
 		Name string `json:"name"`
 	}{}
 	for rows.Next() {
-		rows.Scan(&result.Name)
-		b, err := json.Marshal(&result)
-		if err != nil {
+		if err := rows.Scan(&result.Name); err != nil {
+			return err
+		}
+		if err := output.Print(&result); err != nil {
 			return err
 		}
-		fmt.Printf("%s\n", b)
 	}
 
 	if err := rows.Err(); err != nil {
@@ -262,13 +287,13 @@ func ListTables() error {
 
 // CreateTable creates a table in the database with columns key of type varchar(256)
 // and value of type valueType which defaults to jsonb.
-func CreateTable(name, valueType string) error {
+func CreateTable(ctx context.Context, name, valueType string) error {
 
 	if valueType == "" {
 		valueType = "jsonb"
 	}
 
-	db, err := DbFromEnv()
+	db, err := openDB()
 	if err != nil {
 		return err
 	}
@@ -281,7 +306,7 @@ func CreateTable(name, valueType string) error {
 	);
 	`
 
-	_, err = db.Exec(fmt.Sprintf(sql1, name, valueType))
+	_, err = db.ExecContext(ctx, fmt.Sprintf(sql1, name, valueType))
 	if err != nil {
 		return err
 	}
@@ -290,8 +315,8 @@ func CreateTable(name, valueType string) error {
 }
 
 // DeleteTable deletes a table from the database
-func DeleteTable(name string) error {
-	db, err := DbFromEnv()
+func DeleteTable(ctx context.Context, name string) error {
+	db, err := openDB()
 	if err != nil {
 		return err
 	}
@@ -299,7 +324,7 @@ func DeleteTable(name string) error {
 
 	sql1 := `drop table %s;`
 
-	_, err = db.Exec(fmt.Sprintf(sql1, name))
+	_, err = db.ExecContext(ctx, fmt.Sprintf(sql1, name))
 	if err != nil {
 		return err
 	}
@@ -312,12 +337,12 @@ func DeleteTable(name string) error {
 // This uses the bulk import approach outlined in the pq docs:
 // https://pkg.go.dev/github.com/lib/pq#hdr-Bulk_imports
 // We set a batchSize, which defaults to 100 if batchSize == 0
-func InsertStdinBulk(table string, batchSize int) error {
+func InsertStdinBulk(ctx context.Context, table string, batchSize int) error {
 	if batchSize == 0 {
 		batchSize = 100
 	}
 
-	db, err := DbFromEnv()
+	db, err := openDB()
 	if err != nil {
 		return err
 	}
@@ -330,12 +355,14 @@ func InsertStdinBulk(table string, batchSize int) error {
 
 	insertBulkJSON := func(table string, values []keyValue) (int64, error) {
 
-		txn, err := db.Begin()
+		txn, err := db.BeginTx(ctx, nil)
 		if err != nil {
 			return 0, err
 		}
+		// Rollback does nothing once the transaction is committed
+		defer txn.Rollback()
 
-		stmt, err := txn.Prepare(pq.CopyIn(table, "key", "value"))
+		stmt, err := txn.PrepareContext(ctx, pq.CopyIn(table, "key", "value"))
 		if err != nil {
 			return 0, err
 		}
@@ -346,13 +373,13 @@ func InsertStdinBulk(table string, batchSize int) error {
 				return 0, err
 			}
 
-			_, err = stmt.Exec(value.Key, string(b))
+			_, err = stmt.ExecContext(ctx, value.Key, string(b))
 			if err != nil {
 				return 0, err
 			}
 		}
 
-		result, err := stmt.Exec()
+		result, err := stmt.ExecContext(ctx)
 		if err != nil {
 			return 0, err
 		}
@@ -374,17 +401,14 @@ func InsertStdinBulk(table string, batchSize int) error {
 		return rowsAffected, nil
 	}
 
-	scanner := bufio.NewScanner(os.Stdin)
-
-	map1 := map[string]interface{}{}
+	scanner := bufio.NewScanner(stdin)
 
 	batch := []keyValue{}
-	i := 0
 	for scanner.Scan() {
-
+		map1 := map[string]interface{}{}
 		err := json.Unmarshal(scanner.Bytes(), &map1)
 		if err != nil {
-			return nil
+			return err
 		}
 		key := ""
 		if val, ok := map1["Key"]; ok {
@@ -401,8 +425,7 @@ func InsertStdinBulk(table string, batchSize int) error {
 		}
 		batch = append(batch, kv)
 
-		i++
-		if batchSize == i {
+		if len(batch) == batchSize {
 			rowsAffected, err := insertBulkJSON(table, batch)
 			if err != nil {
 				return err
@@ -429,9 +452,9 @@ func InsertStdinBulk(table string, batchSize int) error {
 // InsertStdin takes one or more records from the standard input and inserts
 // them individually using insertJSON which is similar to InsertJSON but reuses
 // the database connection so we avoid exhausting them in a loop.
-func InsertStdin(table string) error {
+func InsertStdin(ctx context.Context, table string) error {
 
-	db, err := DbFromEnv()
+	db, err := openDB()
 	if err != nil {
 		return err
 	}
@@ -443,7 +466,7 @@ func InsertStdin(table string) error {
 			return err
 		}
 
-		_, err = db.Exec("insert into "+table+" values ($1, $2);", key, b)
+		_, err = db.ExecContext(ctx, "insert into "+table+" values ($1, $2);", key, b)
 		if err != nil {
 			return err
 		}
@@ -451,13 +474,13 @@ func InsertStdin(table string) error {
 		return nil
 	}
 
-	scanner := bufio.NewScanner(os.Stdin)
+	scanner := bufio.NewScanner(stdin)
 
-	map1 := map[string]interface{}{}
 	for scanner.Scan() {
+		map1 := map[string]interface{}{}
 		err := json.Unmarshal(scanner.Bytes(), &map1)
 		if err != nil {
-			return nil
+			return err
 		}
 		key := ""
 		if val, ok := map1["Key"]; ok {
@@ -486,14 +509,67 @@ type KeyValue struct {
 	Value string
 }
 
-func mustGetEnv(key string) string {
-	value := os.Getenv(key)
-	if value == "" {
-		log.Fatalf("Require environment variable: %s\n", key)
-	}
-	return value
+// smokeTable names the temporary table used by Test, and is replaced in
+// tests.
+var smokeTable = func() string {
+	return smoke.Name("azgo_smoke", "_")
 }
 
-func Test() error {
-	return nil
+// Test is a smoke test of the database. It creates a temporary table,
+// inserts a key/value pair, reads it back, finds the table in pg_tables,
+// deletes the pair and drops the table, printing each step via
+// output.Print (see package smoke). It returns an error if any step failed.
+func Test(ctx context.Context) error {
+	test := smoke.New("postgres")
+	table := smokeTable()
+	key := "smoke"
+	value := "azgo smoke test of " + table
+
+	created := test.Step(ctx, "create table", func(ctx context.Context) error {
+		return CreateTable(ctx, table, "text")
+	})
+	if !created {
+		return test.Err()
+	}
+	test.Step(ctx, "insert", func(ctx context.Context) error {
+		return InsertKeyValue(ctx, table, key, value)
+	})
+	test.Step(ctx, "select", func(ctx context.Context) error {
+		got := ""
+		if err := queryRow(ctx, &got, "select value from "+table+" where key = $1;", key); err != nil {
+			return err
+		}
+		if got != value {
+			return fmt.Errorf("selected %q, want %q", got, value)
+		}
+		return nil
+	})
+	test.Step(ctx, "list", func(ctx context.Context) error {
+		n := 0
+		if err := queryRow(ctx, &n, "select count(*) from pg_tables where tablename = $1;", table); err != nil {
+			return err
+		}
+		if n != 1 {
+			return fmt.Errorf("%s is missing from pg_tables", table)
+		}
+		return nil
+	})
+	test.Step(ctx, "delete", func(ctx context.Context) error {
+		return Delete(ctx, table, key)
+	})
+	test.Cleanup(ctx, "drop table", func(ctx context.Context) error {
+		return DeleteTable(ctx, table)
+	})
+	return test.Err()
+}
+
+// queryRow runs a query which returns a single row and column, and scans
+// it into dest.
+func queryRow(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.QueryRowContext(ctx, query, args...).Scan(dest)
 }
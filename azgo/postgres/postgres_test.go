@@ -0,0 +1,351 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/blue-eight/azgo/azgo/config"
+	"github.com/blue-eight/azgo/azgo/internal/testutil"
+)
+
+// fakeDB records the statements run against it and answers queries with
+// canned rows. It is reached through the "fakepg" database/sql driver.
+type fakeDB struct {
+	mu      sync.Mutex
+	execs   []fakeExec
+	results map[string]fakeResult
+	fail    error
+	commits int
+}
+
+type fakeExec struct {
+	query string
+	args  []driver.Value
+}
+
+type fakeResult struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+var (
+	fakeDatabases = map[string]*fakeDB{}
+	fakeLock      sync.Mutex
+)
+
+func init() {
+	sql.Register("fakepg", fakeDriver{})
+}
+
+func useFake(t *testing.T) *fakeDB {
+	db := &fakeDB{results: map[string]fakeResult{}}
+	fakeLock.Lock()
+	fakeDatabases[t.Name()] = db
+	fakeLock.Unlock()
+	previous := openDB
+	openDB = func() (*sql.DB, error) { return sql.Open("fakepg", t.Name()) }
+	t.Cleanup(func() { openDB = previous })
+	return db
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	fakeLock.Lock()
+	defer fakeLock.Unlock()
+	db, ok := fakeDatabases[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown database %q", name)
+	}
+	return &fakeConn{db: db}, nil
+}
+
+type fakeConn struct {
+	db *fakeDB
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{db: c.db, query: query}, nil
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Begin() (driver.Tx, error) { return fakeTx{c.db}, nil }
+
+type fakeTx struct {
+	db *fakeDB
+}
+
+func (tx fakeTx) Commit() error {
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+	tx.db.commits++
+	return nil
+}
+
+func (tx fakeTx) Rollback() error { return nil }
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+	// copied buffers the rows of a COPY until the final Exec without args
+	copied []driver.Value
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	if s.db.fail != nil {
+		return nil, s.db.fail
+	}
+	if strings.HasPrefix(s.query, "COPY") {
+		if len(args) > 0 {
+			s.copied = append(s.copied, args...)
+			return driver.RowsAffected(0), nil
+		}
+		s.db.execs = append(s.db.execs, fakeExec{s.query, s.copied})
+		return driver.RowsAffected(len(s.copied) / 2), nil
+	}
+	s.db.execs = append(s.db.execs, fakeExec{s.query, args})
+	return driver.RowsAffected(1), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	if s.db.fail != nil {
+		return nil, s.db.fail
+	}
+	result, ok := s.db.results[s.query]
+	if !ok {
+		return nil, fmt.Errorf("unexpected query %q", s.query)
+	}
+	return &fakeRows{result: result}, nil
+}
+
+type fakeRows struct {
+	result fakeResult
+	next   int
+}
+
+func (r *fakeRows) Columns() []string { return r.result.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.result.rows) {
+		return io.EOF
+	}
+	copy(dest, r.result.rows[r.next])
+	r.next++
+	return nil
+}
+
+func TestExec(t *testing.T) {
+	ctx := context.Background()
+	db := useFake(t)
+
+	if err := InsertKeyValue(ctx, "", "greeting", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Delete(ctx, "other", "greeting"); err != nil {
+		t.Fatal(err)
+	}
+	n, err := Exec(ctx, "update kv set value = $1", "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("Exec rows affected = %d, want 1", n)
+	}
+
+	want := []string{
+		"insert into kv values ($1, $2); [greeting hello]",
+		"delete from other where key = $1; [greeting]",
+		"update kv set value = $1 [x]",
+	}
+	if len(db.execs) != len(want) {
+		t.Fatalf("ran %d statements, want %d: %v", len(db.execs), len(want), db.execs)
+	}
+	for i, exec := range db.execs {
+		if got := fmt.Sprintf("%s %v", exec.query, exec.args); got != want[i] {
+			t.Errorf("statement %d = %s, want %s", i, got, want[i])
+		}
+	}
+
+	db.fail = errors.New("relation does not exist")
+	if err := InsertKeyValue(ctx, "missing", "k", "v"); !errors.Is(err, db.fail) {
+		t.Errorf("InsertKeyValue error = %v, want %v", err, db.fail)
+	}
+}
+
+func TestQueries(t *testing.T) {
+	ctx := context.Background()
+	db := useFake(t)
+	db.results["select key, value from kv"] = fakeResult{
+		columns: []string{"key", "value"},
+		rows:    [][]driver.Value{{"a", `{"n":1}`}, {"b", `{"n":2}`}},
+	}
+	db.results["select key, n from kv"] = fakeResult{
+		columns: []string{"key", "n"},
+		rows:    [][]driver.Value{{"a", int64(1)}},
+	}
+	db.results["select tablename from pg_tables where schemaname = 'public';"] = fakeResult{
+		columns: []string{"tablename"},
+		rows:    [][]driver.Value{{"kv"}, {"events"}},
+	}
+
+	tests := []struct {
+		name string
+		run  func() error
+		want string
+	}{
+		{"QueryKeyValue", func() error { return QueryKeyValue(ctx, "") },
+			"{\"Key\":\"a\",\"Value\":\"{\\\"n\\\":1}\"}\n{\"Key\":\"b\",\"Value\":\"{\\\"n\\\":2}\"}\n"},
+		{"QueryJSON", func() error { return QueryJSON(ctx, "select key, n from kv") },
+			"{\"key\":\"a\",\"n\":1}\n"},
+		{"ListTables", func() error { return ListTables(ctx) },
+			"{\"name\":\"kv\"}\n{\"name\":\"events\"}\n"},
+	}
+	for _, test := range tests {
+		out := testutil.CaptureOutput(t)
+		if err := test.run(); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if out.String() != test.want {
+			t.Errorf("%s printed\n%s\nwant\n%s", test.name, out, test.want)
+		}
+	}
+
+	if err := QueryJSON(ctx, "select nothing"); err == nil {
+		t.Error("QueryJSON of an unknown query returned no error")
+	}
+}
+
+func TestInsertStdin(t *testing.T) {
+	ctx := context.Background()
+	db := useFake(t)
+	defer func() { stdin = os.Stdin }()
+
+	stdin = strings.NewReader(`{"Key":"a","n":1}
+{"n":2}
+`)
+	if err := InsertStdin(ctx, "events"); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.execs) != 2 {
+		t.Fatalf("ran %d statements, want 2", len(db.execs))
+	}
+	if key := db.execs[0].args[0]; key != "a" {
+		t.Errorf("first key = %v, want a", key)
+	}
+	if key, _ := db.execs[1].args[0].(string); len(key) != 36 {
+		t.Errorf("second key = %q, want a generated UUID", key)
+	}
+	if value := string(db.execs[1].args[1].([]byte)); value != `{"n":2}` {
+		t.Errorf("second value = %s, want only its own fields", value)
+	}
+
+	stdin = strings.NewReader("{not json}\n")
+	if err := InsertStdin(ctx, "events"); err == nil {
+		t.Error("InsertStdin of invalid JSON returned no error")
+	}
+}
+
+func TestInsertStdinBulk(t *testing.T) {
+	ctx := context.Background()
+	db := useFake(t)
+	defer func() { stdin = os.Stdin }()
+
+	stdin = strings.NewReader("{\"Key\":\"1\"}\n{\"Key\":\"2\"}\n{\"Key\":\"3\"}\n{\"Key\":\"4\"}\n{\"Key\":\"5\"}\n")
+	if err := InsertStdinBulk(ctx, "events", 2); err != nil {
+		t.Fatal(err)
+	}
+	if db.commits != 3 {
+		t.Errorf("committed %d batches, want 3", db.commits)
+	}
+	rows := []int{}
+	for _, exec := range db.execs {
+		if !strings.HasPrefix(exec.query, `COPY "events" ("key", "value")`) {
+			t.Errorf("unexpected statement %q", exec.query)
+		}
+		rows = append(rows, len(exec.args)/2)
+	}
+	if got := fmt.Sprint(rows); got != "[2 2 1]" {
+		t.Errorf("batch sizes = %s, want [2 2 1]", got)
+	}
+}
+
+func TestMissingURL(t *testing.T) {
+	testutil.UseProfile(t, &config.Profile{})
+	if err := InsertKeyValue(context.Background(), "", "k", "v"); err == nil {
+		t.Error("InsertKeyValue without postgres_url returned no error")
+	}
+}
+
+func TestSmoke(t *testing.T) {
+	ctx := context.Background()
+	db := useFake(t)
+	previous := smokeTable
+	smokeTable = func() string { return "azgo_smoke_test" }
+	defer func() { smokeTable = previous }()
+	db.results["select value from azgo_smoke_test where key = $1;"] = fakeResult{
+		columns: []string{"value"},
+		rows:    [][]driver.Value{{"azgo smoke test of azgo_smoke_test"}},
+	}
+	db.results["select count(*) from pg_tables where tablename = $1;"] = fakeResult{
+		columns: []string{"count"},
+		rows:    [][]driver.Value{{int64(1)}},
+	}
+
+	out := testutil.CaptureOutput(t)
+	if err := Test(ctx); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+	records := testutil.Records(t, out)
+	steps := []string{"create table", "insert", "select", "list", "delete", "drop table"}
+	if len(records) != len(steps) {
+		t.Fatalf("Test printed %d steps, want %d:\n%s", len(records), len(steps), out)
+	}
+	for i, step := range steps {
+		if records[i]["step"] != step || records[i]["status"] != "pass" {
+			t.Errorf("step %d = %v, want %s to pass", i, records[i], step)
+		}
+	}
+	if last := db.execs[len(db.execs)-1].query; last != "drop table azgo_smoke_test;" {
+		t.Errorf("last statement = %q, want the table dropped", last)
+	}
+
+	// a wrong value fails the select, skips the rest and still drops the table
+	db.results["select value from azgo_smoke_test where key = $1;"] = fakeResult{
+		columns: []string{"value"},
+		rows:    [][]driver.Value{{"stale"}},
+	}
+	db.execs = nil
+	out.Reset()
+	if err := Test(ctx); err == nil || !strings.Contains(err.Error(), "select") {
+		t.Errorf("Test error = %v, want the select step to fail", err)
+	}
+	statuses := []string{}
+	for _, r := range testutil.Records(t, out) {
+		statuses = append(statuses, fmt.Sprint(r["step"], "=", r["status"]))
+	}
+	want := "[create table=pass insert=pass select=fail list=skip delete=skip drop table=pass]"
+	if got := fmt.Sprint(statuses); got != want {
+		t.Errorf("steps = %s, want %s", got, want)
+	}
+	if last := db.execs[len(db.execs)-1].query; last != "drop table azgo_smoke_test;" {
+		t.Errorf("last statement = %q, want the table dropped", last)
+	}
+}
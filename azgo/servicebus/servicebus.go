@@ -2,19 +2,35 @@ package servicebus
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"log"
-	"os"
 	"time"
 
 	servicebus "github.com/Azure/azure-service-bus-go"
+	"github.com/blue-eight/azgo/azgo/config"
+	"github.com/blue-eight/azgo/azgo/output"
+	"github.com/blue-eight/azgo/azgo/smoke"
 )
 
 // ServiceBusFromEnv creates a new *servicebus.Namespace authenticated via the
 // AZGO_SERVICEBUS_CONNECTION_STRING environment variable
 func ServiceBusFromEnv() (*servicebus.Namespace, error) {
-	connStr := mustGetEnv("AZGO_SERVICEBUS_CONNECTION_STRING")
+	return ServiceBusFromProfile(config.FromEnv())
+}
+
+// ServiceBusFromConfig creates a new *servicebus.Namespace for the active
+// profile (see config.Active), which is what the functions in this package use.
+func ServiceBusFromConfig() (*servicebus.Namespace, error) {
+	return ServiceBusFromProfile(config.Active())
+}
+
+// ServiceBusFromProfile creates a new *servicebus.Namespace authenticated via
+// the servicebus_connection_string of the profile. It returns an error if
+// the connection string is missing.
+func ServiceBusFromProfile(p *config.Profile) (*servicebus.Namespace, error) {
+	connStr := p.ServiceBusConnectionString
+	if connStr == "" {
+		return nil, config.Missing("servicebus_connection_string")
+	}
 	ns, err := servicebus.NewNamespace(servicebus.NamespaceWithConnectionString(connStr))
 	if err != nil {
 		return nil, err
@@ -22,122 +38,184 @@ func ServiceBusFromEnv() (*servicebus.Namespace, error) {
 	return ns, nil
 }
 
-// CreateQueue creates a service bus queue.
-func CreateQueue(name string) error {
-	ns, err := ServiceBusFromEnv()
+// client is the part of a Service Bus namespace the functions in this
+// package use. sdkClient implements it with the SDK, and tests replace
+// newClient with an in-memory fake.
+type client interface {
+	PutQueue(ctx context.Context, name string) error
+	DeleteQueue(ctx context.Context, name string) error
+	ListQueues(ctx context.Context) ([]*servicebus.QueueEntity, error)
+	Send(ctx context.Context, queue, message string) error
+	// ReceiveOne receives and completes a single message.
+	ReceiveOne(ctx context.Context, queue string) (string, error)
+}
+
+var newClient = func() (client, error) {
+	ns, err := ServiceBusFromConfig()
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return sdkClient{ns}, nil
+}
 
-	ctx := context.Background()
-	qm := ns.NewQueueManager()
-	_, err = qm.Put(ctx, name)
+type sdkClient struct {
+	ns *servicebus.Namespace
+}
+
+func (c sdkClient) PutQueue(ctx context.Context, name string) error {
+	_, err := c.ns.NewQueueManager().Put(ctx, name)
+	return err
+}
+
+func (c sdkClient) DeleteQueue(ctx context.Context, name string) error {
+	return c.ns.NewQueueManager().Delete(ctx, name)
+}
+
+func (c sdkClient) ListQueues(ctx context.Context) ([]*servicebus.QueueEntity, error) {
+	return c.ns.NewQueueManager().List(ctx)
+}
+
+func (c sdkClient) Send(ctx context.Context, queue, message string) error {
+	q, err := c.ns.NewQueue(queue)
 	if err != nil {
 		return err
 	}
-	return nil
+	defer q.Close(ctx)
+	return q.Send(ctx, servicebus.NewMessageFromString(message))
 }
 
-// DeleteQueue deletes a service bus queue.
-func DeleteQueue(name string) error {
-	ns, err := ServiceBusFromEnv()
+func (c sdkClient) ReceiveOne(ctx context.Context, queue string) (string, error) {
+	q, err := c.ns.NewQueue(queue)
 	if err != nil {
-		return err
+		return "", err
 	}
+	defer q.Close(ctx)
 
-	ctx := context.Background()
-	qm := ns.NewQueueManager()
-	err = qm.Delete(ctx, name)
+	result := make(chan string, 1)
+	err = q.ReceiveOne(
+		ctx,
+		servicebus.HandlerFunc(func(ctx context.Context, message *servicebus.Message) error {
+			// we use a buffered channel to avoid blocking here
+			result <- string(message.Data)
+			return message.Complete(ctx)
+		}),
+	)
 	if err != nil {
-		return err
+		return "", err
 	}
-	return nil
+	return <-result, nil
 }
 
-// ListQueues lists service bus queues in the account and marshals them
-// to JSON which provides full details.
-func ListQueues() error {
-	ns, err := ServiceBusFromEnv()
+// CreateQueue creates a service bus queue.
+func CreateQueue(ctx context.Context, name string) error {
+	c, err := newClient()
 	if err != nil {
 		return err
 	}
+	return c.PutQueue(ctx, name)
+}
 
-	ctx := context.Background()
-	qm := ns.NewQueueManager()
-	result, err := qm.List(ctx)
+// DeleteQueue deletes a service bus queue.
+func DeleteQueue(ctx context.Context, name string) error {
+	c, err := newClient()
 	if err != nil {
 		return err
 	}
-	for _, x := range result {
-		b, err := json.Marshal(x)
-		if err != nil {
-			return err
-		}
-		fmt.Printf("%s\n", b)
-	}
-	return nil
+	return c.DeleteQueue(ctx, name)
 }
 
-// Send sends a message to the named service bus queue.
-func Send(queue, message string) error {
-	ns, err := ServiceBusFromEnv()
+// ListQueues lists service bus queues in the account and prints them
+// via output.Print, which provides full details.
+func ListQueues(ctx context.Context) error {
+	c, err := newClient()
 	if err != nil {
 		return err
 	}
 
-	q, err := ns.NewQueue(queue)
+	result, err := c.ListQueues(ctx)
 	if err != nil {
 		return err
 	}
-
-	ctx := context.Background()
-	err = q.Send(ctx, servicebus.NewMessageFromString(message))
-	if err != nil {
-		return nil
+	for _, x := range result {
+		if err := output.Print(x); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-// Receive receives a single message from the service bus queue using the
-// ReceiveOne method, with the help of a channel.
-func Receive(queue string) (string, error) {
-
-	ns, err := ServiceBusFromEnv()
+// Send sends a message to the named service bus queue.
+func Send(ctx context.Context, queue, message string) error {
+	c, err := newClient()
 	if err != nil {
-		return "", err
+		return err
 	}
+	return c.Send(ctx, queue, message)
+}
 
-	q, err := ns.NewQueue(queue)
+// receiveTimeout is how long Receive waits for a message.
+var receiveTimeout = 10 * time.Second
+
+// Receive receives a single message from the service bus queue using the
+// ReceiveOne method, with the help of a channel. It waits for at most 10
+// seconds, or less if ctx has an earlier deadline.
+func Receive(ctx context.Context, queue string) (string, error) {
+	c, err := newClient()
 	if err != nil {
 		return "", err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, receiveTimeout)
 	defer cancel()
-	c := make(chan string, 1)
-	err = q.ReceiveOne(
-		ctx,
-		servicebus.HandlerFunc(func(ctx context.Context, message *servicebus.Message) error {
-			// we use a buffered channel to avoid blocking here
-			c <- string(message.Data)
-			return message.Complete(ctx)
-		}),
-	)
-	if err != nil {
-		return "", err
-	}
-	result := <-c
-	return result, nil
+	return c.ReceiveOne(ctx, queue)
 }
 
-func mustGetEnv(key string) string {
-	value := os.Getenv(key)
-	if value == "" {
-		log.Fatalf("Require environment variable: %s\n", key)
+// Test is a smoke test of the namespace. It creates a temporary queue,
+// sends a message, receives it, lists the queues, and deletes the queue,
+// printing each step via output.Print (see package smoke). It returns an
+// error if any step failed.
+func Test(ctx context.Context) error {
+	test := smoke.New("servicebus")
+	queue := smoke.Name("azgo-smoke", "-")
+	message := "azgo smoke test of " + queue
+
+	created := test.Step(ctx, "create queue", func(ctx context.Context) error {
+		return CreateQueue(ctx, queue)
+	})
+	if !created {
+		return test.Err()
 	}
-	return value
-}
-
-func Test() error {
-	return nil
+	test.Step(ctx, "send", func(ctx context.Context) error {
+		return Send(ctx, queue, message)
+	})
+	test.Step(ctx, "receive", func(ctx context.Context) error {
+		got, err := Receive(ctx, queue)
+		if err != nil {
+			return err
+		}
+		if got != message {
+			return fmt.Errorf("received %q, want %q", got, message)
+		}
+		return nil
+	})
+	test.Step(ctx, "list", func(ctx context.Context) error {
+		c, err := newClient()
+		if err != nil {
+			return err
+		}
+		queues, err := c.ListQueues(ctx)
+		if err != nil {
+			return err
+		}
+		for _, q := range queues {
+			if q.Name == queue {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s is missing from the list of queues", queue)
+	})
+	test.Cleanup(ctx, "delete queue", func(ctx context.Context) error {
+		return DeleteQueue(ctx, queue)
+	})
+	return test.Err()
 }
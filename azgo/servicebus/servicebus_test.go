@@ -0,0 +1,223 @@
+package servicebus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	servicebus "github.com/Azure/azure-service-bus-go"
+	"github.com/blue-eight/azgo/azgo/config"
+	"github.com/blue-eight/azgo/azgo/internal/testutil"
+)
+
+var errQueueNotFound = errors.New("queue not found")
+
+// fakeClient is an in-memory namespace of FIFO queues.
+type fakeClient struct {
+	mu     sync.Mutex
+	queues map[string][]string
+}
+
+func (f *fakeClient) PutQueue(ctx context.Context, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.queues[name]; !ok {
+		f.queues[name] = []string{}
+	}
+	return nil
+}
+
+func (f *fakeClient) DeleteQueue(ctx context.Context, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.queues[name]; !ok {
+		return errQueueNotFound
+	}
+	delete(f.queues, name)
+	return nil
+}
+
+func (f *fakeClient) ListQueues(ctx context.Context) ([]*servicebus.QueueEntity, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	entities := []*servicebus.QueueEntity{}
+	for name, messages := range f.queues {
+		count := int64(len(messages))
+		entities = append(entities, &servicebus.QueueEntity{
+			Entity:           &servicebus.Entity{Name: name},
+			QueueDescription: &servicebus.QueueDescription{MessageCount: &count},
+		})
+	}
+	sort.Slice(entities, func(i, j int) bool { return entities[i].Name < entities[j].Name })
+	return entities, nil
+}
+
+func (f *fakeClient) Send(ctx context.Context, queue, message string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.queues[queue]; !ok {
+		return errQueueNotFound
+	}
+	f.queues[queue] = append(f.queues[queue], message)
+	return nil
+}
+
+func (f *fakeClient) ReceiveOne(ctx context.Context, queue string) (string, error) {
+	for {
+		f.mu.Lock()
+		messages, ok := f.queues[queue]
+		if !ok {
+			f.mu.Unlock()
+			return "", errQueueNotFound
+		}
+		if len(messages) > 0 {
+			f.queues[queue] = messages[1:]
+			f.mu.Unlock()
+			return messages[0], nil
+		}
+		f.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+// lossyClient drops every message it sends.
+type lossyClient struct {
+	*fakeClient
+}
+
+func (lossyClient) Send(ctx context.Context, queue, message string) error { return nil }
+
+func useFake(t *testing.T) *fakeClient {
+	f := &fakeClient{queues: map[string][]string{}}
+	previous := newClient
+	newClient = func() (client, error) { return f, nil }
+	t.Cleanup(func() { newClient = previous })
+	return f
+}
+
+func TestQueues(t *testing.T) {
+	ctx := context.Background()
+	useFake(t)
+
+	for _, name := range []string{"orders", "audit"} {
+		if err := CreateQueue(ctx, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Send(ctx, "orders", "first"); err != nil {
+		t.Fatal(err)
+	}
+
+	out := testutil.CaptureOutput(t)
+	if err := ListQueues(ctx); err != nil {
+		t.Fatal(err)
+	}
+	records := testutil.Records(t, out)
+	if len(records) != 2 {
+		t.Fatalf("ListQueues printed %d records, want 2:\n%s", len(records), out)
+	}
+	if records[0]["Name"] != "audit" || records[1]["Name"] != "orders" {
+		t.Errorf("ListQueues printed %v", records)
+	}
+	if records[1]["MessageCount"] != 1.0 {
+		t.Errorf("orders MessageCount = %v, want 1", records[1]["MessageCount"])
+	}
+
+	if err := DeleteQueue(ctx, "audit"); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteQueue(ctx, "audit"); !errors.Is(err, errQueueNotFound) {
+		t.Errorf("DeleteQueue(audit) again error = %v, want not found", err)
+	}
+}
+
+func TestSendReceive(t *testing.T) {
+	ctx := context.Background()
+	useFake(t)
+	if err := CreateQueue(ctx, "orders"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := Send(ctx, "orders", fmt.Sprint("message ", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		message, err := Receive(ctx, "orders")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprint("message ", i); message != want {
+			t.Errorf("Receive = %q, want %q", message, want)
+		}
+	}
+
+	if err := Send(ctx, "missing", "lost"); !errors.Is(err, errQueueNotFound) {
+		t.Errorf("Send to a missing queue error = %v, want not found", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := Receive(ctx, "orders"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Receive from an empty queue error = %v, want deadline exceeded", err)
+	}
+}
+
+func TestMissingConnectionString(t *testing.T) {
+	testutil.UseProfile(t, &config.Profile{})
+	if err := CreateQueue(context.Background(), "orders"); err == nil {
+		t.Error("CreateQueue without servicebus_connection_string returned no error")
+	}
+}
+
+func TestSmoke(t *testing.T) {
+	ctx := context.Background()
+	f := useFake(t)
+
+	out := testutil.CaptureOutput(t)
+	if err := Test(ctx); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+	records := testutil.Records(t, out)
+	steps := []string{"create queue", "send", "receive", "list", "delete queue"}
+	if len(records) != len(steps) {
+		t.Fatalf("Test printed %d steps, want %d:\n%s", len(records), len(steps), out)
+	}
+	for i, step := range steps {
+		if records[i]["step"] != step || records[i]["status"] != "pass" || records[i]["service"] != "servicebus" {
+			t.Errorf("step %d = %v, want %s to pass", i, records[i], step)
+		}
+	}
+	if len(f.queues) != 0 {
+		t.Errorf("Test left queues behind: %v", f.queues)
+	}
+
+	// a lost message fails receive, skips list and still deletes the queue
+	newClient = func() (client, error) { return lossyClient{f}, nil }
+	receiveTimeout = 20 * time.Millisecond
+	defer func() { receiveTimeout = 10 * time.Second }()
+	out.Reset()
+	if err := Test(ctx); err == nil {
+		t.Error("Test losing the message returned no error")
+	}
+	statuses := []string{}
+	for _, r := range testutil.Records(t, out) {
+		statuses = append(statuses, fmt.Sprint(r["step"], "=", r["status"]))
+	}
+	want := "[create queue=pass send=pass receive=fail list=skip delete queue=pass]"
+	if got := fmt.Sprint(statuses); got != want {
+		t.Errorf("steps = %s, want %s", got, want)
+	}
+	if len(f.queues) != 0 {
+		t.Errorf("Test left queues behind: %v", f.queues)
+	}
+}
@@ -0,0 +1,19 @@
+/*
+Package smoke runs the end-to-end checks behind `azgo <service> test`,
+which we use as post-deploy health checks.
+
+Each service's Test function makes a round trip against the configured
+backend (e.g. create a temporary container, write a blob, read it back,
+list it, delete it and the container) as a series of steps. Every step is
+printed via output.Print as it finishes, with its duration and status:
+
+	{"service":"blob","step":"create container","status":"pass","duration_ms":41.2}
+	{"service":"blob","step":"upload","status":"fail","duration_ms":12.9,"error":"..."}
+	{"service":"blob","step":"download","status":"skip","duration_ms":0}
+	{"service":"blob","step":"delete container","status":"pass","duration_ms":30.4}
+
+Once a step fails the remaining steps are skipped, except for cleanup
+steps, which always run so nothing is left behind. Test then returns an
+error, so the CLI exits non-zero.
+*/
+package smoke
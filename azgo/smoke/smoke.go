@@ -0,0 +1,102 @@
+package smoke
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/blue-eight/azgo/azgo/output"
+	"github.com/google/uuid"
+)
+
+// Statuses of a Step.
+const (
+	Pass = "pass"
+	Fail = "fail"
+	Skip = "skip"
+)
+
+// Step is the result of one step of a smoke test.
+type Step struct {
+	Service    string  `json:"service"`
+	Step       string  `json:"step"`
+	Status     string  `json:"status"`
+	DurationMS float64 `json:"duration_ms"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// cleanupTimeout bounds each Cleanup step.
+const cleanupTimeout = 30 * time.Second
+
+// Test is a smoke test of a single service.
+type Test struct {
+	service string
+	failed  []string
+	err     error
+}
+
+// New starts a smoke test of service.
+func New(service string) *Test {
+	return &Test{service: service}
+}
+
+// Name returns a unique name for a temporary resource, made of prefix
+// and sep followed by random hex, e.g. Name("azgo-smoke", "-").
+func Name(prefix, sep string) string {
+	return prefix + sep + strings.ReplaceAll(uuid.New().String(), "-", "")[:12]
+}
+
+// Step runs fn as the named step and reports whether it passed. It is
+// skipped, and reports false, if an earlier step failed.
+func (t *Test) Step(ctx context.Context, name string, fn func(ctx context.Context) error) bool {
+	if len(t.failed) > 0 {
+		t.print(Step{Service: t.service, Step: name, Status: Skip})
+		return false
+	}
+	return t.run(ctx, name, fn)
+}
+
+// Cleanup runs fn as the named step even if an earlier step failed. ctx
+// may already be done (after --timeout or Ctrl-C), so fn gets its own
+// deadline of cleanupTimeout instead, and the temporary resource is still
+// removed.
+func (t *Test) Cleanup(ctx context.Context, name string, fn func(ctx context.Context) error) bool {
+	cleanupCtx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+	defer cancel()
+	return t.run(cleanupCtx, name, fn)
+}
+
+func (t *Test) run(ctx context.Context, name string, fn func(ctx context.Context) error) bool {
+	start := time.Now()
+	err := fn(ctx)
+	step := Step{
+		Service:    t.service,
+		Step:       name,
+		Status:     Pass,
+		DurationMS: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		step.Status = Fail
+		step.Error = err.Error()
+		t.failed = append(t.failed, name)
+	}
+	t.print(step)
+	return err == nil
+}
+
+// print prints step, keeping the first error from output.Print for Err.
+func (t *Test) print(step Step) {
+	if err := output.Print(step); err != nil && t.err == nil {
+		t.err = err
+	}
+}
+
+// Err returns an error naming the steps which failed, or nil if they all
+// passed.
+func (t *Test) Err() error {
+	if len(t.failed) > 0 {
+		return fmt.Errorf("%s smoke test failed: %s", t.service, strings.Join(t.failed, ", "))
+	}
+	return t.err
+}
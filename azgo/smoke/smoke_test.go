@@ -0,0 +1,84 @@
+package smoke
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/blue-eight/azgo/azgo/internal/testutil"
+)
+
+func TestSteps(t *testing.T) {
+	ctx := context.Background()
+	out := testutil.CaptureOutput(t)
+	ok := func(context.Context) error { return nil }
+
+	test := New("fake")
+	if !test.Step(ctx, "first", ok) {
+		t.Error("a passing step reported false")
+	}
+	if test.Step(ctx, "second", func(context.Context) error { return errors.New("boom") }) {
+		t.Error("a failing step reported true")
+	}
+	if test.Step(ctx, "third", ok) {
+		t.Error("a step after a failure reported true")
+	}
+	if !test.Cleanup(ctx, "cleanup", ok) {
+		t.Error("cleanup after a failure reported false")
+	}
+
+	err := test.Err()
+	if err == nil || err.Error() != "fake smoke test failed: second" {
+		t.Errorf("Err = %v", err)
+	}
+	statuses := []string{}
+	for _, r := range testutil.Records(t, out) {
+		if r["service"] != "fake" {
+			t.Errorf("record %v has the wrong service", r)
+		}
+		statuses = append(statuses, fmt.Sprint(r["step"], "=", r["status"]))
+	}
+	if got, want := fmt.Sprint(statuses), "[first=pass second=fail third=skip cleanup=pass]"; got != want {
+		t.Errorf("steps = %s, want %s", got, want)
+	}
+	if !strings.Contains(out.String(), `"error":"boom"`) {
+		t.Errorf("the failed step has no error:\n%s", out)
+	}
+
+	if err := New("fake").Err(); err != nil {
+		t.Errorf("Err of an empty test = %v", err)
+	}
+}
+
+func TestCleanupAfterCancel(t *testing.T) {
+	testutil.CaptureOutput(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	test := New("fake")
+	if test.Step(ctx, "create", func(ctx context.Context) error { return ctx.Err() }) {
+		t.Error("a step with a cancelled ctx reported true")
+	}
+	ran := test.Cleanup(ctx, "delete", func(ctx context.Context) error {
+		if _, ok := ctx.Deadline(); !ok {
+			return errors.New("cleanup ctx has no deadline")
+		}
+		return ctx.Err()
+	})
+	if !ran {
+		t.Error("cleanup after the ctx was cancelled reported false")
+	}
+	if err := test.Err(); err == nil || err.Error() != "fake smoke test failed: create" {
+		t.Errorf("Err = %v", err)
+	}
+}
+
+func TestName(t *testing.T) {
+	a, b := Name("azgo-smoke", "-"), Name("azgo-smoke", "-")
+	if a == b || !regexp.MustCompile(`^azgo-smoke-[0-9a-f]{12}$`).MatchString(a) {
+		t.Errorf("Name = %s, %s", a, b)
+	}
+}
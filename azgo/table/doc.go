@@ -28,9 +28,11 @@ which causes them to be optimized for the simple CLI use-case.
 They are purposely designed to be simple, and able to be borrowed from and
 tweaked for more complex use-cases.
 
-The main convention we have is the use of TableClientFromEnv to create a
-TableClient from the AZGO_TABLE_ACCOUNT and AZGO_TABLE_KEY environment variables,
-and optionally the AZGO_TABLE_TYPE variable which can be set to "storage" to
-connect to a Storage Account rather than Cosmos DB (default).
+The main convention we have is the use of ServiceClientFromConfig to create a
+ServiceClient from the table_account and table_key of the active profile (see
+package config), which can be overridden by the AZGO_TABLE_ACCOUNT and
+AZGO_TABLE_KEY environment variables. The optional table_type (or
+AZGO_TABLE_TYPE) can be set to "storage" to connect to a Storage Account
+rather than Cosmos DB (default).
 */
 package table
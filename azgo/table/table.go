@@ -6,33 +6,90 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"io"
 	"os"
+	"strings"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
 	"github.com/Azure/azure-sdk-for-go/sdk/data/aztables"
+	"github.com/blue-eight/azgo/azgo/config"
+	"github.com/blue-eight/azgo/azgo/output"
+	"github.com/blue-eight/azgo/azgo/trace"
 	"github.com/google/uuid"
 )
 
-// TableClientFromEnv creates an *aztables.TableServiceClient authenticated
+var (
+	// stdin is read by InsertStdin, and replaced in tests.
+	stdin io.Reader = os.Stdin
+	// transport sends the requests of the table clients. nil is the SDK
+	// default; tests replay cassettes through it.
+	transport policy.Transporter
+)
+
+// ServiceClientFromEnv creates an *aztables.ServiceClient authenticated
 // by the environment variables AZGO_TABLE_ACCOUNT and AZGO_TABLE_KEY.
 // This uses Cosmos DB by default, but also lets us choose Storage Account
 // if the optional environment variable AZGO_TABLE_TYPE="storage"
 func ServiceClientFromEnv() (*aztables.ServiceClient, error) {
-	tableAccount := mustGetEnv("AZGO_TABLE_ACCOUNT")
-	tableKey := mustGetEnv("AZGO_TABLE_KEY")
-	tableType := os.Getenv("AZGO_TABLE_TYPE")
+	return ServiceClientFromProfile(config.FromEnv())
+}
 
-	credential, err := aztables.NewSharedKeyCredential(tableAccount, tableKey)
-	if err != nil {
-		return nil, err
+// ServiceClientFromConfig creates an *aztables.ServiceClient for the active
+// profile (see config.Active), which is what the functions in this package use.
+func ServiceClientFromConfig() (*aztables.ServiceClient, error) {
+	return ServiceClientFromProfile(config.Active())
+}
+
+// ServiceClientFromProfile creates an *aztables.ServiceClient for the
+// profile. If the profile has a table_connection_string (e.g.
+// "UseDevelopmentStorage=true" for Azurite) we use its endpoint and key or
+// SAS. Otherwise we use table_account and table_key, with table_endpoint
+// overriding the default endpoint, which is Cosmos DB unless table_type is
+// "storage". It returns an error if the settings are missing or malformed.
+func ServiceClientFromProfile(p *config.Profile) (*aztables.ServiceClient, error) {
+	tableAccount := p.TableAccount
+	tableKey := p.TableKey
+	serviceURL := p.TableEndpoint
+	sas := ""
+	if p.TableConnectionString != "" {
+		conn, err := config.ParseStorageConnectionString(p.TableConnectionString)
+		if err != nil {
+			return nil, err
+		}
+		tableAccount, tableKey, sas = conn.AccountName, conn.AccountKey, conn.SharedAccessSignature
+		serviceURL = conn.TableEndpoint
 	}
-	accountEndpoint := "https://%s.table.cosmos.azure.com/"
-	if tableType == "storage" {
-		accountEndpoint = "https://%s.table.core.windows.net/"
+	if serviceURL == "" {
+		if tableAccount == "" {
+			return nil, config.Missing("table_account")
+		}
+		accountEndpoint := "https://%s.table.cosmos.azure.com/"
+		if p.TableType == "storage" {
+			accountEndpoint = "https://%s.table.core.windows.net/"
+		}
+		serviceURL = fmt.Sprintf(accountEndpoint, tableAccount)
 	}
 
-	serviceURL := fmt.Sprintf(accountEndpoint, tableAccount)
-	tableClientOptions := &aztables.ClientOptions{}
+	var credential azcore.Credential
+	if sas != "" {
+		credential = azcore.NewAnonymousCredential()
+		serviceURL = strings.TrimSuffix(serviceURL, "/") + "/?" + sas
+	} else {
+		if tableAccount == "" {
+			return nil, config.Missing("table_account")
+		}
+		if tableKey == "" {
+			return nil, config.Missing("table_key")
+		}
+		var err error
+		credential, err = aztables.NewSharedKeyCredential(tableAccount, tableKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tableClientOptions := &aztables.ClientOptions{Transporter: trace.Transport(transport)}
 	serviceClient, err := aztables.NewServiceClient(serviceURL, credential, tableClientOptions)
 	if err != nil {
 		return nil, err
@@ -43,63 +100,59 @@ func ServiceClientFromEnv() (*aztables.ServiceClient, error) {
 // ListTables lists all the tables in the account and prints them to
 // the standard output. It does this without supplying any filter
 // to the Query() function.
-func ListTables() error {
-	//client, err := TableClientFromEnv()
-	client, err := ServiceClientFromEnv()
+func ListTables(ctx context.Context) error {
+	client, err := ServiceClientFromConfig()
 
 	if err != nil {
 		return err
 	}
 	pager := client.ListTables(nil)
-	ctx := context.Background()
 	for pager.NextPage(ctx) {
 		resp := pager.PageResponse()
 		for _, item := range resp.Tables {
 			map1 := map[string]interface{}{
 				"name": *item.TableName,
 			}
-			b, err := json.Marshal(map1)
-			if err != nil {
+			if err := output.Print(map1); err != nil {
 				return err
 			}
-			fmt.Printf("%s\n", b)
 		}
 	}
+	if err := pager.Err(); err != nil {
+		return err
+	}
 	return nil
 }
 
 // CreateTable creates a table in the account
-func CreateTable(name string) error {
-	client, err := ServiceClientFromEnv()
+func CreateTable(ctx context.Context, name string) error {
+	client, err := ServiceClientFromConfig()
 	if err != nil {
 		return err
 	}
-	ctx := context.Background()
 	_, err = client.CreateTable(ctx, name, nil)
 	return err
 }
 
 // DeleteTable deletes a table from the account
-func DeleteTable(name string) error {
-	client, err := ServiceClientFromEnv()
+func DeleteTable(ctx context.Context, name string) error {
+	client, err := ServiceClientFromConfig()
 	if err != nil {
 		return err
 	}
-	ctx := context.Background()
 	_, err = client.DeleteTable(ctx, name, nil)
 	return err
 }
 
 // UpsertKeyValue upserts an entity into the table with a default PartitionKey of
 // main. In this case we use a map[string]interface{} to do so. Its only field is Value.
-func UpsertKeyValue(table, key, value string) error {
-	client, err := ServiceClientFromEnv()
+func UpsertKeyValue(ctx context.Context, table, key, value string) error {
+	client, err := ServiceClientFromConfig()
 	if err != nil {
 		return err
 	}
 
 	entity := map[string]interface{}{
-		"ETag":         "*",
 		"PartitionKey": "main",
 		"RowKey":       key,
 		"Value":        value,
@@ -109,9 +162,10 @@ func UpsertKeyValue(table, key, value string) error {
 		return err
 	}
 
-	ctx := context.Background()
+	// InsertEntity sends no If-Match, so it creates or replaces; UpdateEntity
+	// would fail for a new key
 	tableClient := client.NewClient(table)
-	_, err = tableClient.UpdateEntity(ctx, b, &aztables.UpdateEntityOptions{UpdateMode: aztables.ReplaceEntity})
+	_, err = tableClient.InsertEntity(ctx, b, &aztables.InsertEntityOptions{UpdateMode: aztables.ReplaceEntity})
 	if err != nil {
 		return err
 	}
@@ -121,7 +175,7 @@ func UpsertKeyValue(table, key, value string) error {
 
 // InsertKeyValue inserts an entity into the table with a default PartitionKey of
 // main. It is an example of using a struct as an entity. Its only field is Value.
-func InsertKeyValue(table, key, value string) error {
+func InsertKeyValue(ctx context.Context, table, key, value string) error {
 	type KeyValue struct {
 		ETag         string
 		PartitionKey string
@@ -129,7 +183,7 @@ func InsertKeyValue(table, key, value string) error {
 		Value        string
 	}
 
-	client, err := ServiceClientFromEnv()
+	client, err := ServiceClientFromConfig()
 	if err != nil {
 		return err
 	}
@@ -144,7 +198,6 @@ func InsertKeyValue(table, key, value string) error {
 	if err != nil {
 		return err
 	}
-	ctx := context.Background()
 	tableClient := client.NewClient(table)
 	_, err = tableClient.AddEntity(ctx, b, nil)
 	if err != nil {
@@ -158,9 +211,9 @@ func InsertKeyValue(table, key, value string) error {
 // main and the RowKey to a UUIDv4 if not provided. It then uses AddEntity to
 // add it to the table. It is an example of using a map[string]interface{} as
 // the entity type.
-func InsertJSON(table string, value []byte) error {
+func InsertJSON(ctx context.Context, table string, value []byte) error {
 
-	client, err := ServiceClientFromEnv()
+	client, err := ServiceClientFromConfig()
 	if err != nil {
 		return err
 	}
@@ -184,7 +237,6 @@ func InsertJSON(table string, value []byte) error {
 		return err
 	}
 
-	ctx := context.Background()
 	tableClient := client.NewClient(table)
 	_, err = tableClient.AddEntity(ctx, b, nil)
 	if err != nil {
@@ -196,10 +248,10 @@ func InsertJSON(table string, value []byte) error {
 
 // InsertStdin takes one or more records from the standard input and inserts
 // them individually using InsertJSON
-func InsertStdin(table string) error {
-	scanner := bufio.NewScanner(os.Stdin)
+func InsertStdin(ctx context.Context, table string) error {
+	scanner := bufio.NewScanner(stdin)
 	for scanner.Scan() {
-		err := InsertJSON(table, scanner.Bytes())
+		err := InsertJSON(ctx, table, scanner.Bytes())
 		if err != nil {
 			return err
 		}
@@ -217,8 +269,8 @@ func InsertStdin(table string) error {
 // 	RowKey eq '1'
 // 	PartitionKey eq 'main' and resourceGroup ge '2' and resourceGroup le '3'
 // The latter is a useful way to find items with a particular prefix (in this case '2')
-func Query(table, filter string) error {
-	client, err := ServiceClientFromEnv()
+func Query(ctx context.Context, table, filter string) error {
+	client, err := ServiceClientFromConfig()
 	if err != nil {
 		return err
 	}
@@ -227,7 +279,6 @@ func Query(table, filter string) error {
 		Filter: &filter,
 	}
 	pager := tableClient.List(queryOptions)
-	ctx := context.Background()
 	for pager.NextPage(ctx) {
 		resp := pager.PageResponse()
 		// TODO: let's explore AsModels here, too
@@ -239,13 +290,14 @@ func Query(table, filter string) error {
 			}
 			// we remove the odata.etag for cleaner/friendlier output
 			delete(entity, "odata.etag")
-			b, err := json.Marshal(entity)
-			if err != nil {
+			if err := output.Print(entity); err != nil {
 				return err
 			}
-			fmt.Printf("%s\n", b)
 		}
 	}
+	if err := pager.Err(); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -253,11 +305,11 @@ func Query(table, filter string) error {
 // https://docs.microsoft.com/en-us/azure/search/query-odata-filter-orderby-syntax).
 // but in QueryDelete we both *require* a filter, and delete each item in the
 // query before printing it to the standard output.
-func QueryDelete(table, filter string) error {
+func QueryDelete(ctx context.Context, table, filter string) error {
 	if filter == "" {
 		return errors.New("filter must be supplied for Delete operation")
 	}
-	client, err := ServiceClientFromEnv()
+	client, err := ServiceClientFromConfig()
 	if err != nil {
 		return err
 	}
@@ -266,7 +318,6 @@ func QueryDelete(table, filter string) error {
 		Filter: &filter,
 	}
 	pager := tableClient.List(queryOptions)
-	ctx := context.Background()
 	for pager.NextPage(ctx) {
 		resp := pager.PageResponse()
 		for _, x := range resp.Entities {
@@ -281,26 +332,26 @@ func QueryDelete(table, filter string) error {
 			}
 			// we remove the odata.etag for cleaner/friendlier output
 			delete(entity, "odata.etag")
-			b, err := json.Marshal(entity)
-			if err != nil {
+			if err := output.Print(entity); err != nil {
 				return err
 			}
-			fmt.Printf("%s\n", b)
 		}
 	}
+	if err := pager.Err(); err != nil {
+		return err
+	}
 	return nil
 }
 
 // Get returns a single entity from a table by its PartitionKey and RowKey
 // This guarantees we return a single item, or an error, and also avoids
 // us having to create a Query for a single item
-func Get(table, partitionKey, rowKey string) (map[string]interface{}, error) {
-	client, err := ServiceClientFromEnv()
+func Get(ctx context.Context, table, partitionKey, rowKey string) (map[string]interface{}, error) {
+	client, err := ServiceClientFromConfig()
 	if err != nil {
 		return nil, err
 	}
 	tableClient := client.NewClient(table)
-	ctx := context.Background()
 	resp, err := tableClient.GetEntity(ctx, partitionKey, rowKey, nil)
 	if err != nil {
 		return nil, err
@@ -315,13 +366,12 @@ func Get(table, partitionKey, rowKey string) (map[string]interface{}, error) {
 
 // Delete deletes and returns a single item from a table by its PartitionKey
 // and RowKey. It will return an error if the item is not found.
-func Delete(table, partitionKey, rowKey string) (map[string]interface{}, error) {
-	client, err := ServiceClientFromEnv()
+func Delete(ctx context.Context, table, partitionKey, rowKey string) (map[string]interface{}, error) {
+	client, err := ServiceClientFromConfig()
 	if err != nil {
 		return nil, err
 	}
 	tableClient := client.NewClient(table)
-	ctx := context.Background()
 	resp, err := tableClient.GetEntity(ctx, partitionKey, rowKey, nil)
 	if err != nil {
 		return nil, err
@@ -337,11 +387,3 @@ func Delete(table, partitionKey, rowKey string) (map[string]interface{}, error)
 	}
 	return entity, nil
 }
-
-func mustGetEnv(key string) string {
-	value := os.Getenv(key)
-	if value == "" {
-		log.Fatalf("Require environment variable: %s\n", key)
-	}
-	return value
-}
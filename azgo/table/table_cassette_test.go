@@ -0,0 +1,47 @@
+package table
+
+import (
+	"context"
+	"testing"
+
+	"github.com/blue-eight/azgo/azgo/config"
+	"github.com/blue-eight/azgo/azgo/internal/cassette"
+	"github.com/blue-eight/azgo/azgo/internal/testutil"
+)
+
+// TestCassetteQueryPages replays a query which spans several pages. To
+// record it, AZGO_CASSETTE_TABLE must name a table in a storage account
+// with more than a page (1000 entities) in partition p1.
+func TestCassetteQueryPages(t *testing.T) {
+	rec := cassette.New(t, "testdata/cassettes/query-pages.json")
+	testutil.UseProfile(t, &config.Profile{
+		TableAccount: rec.Value("AZGO_TABLE_ACCOUNT", "azgocassette"),
+		TableKey:     rec.Value("AZGO_TABLE_KEY", config.DevelopmentAccountKey),
+		TableType:    "storage",
+	})
+	table := rec.Value("AZGO_CASSETTE_TABLE", "orders")
+	previous := transport
+	transport = rec
+	t.Cleanup(func() { transport = previous })
+
+	out := testutil.CaptureOutput(t)
+	if err := Query(context.Background(), table, "PartitionKey eq 'p1'"); err != nil {
+		t.Fatal(err)
+	}
+	records := testutil.Records(t, out)
+	if len(records) == 0 {
+		t.Fatal("Query printed no entities")
+	}
+	for _, r := range records {
+		if r["PartitionKey"] != "p1" || r["RowKey"] == nil {
+			t.Errorf("Query printed %v", r)
+		}
+		if _, ok := r["odata.etag"]; ok {
+			t.Errorf("Query kept odata.etag in %v", r)
+		}
+	}
+	// the cassette has three pages, joined by continuation headers
+	if !rec.Recording() && len(records) != 5 {
+		t.Errorf("Query printed %d entities, want 5", len(records))
+	}
+}
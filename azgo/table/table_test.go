@@ -0,0 +1,187 @@
+package table
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/blue-eight/azgo/azgo/internal/fakestorage"
+	"github.com/blue-eight/azgo/azgo/internal/testutil"
+)
+
+func newServer(t *testing.T) *fakestorage.TableServer {
+	s := fakestorage.NewTableServer()
+	t.Cleanup(s.Close)
+	testutil.UseProfile(t, s.Profile())
+	return s
+}
+
+func statusCode(err error) int {
+	var httpErr azcore.HTTPResponse
+	if errors.As(err, &httpErr) {
+		return httpErr.RawResponse().StatusCode
+	}
+	return 0
+}
+
+func TestTables(t *testing.T) {
+	ctx := context.Background()
+	s := newServer(t)
+	s.PageSize = 2
+
+	for _, name := range []string{"gamma", "alpha", "beta"} {
+		if err := CreateTable(ctx, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := CreateTable(ctx, "alpha"); statusCode(err) != http.StatusConflict {
+		t.Errorf("CreateTable(alpha) again error = %v, want 409", err)
+	}
+
+	out := testutil.CaptureOutput(t)
+	if err := ListTables(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if want := "{\"name\":\"alpha\"}\n{\"name\":\"beta\"}\n{\"name\":\"gamma\"}\n"; out.String() != want {
+		t.Errorf("ListTables printed\n%s\nwant\n%s", out, want)
+	}
+
+	if err := DeleteTable(ctx, "beta"); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteTable(ctx, "beta"); statusCode(err) != http.StatusNotFound {
+		t.Errorf("DeleteTable(beta) again error = %v, want 404", err)
+	}
+	if got := fmt.Sprint(s.Tables()); got != "[alpha gamma]" {
+		t.Errorf("tables = %s, want [alpha gamma]", got)
+	}
+}
+
+func TestKeyValue(t *testing.T) {
+	ctx := context.Background()
+	s := newServer(t)
+	s.CreateTable("kv")
+
+	if err := InsertKeyValue(ctx, "kv", "greeting", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if err := InsertKeyValue(ctx, "kv", "greeting", "again"); statusCode(err) != http.StatusConflict {
+		t.Errorf("InsertKeyValue of an existing key error = %v, want 409", err)
+	}
+	if err := UpsertKeyValue(ctx, "kv", "greeting", "hi"); err != nil {
+		t.Fatal(err)
+	}
+	if err := UpsertKeyValue(ctx, "kv", "other", "new"); err != nil {
+		t.Fatal(err)
+	}
+
+	entity, err := Get(ctx, "kv", "main", "greeting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entity["Value"] != "hi" || entity["PartitionKey"] != "main" || entity["RowKey"] != "greeting" {
+		t.Errorf("Get = %v", entity)
+	}
+
+	deleted, err := Delete(ctx, "kv", "main", "greeting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted["Value"] != "hi" {
+		t.Errorf("Delete returned %v", deleted)
+	}
+	if s.Entity("kv", "main", "greeting") != nil {
+		t.Error("entity still exists after Delete")
+	}
+	if _, err := Get(ctx, "kv", "main", "greeting"); statusCode(err) != http.StatusNotFound {
+		t.Errorf("Get after Delete error = %v, want 404", err)
+	}
+	if _, err := Delete(ctx, "kv", "main", "greeting"); statusCode(err) != http.StatusNotFound {
+		t.Errorf("Delete of a missing entity error = %v, want 404", err)
+	}
+	if err := InsertKeyValue(ctx, "missing", "k", "v"); statusCode(err) != http.StatusNotFound {
+		t.Errorf("InsertKeyValue into a missing table error = %v, want 404", err)
+	}
+}
+
+func TestInsertStdinQuery(t *testing.T) {
+	ctx := context.Background()
+	s := newServer(t)
+	s.CreateTable("events")
+	s.PageSize = 2
+
+	stdin = strings.NewReader(`{"RowKey":"1","kind":"a","n":1}
+{"RowKey":"2","kind":"b","n":2}
+{"RowKey":"3","kind":"a","n":3}
+{"PartitionKey":"other","RowKey":"4","kind":"a","n":4}
+{"kind":"a","n":5}
+`)
+	defer func() { stdin = os.Stdin }()
+	if err := InsertStdin(ctx, "events"); err != nil {
+		t.Fatal(err)
+	}
+
+	out := testutil.CaptureOutput(t)
+	if err := Query(ctx, "events", "PartitionKey eq 'main' and kind eq 'a'"); err != nil {
+		t.Fatal(err)
+	}
+	records := testutil.Records(t, out)
+	if len(records) != 3 {
+		t.Fatalf("Query printed %d records, want 3:\n%s", len(records), out)
+	}
+	for _, record := range records {
+		if record["kind"] != "a" || record["PartitionKey"] != "main" {
+			t.Errorf("Query printed %v", record)
+		}
+		if _, ok := record["odata.etag"]; ok {
+			t.Errorf("Query printed odata.etag in %v", record)
+		}
+	}
+	// the row without a RowKey gets a random one, so it can sort anywhere
+	for i := 1; i < len(records); i++ {
+		if records[i-1]["RowKey"].(string) >= records[i]["RowKey"].(string) {
+			t.Errorf("Query printed rows out of order: %v", records)
+		}
+	}
+
+	stdin = strings.NewReader("{not json}\n")
+	if err := InsertStdin(ctx, "events"); err == nil {
+		t.Error("InsertStdin of invalid JSON returned no error")
+	}
+}
+
+func TestQueryDelete(t *testing.T) {
+	ctx := context.Background()
+	s := newServer(t)
+	s.PageSize = 2
+	for i := 0; i < 5; i++ {
+		s.PutEntity("kv", fakestorage.Entity{"PartitionKey": "main", "RowKey": fmt.Sprint(i), "Value": fmt.Sprint(i % 2)})
+	}
+
+	if err := QueryDelete(ctx, "kv", ""); err == nil {
+		t.Error("QueryDelete without a filter returned no error")
+	}
+
+	out := testutil.CaptureOutput(t)
+	if err := QueryDelete(ctx, "kv", "Value eq '0'"); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(testutil.Records(t, out)); n != 3 {
+		t.Errorf("QueryDelete printed %d records, want 3:\n%s", n, out)
+	}
+	for i := 0; i < 5; i++ {
+		exists := s.Entity("kv", "main", fmt.Sprint(i)) != nil
+		if want := i%2 == 1; exists != want {
+			t.Errorf("entity %d exists = %t, want %t", i, exists, want)
+		}
+	}
+
+	if err := Query(ctx, "kv", "Value eq"); statusCode(err) != http.StatusBadRequest {
+		t.Errorf("Query with a malformed filter error = %v, want 400", err)
+	}
+}
@@ -0,0 +1,45 @@
+package trace
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+)
+
+// tryHeader counts the tries of a request. The azcore retry policy sends
+// the same *http.Request on every try (unless RetryOptions.TryTimeout is
+// set, which we never do), so the count is kept on the request itself and
+// removed from the copy which goes over the wire.
+const tryHeader = "X-Azgo-Trace-Try"
+
+type transport struct {
+	next policy.Transporter
+}
+
+// Transport wraps next, the transport of an azcore pipeline (e.g.
+// arm.ConnectionOptions.HTTPClient or aztables.ClientOptions.Transporter),
+// so each try is traced. A nil next means http.DefaultClient. When
+// tracing is off it returns next unchanged, so nil keeps the SDK default.
+func Transport(next policy.Transporter) policy.Transporter {
+	if !Enabled() {
+		return next
+	}
+	if next == nil {
+		next = http.DefaultClient
+	}
+	return &transport{next: next}
+}
+
+func (t *transport) Do(req *http.Request) (*http.Response, error) {
+	try, _ := strconv.Atoi(req.Header.Get(tryHeader))
+	req.Header.Set(tryHeader, strconv.Itoa(try+1))
+	sent := req.Clone(req.Context())
+	sent.Header.Del(tryHeader)
+
+	start := time.Now()
+	res, err := t.next.Do(sent)
+	write(newRecord(req, try, start, res, err))
+	return res, err
+}
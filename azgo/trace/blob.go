@@ -0,0 +1,64 @@
+package trace
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// triesKey is the context key of the try counter for a blob request.
+type triesKey struct{}
+
+// NewBlobPipeline is azblob.NewPipeline with tracing when it is on. azblob
+// copies the request for every try, so the try count travels in the
+// context: a policy ahead of the retry policy adds a counter, and the
+// tracing policy behind it counts and logs each try.
+func NewBlobPipeline(c azblob.Credential, o azblob.PipelineOptions) pipeline.Pipeline {
+	if !Enabled() {
+		return azblob.NewPipeline(c, o)
+	}
+	// the factories of azblob.NewPipeline, in the same order
+	f := []pipeline.Factory{
+		azblob.NewTelemetryPolicyFactory(o.Telemetry),
+		azblob.NewUniqueRequestIDPolicyFactory(),
+		pipeline.FactoryFunc(countTries),
+		azblob.NewRetryPolicyFactory(o.Retry),
+		pipeline.FactoryFunc(traceTry),
+		c, // azblob leaves out the anonymous credential, which does nothing
+		azblob.NewRequestLogPolicyFactory(o.RequestLog),
+		pipeline.MethodFactoryMarker(),
+	}
+	return pipeline.NewPipeline(f, pipeline.Options{HTTPSender: o.HTTPSender, Log: o.Log})
+}
+
+func countTries(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.PolicyFunc {
+	return func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+		return next.Do(context.WithValue(ctx, triesKey{}, new(int)), request)
+	}
+}
+
+func traceTry(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.PolicyFunc {
+	return func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+		retry := 0
+		if tries, ok := ctx.Value(triesKey{}).(*int); ok {
+			retry = *tries
+			*tries++
+		}
+		start := time.Now()
+		res, err := next.Do(ctx, request)
+		write(newRecord(request.Request, retry, start, response(res), err))
+		return res, err
+	}
+}
+
+// response returns the *http.Response of res, which is nil when the
+// request failed before getting one.
+func response(res pipeline.Response) *http.Response {
+	if res == nil {
+		return nil
+	}
+	return res.Response()
+}
@@ -0,0 +1,22 @@
+/*
+Package trace logs every HTTP request the Azure SDKs make, one JSON object
+per line, so throttling, retries and slow calls can be debugged without
+recompiling. It grew out of arm.MyPolicy, which logs the URL and duration
+for one example function.
+
+The CLI turns it on with the global --trace flag, which writes to standard
+error:
+
+	{"time":"...","method":"GET","url":"https://...?sig=REDACTED","status":503,"request_id":"...","retry":0,"latency_ms":12.5}
+	{"time":"...","method":"GET","url":"https://...?sig=REDACTED","status":200,"request_id":"...","retry":1,"latency_ms":8.1}
+
+Each line is a single try, so a request which was retried appears once per
+try with an increasing retry count. Signatures, tokens, secrets and
+passwords in URLs are replaced by REDACTED.
+
+The azcore-based clients (arm, aks and table) are traced by wrapping their
+transport with Transport, and blob by building its pipeline with
+NewBlobPipeline. Service Bus, Event Hubs and Postgres do not use HTTP
+pipelines and are not traced.
+*/
+package trace
@@ -0,0 +1,111 @@
+package trace
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Record is a single try of an HTTP request.
+type Record struct {
+	Time      time.Time `json:"time"`
+	Method    string    `json:"method"`
+	URL       string    `json:"url"`
+	Status    int       `json:"status,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	Retry     int       `json:"retry"`
+	LatencyMS float64   `json:"latency_ms"`
+	Error     string    `json:"error,omitempty"`
+}
+
+var (
+	mu  sync.Mutex
+	out io.Writer
+)
+
+// SetOutput starts writing records to w, or stops tracing if w is nil.
+// Clients pick this up when they are created, so call it first.
+func SetOutput(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+	out = w
+}
+
+// Enabled reports whether tracing is on.
+func Enabled() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return out != nil
+}
+
+// newRecord describes a try of req which started at start and returned
+// res or err. retry is 0 for the first try.
+func newRecord(req *http.Request, retry int, start time.Time, res *http.Response, err error) Record {
+	r := Record{
+		Time:      start.UTC(),
+		Method:    req.Method,
+		URL:       RedactURL(req.URL),
+		Retry:     retry,
+		LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if res != nil {
+		r.Status = res.StatusCode
+		r.RequestID = res.Header.Get("x-ms-request-id")
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	return r
+}
+
+// write writes r as a line of JSON, if tracing is on.
+func write(r Record) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if out != nil {
+		out.Write(append(b, '\n'))
+	}
+}
+
+// secrets are the query parameters RedactURL hides: SAS signatures and
+// the codes, tokens and secrets used by OAuth and Azure Functions.
+var secrets = map[string]bool{
+	"sig":           true,
+	"signature":     true,
+	"code":          true,
+	"token":         true,
+	"access_token":  true,
+	"refresh_token": true,
+	"client_secret": true,
+	"password":      true,
+	"key":           true,
+}
+
+// RedactURL returns u as a string with any password and secret query
+// parameters replaced by REDACTED.
+func RedactURL(u *url.URL) string {
+	r := *u
+	if _, ok := r.User.Password(); ok {
+		r.User = url.UserPassword(r.User.Username(), "REDACTED")
+	}
+	query := r.Query()
+	redacted := false
+	for name := range query {
+		if secrets[strings.ToLower(name)] {
+			query[name] = []string{"REDACTED"}
+			redacted = true
+		}
+	}
+	if redacted {
+		r.RawQuery = query.Encode()
+	}
+	return r.String()
+}